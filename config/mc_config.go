@@ -9,6 +9,13 @@ var (
 		BodyInCStr:  "4K",
 		FlushMaxStr: "100M",
 		TimeoutMS:   3000,
+
+		SlowCmdMS:   100,
+		SlowLogSize: 1000,
+
+		HotKeySample: 100,
+		HotKeyTopK:   20,
+		HotKeyWindow: 60,
 	}
 )
 
@@ -28,6 +35,13 @@ type MCConfig struct {
 
 	BodyInCStr string `yaml:"body_c_str,omitempty"`
 	TimeoutMS  int    `yaml:"timeout_ms,omitempty"`
+
+	SlowCmdMS   int `yaml:"slow_cmd_ms,omitempty"`   // requests slower than this are counted and kept in slow log
+	SlowLogSize int `yaml:"slow_log_size,omitempty"` // num of recent slow requests kept
+
+	HotKeySample int `yaml:"hotkey_sample,omitempty"` // track 1 of every N get/set, 0 to disable
+	HotKeyTopK   int `yaml:"hotkey_topk,omitempty"`   // num of hot/big keys reported per bucket
+	HotKeyWindow int `yaml:"hotkey_window,omitempty"` // in seconds
 }
 
 func IsValidKeySize(ksz uint32) bool {
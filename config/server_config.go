@@ -29,8 +29,28 @@ type ServerConfig struct {
 	AnalysisLog string   `yaml:",omitempty"`
 	StaticDir   string   `yaml:",omitempty"` // directory for static files, e.g. *.html
 
+	TraceExporter string  `yaml:",omitempty"` // "otlp" or "file", tracing is disabled if empty
+	TraceEndpoint string  `yaml:",omitempty"` // e.g. http://127.0.0.1:4318/v1/traces
+	TraceFile     string  `yaml:",omitempty"` // spans as JSON lines
+	TraceSample   float64 `yaml:",omitempty"` // fraction of requests traced
+
+	WebUsers []WebUser `yaml:",omitempty"` // web auth is disabled if empty
+	AuditLog string    `yaml:",omitempty"` // mutating web calls, to errorlog if empty
+}
+
+// WebUser authenticates with a bearer token, or with basic auth as Name/Password.
+type WebUser struct {
+	Name     string `yaml:"name"`
+	Role     string `yaml:"role"` // "read", "operator" or "admin"
+	Token    string `yaml:"token,omitempty" json:"-"`
+	Password string `yaml:"password,omitempty" json:"-"`
 }
 
 func (c *ServerConfig) Addr() string {
 	return fmt.Sprintf("%s:%d", c.Hostname, c.Port)
 }
+
+// GoString hides the secrets when the config is logged with %#v.
+func (u WebUser) GoString() string {
+	return fmt.Sprintf("config.WebUser{Name:%q, Role:%q}", u.Name, u.Role)
+}
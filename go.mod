@@ -1,6 +1,9 @@
 module github.com/douban/gobeansdb
 
 require (
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.17.9
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/samuel/go-zookeeper v0.0.0-20190923202752-2cc03de413da
 	github.com/spaolacci/murmur3 v1.1.0
 	gopkg.in/yaml.v2 v2.2.7
@@ -0,0 +1,1090 @@
+package gobeansdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/loghub"
+	mc "github.com/douban/gobeansdb/memcache"
+	"github.com/douban/gobeansdb/store"
+	"github.com/douban/gobeansdb/utils"
+)
+
+// JSON admin API under /api/v1/.
+//
+// Successful calls return the result object with status 200 (202 for async
+// jobs). Failed calls return a status >= 400 and
+//   {"error": {"code": "not_found", "message": "bucket 0f is not served"}}
+// where code is one of the Err* constants below.
+
+const (
+	ErrBadRequest       = "bad_request"
+	ErrUnauthorized     = "unauthorized"
+	ErrForbidden        = "forbidden"
+	ErrNotFound         = "not_found"
+	ErrMethodNotAllowed = "method_not_allowed"
+	ErrConflict         = "conflict"
+	ErrInternal         = "internal"
+	ErrUnavailable      = "unavailable"
+)
+
+var errCodeStatus = map[string]int{
+	ErrBadRequest:       http.StatusBadRequest,
+	ErrUnauthorized:     http.StatusUnauthorized,
+	ErrForbidden:        http.StatusForbidden,
+	ErrNotFound:         http.StatusNotFound,
+	ErrMethodNotAllowed: http.StatusMethodNotAllowed,
+	ErrConflict:         http.StatusConflict,
+	ErrInternal:         http.StatusInternalServerError,
+	ErrUnavailable:      http.StatusServiceUnavailable,
+}
+
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *APIError) Status() int {
+	if s, ok := errCodeStatus[e.Code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+func apiErrorf(code string, format string, args ...interface{}) *APIError {
+	return &APIError{code, fmt.Sprintf(format, args...)}
+}
+
+type apiErrorBody struct {
+	Error *APIError `json:"error"`
+}
+
+func writeAPIJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	e, ok := err.(*APIError)
+	if !ok {
+		e = &APIError{ErrInternal, err.Error()}
+	}
+	if e.Code == ErrUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gobeansdb"`)
+	}
+	writeAPIJson(w, e.Status(), apiErrorBody{e})
+}
+
+// apiAccepted makes a handler respond 202, for jobs running in background.
+type apiAccepted struct {
+	v interface{}
+}
+
+// apiRaw makes a handler respond the body as is, e.g. a value, with some
+// headers describing it.
+type apiRaw struct {
+	body   []byte
+	header map[string]string
+}
+
+// apiFunc gets the values of the {} segments of its pattern in args.
+type apiFunc func(r *http.Request, args []string) (interface{}, error)
+
+type apiRoute struct {
+	method    string
+	segments  []string
+	role      int
+	needStore bool
+	handle    apiFunc
+}
+
+var apiRoutes []*apiRoute
+
+// addAPI registers handle for method and pattern, e.g.
+// "/api/v1/admin/buckets/{bucket}". A last segment like {key...} takes the rest
+// of the path, slashes included. Calls with a method other than GET are
+// audited.
+func addAPI(method, pattern string, role int, needStore bool, handle apiFunc) {
+	apiRoutes = append(apiRoutes, &apiRoute{
+		method:    method,
+		segments:  strings.Split(strings.Trim(pattern, "/"), "/"),
+		role:      role,
+		needStore: needStore,
+		handle:    handle,
+	})
+}
+
+func (rt *apiRoute) match(segments []string) (args []string, ok bool) {
+	n := len(rt.segments)
+	rest := strings.HasSuffix(rt.segments[n-1], "...}")
+	if len(segments) != n && !(rest && len(segments) > n) {
+		return nil, false
+	}
+	for i, s := range rt.segments {
+		if rest && i == n-1 {
+			args = append(args, strings.Join(segments[i:], "/"))
+		} else if strings.HasPrefix(s, "{") {
+			args = append(args, segments[i])
+		} else if s != segments[i] {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// findAPI returns the route of a request, allowed lists the methods of the
+// path if only the method does not match.
+func findAPI(r *http.Request) (rt *apiRoute, args []string, allowed []string) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for _, route := range apiRoutes {
+		a, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method == r.Method || (route.method == "GET" && r.Method == "HEAD") {
+			return route, a, nil
+		}
+		allowed = append(allowed, route.method)
+	}
+	return
+}
+
+func apiRole(r *http.Request) (role int, mutating bool) {
+	rt, _, _ := findAPI(r)
+	if rt == nil {
+		return RoleRead, false
+	}
+	return rt.role, rt.method != "GET"
+}
+
+func handleAPI(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if e := recover(); e != nil {
+			stack := utils.GetStack(2000)
+			logger.Errorf("api req panic:%#v, stack:%s", e, stack)
+			writeAPIError(w, apiErrorf(ErrInternal, "panic: %v", e))
+		}
+	}()
+	rt, args, allowed := findAPI(r)
+	if rt == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeAPIError(w, apiErrorf(ErrMethodNotAllowed, "%s not allowed on %s", r.Method, r.URL.Path))
+		} else {
+			writeAPIError(w, apiErrorf(ErrNotFound, "no api %s", r.URL.Path))
+		}
+		return
+	}
+	if rt.needStore && (storage == nil || server == nil) {
+		writeAPIError(w, apiErrorf(ErrUnavailable, "starting"))
+		return
+	}
+	v, err := rt.handle(r, args)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if a, ok := v.(apiAccepted); ok {
+		writeAPIJson(w, http.StatusAccepted, a.v)
+		return
+	}
+	if raw, ok := v.(*apiRaw); ok {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for k, v := range raw.header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw.body)
+		return
+	}
+	writeAPIJson(w, http.StatusOK, v)
+}
+
+func init() {
+	http.HandleFunc("/api/v1/", handleAPI)
+
+	addAPI("GET", "/api/v1/admin/buckets", RoleRead, true, apiListBuckets)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}", RoleRead, true, apiGetBucket)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}/collisions", RoleRead, true, apiGetCollisions)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}/chunks", RoleRead, true, apiGetChunks)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}/gc", RoleRead, true, apiGetGC)
+	addAPI("POST", "/api/v1/admin/buckets/{bucket}/gc", RoleOperator, true, apiStartGC)
+	addAPI("DELETE", "/api/v1/admin/buckets/{bucket}/gc", RoleOperator, true, apiCancelGC)
+	addAPI("POST", "/api/v1/admin/buckets/{bucket}/merge", RoleOperator, true, apiMergeHints)
+	addAPI("GET", "/api/v1/admin/gc", RoleRead, true, apiListGC)
+	addAPI("DELETE", "/api/v1/admin/gc", RoleOperator, true, apiCancelAllGC)
+	addAPI("GET", "/api/v1/admin/gc/scheduler", RoleRead, true, apiGetGCScheduler)
+	addAPI("POST", "/api/v1/admin/gc/scheduler/pause", RoleOperator, true, apiPauseGCScheduler)
+	addAPI("POST", "/api/v1/admin/gc/scheduler/resume", RoleOperator, true, apiResumeGCScheduler)
+	addAPI("GET", "/api/v1/admin/gc/throttle", RoleRead, true, apiGetGCThrottle)
+	addAPI("PUT", "/api/v1/admin/gc/throttle", RoleOperator, true, apiSetGCThrottle)
+	addAPI("GET", "/api/v1/admin/scrub", RoleRead, true, apiListScrub)
+	addAPI("POST", "/api/v1/admin/scrub/pause", RoleOperator, true, apiPauseScrubber)
+	addAPI("POST", "/api/v1/admin/scrub/resume", RoleOperator, true, apiResumeScrubber)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}/scrub", RoleRead, true, apiGetScrub)
+	addAPI("POST", "/api/v1/admin/buckets/{bucket}/scrub", RoleOperator, true, apiStartScrub)
+	addAPI("DELETE", "/api/v1/admin/buckets/{bucket}/broken/{keyhash}", RoleOperator, true, apiRemoveBrokenKey)
+	addAPI("POST", "/api/v1/admin/buckets/{bucket}/repair", RoleOperator, true, apiRepair)
+	addAPI("POST", "/api/v1/admin/flush", RoleOperator, true, apiFlush)
+	addAPI("GET", "/api/v1/admin/stats", RoleRead, true, apiGetStats)
+	addAPI("GET", "/api/v1/admin/errors", RoleRead, false, apiGetErrors)
+	addAPI("GET", "/api/v1/admin/keyhash/{keyhash}", RoleRead, true, apiGetKeyhash)
+	addAPI("GET", "/api/v1/key/{key...}", RoleOperator, true, apiInspectKey)
+	addAPI("GET", "/api/v1/versions/{key...}", RoleOperator, true, apiGetVersions)
+	addAPI("POST", "/api/v1/admin/undelete", RoleOperator, true, apiUndelete)
+	addAPI("GET", "/api/v1/admin/holds", RoleRead, true, apiListHolds)
+	addAPI("POST", "/api/v1/admin/holds", RoleOperator, true, apiAddHold)
+	addAPI("DELETE", "/api/v1/admin/holds", RoleOperator, true, apiRemoveHold)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}/holds", RoleRead, true, apiGetHolds)
+	addAPI("GET", "/api/v1/admin/buckets/{bucket}/dicts", RoleRead, true, apiGetDicts)
+	addAPI("POST", "/api/v1/admin/buckets/{bucket}/dicts", RoleOperator, true, apiTrainDict)
+	addAPI("GET", "/api/v1/admin/du", RoleRead, true, apiGetDU)
+	addAPI("GET", "/api/v1/admin/route", RoleRead, false, apiGetRoute)
+	addAPI("GET", "/api/v1/admin/route/version", RoleRead, false, apiGetRouteVersion)
+	addAPI("POST", "/api/v1/admin/route/reload", RoleAdmin, false, apiReloadRoute)
+	addAPI("GET", "/api/v1/admin/config", RoleRead, false, apiGetConfig)
+}
+
+// parseBucketArg accepts a served bucket id in hex.
+func parseBucketArg(s string) (int, error) {
+	id, err := strconv.ParseInt(s, 16, 32)
+	if err != nil || id < 0 || int(id) >= conf.NumBucket {
+		return 0, apiErrorf(ErrBadRequest, "bad bucket id %q", s)
+	}
+	bucketID := int(id)
+	if conf.BucketsStat[bucketID] <= 0 || storage.hstore.GetBucketState(bucketID) != store.BUCKET_STAT_READY {
+		return 0, apiErrorf(ErrNotFound, "bucket %s is not served", s)
+	}
+	return bucketID, nil
+}
+
+func apiListBuckets(r *http.Request, args []string) (interface{}, error) {
+	all := make([]*store.BucketInfo, 0)
+	for i, s := range conf.BucketsStat {
+		if s > 0 && storage.hstore.GetBucketState(i) == store.BUCKET_STAT_READY {
+			all = append(all, storage.hstore.GetBucketInfo(i))
+		}
+	}
+	return all, nil
+}
+
+func apiGetBucket(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return storage.hstore.GetBucketInfo(bucketID), nil
+}
+
+func apiGetCollisions(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return storage.hstore.GetCollisionItems(bucketID), nil
+}
+
+// apiGetChunks returns the live and superseded records and bytes of each chunk.
+func apiGetChunks(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	usage := storage.hstore.GetChunkUsage(bucketID)
+	if usage == nil {
+		usage = []store.ChunkUsage{}
+	}
+	return usage, nil
+}
+
+func apiListHolds(r *http.Request, args []string) (interface{}, error) {
+	res := make(map[string][]store.RetentionHold)
+	for id, holds := range storage.hstore.GetHolds() {
+		res[config.BucketIDHex(id, conf.NumBucket)] = holds
+	}
+	return res, nil
+}
+
+func apiGetHolds(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	holds := storage.hstore.GetHolds()[bucketID]
+	if holds == nil {
+		holds = []store.RetentionHold{}
+	}
+	return holds, nil
+}
+
+// apiGetDicts returns the zstd dictionaries of a bucket and their ratios.
+func apiGetDicts(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	dicts := storage.hstore.GetDicts(bucketID)
+	if dicts == nil {
+		dicts = []store.DictInfo{}
+	}
+	return dicts, nil
+}
+
+// apiTrainDict trains a new dictionary from values of the bucket.
+func apiTrainDict(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	info, err := storage.hstore.TrainDict(bucketID)
+	if err == store.ErrNoDictSamples {
+		return nil, apiErrorf(ErrConflict, "%s", err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// HoldRequest puts keys matching Pattern under hold until Expire, or for TTL
+// seconds. A glob pattern applies to Bucket, or all buckets if empty.
+type HoldRequest struct {
+	Pattern string
+	Expire  time.Time
+	TTL     int64
+	Reason  string
+	Bucket  string
+}
+
+type HoldResult struct {
+	Pattern string
+	Buckets []string
+}
+
+func bucketsHex(ids []int) []string {
+	res := make([]string, len(ids))
+	for i, id := range ids {
+		res[i] = config.BucketIDHex(id, conf.NumBucket)
+	}
+	return res
+}
+
+func parseHoldRequest(r *http.Request) (*HoldRequest, error) {
+	req := &HoldRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "bad json: %s", err.Error())
+		}
+	} else {
+		req.Pattern = r.FormValue("pattern")
+		req.Reason = r.FormValue("reason")
+		req.Bucket = r.FormValue("bucket")
+		if s := r.FormValue("expire"); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, apiErrorf(ErrBadRequest, "bad expire: %s", err.Error())
+			}
+			req.Expire = t
+		}
+		if s := r.FormValue("ttl"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, apiErrorf(ErrBadRequest, "bad ttl: %s", err.Error())
+			}
+			req.TTL = n
+		}
+	}
+	if req.Pattern == "" {
+		return nil, apiErrorf(ErrBadRequest, "need a pattern")
+	}
+	if req.TTL > 0 {
+		if !req.Expire.IsZero() {
+			return nil, apiErrorf(ErrBadRequest, "expire and ttl are exclusive")
+		}
+		req.Expire = time.Now().Add(time.Duration(req.TTL) * time.Second)
+	}
+	if !req.Expire.After(time.Now()) {
+		return nil, apiErrorf(ErrBadRequest, "need an expire time in the future")
+	}
+	return req, nil
+}
+
+func parseOptionalBucket(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	return parseBucketArg(s)
+}
+
+func apiAddHold(r *http.Request, args []string) (interface{}, error) {
+	req, err := parseHoldRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	bucketID, err := parseOptionalBucket(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := storage.hstore.AddHold(bucketID, req.Pattern, req.Reason, req.Expire)
+	if err == store.ErrBucketNotServed {
+		return nil, apiErrorf(ErrNotFound, "%s", err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+	}
+	return &HoldResult{req.Pattern, bucketsHex(buckets)}, nil
+}
+
+func apiRemoveHold(r *http.Request, args []string) (interface{}, error) {
+	pattern := r.FormValue("pattern")
+	if pattern == "" {
+		return nil, apiErrorf(ErrBadRequest, "need a pattern")
+	}
+	bucketID, err := parseOptionalBucket(r.FormValue("bucket"))
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := storage.hstore.RemoveHold(bucketID, pattern)
+	if err == store.ErrNoHold {
+		return nil, apiErrorf(ErrNotFound, "no hold %q", pattern)
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	return &HoldResult{pattern, bucketsHex(buckets)}, nil
+}
+
+type BucketGC struct {
+	Running *store.GCStatus `json:",omitempty"`
+	History []store.GCState
+}
+
+func apiGetGC(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &BucketGC{
+		Running: storage.hstore.GetGCStatus(bucketID),
+		History: storage.hstore.GetGCHistory(bucketID),
+	}, nil
+}
+
+func apiListGC(r *http.Request, args []string) (interface{}, error) {
+	return storage.hstore.GCStatus(), nil
+}
+
+func apiGetGCScheduler(r *http.Request, args []string) (interface{}, error) {
+	return storage.hstore.GCSchedulerStatus(), nil
+}
+
+func apiPauseGCScheduler(r *http.Request, args []string) (interface{}, error) {
+	storage.hstore.PauseGCScheduler(true)
+	return storage.hstore.GCSchedulerStatus(), nil
+}
+
+func apiResumeGCScheduler(r *http.Request, args []string) (interface{}, error) {
+	storage.hstore.PauseGCScheduler(false)
+	return storage.hstore.GCSchedulerStatus(), nil
+}
+
+func apiGetGCThrottle(r *http.Request, args []string) (interface{}, error) {
+	return storage.hstore.GCThrottleStatus(), nil
+}
+
+// parseGCThrottle reads new limits as JSON or form values mbps and recs,
+// limits not given are kept.
+func parseGCThrottle(r *http.Request, th *store.GCThrottle) error {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(th); err != nil {
+			return apiErrorf(ErrBadRequest, "bad json: %s", err.Error())
+		}
+	} else {
+		floats := []struct {
+			name string
+			p    *float64
+		}{{"mbps", &th.MaxMBps}, {"recs", &th.MaxRecsPerSec}}
+		for _, f := range floats {
+			if s := r.FormValue(f.name); s != "" {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return apiErrorf(ErrBadRequest, "bad %s: %s", f.name, err.Error())
+				}
+				*f.p = v
+			}
+		}
+	}
+	if th.MaxMBps < 0 || th.MaxRecsPerSec < 0 {
+		return apiErrorf(ErrBadRequest, "limits should not be negative")
+	}
+	return nil
+}
+
+func apiSetGCThrottle(r *http.Request, args []string) (interface{}, error) {
+	th := storage.hstore.GCThrottleStatus().GCThrottle
+	if err := parseGCThrottle(r, &th); err != nil {
+		return nil, err
+	}
+	storage.hstore.SetGCThrottle(th)
+	return storage.hstore.GCThrottleStatus(), nil
+}
+
+// GCRequest is the body of POST .../gc, as JSON or as form values.
+// Chunk ids of -1 let the bucket choose.
+type GCRequest struct {
+	Start    int
+	End      int
+	NoGCDays int
+	Merge    bool
+	Pretend  bool
+}
+
+func parseGCRequest(r *http.Request) (*GCRequest, error) {
+	req := &GCRequest{Start: -1, End: -1, NoGCDays: -1}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "bad json: %s", err.Error())
+		}
+		return req, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+	}
+	ints := []struct {
+		name string
+		p    *int
+	}{{"start", &req.Start}, {"end", &req.End}, {"nogcdays", &req.NoGCDays}}
+	for _, f := range ints {
+		n, err := getFormValueInt(r, f.name, *f.p)
+		if err != nil {
+			return nil, apiErrorf(ErrBadRequest, "bad %s: %s", f.name, err.Error())
+		}
+		*f.p = n
+	}
+	bools := []struct {
+		name string
+		p    *bool
+	}{{"merge", &req.Merge}, {"pretend", &req.Pretend}}
+	for _, f := range bools {
+		if s := r.FormValue(f.name); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, apiErrorf(ErrBadRequest, "bad %s: %s", f.name, err.Error())
+			}
+			*f.p = b
+		}
+	}
+	return req, nil
+}
+
+type GCStartResult struct {
+	Bucket  string
+	Start   int
+	End     int
+	Merge   bool
+	Pretend bool
+}
+
+func apiStartGC(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseGCRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if storage.hstore.GetGCStatus(bucketID) != nil {
+		return nil, apiErrorf(ErrConflict, "gc on bucket %s already running", args[0])
+	}
+	start, end, err := storage.hstore.GC(bucketID, req.Start, req.End, req.NoGCDays, req.Merge, req.Pretend)
+	if err == store.ErrGCRunning || err == store.ErrGCDeviceBusy {
+		return nil, apiErrorf(ErrConflict, "%s", err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+	}
+	res := &GCStartResult{args[0], start, end, req.Merge, req.Pretend}
+	if req.Pretend {
+		return res, nil
+	}
+	return apiAccepted{res}, nil
+}
+
+type GCCancelResult struct {
+	Bucket string
+	Src    int
+	Dst    int
+}
+
+func apiCancelGC(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	src, dst := storage.hstore.CancelGC(bucketID)
+	if src == -1 {
+		return nil, apiErrorf(ErrConflict, "bucket %s is not gcing", args[0])
+	}
+	return &GCCancelResult{args[0], src, dst}, nil
+}
+
+// apiCancelAllGC cancels the gc of all buckets, and returns the canceled ones.
+func apiCancelAllGC(r *http.Request, args []string) (interface{}, error) {
+	return storage.hstore.CancelAllGC(), nil
+}
+
+type MergeResult struct {
+	Bucket string
+}
+
+func apiMergeHints(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.hstore.MergeHints(bucketID); err == store.ErrHintBusy {
+		return nil, apiErrorf(ErrConflict, "bucket %s: %s", args[0], err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	return apiAccepted{&MergeResult{args[0]}}, nil
+}
+
+func apiFlush(r *http.Request, args []string) (interface{}, error) {
+	storage.hstore.Flush()
+	return struct{}{}, nil
+}
+
+// ServerStats is polled by the dashboard, rates are computed by the caller
+// from the deltas of Counters.
+type ScrubList struct {
+	Stats   store.ScrubStats
+	Buckets []store.ScrubStatus
+}
+
+func apiListScrub(r *http.Request, args []string) (interface{}, error) {
+	return &ScrubList{
+		Stats:   storage.hstore.ScrubStats(),
+		Buckets: storage.hstore.ScrubStatus(),
+	}, nil
+}
+
+func apiPauseScrubber(r *http.Request, args []string) (interface{}, error) {
+	storage.hstore.PauseScrubber(true)
+	return storage.hstore.ScrubStats(), nil
+}
+
+func apiResumeScrubber(r *http.Request, args []string) (interface{}, error) {
+	storage.hstore.PauseScrubber(false)
+	return storage.hstore.ScrubStats(), nil
+}
+
+func apiGetScrub(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return storage.hstore.GetScrubStatus(bucketID), nil
+}
+
+// apiStartScrub runs or resumes a scrub round on the bucket at once.
+func apiStartScrub(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = storage.hstore.ScrubBucket(bucketID); err == store.ErrScrubRunning {
+		return nil, apiErrorf(ErrConflict, "%s", err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	return apiAccepted{storage.hstore.GetScrubStatus(bucketID)}, nil
+}
+
+// apiRemoveBrokenKey forgets a broken key found by the scrubber, so that gets
+// of it are not quarantined.
+func apiRemoveBrokenKey(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	keyhash, err := strconv.ParseUint(args[1], 16, 64)
+	if err != nil {
+		return nil, apiErrorf(ErrBadRequest, "bad keyhash %q", args[1])
+	}
+	if err = storage.hstore.RemoveBrokenKey(bucketID, keyhash); err == store.ErrNoBrokenKey {
+		return nil, apiErrorf(ErrNotFound, "no broken key %016x", keyhash)
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	return storage.hstore.GetScrubStatus(bucketID), nil
+}
+
+// RepairRequest lists keys and keyhashes to repair, the broken keys found by
+// the scrubber if none. Peers default to other servers of the bucket.
+type RepairRequest struct {
+	Keys      []string
+	KeyHashes []string
+	Peers     []string
+}
+
+type RepairResults struct {
+	Peers   []string
+	Results []store.RepairResult
+}
+
+func parseRepairRequest(r *http.Request) (*RepairRequest, error) {
+	req := &RepairRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "bad json: %s", err.Error())
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+		}
+		req.Keys, req.KeyHashes, req.Peers = r.Form["key"], r.Form["keyhash"], r.Form["peer"]
+	}
+	for _, key := range req.Keys {
+		if !store.IsValidKeyString(key) {
+			return nil, apiErrorf(ErrBadRequest, "bad key %q", key)
+		}
+	}
+	return req, nil
+}
+
+// apiRepair fetches records of broken keys from other servers of the bucket
+// and appends them again.
+func apiRepair(r *http.Request, args []string) (interface{}, error) {
+	bucketID, err := parseBucketArg(args[0])
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseRepairRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	keyhashes := make([]uint64, len(req.KeyHashes))
+	for i, s := range req.KeyHashes {
+		if keyhashes[i], err = strconv.ParseUint(s, 16, 64); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "bad keyhash %q", s)
+		}
+	}
+	peers, err := repairPeers(bucketID, req.Peers)
+	if err != nil {
+		return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+	}
+	res := &RepairResults{}
+	for _, p := range peers {
+		res.Peers = append(res.Peers, p.Addr())
+	}
+	if res.Results, err = storage.hstore.Repair(bucketID, req.Keys, keyhashes, peers); err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	return res, nil
+}
+
+type ServerStats struct {
+	Version    string
+	Addr       string
+	Counters   map[string]int64
+	Latency    *mc.LatencyStats
+	Limiter    mc.LimiterState
+	Buffers    *cmem.BeansdbRL
+	Buckets    []BucketStat
+	GC         []store.GCStatus
+	Durability store.DurabilityStats
+	Scrub      store.ScrubStats
+}
+
+func apiGetStats(r *http.Request, args []string) (interface{}, error) {
+	st := server.Stats()
+	return &ServerStats{
+		Version:  config.Version,
+		Addr:     config.ServerConf.Addr(),
+		Counters: st.Stats(),
+		Latency:  st.Latency(),
+		Limiter:  mc.RL.State(),
+		Buffers:  &cmem.DBRL,
+		Buckets:  getBucketStats(storage.hstore),
+		GC:       storage.hstore.GCStatus(),
+
+		Durability: store.GetDurabilityStats(),
+		Scrub:      storage.hstore.ScrubStats(),
+	}, nil
+}
+
+// apiGetErrors returns recent WARN and above lines of the error log, all
+// levels with ?all=true.
+func apiGetErrors(r *http.Request, args []string) (interface{}, error) {
+	hub, ok := loghub.ErrorLogger.Hub.(*loghub.ErrorLogHub)
+	if !ok {
+		return []*loghub.BufferLine{}, nil
+	}
+	return hub.Lines(r.FormValue("all") == "true"), nil
+}
+
+type KeyhashRecord struct {
+	Keyhash  string
+	Bucket   string
+	Key      string
+	InBuffer bool
+	Meta     store.Meta
+}
+
+func apiGetKeyhash(r *http.Request, args []string) (interface{}, error) {
+	s := args[0]
+	if len(s) != 16 {
+		return nil, apiErrorf(ErrBadRequest, "keyhash should be 16 hex digits")
+	}
+	if _, err := strconv.ParseUint(s, 16, 64); err != nil {
+		return nil, apiErrorf(ErrBadRequest, "bad keyhash %q", s)
+	}
+	ki := &store.KeyInfo{StringKey: s, Key: []byte(s), KeyIsPath: true}
+	rec, inbuffer, err := storage.hstore.GetRecordByKeyHash(ki)
+	if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	} else if rec == nil {
+		return nil, apiErrorf(ErrNotFound, "keyhash %s not found", s)
+	}
+	rec.Payload.CArray.Free()
+	return &KeyhashRecord{
+		Keyhash:  s,
+		Bucket:   config.BucketIDHex(ki.BucketID, conf.NumBucket),
+		Key:      string(rec.Key),
+		InBuffer: inbuffer,
+		Meta:     rec.Payload.Meta,
+	}, nil
+}
+
+func apiInspectKey(r *http.Request, args []string) (interface{}, error) {
+	key := args[0]
+	if !config.IsValidKeySize(uint32(len(key))) {
+		return nil, apiErrorf(ErrBadRequest, "bad key size %d", len(key))
+	}
+	preview := 256
+	if s := r.FormValue("preview"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, apiErrorf(ErrBadRequest, "bad preview %q", s)
+		}
+		if n > 4096 {
+			n = 4096
+		}
+		preview = n
+	}
+	scan := r.FormValue("scan") == "true"
+	res, err := storage.hstore.InspectKey([]byte(key), scan, preview)
+	if err == store.ErrBucketNotServed {
+		return nil, apiErrorf(ErrNotFound, "%s", err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	return res, nil
+}
+
+// apiGetVersions lists the versions of a key, or returns the value of the one
+// selected by ?ver=<ver> or ?ts=<unix ts>.
+func apiGetVersions(r *http.Request, args []string) (interface{}, error) {
+	key := args[0]
+	if !store.IsValidKeyString(key) {
+		return nil, apiErrorf(ErrBadRequest, "bad key %q", key)
+	}
+	ki := &store.KeyInfo{StringKey: key, Key: []byte(key)}
+	sel := r.FormValue("ver")
+	if ts := r.FormValue("ts"); ts != "" {
+		if sel != "" {
+			return nil, apiErrorf(ErrBadRequest, "ver and ts are exclusive")
+		}
+		sel = "t" + ts
+	}
+	if sel == "" {
+		versions, err := storage.hstore.ListVersions(ki)
+		if err == store.ErrBucketNotServed {
+			return nil, apiErrorf(ErrNotFound, "%s", err.Error())
+		} else if err != nil {
+			return nil, apiErrorf(ErrInternal, "%s", err.Error())
+		}
+		return versions, nil
+	}
+	ver, ts, err := ParseVersionSelector(sel)
+	if err != nil {
+		return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+	}
+	payload, info, err := storage.hstore.GetVersion(ki, ver, ts)
+	if err == store.ErrBucketNotServed {
+		return nil, apiErrorf(ErrNotFound, "%s", err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	} else if info == nil {
+		return nil, apiErrorf(ErrNotFound, "no version %s of %s", sel, key)
+	} else if payload == nil {
+		return nil, apiErrorf(ErrNotFound, "%s deleted in version %d", key, info.Ver)
+	}
+	raw := &apiRaw{
+		body: append([]byte(nil), payload.Body...),
+		header: map[string]string{
+			"X-Beansdb-Ver":  strconv.Itoa(int(info.Ver)),
+			"X-Beansdb-TS":   strconv.Itoa(int(info.TS)),
+			"X-Beansdb-Flag": strconv.Itoa(int(info.Flag)),
+		},
+	}
+	cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+	payload.CArray.Free()
+	return raw, nil
+}
+
+// UndeleteRequest restores either the listed keys, or the keys deleted in
+// [From, To] (unix time, To defaults to now) of one bucket or all buckets.
+type UndeleteRequest struct {
+	Keys    []string
+	From    int64
+	To      int64
+	Bucket  string
+	Pretend bool
+}
+
+func parseUndeleteRequest(r *http.Request) (*UndeleteRequest, error) {
+	req := &UndeleteRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "bad json: %s", err.Error())
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, apiErrorf(ErrBadRequest, "%s", err.Error())
+		}
+		req.Keys = r.Form["key"]
+		req.Bucket = r.FormValue("bucket")
+		for _, f := range []struct {
+			name string
+			p    *int64
+		}{{"from", &req.From}, {"to", &req.To}} {
+			if s := r.FormValue(f.name); s != "" {
+				n, err := strconv.ParseInt(s, 10, 64)
+				if err != nil {
+					return nil, apiErrorf(ErrBadRequest, "bad %s: %s", f.name, err.Error())
+				}
+				*f.p = n
+			}
+		}
+		if s := r.FormValue("pretend"); s != "" {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return nil, apiErrorf(ErrBadRequest, "bad pretend: %s", err.Error())
+			}
+			req.Pretend = b
+		}
+	}
+	window := req.From != 0 || req.To != 0
+	if len(req.Keys) > 0 == window {
+		return nil, apiErrorf(ErrBadRequest, "need either keys or a time window")
+	}
+	if len(req.Keys) > 0 && req.Bucket != "" {
+		return nil, apiErrorf(ErrBadRequest, "bucket is only for a time window")
+	}
+	if window {
+		if req.To == 0 {
+			req.To = time.Now().Unix()
+		}
+		if req.From < 0 || req.From > req.To || req.To > math.MaxUint32 {
+			return nil, apiErrorf(ErrBadRequest, "bad time window [%d, %d]", req.From, req.To)
+		}
+	}
+	return req, nil
+}
+
+type UndeleteResults struct {
+	Pretend bool
+	Results []store.UndeleteResult
+}
+
+func apiUndelete(r *http.Request, args []string) (interface{}, error) {
+	req, err := parseUndeleteRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	res := &UndeleteResults{Pretend: req.Pretend, Results: []store.UndeleteResult{}}
+	if len(req.Keys) > 0 {
+		for _, key := range req.Keys {
+			one := store.UndeleteResult{Key: key}
+			if !store.IsValidKeyString(key) {
+				one.Err = "bad key"
+			} else {
+				ki := &store.KeyInfo{StringKey: key, Key: []byte(key)}
+				if one.Ver, one.FromVer, err = storage.hstore.Undelete(ki, req.Pretend); err != nil {
+					one.Err = err.Error()
+				}
+			}
+			res.Results = append(res.Results, one)
+		}
+		return res, nil
+	}
+	bucketID := -1
+	if req.Bucket != "" {
+		if bucketID, err = parseBucketArg(req.Bucket); err != nil {
+			return nil, err
+		}
+	}
+	results, err := storage.hstore.UndeleteRange(bucketID, uint32(req.From), uint32(req.To), req.Pretend)
+	if err == store.ErrHintBusy {
+		return nil, apiErrorf(ErrConflict, "%s", err.Error())
+	} else if err != nil {
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+	res.Results = append(res.Results, results...)
+	return res, nil
+}
+
+func apiGetDU(r *http.Request, args []string) (interface{}, error) {
+	return storage.hstore.GetDU(), nil
+}
+
+func apiGetRoute(r *http.Request, args []string) (interface{}, error) {
+	return &config.Route, nil
+}
+
+type RouteVersion struct {
+	Version int // -1 if not using zookeeper
+}
+
+func apiGetRouteVersion(r *http.Request, args []string) (interface{}, error) {
+	if len(conf.ZKServers) == 0 {
+		return &RouteVersion{-1}, nil
+	}
+	return &RouteVersion{config.ZKClient.Version}, nil
+}
+
+func apiReloadRoute(r *http.Request, args []string) (interface{}, error) {
+	r.ParseForm()
+	ver, err := getFormValueInt(r, "ver", -1)
+	if err != nil {
+		return nil, apiErrorf(ErrBadRequest, "bad ver: %s", err.Error())
+	}
+	res, err := reloadRoute(ver)
+	switch err {
+	case nil:
+		return res, nil
+	case errStarting:
+		return nil, apiErrorf(ErrUnavailable, "starting")
+	case errRouteReloading:
+		return nil, apiErrorf(ErrConflict, "route reload in progress")
+	case errNoZK:
+		return nil, apiErrorf(ErrBadRequest, "not using zookeeper")
+	default:
+		return nil, apiErrorf(ErrInternal, "%s", err.Error())
+	}
+}
+
+func apiGetConfig(r *http.Request, args []string) (interface{}, error) {
+	return &conf, nil
+}
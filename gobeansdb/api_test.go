@@ -0,0 +1,186 @@
+package gobeansdb
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansdb/store"
+)
+
+func callAPI(t *testing.T, method, url, body string) (*httptest.ResponseRecorder, *apiErrorBody) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	handleAPI(rec, req)
+	if rec.Code < 400 {
+		return rec, nil
+	}
+	var e apiErrorBody
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.Error == nil {
+		t.Fatalf("%s %s: bad error body %q", method, url, rec.Body.String())
+	}
+	return rec, &e
+}
+
+func TestAPIRouting(t *testing.T) {
+	cases := []struct {
+		method string
+		url    string
+		status int
+		code   string
+	}{
+		{"GET", "/api/v1/admin/config", 200, ""},
+		{"GET", "/api/v1/admin/route/version", 200, ""},
+		{"GET", "/api/v1/admin/nothing", 404, ErrNotFound},
+		{"PUT", "/api/v1/admin/config", 405, ErrMethodNotAllowed},
+		{"POST", "/api/v1/admin/config/reload", 404, ErrNotFound},
+		{"GET", "/api/v1/admin/buckets/0", 503, ErrUnavailable},
+		{"POST", "/api/v1/admin/buckets/0/gc", 503, ErrUnavailable},
+		{"GET", "/api/v1/admin/scrub", 503, ErrUnavailable},
+		{"PUT", "/api/v1/admin/buckets/0/scrub", 405, ErrMethodNotAllowed},
+		{"POST", "/api/v1/admin/buckets/0/repair", 503, ErrUnavailable},
+		{"GET", "/api/v1/admin/buckets/0/repair", 405, ErrMethodNotAllowed},
+	}
+	for _, c := range cases {
+		rec, e := callAPI(t, c.method, c.url, "")
+		if rec.Code != c.status {
+			t.Errorf("%s %s: status %d, expect %d", c.method, c.url, rec.Code, c.status)
+		}
+		if c.code != "" && e.Error.Code != c.code {
+			t.Errorf("%s %s: code %s, expect %s", c.method, c.url, e.Error.Code, c.code)
+		}
+	}
+	rec, _ := callAPI(t, "DELETE", "/api/v1/admin/buckets/0", "")
+	if rec.Header().Get("Allow") != "GET" {
+		t.Errorf("bad Allow header %q", rec.Header().Get("Allow"))
+	}
+
+	r := httptest.NewRequest("DELETE", "/api/v1/admin/buckets/0/gc", nil)
+	if role, mutating := requiredRole(r); role != RoleOperator || !mutating {
+		t.Errorf("cancel gc: role %d, mutating %v", role, mutating)
+	}
+	r = httptest.NewRequest("DELETE", "/api/v1/admin/buckets/0/broken/0123456789abcdef", nil)
+	if role, mutating := requiredRole(r); role != RoleOperator || !mutating {
+		t.Errorf("remove broken key: role %d, mutating %v", role, mutating)
+	}
+	r = httptest.NewRequest("POST", "/api/v1/admin/route/reload", nil)
+	if role, _ := requiredRole(r); role != RoleAdmin {
+		t.Errorf("route reload: role %d", role)
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/key/a/b/c", nil)
+	rt, args, _ := findAPI(r)
+	if rt == nil || len(args) != 1 || args[0] != "a/b/c" {
+		t.Errorf("key with slashes: %v %v", rt, args)
+	}
+	r = httptest.NewRequest("GET", "/api/v1/key", nil)
+	if rt, _, _ := findAPI(r); rt != nil {
+		t.Errorf("key route matched without a key")
+	}
+}
+
+func TestParseGCRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/admin/buckets/0/gc?start=2&merge=true", nil)
+	req, err := parseGCRequest(r)
+	if err != nil || req.Start != 2 || req.End != -1 || !req.Merge || req.Pretend {
+		t.Fatalf("%#v %v", req, err)
+	}
+	r = httptest.NewRequest("POST", "/api/v1/admin/buckets/0/gc", strings.NewReader(`{"End": 3, "Pretend": true}`))
+	r.Header.Set("Content-Type", "application/json")
+	req, err = parseGCRequest(r)
+	if err != nil || req.Start != -1 || req.End != 3 || !req.Pretend {
+		t.Fatalf("%#v %v", req, err)
+	}
+	r = httptest.NewRequest("POST", "/api/v1/admin/buckets/0/gc?merge=yes", nil)
+	if _, err = parseGCRequest(r); err == nil {
+		t.Fatal("bad bool should fail")
+	}
+}
+
+func TestParseUndeleteRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/admin/undelete?key=a&key=b&pretend=true", nil)
+	req, err := parseUndeleteRequest(r)
+	if err != nil || len(req.Keys) != 2 || !req.Pretend {
+		t.Fatalf("%#v %v", req, err)
+	}
+	r = httptest.NewRequest("POST", "/api/v1/admin/undelete", strings.NewReader(`{"From": 100}`))
+	r.Header.Set("Content-Type", "application/json")
+	req, err = parseUndeleteRequest(r)
+	if err != nil || req.From != 100 || req.To < 100 {
+		t.Fatalf("%#v %v", req, err)
+	}
+	for _, q := range []string{"", "?key=a&from=1", "?from=10&to=5", "?key=a&bucket=0"} {
+		r = httptest.NewRequest("POST", "/api/v1/admin/undelete"+q, nil)
+		if _, err = parseUndeleteRequest(r); err == nil {
+			t.Errorf("%q should fail", q)
+		}
+	}
+}
+
+func TestParseHoldRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/admin/holds?pattern=a*&ttl=60", nil)
+	req, err := parseHoldRequest(r)
+	if err != nil || req.Pattern != "a*" || !req.Expire.After(time.Now()) {
+		t.Fatalf("%#v %v", req, err)
+	}
+	r = httptest.NewRequest("POST", "/api/v1/admin/holds",
+		strings.NewReader(`{"Pattern": "k", "Expire": "2999-01-01T00:00:00Z", "Reason": "case 1"}`))
+	r.Header.Set("Content-Type", "application/json")
+	req, err = parseHoldRequest(r)
+	if err != nil || req.Reason != "case 1" || req.Expire.Year() != 2999 {
+		t.Fatalf("%#v %v", req, err)
+	}
+	for _, q := range []string{"?ttl=60", "?pattern=k", "?pattern=k&expire=2000-01-01T00:00:00Z",
+		"?pattern=k&ttl=60&expire=2999-01-01T00:00:00Z", "?pattern=k&ttl=x"} {
+		r = httptest.NewRequest("POST", "/api/v1/admin/holds"+q, nil)
+		if _, err = parseHoldRequest(r); err == nil {
+			t.Errorf("%q should fail", q)
+		}
+	}
+}
+
+func TestParseGCThrottle(t *testing.T) {
+	th := store.GCThrottle{MaxMBps: 10, MaxRecsPerSec: 100}
+	r := httptest.NewRequest("PUT", "/api/v1/admin/gc/throttle?mbps=2.5", nil)
+	if err := parseGCThrottle(r, &th); err != nil || th.MaxMBps != 2.5 || th.MaxRecsPerSec != 100 {
+		t.Fatalf("%#v %v", th, err)
+	}
+	r = httptest.NewRequest("PUT", "/api/v1/admin/gc/throttle", strings.NewReader(`{"MaxRecsPerSec": 0}`))
+	r.Header.Set("Content-Type", "application/json")
+	if err := parseGCThrottle(r, &th); err != nil || th.MaxMBps != 2.5 || th.MaxRecsPerSec != 0 {
+		t.Fatalf("%#v %v", th, err)
+	}
+	for _, q := range []string{"?mbps=x", "?recs=-1"} {
+		r = httptest.NewRequest("PUT", "/api/v1/admin/gc/throttle"+q, nil)
+		if err := parseGCThrottle(r, &th); err == nil {
+			t.Errorf("%q should fail", q)
+		}
+	}
+}
+
+func TestParseVersionSelector(t *testing.T) {
+	cases := []struct {
+		sel string
+		ver int32
+		ts  uint32
+		ok  bool
+	}{
+		{"3", 3, 0, true},
+		{"-2", -2, 0, true},
+		{"t1500000000", 0, 1500000000, true},
+		{"0", 0, 0, false},
+		{"t", 0, 0, false},
+		{"x1", 0, 0, false},
+	}
+	for _, c := range cases {
+		ver, ts, err := ParseVersionSelector(c.sel)
+		if (err == nil) != c.ok || (c.ok && (ver != c.ver || ts != c.ts)) {
+			t.Errorf("%q: %d %d %v", c.sel, ver, ts, err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package gobeansdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/loghub"
+)
+
+// Web roles, each one includes the ones before it.
+const (
+	RoleNone     = iota // health probes, no auth needed
+	RoleRead            // stats, bucket info
+	RoleOperator        // gc, flush, merge, runtime knobs
+	RoleAdmin           // route reload, config reload, pprof
+)
+
+var roleNames = []string{"none", "read", "operator", "admin"}
+
+func parseRole(s string) (int, error) {
+	for i, name := range roleNames {
+		if i > RoleNone && name == s {
+			return i, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown web role %q", s)
+}
+
+// webAuth is nil when no web user is configured, then all calls are allowed.
+var webAuth *WebAuth
+
+type webUser struct {
+	name     string
+	role     int
+	token    []byte
+	password []byte
+}
+
+type WebAuth struct {
+	users []webUser
+}
+
+func NewWebAuth(users []config.WebUser) (*WebAuth, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	a := &WebAuth{}
+	for _, u := range users {
+		role, err := parseRole(u.Role)
+		if err != nil {
+			return nil, err
+		}
+		if u.Token == "" && (u.Name == "" || u.Password == "") {
+			return nil, fmt.Errorf("web user %q needs a token or a name and password", u.Name)
+		}
+		a.users = append(a.users, webUser{u.Name, role, []byte(u.Token), []byte(u.Password)})
+	}
+	return a, nil
+}
+
+// Authenticate returns the user of a request, ok is false if no credential matches.
+func (a *WebAuth) Authenticate(r *http.Request) (name string, role int, ok bool) {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := []byte(strings.TrimPrefix(h, "Bearer "))
+		for _, u := range a.users {
+			if len(u.token) > 0 && subtle.ConstantTimeCompare(u.token, token) == 1 {
+				return u.name, u.role, true
+			}
+		}
+		return
+	}
+	user, pass, hasBasic := r.BasicAuth()
+	if !hasBasic {
+		return
+	}
+	for _, u := range a.users {
+		if len(u.password) > 0 && u.name == user &&
+			subtle.ConstantTimeCompare(u.password, []byte(pass)) == 1 {
+			return u.name, u.role, true
+		}
+	}
+	return
+}
+
+// requiredRole returns the role needed by a request and whether it changes
+// the state of the server, so it should be audited.
+func requiredRole(r *http.Request) (role int, mutating bool) {
+	p := r.URL.Path
+	switch {
+	case p == "/healthz" || p == "/readyz":
+		return RoleNone, false
+	case strings.HasPrefix(p, "/api/"):
+		return apiRole(r)
+	case strings.HasPrefix(p, "/debug/pprof"):
+		return RoleAdmin, false
+	case p == "/reload" || p == "/route/reload":
+		return RoleAdmin, true
+	case strings.HasPrefix(p, "/gc/"):
+		if r.FormValue("run") == "true" || r.FormValue("cancel") == "true" {
+			return RoleOperator, true
+		}
+	case p == "/flush" || p == "/freememory" || p == "/stats/reset":
+		return RoleOperator, true
+	case p == "/hotkeys" && r.FormValue("sample") != "":
+		return RoleOperator, true
+	case p == "/slowlog" && r.FormValue("threshold_ms") != "":
+		return RoleOperator, true
+	}
+	return RoleRead, false
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// authHandler checks the role of the caller and audits mutating calls before
+// passing the request to h.
+func authHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need, mutating := requiredRole(r)
+		user := "-"
+		a := webAuth
+		if a != nil && need > RoleNone {
+			name, role, ok := a.Authenticate(r)
+			isAPI := strings.HasPrefix(r.URL.Path, "/api/")
+			if !ok {
+				if isAPI {
+					writeAPIError(w, apiErrorf(ErrUnauthorized, "need a bearer token or basic auth"))
+				} else {
+					w.Header().Set("WWW-Authenticate", `Basic realm="gobeansdb"`)
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+				}
+				audit(r, "-", mutating, http.StatusUnauthorized)
+				return
+			}
+			user = name
+			if role < need {
+				msg := fmt.Sprintf("forbidden, need role %s", roleNames[need])
+				if isAPI {
+					writeAPIError(w, apiErrorf(ErrForbidden, "%s", msg))
+				} else {
+					http.Error(w, msg, http.StatusForbidden)
+				}
+				audit(r, user, mutating, http.StatusForbidden)
+				return
+			}
+		}
+		if !mutating {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sw := &statusWriter{w, http.StatusOK}
+		r = peekJSONBody(r)
+		defer func() {
+			audit(r, user, true, sw.status)
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+type auditBodyKey struct{}
+
+// peekJSONBody keeps a small JSON body for audit, the handler still reads all of it.
+func peekJSONBody(r *http.Request) *http.Request {
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return r
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(r.Body, 4096))
+	r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+	return r.WithContext(context.WithValue(r.Context(), auditBodyKey{}, b))
+}
+
+// audit logs mutating calls, and rejected calls which may be probing.
+func audit(r *http.Request, user string, mutating bool, status int) {
+	if !mutating && status < 400 {
+		return
+	}
+	params := r.Form.Encode()
+	if b, ok := r.Context().Value(auditBodyKey{}).([]byte); ok {
+		params = string(b)
+	}
+	msg := fmt.Sprintf("user=%s remote=%s %s %s params=[%s] status=%d",
+		user, r.RemoteAddr, r.Method, r.URL.Path, params, status)
+	if loghub.AuditLogger.Hub != nil {
+		loghub.AuditLogger.Infof("%s", msg)
+	} else {
+		logger.Infof("audit: %s", msg)
+	}
+}
+
+func initWebAuth() {
+	var err error
+	webAuth, err = NewWebAuth(conf.WebUsers)
+	if err != nil {
+		logger.Fatalf("bad web users: %s", err.Error())
+	}
+	if conf.AuditLog != "" {
+		loghub.InitAuditLog(conf.AuditLog, loghub.INFO)
+		go reopenAuditLog(conf.AuditLog)
+	}
+}
+
+// reopenAuditLog follows logrotate, as the server does for the other logs.
+func reopenAuditLog(path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		if err := loghub.AuditLogger.Hub.Reopen(path); err != nil {
+			logger.Warnf("open audit log %s failed: %s", path, err.Error())
+		}
+	}
+}
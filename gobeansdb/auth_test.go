@@ -0,0 +1,71 @@
+package gobeansdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/douban/gobeansdb/config"
+)
+
+func TestWebAuth(t *testing.T) {
+	a, err := NewWebAuth([]config.WebUser{
+		{Name: "viewer", Role: "read", Token: "t-read"},
+		{Name: "ops", Role: "operator", Password: "secret"},
+		{Name: "root", Role: "admin", Token: "t-admin"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWebAuth([]config.WebUser{{Name: "x", Role: "god", Token: "t"}}); err == nil {
+		t.Fatal("unknown role should fail")
+	}
+	if _, err := NewWebAuth([]config.WebUser{{Name: "x", Role: "read"}}); err == nil {
+		t.Fatal("user without credential should fail")
+	}
+
+	webAuth = a
+	defer func() { webAuth = nil }()
+	served := 0
+	h := authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	cases := []struct {
+		url    string
+		token  string
+		user   string
+		pass   string
+		status int
+	}{
+		{"/healthz", "", "", "", 200},
+		{"/config", "", "", "", 401},
+		{"/config", "bad", "", "", 401},
+		{"/config", "t-read", "", "", 200},
+		{"/gc/1", "t-read", "", "", 200}, // pretend
+		{"/gc/1?run=true", "t-read", "", "", 403},
+		{"/gc/1?run=true", "", "ops", "bad", 401},
+		{"/gc/1?run=true", "", "ops", "secret", 200},
+		{"/flush", "", "ops", "secret", 200},
+		{"/route/reload", "", "ops", "secret", 403},
+		{"/debug/pprof/heap", "", "ops", "secret", 403},
+		{"/route/reload", "t-admin", "", "", 200},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.url, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		} else if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		rec := httptest.NewRecorder()
+		n := served
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %s/%s: status %d, expect %d", c.url, c.token, c.user, rec.Code, c.status)
+		}
+		if (served > n) != (c.status == 200) {
+			t.Errorf("%s: served %v", c.url, served > n)
+		}
+	}
+}
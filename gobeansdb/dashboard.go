@@ -0,0 +1,401 @@
+package gobeansdb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// The dashboard is a single page polling /api/v1/admin/*, it has no external
+// assets so it works on hosts without internet access. A dashboard.html in
+// StaticDir replaces the built-in one, e.g. to try changes without a rebuild.
+
+const dashboardFile = "dashboard.html"
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if conf.StaticDir != "" {
+		path := filepath.Join(conf.StaticDir, dashboardFile)
+		if _, err := os.Stat(path); err == nil {
+			http.ServeFile(w, r, path)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gobeansdb</title>
+<style>
+body { font: 13px/1.4 -apple-system, "Helvetica Neue", Arial, sans-serif; margin: 0; color: #222; background: #f4f5f7; }
+header { background: #263238; color: #eceff1; padding: 8px 16px; display: flex; gap: 24px; align-items: baseline; }
+header h1 { font-size: 16px; margin: 0; }
+header a { color: #90caf9; }
+main { padding: 12px 16px; display: grid; grid-template-columns: repeat(auto-fill, minmax(420px, 1fr)); gap: 12px; }
+section { background: #fff; border: 1px solid #dde; border-radius: 4px; padding: 8px 12px; }
+section.wide { grid-column: 1 / -1; }
+h2 { font-size: 13px; margin: 0 0 6px; text-transform: uppercase; color: #546e7a; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 2px 6px; border-bottom: 1px solid #eee; white-space: nowrap; }
+th { color: #78909c; font-weight: normal; }
+.num { text-align: right; font-variant-numeric: tabular-nums; }
+.kv { display: grid; grid-template-columns: repeat(4, 1fr); gap: 4px 12px; }
+.kv div span { display: block; font-size: 18px; }
+.kv div label { color: #78909c; }
+#grid { display: flex; flex-wrap: wrap; gap: 3px; }
+.cell { width: 64px; padding: 3px; border-radius: 3px; background: #c8e6c9; cursor: pointer; font-size: 11px; }
+.cell b { display: block; font-size: 12px; }
+.cell.gc { background: #ffe0b2; }
+.cell.off { background: #eceff1; color: #999; }
+.cell.sel { outline: 2px solid #1e88e5; }
+canvas { width: 100%; height: 160px; }
+.legend span { margin-right: 12px; }
+.legend i { display: inline-block; width: 10px; height: 3px; margin-right: 4px; vertical-align: middle; }
+form { margin: 6px 0; }
+form input[type=number] { width: 60px; }
+.err { color: #c62828; }
+.msg { color: #2e7d32; }
+.log td { white-space: pre-wrap; font-family: monospace; font-size: 12px; }
+.lv3, .lv4 { color: #c62828; }
+.lv2 { color: #ef6c00; }
+</style>
+</head>
+<body>
+<header>
+  <h1>gobeansdb <span id="addr"></span></h1>
+  <span id="version"></span>
+  <span id="uptime"></span>
+  <span id="status" class="err"></span>
+  <span style="flex:1"></span>
+  <a href="/links">links</a>
+  <a href="/debug/pprof/">pprof</a>
+</header>
+<main>
+  <section>
+    <h2>Requests</h2>
+    <div class="kv">
+      <div><label>get/s</label><span id="rate_get">-</span></div>
+      <div><label>set/s</label><span id="rate_set">-</span></div>
+      <div><label>delete/s</label><span id="rate_delete">-</span></div>
+      <div><label>hit ratio</label><span id="hit_ratio">-</span></div>
+      <div><label>connections</label><span id="conns">-</span></div>
+      <div><label>read/s</label><span id="rate_read">-</span></div>
+      <div><label>write/s</label><span id="rate_written">-</span></div>
+      <div><label>slow cmds</label><span id="slow_cmd">-</span></div>
+    </div>
+  </section>
+  <section>
+    <h2>Limiter and buffers</h2>
+    <div class="kv">
+      <div><label>tokens busy</label><span id="rl_busy">-</span></div>
+      <div><label>waiting</label><span id="rl_wait">-</span></div>
+      <div><label>max wait</label><span id="rl_maxwait">-</span></div>
+      <div><label>goroutines</label><span id="threads">-</span></div>
+      <div><label>flush backlog</label><span id="buf_flush">-</span></div>
+      <div><label>set buffers</label><span id="buf_set">-</span></div>
+      <div><label>get buffers</label><span id="buf_get">-</span></div>
+      <div><label>alloc</label><span id="buf_alloc">-</span></div>
+    </div>
+  </section>
+  <section>
+    <h2>Request rate</h2>
+    <canvas id="chart_rate"></canvas>
+    <div class="legend" id="legend_rate"></div>
+  </section>
+  <section>
+    <h2>Latency (avg per interval, ms)</h2>
+    <canvas id="chart_lat"></canvas>
+    <div class="legend" id="legend_lat"></div>
+    <table id="lat_table"></table>
+  </section>
+  <section class="wide">
+    <h2>Buckets</h2>
+    <div id="grid"></div>
+  </section>
+  <section class="wide" id="bucket_panel" style="display:none">
+    <h2>Bucket <span id="bkt_id"></span></h2>
+    <form id="gc_form">
+      GC chunks start <input type="number" name="start" value="-1">
+      end <input type="number" name="end" value="-1">
+      no gc days <input type="number" name="nogcdays" value="-1">
+      <label><input type="checkbox" name="merge"> merge</label>
+      <label><input type="checkbox" name="pretend" checked> pretend</label>
+      <button type="submit">start gc</button>
+      <button type="button" id="gc_cancel">cancel gc</button>
+      <button type="button" id="hint_merge">merge hints</button>
+      <span id="bkt_msg"></span>
+    </form>
+    <table id="gc_running"></table>
+    <h2>GC history</h2>
+    <table id="gc_history"></table>
+  </section>
+  <section class="wide">
+    <h2>Recent errors <label><input type="checkbox" id="log_all"> all levels</label></h2>
+    <table class="log" id="errors"></table>
+  </section>
+</main>
+<script>
+"use strict";
+var POLL = 2000, POINTS = 150;
+var levels = ["DEBUG", "INFO", "WARN", "ERROR", "FATAL"];
+var colors = ["#1e88e5", "#43a047", "#e53935", "#8e24aa"];
+var hist = { t: [], get: [], set: [], "delete": [], lat_get: [], lat_set: [], lat_getm: [] };
+var last = null, du = {}, selected = null, gcBuckets = {};
+
+function $(id) { return document.getElementById(id); }
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function (c) {
+    return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;" }[c];
+  });
+}
+
+function api(method, path, body) {
+  var opts = { method: method, credentials: "same-origin", headers: {} };
+  if (body) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  return fetch("/api/v1/admin/" + path, opts).then(function (resp) {
+    return resp.json().then(function (v) {
+      if (!resp.ok) {
+        throw new Error(v.error ? v.error.code + ": " + v.error.message : resp.statusText);
+      }
+      return v;
+    });
+  });
+}
+
+function bytes(n) {
+  var u = ["B", "K", "M", "G", "T"], i = 0;
+  while (n >= 1024 && i < u.length - 1) { n /= 1024; i++; }
+  return (i ? n.toFixed(1) : n) + u[i];
+}
+
+function num(n) {
+  if (n >= 1e6) return (n / 1e6).toFixed(1) + "M";
+  if (n >= 1e4) return (n / 1e3).toFixed(1) + "K";
+  return String(Math.round(n * 10) / 10);
+}
+
+function ms(ns) { return (ns / 1e6).toFixed(1) + "ms"; }
+
+function push(name, v) {
+  hist[name].push(v);
+  if (hist[name].length > POINTS) hist[name].shift();
+}
+
+function drawChart(canvas, legend, series) {
+  var dpr = window.devicePixelRatio || 1;
+  var w = canvas.clientWidth, h = canvas.clientHeight;
+  canvas.width = w * dpr;
+  canvas.height = h * dpr;
+  var ctx = canvas.getContext("2d");
+  ctx.scale(dpr, dpr);
+  var max = 0;
+  series.forEach(function (s) {
+    s.data.forEach(function (v) { if (v > max) max = v; });
+  });
+  max = max > 0 ? max * 1.1 : 1;
+  ctx.strokeStyle = "#eee";
+  ctx.fillStyle = "#999";
+  ctx.font = "10px sans-serif";
+  for (var i = 0; i <= 4; i++) {
+    var y = h - 14 - (h - 24) * i / 4;
+    ctx.beginPath(); ctx.moveTo(30, y); ctx.lineTo(w, y); ctx.stroke();
+    ctx.fillText(num(max * i / 4), 0, y + 3);
+  }
+  series.forEach(function (s, k) {
+    ctx.strokeStyle = colors[k % colors.length];
+    ctx.lineWidth = 1.5;
+    ctx.beginPath();
+    s.data.forEach(function (v, i) {
+      var x = 30 + (w - 30) * (i + POINTS - s.data.length) / (POINTS - 1);
+      var y = h - 14 - (h - 24) * v / max;
+      if (i === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  });
+  legend.innerHTML = series.map(function (s, k) {
+    var cur = s.data.length ? num(s.data[s.data.length - 1]) : "-";
+    return "<span><i style='background:" + colors[k % colors.length] + "'></i>" + s.name + " " + cur + "</span>";
+  }).join("");
+}
+
+function histSum(h) { return h ? h.avg_us * h.count : 0; }
+
+function intervalAvg(cur, prev, cmd) {
+  var a = cur.Latency.Cmds[cmd], b = prev.Latency.Cmds[cmd];
+  var n = a.count - b.count;
+  return n > 0 ? (histSum(a) - histSum(b)) / n / 1000 : 0;
+}
+
+function updateStats(st) {
+  var c = st.Counters, now = Date.now();
+  $("addr").textContent = st.Addr;
+  $("version").textContent = "v" + st.Version;
+  $("uptime").textContent = "up " + Math.floor(c.uptime / 3600) + "h" + Math.floor(c.uptime % 3600 / 60) + "m";
+  $("conns").textContent = c.curr_connections;
+  $("slow_cmd").textContent = c.slow_cmd;
+  $("threads").textContent = c.threads;
+  var hits = c.get_hits + c.get_misses;
+  $("hit_ratio").textContent = hits ? (100 * c.get_hits / hits).toFixed(1) + "%" : "-";
+
+  var rl = st.Limiter;
+  $("rl_busy").textContent = rl.Busy + "/" + rl.Size;
+  $("rl_wait").textContent = rl.NumWait;
+  $("rl_maxwait").textContent = ms(rl.MaxWait);
+  var b = st.Buffers;
+  $("buf_flush").textContent = bytes(b.FlushData.Size);
+  $("buf_set").textContent = bytes(b.SetData.Size);
+  $("buf_get").textContent = bytes(b.GetData.Size);
+  $("buf_alloc").textContent = bytes(b.AllocRL.Size);
+
+  if (last) {
+    var dt = (now - last.time) / 1000, p = last.st.Counters;
+    var r = function (k) { return Math.max(0, (c[k] - p[k]) / dt); };
+    push("get", r("cmd_get"));
+    push("set", r("cmd_set"));
+    push("delete", r("cmd_delete"));
+    $("rate_get").textContent = num(r("cmd_get"));
+    $("rate_set").textContent = num(r("cmd_set"));
+    $("rate_delete").textContent = num(r("cmd_delete"));
+    $("rate_read").textContent = bytes(r("bytes_read"));
+    $("rate_written").textContent = bytes(r("bytes_written"));
+    push("lat_get", intervalAvg(st, last.st, "get"));
+    push("lat_getm", intervalAvg(st, last.st, "getm"));
+    push("lat_set", intervalAvg(st, last.st, "set"));
+  }
+  last = { time: now, st: st };
+
+  drawChart($("chart_rate"), $("legend_rate"), [
+    { name: "get", data: hist.get }, { name: "set", data: hist.set }, { name: "delete", data: hist["delete"] }]);
+  drawChart($("chart_lat"), $("legend_lat"), [
+    { name: "get", data: hist.lat_get }, { name: "getm", data: hist.lat_getm }, { name: "set", data: hist.lat_set }]);
+
+  var rows = "<tr><th></th><th class='num'>count</th><th class='num'>p50</th><th class='num'>p99</th><th class='num'>p999</th><th class='num'>max</th></tr>";
+  Object.keys(st.Latency.Cmds).sort().forEach(function (k) {
+    var h = st.Latency.Cmds[k];
+    if (!h.count) return;
+    rows += "<tr><td>" + k + "</td><td class='num'>" + h.count + "</td><td class='num'>" + h.p50_us +
+      "us</td><td class='num'>" + h.p99_us + "us</td><td class='num'>" + h.p999_us + "us</td><td class='num'>" + h.max_us + "us</td></tr>";
+  });
+  $("lat_table").innerHTML = rows;
+
+  gcBuckets = {};
+  (st.GC || []).forEach(function (g) { gcBuckets[g.Bucket] = g; });
+  updateGrid(st.Buckets || []);
+}
+
+function updateGrid(buckets) {
+  $("grid").innerHTML = buckets.map(function (b) {
+    var cls = "cell" + (b.State !== 2 ? " off" : "") + (gcBuckets[b.ID] ? " gc" : "") + (b.ID === selected ? " sel" : "");
+    var size = du[b.ID] !== undefined ? bytes(du[b.ID]) : "";
+    return "<div class='" + cls + "' data-id='" + b.ID + "'><b>" + b.ID + "</b>" +
+      num(b.NumKey) + " keys<br>" + size + (gcBuckets[b.ID] ? "<br>gc " + gcBuckets[b.ID].Src + "/" + gcBuckets[b.ID].End : "") + "</div>";
+  }).join("");
+}
+
+function showBucket(id) {
+  selected = id;
+  $("bucket_panel").style.display = "";
+  $("bkt_id").textContent = id;
+  api("GET", "buckets/" + id + "/gc").then(function (g) {
+    var cols = ["BeginTS", "EndTS", "Begin", "End", "Src", "Dst", "NumBefore", "NumReleased", "SizeBefore", "SizeReleased", "Running"];
+    var head = "<tr>" + cols.map(function (c) { return "<th>" + c + "</th>"; }).join("") + "</tr>";
+    var row = function (s) {
+      return "<tr>" + cols.map(function (c) {
+        var v = s[c];
+        if (c === "SizeBefore" || c === "SizeReleased") v = bytes(v);
+        if (c === "BeginTS" || c === "EndTS") v = v && v.indexOf("0001") !== 0 ? v.replace("T", " ").substr(0, 19) : "";
+        return "<td>" + esc(v) + "</td>";
+      }).join("") + "</tr>";
+    };
+    $("gc_running").innerHTML = g.Running ? head + row(g.Running) : "<tr><td>no gc running</td></tr>";
+    $("gc_history").innerHTML = head + (g.History || []).slice().reverse().map(row).join("");
+  }).catch(function (e) { setMsg(e.message, true); });
+}
+
+function setMsg(s, isErr) {
+  var m = $("bkt_msg");
+  m.className = isErr ? "err" : "msg";
+  m.textContent = s;
+}
+
+$("grid").addEventListener("click", function (ev) {
+  var cell = ev.target.closest(".cell");
+  if (cell) { setMsg(""); showBucket(cell.getAttribute("data-id")); }
+});
+
+$("gc_form").addEventListener("submit", function (ev) {
+  ev.preventDefault();
+  var f = ev.target;
+  var req = {
+    Start: parseInt(f.start.value, 10), End: parseInt(f.end.value, 10), NoGCDays: parseInt(f.nogcdays.value, 10),
+    Merge: f.merge.checked, Pretend: f.pretend.checked
+  };
+  if (!req.Pretend && !confirm("start gc on bucket " + selected + "?")) return;
+  api("POST", "buckets/" + selected + "/gc", req).then(function (r) {
+    setMsg((r.Pretend ? "would gc" : "gc started") + ": chunks " + r.Start + " - " + r.End);
+    showBucket(selected);
+  }).catch(function (e) { setMsg(e.message, true); });
+});
+
+$("gc_cancel").addEventListener("click", function () {
+  if (!confirm("cancel gc on bucket " + selected + "?")) return;
+  api("DELETE", "buckets/" + selected + "/gc").then(function (r) {
+    setMsg("gc cancelled at src " + r.Src + ", dst " + r.Dst);
+    showBucket(selected);
+  }).catch(function (e) { setMsg(e.message, true); });
+});
+
+$("hint_merge").addEventListener("click", function () {
+  api("POST", "buckets/" + selected + "/merge").then(function () {
+    setMsg("hint merge started");
+  }).catch(function (e) { setMsg(e.message, true); });
+});
+
+function pollStats() {
+  api("GET", "stats").then(function (st) {
+    $("status").textContent = "";
+    updateStats(st);
+  }).catch(function (e) {
+    $("status").textContent = e.message;
+  }).then(function () { setTimeout(pollStats, POLL); });
+}
+
+function pollDU() {
+  api("GET", "du").then(function (d) { du = d.BucketsHex || {}; })
+    .catch(function () {})
+    .then(function () { setTimeout(pollDU, 30000); });
+}
+
+function loadErrors() {
+  return api("GET", "errors" + ($("log_all").checked ? "?all=true" : "")).then(function (lines) {
+    $("errors").innerHTML = lines.slice().reverse().slice(0, 100).map(function (l) {
+      return "<tr class='lv" + l.Level + "'><td>" + esc(l.TS.replace("T", " ").substr(0, 23)) + "</td><td>" +
+        levels[l.Level] + "</td><td>" + esc(l.File + ":" + l.Line) + "</td><td>" + esc(l.Msg) + "</td></tr>";
+    }).join("") || "<tr><td>no errors</td></tr>";
+  }).catch(function () {});
+}
+
+function pollErrors() {
+  loadErrors().then(function () { setTimeout(pollErrors, 10000); });
+}
+
+$("log_all").addEventListener("change", loadErrors);
+
+pollStats();
+pollDU();
+pollErrors();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,42 @@
+package gobeansdb
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobeansdb_dashboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := conf.StaticDir
+	conf.StaticDir = dir
+	defer func() { conf.StaticDir = old }()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleDashboard(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	rec := get("/")
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "/api/v1/admin/") {
+		t.Fatalf("built-in dashboard: %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "http://") || strings.Contains(rec.Body.String(), "https://") {
+		t.Fatalf("dashboard should not load external assets")
+	}
+	if rec = get("/nothing"); rec.Code != 404 {
+		t.Fatalf("unknown path: %d", rec.Code)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, dashboardFile), []byte("custom"), 0644)
+	if rec = get("/"); rec.Body.String() != "custom" {
+		t.Fatalf("dashboard in StaticDir not used: %q", rec.Body.String())
+	}
+}
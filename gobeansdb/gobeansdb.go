@@ -11,6 +11,7 @@ import (
 	"github.com/douban/gobeansdb/loghub"
 	mc "github.com/douban/gobeansdb/memcache"
 	"github.com/douban/gobeansdb/store"
+	"github.com/douban/gobeansdb/trace"
 )
 
 var (
@@ -20,6 +21,21 @@ var (
 	logger  = loghub.ErrorLogger
 )
 
+func initTrace() {
+	if conf.TraceExporter == "" {
+		return
+	}
+	err := trace.Init(trace.Options{
+		Sample:   conf.TraceSample,
+		Exporter: conf.TraceExporter,
+		Endpoint: conf.TraceEndpoint,
+		File:     conf.TraceFile,
+	})
+	if err != nil {
+		logger.Errorf("fail to init tracing: %s", err.Error())
+	}
+}
+
 func Main() {
 	var version = flag.Bool("version", false, "print version of gobeansdb")
 	var confdir = flag.String("confdir", "", "path of server config dir")
@@ -66,6 +82,7 @@ func Main() {
 	logger.Infof("route table: %#v", config.Route)
 
 	initWeb()
+	initTrace()
 
 	var err error
 
@@ -74,8 +91,10 @@ func Main() {
 		logger.Fatalf("fail to init NewHStore %s", err.Error())
 	}
 	storage = &Storage{hstore: hstore}
+	initHotKeys()
 
 	server = mc.NewServer(storage)
+	store.GCLoadFunc = gcLoad(server.Stats())
 	addr := fmt.Sprintf("%s:%d", conf.Listen, conf.Port)
 	if err := server.Listen(addr); err != nil {
 		logger.Fatalf("listen failed %s", err.Error())
@@ -86,11 +105,14 @@ func Main() {
 	server.HandleSignals(conf.ErrorLog, conf.AccessLog, conf.AnalysisLog)
 	go storage.hstore.HintDumper(1 * time.Minute) // it may start merge go routine
 	go storage.hstore.Flusher()
+	go storage.hstore.GCScheduler()
+	go storage.hstore.Scrubber()
 	config.AllowReload = true
 	err = server.Serve()
 	tmp := storage
 	storage = nil
 	tmp.hstore.Close()
+	trace.Close()
 
 	logger.Infof("shut down gracefully")
 }
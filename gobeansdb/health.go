@@ -0,0 +1,103 @@
+package gobeansdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/store"
+)
+
+type HealthCheck struct {
+	Name string
+	OK   bool
+	Msg  string `json:",omitempty"`
+}
+
+type HealthReport struct {
+	Status string // "ok" or "fail"
+	Checks []HealthCheck
+}
+
+func (r *HealthReport) add(name string, err string) {
+	r.Checks = append(r.Checks, HealthCheck{name, err == "", err})
+	if err != "" {
+		r.Status = "fail"
+	}
+}
+
+func writeHealth(w http.ResponseWriter, r *HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
+
+// handleHealthz is the liveness probe: the process is up and serving http.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, &HealthReport{Status: "ok"})
+}
+
+// handleReadyz is the readiness probe, it fails until the node can serve all its buckets.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+	writeHealth(w, checkReady())
+}
+
+func checkReady() *HealthReport {
+	report := &HealthReport{Status: "ok"}
+	if storage == nil || server == nil {
+		report.add("started", "starting")
+		return report
+	}
+	report.add("started", "")
+
+	hstore := storage.hstore
+	var notReady []string
+	for i, routed := range conf.BucketsStat {
+		if routed > 0 && hstore.GetBucketState(i) != store.BUCKET_STAT_READY {
+			notReady = append(notReady, config.BucketIDHex(i, conf.NumBucket))
+		}
+	}
+	msg := ""
+	if len(notReady) > 0 {
+		msg = "buckets not ready: " + strings.Join(notReady, ",")
+	}
+	report.add("buckets", msg)
+
+	msg = ""
+	if !server.Accepting() {
+		msg = "mc listener not accepting"
+	}
+	report.add("listener", msg)
+
+	msg = ""
+	if errs := hstore.CheckDataHomes(); len(errs) > 0 {
+		homes := make([]string, 0, len(errs))
+		for home, e := range errs {
+			homes = append(homes, fmt.Sprintf("%s: %s", home, e))
+		}
+		sort.Strings(homes)
+		msg = strings.Join(homes, "; ")
+	}
+	report.add("data_homes", msg)
+
+	msg = ""
+	if backlog := atomic.LoadInt64(&cmem.DBRL.FlushData.Size); backlog > config.MCConf.FlushMax {
+		msg = fmt.Sprintf("flush backlog %d > %d", backlog, config.MCConf.FlushMax)
+	}
+	report.add("flush_backlog", msg)
+
+	msg = ""
+	if !config.AllowReload {
+		msg = "route reload in progress"
+	}
+	report.add("route_reload", msg)
+	return report
+}
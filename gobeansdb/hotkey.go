@@ -0,0 +1,298 @@
+package gobeansdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/douban/gobeansdb/config"
+)
+
+// Hot keys and big keys are found with the space-saving algorithm on a
+// sampled subset of requests. Each bucket keeps two windows: the current one
+// and the last complete one.
+
+var hotKeys *HotKeyTracker
+
+type KeyCount struct {
+	Key   string
+	Count int64 // estimated, already multiplied by sample rate
+	Error int64 // max over-estimation of Count
+}
+
+type KeySize struct {
+	Key  string
+	Size int
+}
+
+type spaceSaving struct {
+	capacity int
+	items    map[string]*KeyCount
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity, make(map[string]*KeyCount, capacity)}
+}
+
+func (ss *spaceSaving) add(key string) {
+	if c, ok := ss.items[key]; ok {
+		c.Count++
+		return
+	}
+	if len(ss.items) < ss.capacity {
+		ss.items[key] = &KeyCount{key, 1, 0}
+		return
+	}
+	var min *KeyCount
+	for _, c := range ss.items {
+		if min == nil || c.Count < min.Count {
+			min = c
+		}
+	}
+	delete(ss.items, min.Key)
+	ss.items[key] = &KeyCount{key, min.Count + 1, min.Count}
+}
+
+func (ss *spaceSaving) top(k int, scale int64) []KeyCount {
+	res := make([]KeyCount, 0, len(ss.items))
+	for _, c := range ss.items {
+		res = append(res, KeyCount{c.Key, c.Count * scale, c.Error * scale})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Count > res[j].Count })
+	if len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+type bigKeys struct {
+	capacity int
+	items    map[string]int
+}
+
+func (b *bigKeys) add(key string, size int) {
+	if old, ok := b.items[key]; ok {
+		if size > old {
+			b.items[key] = size
+		}
+		return
+	}
+	if len(b.items) < b.capacity {
+		b.items[key] = size
+		return
+	}
+	minKey, minSize := "", -1
+	for k, s := range b.items {
+		if minSize < 0 || s < minSize {
+			minKey, minSize = k, s
+		}
+	}
+	if size > minSize {
+		delete(b.items, minKey)
+		b.items[key] = size
+	}
+}
+
+func (b *bigKeys) top() []KeySize {
+	res := make([]KeySize, 0, len(b.items))
+	for k, s := range b.items {
+		res = append(res, KeySize{k, s})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Size > res[j].Size })
+	return res
+}
+
+type hotKeyWindow struct {
+	start time.Time
+	gets  *spaceSaving
+	sets  *spaceSaving
+	big   *bigKeys
+}
+
+func newHotKeyWindow(topK int, now time.Time) *hotKeyWindow {
+	// keep more counters than reported to lower the error of the top ones
+	return &hotKeyWindow{
+		start: now,
+		gets:  newSpaceSaving(topK * 4),
+		sets:  newSpaceSaving(topK * 4),
+		big:   &bigKeys{topK, make(map[string]int, topK)},
+	}
+}
+
+type bucketHotKeys struct {
+	sync.Mutex
+	cur  *hotKeyWindow
+	last *hotKeyWindow
+}
+
+type HotKeyWindowReport struct {
+	Start   time.Time
+	End     time.Time
+	HotGets []KeyCount
+	HotSets []KeyCount
+	BigKeys []KeySize
+}
+
+type HotKeyReport struct {
+	Bucket  string
+	Sample  int
+	Last    *HotKeyWindowReport `json:",omitempty"` // last complete window
+	Current *HotKeyWindowReport `json:",omitempty"`
+}
+
+type HotKeyTracker struct {
+	sample  int64 // track 1 of every sample requests
+	n       int64
+	topK    int
+	window  time.Duration
+	buckets []*bucketHotKeys
+}
+
+func NewHotKeyTracker(numBucket, sample, topK int, window time.Duration) *HotKeyTracker {
+	t := &HotKeyTracker{
+		sample:  int64(sample),
+		topK:    topK,
+		window:  window,
+		buckets: make([]*bucketHotKeys, numBucket),
+	}
+	for i := range t.buckets {
+		t.buckets[i] = &bucketHotKeys{}
+	}
+	return t
+}
+
+func initHotKeys() {
+	c := config.MCConf
+	if c.HotKeySample <= 0 {
+		return
+	}
+	topK, window := c.HotKeyTopK, c.HotKeyWindow
+	if topK <= 0 {
+		topK = config.DefaultMCConfig.HotKeyTopK
+	}
+	if window <= 0 {
+		window = config.DefaultMCConfig.HotKeyWindow
+	}
+	hotKeys = NewHotKeyTracker(conf.NumBucket, c.HotKeySample, topK, time.Duration(window)*time.Second)
+}
+
+func (t *HotKeyTracker) Sample() int {
+	return int(atomic.LoadInt64(&t.sample))
+}
+
+// SetSample changes the sample rate at runtime, counts already collected are not rescaled.
+func (t *HotKeyTracker) SetSample(sample int) {
+	if sample > 0 {
+		atomic.StoreInt64(&t.sample, int64(sample))
+	}
+}
+
+func (t *HotKeyTracker) sampled() bool {
+	return atomic.AddInt64(&t.n, 1)%atomic.LoadInt64(&t.sample) == 0
+}
+
+// rotate must be called with b locked
+func (t *HotKeyTracker) rotate(b *bucketHotKeys, now time.Time) {
+	if b.cur == nil {
+		b.cur = newHotKeyWindow(t.topK, now)
+		return
+	}
+	elapsed := now.Sub(b.cur.start)
+	if elapsed < t.window {
+		return
+	}
+	if elapsed < 2*t.window {
+		b.last = b.cur
+	} else {
+		b.last = nil
+	}
+	b.cur = newHotKeyWindow(t.topK, now)
+}
+
+func (t *HotKeyTracker) add(bucketID int, isSet bool, key string, size int) {
+	if t == nil || bucketID < 0 || bucketID >= len(t.buckets) || !t.sampled() {
+		return
+	}
+	b := t.buckets[bucketID]
+	b.Lock()
+	t.rotate(b, time.Now())
+	if isSet {
+		b.cur.sets.add(key)
+	} else {
+		b.cur.gets.add(key)
+	}
+	if size > 0 {
+		b.cur.big.add(key, size)
+	}
+	b.Unlock()
+}
+
+func (t *HotKeyTracker) AddGet(bucketID int, key string, size int) {
+	t.add(bucketID, false, key, size)
+}
+
+func (t *HotKeyTracker) AddSet(bucketID int, key string, size int) {
+	t.add(bucketID, true, key, size)
+}
+
+func (t *HotKeyTracker) windowReport(w *hotKeyWindow, end time.Time) *HotKeyWindowReport {
+	if w == nil {
+		return nil
+	}
+	scale := atomic.LoadInt64(&t.sample)
+	return &HotKeyWindowReport{
+		Start:   w.start,
+		End:     end,
+		HotGets: w.gets.top(t.topK, scale),
+		HotSets: w.sets.top(t.topK, scale),
+		BigKeys: w.big.top(),
+	}
+}
+
+func (t *HotKeyTracker) Report() []HotKeyReport {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	res := make([]HotKeyReport, 0)
+	for i, b := range t.buckets {
+		b.Lock()
+		if b.cur != nil {
+			t.rotate(b, now)
+			r := HotKeyReport{
+				Bucket:  config.BucketIDHex(i, len(t.buckets)),
+				Sample:  t.Sample(),
+				Current: t.windowReport(b.cur, now),
+			}
+			if b.last != nil {
+				r.Last = t.windowReport(b.last, b.cur.start)
+			}
+			res = append(res, r)
+		}
+		b.Unlock()
+	}
+	return res
+}
+
+// StatLines formats the last complete window (or the current one if there is
+// none yet) as "stats hotkeys" lines.
+func (t *HotKeyTracker) StatLines() (lines []string) {
+	for _, r := range t.Report() {
+		w := r.Last
+		if w == nil {
+			w = r.Current
+		}
+		for _, c := range w.HotGets {
+			lines = append(lines, fmt.Sprintf("hot_get:%s:%s %d", r.Bucket, c.Key, c.Count))
+		}
+		for _, c := range w.HotSets {
+			lines = append(lines, fmt.Sprintf("hot_set:%s:%s %d", r.Bucket, c.Key, c.Count))
+		}
+		for _, c := range w.BigKeys {
+			lines = append(lines, fmt.Sprintf("big:%s:%s %d", r.Bucket, c.Key, c.Size))
+		}
+	}
+	return
+}
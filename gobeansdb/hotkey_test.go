@@ -0,0 +1,51 @@
+package gobeansdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHotKeys(t *testing.T) {
+	tracker := NewHotKeyTracker(16, 1, 3, 200*time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		tracker.AddGet(1, fmt.Sprintf("cold%d", i), 10)
+		if i%2 == 0 {
+			tracker.AddGet(1, "hot1", 10)
+		}
+		if i%4 == 0 {
+			tracker.AddGet(1, "hot2", 10)
+		}
+	}
+	tracker.AddSet(1, "big", 1<<20)
+	tracker.AddSet(2, "other", 100)
+
+	report := tracker.Report()
+	if len(report) != 2 || report[0].Bucket != "1" || report[0].Last != nil {
+		t.Fatalf("bad report %#v", report)
+	}
+	w := report[0].Current
+	if len(w.HotGets) != 3 || w.HotGets[0].Key != "hot1" || w.HotGets[1].Key != "hot2" {
+		t.Fatalf("bad hot gets %#v", w.HotGets)
+	}
+	if w.HotGets[0].Count-w.HotGets[0].Error > 500 || w.HotGets[0].Count < 500 {
+		t.Fatalf("bad count %#v", w.HotGets[0])
+	}
+	if len(w.HotSets) != 1 || len(w.BigKeys) != 3 || w.BigKeys[0] != (KeySize{"big", 1 << 20}) {
+		t.Fatalf("bad big keys %#v %#v", w.HotSets, w.BigKeys)
+	}
+
+	// rotate into the last window
+	time.Sleep(250 * time.Millisecond)
+	tracker.AddGet(1, "new", 1)
+	report = tracker.Report()
+	if report[0].Last == nil || report[0].Current.HotGets[0].Key != "new" {
+		t.Fatalf("bad rotate %#v", report[0])
+	}
+
+	var nilTracker *HotKeyTracker
+	nilTracker.AddGet(0, "a", 1)
+	if nilTracker.StatLines() != nil {
+		t.Fatal("nil tracker should report nothing")
+	}
+}
@@ -0,0 +1,100 @@
+package gobeansdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/store"
+)
+
+// Broken records are repaired from other servers of the bucket in the route
+// table, which return raw records for "get @@keyhash".
+
+const repairTimeout = 5 * time.Second
+
+// mcPeer fetches records from a server by the memcache protocol.
+type mcPeer struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (p *mcPeer) Addr() string {
+	return p.addr
+}
+
+func (p *mcPeer) FetchRecord(keyhash uint64) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	if _, err = fmt.Fprintf(conn, "get @@%016x\r\n", keyhash); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "END" {
+		return nil, nil
+	}
+	var key string
+	var flag, size int
+	if _, err = fmt.Sscanf(line, "VALUE %s %d %d", &key, &flag, &size); err != nil || size < 0 {
+		return nil, fmt.Errorf("bad response %q", line)
+	}
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, err
+	} else if string(data[size:]) != "\r\n" {
+		return nil, fmt.Errorf("bad end of value")
+	}
+	if line, err = r.ReadString('\n'); err != nil {
+		return nil, err
+	} else if line != "END\r\n" {
+		return nil, fmt.Errorf("bad response %q", strings.TrimRight(line, "\r\n"))
+	}
+	return data[:size], nil
+}
+
+// repairPeers returns the servers of bucketID in the route table but this
+// one, or addrs if given, which must be among them.
+func repairPeers(bucketID int, addrs []string) ([]store.RepairPeer, error) {
+	route := config.Route
+	self := config.ServerConf.Addr()
+	var servers []string
+	for addr, main := range route.Buckets[bucketID] {
+		if main && addr != self {
+			servers = append(servers, addr)
+		}
+	}
+	sort.Strings(servers)
+	if len(addrs) > 0 {
+		for _, addr := range addrs {
+			i := sort.SearchStrings(servers, addr)
+			if i == len(servers) || servers[i] != addr {
+				return nil, fmt.Errorf("%s is not a peer of bucket %s in the route table",
+					addr, config.BucketIDHex(bucketID, route.NumBucket))
+			}
+		}
+		servers = addrs
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no peer of bucket %s in the route table",
+			config.BucketIDHex(bucketID, route.NumBucket))
+	}
+	peers := make([]store.RepairPeer, len(servers))
+	for i, addr := range servers {
+		peers[i] = &mcPeer{addr, repairTimeout}
+	}
+	return peers, nil
+}
@@ -0,0 +1,110 @@
+package gobeansdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/store"
+)
+
+// servePeer stands in for a server answering "get @@keyhash" with record,
+// with a server error for keyhash 1.
+func servePeer(t *testing.T, keyhash uint64, record []byte) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			switch line {
+			case fmt.Sprintf("get @@%016x\r\n", keyhash):
+				fmt.Fprintf(conn, "VALUE @@%016x 0 %d\r\n%s\r\nEND\r\n", keyhash, len(record), record)
+			case "get @@0000000000000001\r\n":
+				conn.Write([]byte("SERVER_ERROR crc check fail\r\n"))
+			default:
+				conn.Write([]byte("END\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestMCPeer(t *testing.T) {
+	p := &store.Payload{}
+	p.Ver, p.TS, p.Body = 2, 3, []byte("value\r\nEND\r\n")
+	record := (&store.Record{Key: []byte("key"), Payload: p}).Dumps()
+	ln := servePeer(t, 0xfe42b64b6b5f7996, record)
+	defer ln.Close()
+
+	peer := &mcPeer{ln.Addr().String(), time.Second}
+	if data, err := peer.FetchRecord(0xfe42b64b6b5f7996); err != nil || !bytes.Equal(data, record) {
+		t.Fatalf("%v %q", err, data)
+	}
+	if data, err := peer.FetchRecord(2); err != nil || data != nil {
+		t.Fatalf("%v %q", err, data)
+	}
+	if _, err := peer.FetchRecord(1); err == nil || !strings.Contains(err.Error(), "crc check fail") {
+		t.Fatal(err)
+	}
+	ln.Close()
+	if _, err := peer.FetchRecord(2); err == nil {
+		t.Fatal("fetched from a closed peer")
+	}
+}
+
+func TestRepairPeers(t *testing.T) {
+	oldRoute, oldConf := config.Route, config.ServerConf
+	defer func() {
+		config.Route, config.ServerConf = oldRoute, oldConf
+	}()
+	config.ServerConf.Hostname, config.ServerConf.Port = "a", 7900
+	var rt config.RouteTable
+	err := rt.LoadFromYaml([]byte(`
+numbucket: 16
+main:
+- addr: a:7900
+  buckets: ["0", "1"]
+- addr: c:7900
+  buckets: ["0"]
+- addr: b:7900
+  buckets: ["0"]
+backup:
+- d:7900
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Route = rt
+	addrs := func(peers []store.RepairPeer) (res []string) {
+		for _, p := range peers {
+			res = append(res, p.Addr())
+		}
+		return
+	}
+	if peers, err := repairPeers(0, nil); err != nil || strings.Join(addrs(peers), ",") != "b:7900,c:7900" {
+		t.Fatalf("%v %v", err, addrs(peers))
+	}
+	if peers, err := repairPeers(0, []string{"c:7900"}); err != nil || strings.Join(addrs(peers), ",") != "c:7900" {
+		t.Fatalf("%v %v", err, addrs(peers))
+	}
+	for _, addr := range []string{"a:7900", "d:7900", "e:7900"} {
+		if _, err := repairPeers(0, []string{addr}); err == nil {
+			t.Fatalf("%s is a peer", addr)
+		}
+	}
+	if _, err := repairPeers(1, nil); err == nil {
+		t.Fatal("bucket 1 has a peer")
+	}
+}
@@ -1,13 +1,20 @@
 package gobeansdb
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/config"
 	mc "github.com/douban/gobeansdb/memcache"
 	"github.com/douban/gobeansdb/store"
+	"github.com/douban/gobeansdb/trace"
+	"github.com/douban/gobeansdb/utils"
 )
 
 var (
@@ -22,22 +29,57 @@ type Storage struct {
 
 func (s *Storage) Client() mc.StorageClient {
 	return &StorageClient{
-		s.hstore,
+		hstore: s.hstore,
 	}
 }
 
 type StorageClient struct {
 	hstore *store.HStore
+
+	// details of the request being served, for slow log
+	details []mc.ReqDetail
+	span    *trace.Span
 }
 
 func (s *StorageClient) GetSuccessedTargets() []string {
 	return []string{"localhost"}
 }
 
+func (s *StorageClient) SetSpan(span *trace.Span) {
+	s.span = span
+}
+
 func (s *StorageClient) Clean() {
+	s.details = s.details[:0]
+	s.span = nil
 	return
 }
 
+func (s *StorageClient) ReqDetails() []mc.ReqDetail {
+	if len(s.details) == 0 {
+		return nil
+	}
+	return append([]mc.ReqDetail(nil), s.details...)
+}
+
+func (s *StorageClient) addDetail(ki *store.KeyInfo, size int) {
+	d := mc.ReqDetail{
+		Key:       ki.StringKey,
+		Bucket:    ki.BucketID,
+		ChunkID:   -1,
+		ValueSize: size,
+	}
+	if st := ki.Stat; st != nil && st.RecSize > 0 {
+		d.ChunkID = st.Pos.ChunkID
+		d.Offset = st.Pos.Offset
+		d.InBuffer = st.InBuffer
+		d.Compressed = st.Compressed
+		d.DiskReadUS = int64(st.ReadTime / time.Microsecond)
+		d.DecompressUS = int64(st.DecompressTime / time.Microsecond)
+	}
+	s.details = append(s.details, d)
+}
+
 func (s *StorageClient) Set(key string, item *mc.Item, noreply bool) (bool, error) {
 	tofree := &item.CArray
 	defer func() {
@@ -50,14 +92,24 @@ func (s *StorageClient) Set(key string, item *mc.Item, noreply bool) (bool, erro
 		return false, nil
 	}
 	ki := s.prepare(key, false)
+	durability, err := store.ParseDurability(item.Durability)
+	if err != nil {
+		return false, err
+	}
+	ki.Durability = durability
+	size := len(item.Body)
 	payload := &store.Payload{}
 	payload.Flag = uint32(item.Flag)
 	payload.CArray = item.CArray
 	payload.Ver = int32(item.Exptime)
-	payload.TS = uint32(item.ReceiveTime.Unix())
+	payload.SetTS(item.ReceiveTime)
 
 	tofree = nil
-	err := s.hstore.Set(ki, payload)
+	err = s.hstore.Set(ki, payload)
+	if err == nil {
+		hotKeys.AddSet(ki.BucketID, key, size)
+	}
+	s.addDetail(ki, size)
 	if err != nil {
 		logger.Errorf("err to get %s: %s", key, err.Error())
 		return false, err
@@ -70,6 +122,7 @@ func (s *StorageClient) prepare(key string, isPath bool) *store.KeyInfo {
 	ki.StringKey = key
 	ki.Key = []byte(key)
 	ki.KeyIsPath = isPath
+	ki.Span = s.span
 	return ki
 }
 
@@ -104,6 +157,7 @@ func (s *StorageClient) getMeta(key string, extended bool) (*mc.Item, error) {
 
 	var body string
 	if extended {
+		// clients parse 7 fields, ts64 is in the key api
 		body = fmt.Sprintf("%d %d %d %d %d %d %d",
 			payload.Ver, vhash, payload.Flag, len(payload.Body), payload.TS, pos.ChunkID, pos.Offset)
 
@@ -121,6 +175,68 @@ func (s *StorageClient) getMeta(key string, extended bool) (*mc.Item, error) {
 	return item, nil
 }
 
+// ParseVersionSelector parses "<ver>" or "t<unix ts>" for GetVersion.
+func ParseVersionSelector(sel string) (ver int32, ts uint32, err error) {
+	if strings.HasPrefix(sel, "t") {
+		var n uint64
+		n, err = strconv.ParseUint(sel[1:], 10, 32)
+		ts = uint32(n)
+	} else {
+		var n int64
+		n, err = strconv.ParseInt(sel, 10, 32)
+		ver = int32(n)
+		if err == nil && ver == 0 {
+			err = fmt.Errorf("version 0")
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("bad version selector %q", sel)
+	}
+	return
+}
+
+// getHistory serves "?@@key", which lists the versions of key, one
+// "ver ts flag size chunk offset" per line, and "?@<ver>@key" or
+// "?@t<ts>@key", which returns the value of a version.
+func (s *StorageClient) getHistory(arg string) (*mc.Item, error) {
+	i := strings.IndexByte(arg, '@')
+	if i < 0 {
+		return nil, fmt.Errorf("bad command line format")
+	}
+	sel, key := arg[:i], arg[i+1:]
+	if !store.IsValidKeyString(key) {
+		return nil, nil
+	}
+	ki := s.prepare(key, false)
+	if sel == "" {
+		versions, err := s.hstore.ListVersions(ki)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		for _, v := range versions {
+			fmt.Fprintf(&buf, "%d %d %d %d %d %d\n", v.Ver, v.TS, v.Flag, v.Size, v.Pos.ChunkID, v.Pos.Offset)
+		}
+		item := new(mc.Item)
+		item.Body = buf.Bytes()
+		return item, nil
+	}
+	ver, ts, err := ParseVersionSelector(sel)
+	if err != nil {
+		return nil, err
+	}
+	payload, _, err := s.hstore.GetVersion(ki, ver, ts)
+	if err != nil || payload == nil {
+		return nil, err
+	}
+	// the response of a "?" key is freed without accounting
+	cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+	item := new(mc.Item)
+	item.CArray = payload.CArray
+	item.Flag = int(payload.Flag)
+	return item, nil
+}
+
 func (s *StorageClient) Get(key string) (*mc.Item, error) {
 	if key[0] == '@' {
 		if len(key) > 1 && key[1] == '@' {
@@ -156,7 +272,9 @@ func (s *StorageClient) Get(key string) (*mc.Item, error) {
 
 	} else if key[0] == '?' {
 		extended := false
-		if len(key) > 1 {
+		if len(key) > 1 && key[1] == '@' {
+			return s.getHistory(key[2:])
+		} else if len(key) > 1 {
 			if key[1] == '?' {
 				extended = true
 				key = key[2:]
@@ -173,14 +291,19 @@ func (s *StorageClient) Get(key string) (*mc.Item, error) {
 	}
 
 	ki := s.prepare(key, false)
+	ki.Stat = &store.GetStat{}
 	payload, _, err := s.hstore.Get(ki, false)
 	if err != nil {
 		logger.Errorf("err to get %s: %s", key, err.Error())
 		return nil, err
 	}
 	if payload == nil {
+		hotKeys.AddGet(ki.BucketID, key, 0)
+		s.addDetail(ki, 0)
 		return nil, nil
 	}
+	hotKeys.AddGet(ki.BucketID, key, len(payload.Body))
+	s.addDetail(ki, len(payload.Body))
 	if payload.Ver < 0 {
 		cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
 		payload.CArray.Free()
@@ -243,6 +366,88 @@ func (s *StorageClient) Close() {
 
 }
 
+type BucketStat struct {
+	ID     string
+	State  int
+	NumKey int
+	NumGet int64
+	NumSet int64
+}
+
+func getBucketStats(hstore *store.HStore) []BucketStat {
+	cmds := hstore.GetNumCmdByBuckets()
+	keys := hstore.GetNumKeyByBuckets()
+	stats := make([]BucketStat, 0, len(cmds))
+	for i, c := range cmds {
+		if c[0] == 0 {
+			continue
+		}
+		stats = append(stats, BucketStat{
+			ID:     config.BucketIDHex(i, conf.NumBucket),
+			State:  int(c[0]),
+			NumKey: keys[i],
+			NumGet: c[1],
+			NumSet: c[2],
+		})
+	}
+	return stats
+}
+
+func (s *StorageClient) SubStats(name string) (lines []string, ok bool) {
+	switch name {
+	case "buckets":
+		for _, b := range getBucketStats(s.hstore) {
+			lines = append(lines,
+				fmt.Sprintf("%s:state %d", b.ID, b.State),
+				fmt.Sprintf("%s:keys %d", b.ID, b.NumKey),
+				fmt.Sprintf("%s:cmd_get %d", b.ID, b.NumGet),
+				fmt.Sprintf("%s:cmd_set %d", b.ID, b.NumSet))
+		}
+		return lines, true
+	case "hotkeys":
+		return hotKeys.StatLines(), true
+	case "durability":
+		st := store.GetDurabilityStats()
+		lines = append(lines,
+			"default "+st.Default,
+			fmt.Sprintf("num_wait %d", st.NumWait),
+			fmt.Sprintf("num_flush %d", st.NumFlush),
+			fmt.Sprintf("num_fsync %d", st.NumFsync))
+		for _, h := range []struct {
+			name string
+			s    utils.HistogramSummary
+		}{{"flush", st.Flush}, {"fsync", st.Fsync}} {
+			lines = append(lines,
+				fmt.Sprintf("%s:count %d", h.name, h.s.Count),
+				fmt.Sprintf("%s:avg_us %d", h.name, h.s.AvgUS),
+				fmt.Sprintf("%s:p50_us %d", h.name, h.s.P50US),
+				fmt.Sprintf("%s:p99_us %d", h.name, h.s.P99US),
+				fmt.Sprintf("%s:max_us %d", h.name, h.s.MaxUS))
+		}
+		return lines, true
+	case "scrub":
+		st := s.hstore.ScrubStats()
+		lines = append(lines,
+			fmt.Sprintf("paused %v", st.Paused),
+			fmt.Sprintf("bytes %d", st.Bytes),
+			fmt.Sprintf("records %d", st.Records),
+			fmt.Sprintf("broken_bytes %d", st.BrokenBytes),
+			fmt.Sprintf("ranges %d", st.Ranges),
+			fmt.Sprintf("mismatches %d", st.Mismatches),
+			fmt.Sprintf("broken_keys %d", st.BrokenKeys),
+			fmt.Sprintf("rounds %d", st.Rounds))
+		for _, b := range s.hstore.ScrubStatus() {
+			lines = append(lines,
+				fmt.Sprintf("%s:ranges %d", b.Bucket, len(b.Ranges)),
+				fmt.Sprintf("%s:mismatches %d", b.Bucket, len(b.Mismatches)),
+				fmt.Sprintf("%s:broken_keys %d", b.Bucket, len(b.BrokenKeys)),
+				fmt.Sprintf("%s:rounds %d", b.Bucket, b.Rounds))
+		}
+		return lines, true
+	}
+	return nil, false
+}
+
 func (s *StorageClient) Process(cmd string, args []string) (status string, msg string) {
 	status = "CLIENT_ERROR"
 	msg = "bad command line format"
@@ -252,13 +457,54 @@ func (s *StorageClient) Process(cmd string, args []string) (status string, msg s
 		msg = ""
 		if s.hstore.IsGCRunning() {
 			status = "running"
+			var gcs []string
+			for _, st := range s.hstore.GCStatus() {
+				gcs = append(gcs, fmt.Sprintf("%s:%d-%d", st.Bucket, st.Src, st.End))
+			}
+			msg = strings.Join(gcs, " ")
 		} else {
 			status = "none"
 		}
 
+	case "undelete":
+		// undelete <key>, replies "UNDELETED <new version>"
+		if len(args) != 1 || !store.IsValidKeyString(args[0]) {
+			return
+		}
+		ver, _, err := s.hstore.Undelete(s.prepare(args[0], false), false)
+		switch err {
+		case nil:
+			status, msg = "UNDELETED", strconv.Itoa(int(ver))
+		case store.ErrNotDeleted, store.ErrNoLiveVersion, store.ErrBucketNotServed:
+			status, msg = "NOT_FOUND", err.Error()
+		default:
+			status, msg = "SERVER_ERROR", err.Error()
+		}
+
 	default:
 		status = "ERROR"
 		msg = ""
 	}
 	return
 }
+
+// gcLoad returns the function telling gc the foreground load: requests
+// waiting for a token, and average latency of gets since the last call.
+func gcLoad(st *mc.Stats) func() store.GCLoad {
+	var mu sync.Mutex
+	var lastN int64
+	var lastSum time.Duration
+	return func() (load store.GCLoad) {
+		mu.Lock()
+		defer mu.Unlock()
+		if mc.RL != nil {
+			load.Waiting = int(mc.RL.State().NumWait)
+		}
+		n, sum := st.CmdLatencySum("get")
+		if n > lastN && sum >= lastSum {
+			load.Latency = (sum - lastSum) / time.Duration(n-lastN)
+		}
+		lastN, lastSum = n, sum
+		return
+	}
+}
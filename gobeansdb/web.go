@@ -2,6 +2,7 @@ package gobeansdb
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
@@ -9,6 +10,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -28,14 +30,23 @@ import (
 //    - buckets: #key, #req, space
 
 func init() {
-	http.HandleFunc("/", handleIndex)
+	http.HandleFunc("/", handleDashboard)
+	http.HandleFunc("/links", handleIndex)
 
 	http.HandleFunc("/config", handleConfig)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
 	//stats
 	http.HandleFunc("/requests", handleRequests)
 	http.HandleFunc("/buffers", handleBuffers)
 	http.HandleFunc("/memstats", handleMemStates)
 	http.HandleFunc("/rusage", handleRusage)
+	http.HandleFunc("/stats/latency", handleStatsLatency)
+	http.HandleFunc("/stats/buckets", handleStatsBuckets)
+	http.HandleFunc("/stats/conns", handleStatsConns)
+	http.HandleFunc("/stats/reset", handleStatsReset)
+	http.HandleFunc("/hotkeys", handleHotKeys)
+	http.HandleFunc("/slowlog", handleSlowLog)
 
 	http.HandleFunc("/reload", handleReload)
 	http.HandleFunc("/logbuf", handleLogBuffer)
@@ -55,15 +66,17 @@ func init() {
 
 	http.HandleFunc("/statgetset", handleStatGetSet)
 	http.HandleFunc("/freememory", handleFreeMemory)
+	http.HandleFunc("/flush", handleFlush)
 }
 
 func initWeb() {
 	webaddr := fmt.Sprintf("%s:%d", conf.Listen, conf.WebPort)
+	initWebAuth()
 	//http.Handle("/log", http.FileServer(http.Dir(conf.LogDir))) // TODO: tail
 
 	go func() {
 		logger.Infof("http listen at %s", webaddr)
-		err := http.ListenAndServe(webaddr, nil) //start web before load
+		err := http.ListenAndServe(webaddr, authHandler(http.DefaultServeMux)) //start web before load
 		if err != nil {
 			logger.Fatalf(err.Error())
 		}
@@ -72,7 +85,7 @@ func initWeb() {
 }
 
 func checkStarting(w http.ResponseWriter) (starting bool) {
-	starting = storage == nil
+	starting = storage == nil || server == nil
 	if starting {
 		w.Write([]byte("starting"))
 	}
@@ -82,26 +95,38 @@ func checkStarting(w http.ResponseWriter) (starting bool) {
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w,
 		`
+    <a href='/'> dashboard </a> <p/>
     <a href='/debug/pprof'> /debug/pprof </a> <p/>
 
      <hr/>
 
+    <a href='/healthz'> /healthz </a> <p/>
+    <a href='/readyz'> /readyz </a> <p/>
     <a href='/config'> /config </a> <p/>
     <a href='/requests'> /requests </a> <p/>
     <a href='/buffers'> /buffers </a> <p/>
     <a href='/memstats'> /memstats </a> <p/>
     <a href='/rusage'> /rusage </a> <p/>
+    <a href='/stats/latency'> /stats/latency </a> <p/>
+    <a href='/stats/buckets'> /stats/buckets </a> <p/>
+    <a href='/stats/conns'> /stats/conns </a> <p/>
+    <a href='/hotkeys'> /hotkeys </a> <p/>
+    <a href='/slowlog'> /slowlog </a> <p/>
     <a href='/logbuf'> /logbuf </a> <p/>
     <a href='/logbufall'> /logbufall </a> <p/>
     <a href='/loglast'> /loglast </a> <p/>
     <a href='/du'> /du </a> <p/>
     <a href='/statgetset'> /statgetset </a> <p/>
+    <a href='/api/v1/admin/buckets'> /api/v1/admin/buckets </a> <p/>
+    <a href='/api/v1/admin/scrub'> /api/v1/admin/scrub </a> <p/>
 
     <hr/>
 
     <a href='/bucket'> /bucket/{hex bucket id} </a> <p/>
     <a href='/collision'> /collision/{16-byte-len hex keyhash} </a> <p/>
     <a href='/hash'> /hash/{hex bucket id} </a> <p/>
+    <a href='/api/v1/key/'> /api/v1/key/{key}?scan=true&preview=256 </a> <p/>
+    <a href='/api/v1/versions/'> /api/v1/versions/{key}?ver=&ts= </a> <p/>
 
     `)
 }
@@ -181,6 +206,66 @@ func handleBuffers(w http.ResponseWriter, r *http.Request) {
 	handleJson(w, &cmem.DBRL)
 }
 
+func handleStatsLatency(w http.ResponseWriter, r *http.Request) {
+	if checkStarting(w) {
+		return
+	}
+	handleJson(w, server.Stats().Latency())
+}
+
+func handleStatsBuckets(w http.ResponseWriter, r *http.Request) {
+	if checkStarting(w) {
+		return
+	}
+	handleJson(w, getBucketStats(storage.hstore))
+}
+
+func handleStatsConns(w http.ResponseWriter, r *http.Request) {
+	if checkStarting(w) {
+		return
+	}
+	handleJson(w, server.Stats().Conns())
+}
+
+func handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if checkStarting(w) {
+		return
+	}
+	server.Stats().Reset()
+	w.Write([]byte("ok"))
+}
+
+func handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	if checkStarting(w) {
+		return
+	}
+	defer handleWebPanic(w)
+	if hotKeys == nil {
+		w.Write([]byte("hot key tracking disabled, see mc.hotkey_sample"))
+		return
+	}
+	sample, err := getFormValueInt(r, "sample", 0)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	hotKeys.SetSample(sample)
+	handleJson(w, hotKeys.Report())
+}
+
+func handleSlowLog(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+	ms, err := getFormValueInt(r, "threshold_ms", -1)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if ms >= 0 {
+		mc.SlowReqs.SetThreshold(time.Duration(ms) * time.Millisecond)
+	}
+	handleJson(w, mc.SlowReqs.Entries())
+}
+
 func handleCollision(w http.ResponseWriter, r *http.Request) {
 	if checkStarting(w) {
 		return
@@ -265,6 +350,15 @@ func handleFreeMemory(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func handleFlush(w http.ResponseWriter, r *http.Request) {
+	if checkStarting(w) {
+		return
+	}
+	defer handleWebPanic(w)
+	storage.hstore.Flush()
+	w.Write([]byte("ok"))
+}
+
 func handleKeyhash(w http.ResponseWriter, r *http.Request) {
 	if checkStarting(w) {
 		return
@@ -406,60 +500,82 @@ func handleRouteVersion(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleReloadRoute(w http.ResponseWriter, r *http.Request) {
-	var err error
+var (
+	errStarting       = errors.New("starting")
+	errRouteReloading = errors.New("reloading")
+	errNoZK           = errors.New("not using zookeeper")
+)
+
+type RouteReloadResult struct {
+	Version  int
+	Same     bool // already at this version, nothing changed
+	Loaded   []int
+	Unloaded []int
+}
+
+// reloadRoute loads route version ver (-1 for the latest) from zk,
+// and loads/unloads buckets of this node accordingly.
+func reloadRoute(ver int) (res *RouteReloadResult, err error) {
 	if !config.AllowReload {
-		w.Write([]byte("err: reloading"))
-		return
+		return nil, errRouteReloading
 	}
 	config.AllowReload = false
 	defer func() {
 		config.AllowReload = true
-		if err != nil {
-			logger.Errorf("handleRoute err: %s", err.Error())
-			w.Write([]byte(fmt.Sprintf(err.Error())))
-			return
-		}
 	}()
-
-	if checkStarting(w) {
-		return
+	if storage == nil || server == nil {
+		return nil, errStarting
 	}
 	if len(conf.ZKServers) == 0 {
-		w.Write([]byte("err: not using zookeeper"))
-		return
+		return nil, errNoZK
 	}
-	defer handleWebPanic(w)
 
-	r.ParseForm()
-	ver, err := getFormValueInt(r, "ver", -1)
+	newRouteContent, ver, err := config.ZKClient.GetRouteRaw(ver)
 	if err != nil {
 		return
 	}
-
-	newRouteContent, ver, err := config.ZKClient.GetRouteRaw(ver)
+	res = &RouteReloadResult{Version: ver}
 	if ver == config.ZKClient.Version {
-		w.Write([]byte(fmt.Sprintf("warn: same version %d", ver)))
+		res.Same = true
 		return
 	}
 
-	info := fmt.Sprintf("update with route version %d\n", ver)
-	logger.Infof(info)
+	logger.Infof("update with route version %d", ver)
 	newRoute := new(config.RouteTable)
 	err = newRoute.LoadFromYaml(newRouteContent)
 	if err != nil {
-		return
+		return nil, err
 	}
 	dbRouteConfig := newRoute.GetDBRouteConfig(config.ServerConf.Addr())
-	loaded, unloaded, err := storage.hstore.ChangeRoute(dbRouteConfig)
+	res.Loaded, res.Unloaded, err = storage.hstore.ChangeRoute(dbRouteConfig)
 	if err != nil {
-		w.Write([]byte(fmt.Sprintf("err: %v", err)))
 		logger.Infof("fail to reload: %v", err)
-		return
+		return nil, err
 	}
-	info = fmt.Sprintf("ok: loaded:%v, unloaded:%v", loaded, unloaded)
-	w.Write([]byte(info))
 	store.Conf.DBRouteConfig = dbRouteConfig
 	config.Route = *newRoute
 	config.ZKClient.Version = ver
+	return
+}
+
+func handleReloadRoute(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+	r.ParseForm()
+	ver, err := getFormValueInt(r, "ver", -1)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+	res, err := reloadRoute(ver)
+	switch {
+	case err == errStarting:
+		w.Write([]byte("starting"))
+	case err != nil:
+		logger.Errorf("handleRoute err: %s", err.Error())
+		w.Write([]byte(fmt.Sprintf("err: %v", err)))
+	case res.Same:
+		w.Write([]byte(fmt.Sprintf("warn: same version %d", res.Version)))
+	default:
+		w.Write([]byte(fmt.Sprintf("ok: loaded:%v, unloaded:%v", res.Loaded, res.Unloaded)))
+	}
 }
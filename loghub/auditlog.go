@@ -0,0 +1,49 @@
+package loghub
+
+import (
+	"io"
+	"log"
+	"os"
+)
+
+var (
+	AuditLogFlag = (log.Ldate | log.Ltime | log.Lmicroseconds)
+	AuditLogger  *Logger
+)
+
+// AuditLogHub records mutating admin calls, one line per call.
+type AuditLogHub struct {
+	logger *log.Logger
+	logFd  *os.File
+}
+
+func init() {
+	AuditLogger = NewLogger("", nil, DEBUG)
+}
+
+func InitAuditLog(path string, level int) (err error) {
+	auditLog, auditFd, err := openLog(path, AuditLogFlag)
+	if err != nil {
+		log.Fatalf("open audit log error, path=[%s], err=[%s]", path, err.Error())
+	}
+	AuditLogger.Hub = &AuditLogHub{logger: auditLog, logFd: auditFd}
+	AuditLogger.SetLevel(level)
+	return
+}
+
+func (hub *AuditLogHub) Log(name string, level int, file string, line int, msg string) {
+	hub.logger.Printf("%s %s", levelString[level], msg)
+}
+
+func (hub *AuditLogHub) Reopen(path string) (err error) {
+	return reopenLogger(&hub.logger, &hub.logFd, path, AuditLogFlag)
+}
+
+func (hub *AuditLogHub) GetLastLog() []byte {
+	// not implement
+	return nil
+}
+
+func (hub *AuditLogHub) DumpBuffer(all bool, out io.Writer) {
+	// not implement
+}
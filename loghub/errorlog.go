@@ -93,6 +93,16 @@ func (l *BufferLog) Add(line *BufferLine) {
 	}
 }
 
+// Lines returns the buffered lines oldest first, only WARN and above unless all.
+func (l *BufferLog) Lines(all bool) []*BufferLine {
+	l.Lock()
+	defer l.Unlock()
+	if all {
+		return l.all.Lines()
+	}
+	return l.warn.Lines()
+}
+
 func (l *BufferLog) GetLastLog() []byte {
 	b, _ := json.Marshal(l.Last[:])
 	return b
@@ -119,6 +129,21 @@ func (q *queue) Add(line *BufferLine) {
 	}
 }
 
+func (q *queue) Lines() []*BufferLine {
+	lines := make([]*BufferLine, 0, len(q.Buffer))
+	i := q.head
+	for j := 0; j < len(q.Buffer); j++ {
+		if line := q.Buffer[i]; line != nil {
+			lines = append(lines, line)
+		}
+		i += 1
+		if i >= len(q.Buffer) {
+			i = 0
+		}
+	}
+	return lines
+}
+
 func (q *queue) DumpBuffer(out io.Writer) {
 	i := q.head
 	for j := 0; j < len(q.Buffer); j++ {
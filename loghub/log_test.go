@@ -24,3 +24,23 @@ func TestDemoHubger(t *testing.T) {
 		t.Errorf("\nwant: [%s]\ngot : [%s]", exp, res)
 	}
 }
+
+func TestBufferLines(t *testing.T) {
+	var l BufferLog
+	l.InitBuffer(3)
+	for i := 0; i < 5; i++ {
+		level := INFO
+		if i%2 == 0 {
+			level = WARN
+		}
+		l.Add(&BufferLine{Level: level, Line: i})
+	}
+	all := l.Lines(true)
+	if len(all) != 3 || all[0].Line != 2 || all[2].Line != 4 {
+		t.Fatalf("bad all lines %v", all)
+	}
+	warn := l.Lines(false)
+	if len(warn) != 3 || warn[0].Line != 0 || warn[2].Line != 4 {
+		t.Fatalf("bad warn lines %v", warn)
+	}
+}
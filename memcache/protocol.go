@@ -12,6 +12,7 @@ import (
 
 	"github.com/douban/gobeansdb/cmem"
 	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/trace"
 )
 
 const VERSION = "0.1.0"
@@ -56,9 +57,18 @@ type Item struct {
 	Flag        int
 	Exptime     int
 	Cas         int
+	Durability  string // one of DurabilityFlags, "" for the default of the server
 	cmem.CArray `json:"-"`
 }
 
+// DurabilityFlags may follow the size of a storage command to tell when it is
+// acked, e.g. "set <key> <flags> <exptime> <bytes> fsync-before-ack [noreply]".
+var DurabilityFlags = map[string]bool{
+	"buffered":         true,
+	"flush-before-ack": true,
+	"fsync-before-ack": true,
+}
+
 func (it *Item) String() (s string) {
 	return fmt.Sprintf("Item(Flag:%d, Exptime:%d, Length:%d, Cas:%d, Body:%v",
 		it.Flag, it.Exptime, len(it.Body), it.Cas, it.Body)
@@ -71,8 +81,12 @@ type Request struct {
 	Item        *Item
 	NoReply     bool
 
-	Token   int
-	Working bool
+	Token     int
+	Working   bool
+	WaitStart time.Time
+	WaitTime  time.Duration // time spent waiting for a token in RL
+
+	TraceParent trace.SpanContext // set by "trace" cmd
 }
 
 func (req *Request) String() (s string) {
@@ -82,6 +96,8 @@ func (req *Request) String() (s string) {
 
 func (req *Request) Clear() {
 	req.NoReply = false
+	req.WaitTime = 0
+	req.TraceParent = trace.SpanContext{}
 	if req.Item != nil {
 		req.Item = nil
 	}
@@ -124,6 +140,9 @@ func (req *Request) Write(w io.Writer) (e error) {
 			noreply = " noreply"
 		}
 		item := req.Item
+		if item.Durability != "" {
+			noreply = " " + item.Durability + noreply
+		}
 		if req.Cmd == "cas" {
 			fmt.Fprintf(w, "%s %s %d %d %d %d%s\r\n", req.Cmd, req.Keys[0], item.Flag,
 				item.Exptime, item.Cas, len(item.Body), noreply)
@@ -179,7 +198,7 @@ func (req *Request) Read(b *bufio.Reader) error {
 		RL.Get(req)
 
 	case "set", "add", "replace", "cas", "append", "prepend":
-		if len(parts) < 5 || len(parts) > 7 {
+		if len(parts) < 5 || len(parts) > 8 {
 			return ErrInvalidCmd
 		}
 		req.Keys = parts[1:2]
@@ -205,20 +224,22 @@ func (req *Request) Read(b *bufio.Reader) error {
 				return ErrOOM
 			}
 		}
+		flags := parts[5:]
 		if req.Cmd == "cas" {
 			if len(parts) < 6 {
 				return ErrInvalidCmd
 			}
 			item.Cas, e = strconv.Atoi(parts[5])
-			if len(parts) > 6 && parts[6] != "noreply" {
-				return ErrInvalidCmd
-			}
-			req.NoReply = len(parts) > 6 && parts[6] == "noreply"
-		} else {
-			if len(parts) > 5 && parts[5] != "noreply" {
+			flags = parts[6:]
+		}
+		for _, flag := range flags {
+			if flag == "noreply" && !req.NoReply {
+				req.NoReply = true
+			} else if DurabilityFlags[flag] && item.Durability == "" && !req.NoReply {
+				item.Durability = flag
+			} else {
 				return ErrInvalidCmd
 			}
-			req.NoReply = len(parts) > 5 && parts[5] == "noreply"
 		}
 
 		RL.Get(req)
@@ -273,6 +294,23 @@ func (req *Request) Read(b *bufio.Reader) error {
 	case "stats":
 		req.Keys = parts[1:]
 
+	case "trace":
+		// trace <trace id> [<parent span id>] [noreply], traces the next command
+		if len(parts) < 2 || len(parts) > 4 {
+			return ErrInvalidCmd
+		}
+		req.NoReply = parts[len(parts)-1] == "noreply"
+		if req.NoReply {
+			parts = parts[:len(parts)-1]
+		}
+		spanID := ""
+		if len(parts) > 2 {
+			spanID = parts[2]
+		}
+		if req.TraceParent, e = trace.ParseSpanContext(parts[1], spanID); e != nil {
+			return ErrInvalidCmd
+		}
+
 	case "quit", "version", "flush_all":
 	case "verbosity":
 		if len(parts) >= 2 {
@@ -485,7 +523,7 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 			for _, item := range resp.Items {
 				bytes += int64(len(item.Body))
 			}
-			stat.bytes_written += bytes
+			atomic.AddInt64(&stat.bytes_written, bytes)
 		} else {
 			atomic.AddInt64(&stat.cmd_get, 1)
 			key := req.Keys[0]
@@ -502,7 +540,7 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 				resp.Items = make(map[string]*Item, 1)
 				resp.Items[key] = item
 				atomic.AddInt64(&stat.get_hits, 1)
-				stat.bytes_written += int64(len(item.Body))
+				atomic.AddInt64(&stat.bytes_written, int64(len(item.Body)))
 			}
 		}
 
@@ -510,7 +548,7 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 		// We MUST update stat at first, because req.Item will be released
 		// in `store.Set`.
 		atomic.AddInt64(&stat.cmd_set, 1)
-		stat.bytes_read += int64(len(req.Item.Body))
+		atomic.AddInt64(&stat.bytes_read, int64(len(req.Item.Body)))
 
 		key := req.Keys[0]
 		var suc bool
@@ -529,7 +567,7 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 
 	case "append":
 		atomic.AddInt64(&stat.cmd_set, 1)
-		stat.bytes_read += int64(len(req.Item.Body))
+		atomic.AddInt64(&stat.bytes_read, int64(len(req.Item.Body)))
 
 		key := req.Keys[0]
 		var suc bool
@@ -548,7 +586,7 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 
 	case "incr":
 		atomic.AddInt64(&stat.cmd_set, 1)
-		stat.bytes_read += int64(len(req.Item.Body))
+		atomic.AddInt64(&stat.bytes_read, int64(len(req.Item.Body)))
 
 		resp.Noreply = req.NoReply
 		key := req.Keys[0]
@@ -583,9 +621,21 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 		} else {
 			resp.Status = "NOT_FOUND"
 		}
-		stat.cmd_delete++
+		atomic.AddInt64(&stat.cmd_delete, 1)
 
 	case "stats":
+		if len(req.Keys) == 1 {
+			if msg, ok := stat.subStats(req.Keys[0], store); ok {
+				resp.Status = "STAT"
+				resp.Msg = msg
+				break
+			}
+			if req.Keys[0] == "reset" {
+				stat.Reset()
+				resp.Status = "RESET"
+				break
+			}
+		}
 		st := stat.Stats()
 		n := int64(store.Len())
 		st["curr_items"] = n
@@ -614,7 +664,7 @@ func (req *Request) Process(store StorageClient, stat *Stats) (resp *Response, e
 		resp.Status = "VERSION"
 		resp.Msg = config.Version
 
-	case "verbosity", "flush_all":
+	case "verbosity", "flush_all", "trace":
 		resp.Status = "OK"
 
 	case "quit":
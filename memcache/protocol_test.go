@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/douban/gobeansdb/config"
 )
@@ -150,6 +152,42 @@ var reqTests = []reqTest{
 		cmd:    "version\r\n",
 		answer: "VERSION " + config.Version + "\r\n",
 	},
+	{
+		cmd:    "trace 0102030405060708090a0b0c0d0e0f10 0102030405060708\r\n",
+		answer: "OK\r\n",
+	},
+	{
+		cmd:    "trace 0102030405060708090a0b0c0d0e0f10 noreply\r\n",
+		answer: "",
+	},
+	{
+		cmd:    "trace 0102\r\n",
+		answer: "CLIENT_ERROR invalid cmd\r\n",
+	},
+	{
+		cmd:    "stats reset\r\n",
+		answer: "RESET\r\n",
+	},
+	{
+		cmd:    "stats cmd_get cmd_set\r\n",
+		answer: "STAT cmd_get 0\r\nSTAT cmd_set 0\r\nEND\r\n",
+	},
+	{
+		cmd:    "set dur 0 0 2 fsync-before-ack\r\nok\r\n",
+		answer: "STORED\r\n",
+	},
+	{
+		cmd:    "set dur 0 0 2 flush-before-ack noreply\r\nok\r\n",
+		answer: "",
+	},
+	{
+		cmd:    "set dur 0 0 2 noreply fsync-before-ack\r\nok\r\n",
+		answer: "CLIENT_ERROR invalid cmd\r\n",
+	},
+	{
+		cmd:    "set dur 0 0 2 sync\r\nok\r\n",
+		answer: "CLIENT_ERROR invalid cmd\r\n",
+	},
 
 	{
 		cmd:    "quit\r\n",
@@ -192,5 +230,78 @@ func TestRequest(t *testing.T) {
 				test.answer, len(test.answer), ans, len(ans))
 		}
 		req.Clear()
+		if req.Working {
+			RL.Put(req)
+		}
+	}
+}
+
+// TestStatsReset runs commands while stats are reset, for the race detector.
+// Sets are left out as the buffer limiter is not safe for it.
+func TestStatsReset(t *testing.T) {
+	InitTokens()
+	store := NewMapStore()
+	stats := NewStats()
+	process := func(cmd string) {
+		req := new(Request)
+		if err := req.Read(bufio.NewReader(bytes.NewBufferString(cmd))); err != nil {
+			t.Error(err)
+			return
+		}
+		req.Process(store, stats)
+		req.Clear()
+		if req.Working {
+			RL.Put(req)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", i)
+			for j := 0; j < 100; j++ {
+				process("get " + key + "\r\n")
+				process("delete " + key + "\r\n")
+			}
+		}(i)
+	}
+	for i := 0; i < 100; i++ {
+		stats.Reset()
+	}
+	wg.Wait()
+	stats.Reset()
+	process("get k0\r\n")
+	if st := stats.Stats(); st["cmd_get"] != 1 || st["get_misses"] != 1 || st["cmd_delete"] != 0 {
+		t.Fatalf("%v", st)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	InitTokens()
+	store := NewMapStore()
+	stats := NewStats()
+	req := &Request{Cmd: "get", Keys: []string{"a"}}
+	stats.observeCmd(req, 3*time.Millisecond)
+	stats.observeStage("wait", time.Millisecond)
+
+	req = &Request{Cmd: "stats", Keys: []string{"latency"}}
+	resp, _ := req.Process(store, stats)
+	for _, line := range []string{
+		"STAT get:count 1\r\n",
+		"STAT get:max_us 3000\r\n",
+		"STAT getm:count 0\r\n",
+		"STAT stage_wait:p99_us 1000\r\n",
+	} {
+		if !strings.Contains(resp.Msg, line) {
+			t.Fatalf("%q not in %q", line, resp.Msg)
+		}
+	}
+	if ls := stats.Latency(); ls.Cmds["get"].P999US != 3000 {
+		t.Fatalf("bad latency %#v", ls)
+	}
+	stats.Reset()
+	if ls := stats.Latency(); ls.Cmds["get"].Count != 0 || ls.Stages["wait"].Count != 0 {
+		t.Fatalf("not reset %#v", ls)
 	}
 }
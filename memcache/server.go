@@ -17,6 +17,7 @@ import (
 
 	"github.com/douban/gobeansdb/config"
 	"github.com/douban/gobeansdb/loghub"
+	"github.com/douban/gobeansdb/trace"
 	"github.com/douban/gobeansdb/utils"
 )
 
@@ -36,6 +37,13 @@ type ServerConn struct {
 	rbuf *bufio.Reader
 	wbuf *bufio.Writer
 	req  *Request
+
+	connected  time.Time
+	numCmd     int64
+	lastActive int64        // unix nano
+	lastCmd    atomic.Value // string
+
+	traceParent trace.SpanContext // from the last "trace" cmd
 }
 
 func newServerConn(conn net.Conn) *ServerConn {
@@ -46,9 +54,22 @@ func newServerConn(conn net.Conn) *ServerConn {
 	c.rbuf = bufio.NewReader(c.rwc)
 	c.wbuf = bufio.NewWriter(c.rwc)
 	c.req = new(Request)
+	c.connected = time.Now()
+	c.lastActive = c.connected.UnixNano()
+	c.lastCmd.Store("")
 	return c
 }
 
+func (c *ServerConn) stat(now time.Time) ConnStat {
+	return ConnStat{
+		Addr:      c.RemoteAddr,
+		Connected: c.connected,
+		NumCmd:    atomic.LoadInt64(&c.numCmd),
+		LastCmd:   c.lastCmd.Load().(string),
+		IdleSec:   int64(now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive))).Seconds()),
+	}
+}
+
 func (c *ServerConn) Close() {
 	if c.rwc != nil {
 		c.rwc.Close()
@@ -67,7 +88,18 @@ func overdue(recvtime, now time.Time) bool {
 func (c *ServerConn) ServeOnce(storageClient StorageClient, stats *Stats) (err error) {
 	req := c.req
 	var resp *Response = nil
+	served := false
+	var processTime, respTime time.Duration
+	var span *trace.Span
 	defer func() {
+		span.End()
+		if served {
+			total := time.Since(req.ReceiveTime)
+			stats.observeCmd(req, total)
+			if SlowReqs.IsSlow(total) {
+				c.logSlow(storageClient, total, processTime, respTime)
+			}
+		}
 		storageClient.Clean()
 		if e := recover(); e != nil {
 			logger.Errorf("mc panic(%#v), cmd %s, keys %v, stack: %s",
@@ -95,6 +127,11 @@ func (c *ServerConn) ServeOnce(storageClient StorageClient, stats *Stats) (err e
 	err = req.Read(c.rbuf)
 	t := time.Now()
 	readTimeout := false
+	if err != ErrNetworkError {
+		atomic.AddInt64(&c.numCmd, 1)
+		atomic.StoreInt64(&c.lastActive, t.UnixNano())
+		c.lastCmd.Store(req.Cmd)
+	}
 
 	if err != nil {
 		if req.Item != nil {
@@ -137,10 +174,22 @@ func (c *ServerConn) ServeOnce(storageClient StorageClient, stats *Stats) (err e
 			bodySize = len(req.Item.Body)
 		}
 
+		if req.Working {
+			stats.observeStage("wait", req.WaitTime)
+		}
+		if req.Cmd == "trace" {
+			c.traceParent = req.TraceParent
+		} else {
+			span = c.startSpan(storageClient, t)
+		}
+
 		// process memcache commands, e.g. 'set', 'get', 'incr'.
 		req.SetStat("process")
 		resp, err = req.Process(storageClient, stats)
 		dt := time.Since(t)
+		processTime = dt
+		stats.observeStage("process", dt)
+		served = true
 		if dt > SlowCmdTime {
 			atomic.AddInt64(&(stats.slow_cmd), 1)
 		}
@@ -167,17 +216,61 @@ func (c *ServerConn) ServeOnce(storageClient StorageClient, stats *Stats) (err e
 		}
 
 		req.SetStat("resp")
+		tw := time.Now()
 		if err = resp.Write(c.wbuf); err != nil {
 			return
 		}
 		if err = c.wbuf.Flush(); err != nil {
 			return
 		}
+		respTime = time.Since(tw)
+		stats.observeStage("resp", respTime)
+		span.Record("mc.write", tw, tw.Add(respTime))
 	}
 
 	return
 }
 
+func (c *ServerConn) startSpan(storageClient StorageClient, parsed time.Time) *trace.Span {
+	req := c.req
+	span := trace.StartRoot("mc."+req.Cmd, req.ReceiveTime, c.traceParent)
+	c.traceParent = trace.SpanContext{}
+	if span == nil {
+		return nil
+	}
+	span.SetAttr("net.peer", c.RemoteAddr)
+	span.SetAttr("mc.num_keys", len(req.Keys))
+	if len(req.Keys) > 0 {
+		span.SetAttr("mc.key", req.Keys[0])
+	}
+	span.Record("mc.parse", req.ReceiveTime, parsed)
+	if req.Working {
+		span.Record("limiter.wait", req.WaitStart, req.WaitStart.Add(req.WaitTime))
+	}
+	if tc, ok := storageClient.(TracedClient); ok {
+		tc.SetSpan(span)
+	}
+	return span
+}
+
+func (c *ServerConn) logSlow(storageClient StorageClient, total, process, resp time.Duration) {
+	req := c.req
+	e := &SlowLogEntry{
+		Time:      req.ReceiveTime,
+		Remote:    c.RemoteAddr,
+		Cmd:       req.Cmd,
+		Keys:      req.Keys,
+		TotalUS:   int64(total / time.Microsecond),
+		WaitUS:    int64(req.WaitTime / time.Microsecond),
+		ProcessUS: int64(process / time.Microsecond),
+		RespUS:    int64(resp / time.Microsecond),
+	}
+	if dc, ok := storageClient.(ReqDetailClient); ok {
+		e.Details = dc.ReqDetails()
+	}
+	SlowReqs.Add(e)
+}
+
 // 记录 accesslog, 主要用于 proxy 中
 func (c *ServerConn) writeAccessLog(resp *Response, bodySize int, processErr error, dt time.Duration, hosts []string) {
 	req := c.req
@@ -254,6 +347,8 @@ type Server struct {
 	conns map[string]*ServerConn
 	stats *Stats
 	stop  bool
+
+	accepting int32
 }
 
 func NewServer(store Storage) *Server {
@@ -261,9 +356,30 @@ func NewServer(store Storage) *Server {
 	s.store = store
 	s.conns = make(map[string]*ServerConn, 1024)
 	s.stats = NewStats()
+	s.stats.conns = s.connStats
 	return s
 }
 
+// Accepting tells whether Serve is accepting new connections.
+func (s *Server) Accepting() bool {
+	return atomic.LoadInt32(&s.accepting) == 1 && !s.stop
+}
+
+func (s *Server) Stats() *Stats {
+	return s.stats
+}
+
+func (s *Server) connStats() []ConnStat {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	conns := make([]ConnStat, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c.stat(now))
+	}
+	return conns
+}
+
 func (s *Server) Listen(addr string) (e error) {
 	s.addr = addr
 	s.l, e = net.Listen("tcp", addr)
@@ -272,10 +388,13 @@ func (s *Server) Listen(addr string) (e error) {
 
 func (s *Server) Serve() (e error) {
 	InitTokens()
+	InitSlowLog()
 	if s.l == nil {
 		return errors.New("no listener")
 	}
 
+	atomic.StoreInt32(&s.accepting, 1)
+	defer atomic.StoreInt32(&s.accepting, 0)
 	for {
 		rw, e := s.l.Accept()
 		if e != nil {
@@ -290,14 +409,14 @@ func (s *Server) Serve() (e error) {
 			s.Lock()
 			s.conns[c.RemoteAddr] = c
 
-			s.stats.curr_connections++
-			s.stats.total_connections++
+			atomic.AddInt64(&s.stats.curr_connections, 1)
+			atomic.AddInt64(&s.stats.total_connections, 1)
 			s.Unlock()
 
 			c.Serve(s.store.Client(), s.stats)
 
 			s.Lock()
-			s.stats.curr_connections--
+			atomic.AddInt64(&s.stats.curr_connections, -1)
 			delete(s.conns, c.RemoteAddr)
 			s.Unlock()
 		}()
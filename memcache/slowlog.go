@@ -0,0 +1,108 @@
+package memcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/douban/gobeansdb/config"
+)
+
+var SlowReqs = NewSlowLog(1000, SlowCmdTime)
+
+// ReqDetail describes how the storage served one key of a request.
+type ReqDetail struct {
+	Key          string
+	Bucket       int
+	ChunkID      int
+	Offset       uint32
+	ValueSize    int
+	InBuffer     bool
+	Compressed   bool
+	DiskReadUS   int64
+	DecompressUS int64
+}
+
+// ReqDetailClient may be implemented by a StorageClient to report details
+// of the request just served, it is called before Clean().
+type ReqDetailClient interface {
+	ReqDetails() []ReqDetail
+}
+
+type SlowLogEntry struct {
+	Time      time.Time
+	Remote    string
+	Cmd       string
+	Keys      []string
+	TotalUS   int64
+	WaitUS    int64 // in ReqLimiter queue
+	ProcessUS int64
+	RespUS    int64       // writing response
+	Details   []ReqDetail `json:",omitempty"`
+}
+
+// SlowLog is a ring buffer of the most recent slow requests.
+type SlowLog struct {
+	sync.Mutex
+	threshold int64 // nanoseconds
+	head      int
+	entries   []*SlowLogEntry
+}
+
+func NewSlowLog(size int, threshold time.Duration) *SlowLog {
+	return &SlowLog{
+		threshold: int64(threshold),
+		entries:   make([]*SlowLogEntry, size),
+	}
+}
+
+func InitSlowLog() {
+	if config.MCConf.SlowCmdMS > 0 {
+		SlowCmdTime = time.Duration(config.MCConf.SlowCmdMS) * time.Millisecond
+	}
+	size := config.MCConf.SlowLogSize
+	if size <= 0 {
+		size = config.DefaultMCConfig.SlowLogSize
+	}
+	SlowReqs = NewSlowLog(size, SlowCmdTime)
+}
+
+func (l *SlowLog) Threshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.threshold))
+}
+
+func (l *SlowLog) SetThreshold(d time.Duration) {
+	atomic.StoreInt64(&l.threshold, int64(d))
+}
+
+func (l *SlowLog) IsSlow(d time.Duration) bool {
+	return d > l.Threshold()
+}
+
+func (l *SlowLog) Add(e *SlowLogEntry) {
+	l.Lock()
+	l.entries[l.head] = e
+	l.head++
+	if l.head >= len(l.entries) {
+		l.head = 0
+	}
+	l.Unlock()
+}
+
+// Entries returns entries in the buffer, oldest first.
+func (l *SlowLog) Entries() []*SlowLogEntry {
+	l.Lock()
+	defer l.Unlock()
+	res := make([]*SlowLogEntry, 0, len(l.entries))
+	i := l.head
+	for j := 0; j < len(l.entries); j++ {
+		if e := l.entries[i]; e != nil {
+			res = append(res, e)
+		}
+		i++
+		if i >= len(l.entries) {
+			i = 0
+		}
+	}
+	return res
+}
@@ -0,0 +1,27 @@
+package memcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := NewSlowLog(3, 10*time.Millisecond)
+	if l.IsSlow(10*time.Millisecond) || !l.IsSlow(11*time.Millisecond) {
+		t.Fatal("bad threshold")
+	}
+	l.SetThreshold(time.Second)
+	if l.IsSlow(11 * time.Millisecond) {
+		t.Fatal("threshold not changed")
+	}
+	if len(l.Entries()) != 0 {
+		t.Fatal("should be empty")
+	}
+	for _, cmd := range []string{"a", "b", "c", "d"} {
+		l.Add(&SlowLogEntry{Cmd: cmd})
+	}
+	entries := l.Entries()
+	if len(entries) != 3 || entries[0].Cmd != "b" || entries[2].Cmd != "d" {
+		t.Fatalf("bad entries %v", entries)
+	}
+}
@@ -1,8 +1,12 @@
 package memcache
 
 import (
+	"fmt"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/douban/gobeansdb/utils"
@@ -17,14 +21,176 @@ type Stats struct {
 	curr_connections, total_connections int64
 	bytes_read, bytes_written           int64
 	slow_cmd                            int64 // slow_cmd is not a stats in memecached protocol
+
+	// histograms are created once in NewStats, so recording needs no lock
+	cmdLatency   map[string]*utils.Histogram
+	stageLatency map[string]*utils.Histogram
+
+	// set by Server, nil in tests
+	conns func() []ConnStat
+}
+
+var (
+	LatencyCmds   = []string{"get", "getm", "set", "delete", "incr", "append", "other"}
+	LatencyStages = []string{"wait", "process", "resp"}
+)
+
+type LatencyStats struct {
+	Cmds   map[string]utils.HistogramSummary
+	Stages map[string]utils.HistogramSummary
+}
+
+type ConnStat struct {
+	Addr      string
+	Connected time.Time
+	NumCmd    int64
+	LastCmd   string
+	IdleSec   int64
 }
 
 func NewStats() *Stats {
 	s := new(Stats)
 	s.start = time.Now()
+	s.cmdLatency = make(map[string]*utils.Histogram, len(LatencyCmds))
+	for _, name := range LatencyCmds {
+		s.cmdLatency[name] = new(utils.Histogram)
+	}
+	s.stageLatency = make(map[string]*utils.Histogram, len(LatencyStages))
+	for _, name := range LatencyStages {
+		s.stageLatency[name] = new(utils.Histogram)
+	}
 	return s
 }
 
+func latencyCmdName(req *Request) string {
+	switch req.Cmd {
+	case "get", "gets":
+		if len(req.Keys) > 1 {
+			return "getm"
+		}
+		return "get"
+	case "set", "add", "replace", "cas":
+		return "set"
+	case "delete", "incr", "append":
+		return req.Cmd
+	}
+	return "other"
+}
+
+func (s *Stats) observeCmd(req *Request, d time.Duration) {
+	s.cmdLatency[latencyCmdName(req)].Observe(d)
+}
+
+func (s *Stats) observeStage(stage string, d time.Duration) {
+	s.stageLatency[stage].Observe(d)
+}
+
+func (s *Stats) Latency() *LatencyStats {
+	ls := &LatencyStats{
+		Cmds:   make(map[string]utils.HistogramSummary, len(s.cmdLatency)),
+		Stages: make(map[string]utils.HistogramSummary, len(s.stageLatency)),
+	}
+	for name, h := range s.cmdLatency {
+		ls.Cmds[name] = h.Summary()
+	}
+	for name, h := range s.stageLatency {
+		ls.Stages[name] = h.Summary()
+	}
+	return ls
+}
+
+// CmdLatencySum returns the count and total latency of cmd, one of LatencyCmds.
+func (s *Stats) CmdLatencySum(cmd string) (n int64, sum time.Duration) {
+	if h, ok := s.cmdLatency[cmd]; ok {
+		n, sum = h.Count(), h.Sum()
+	}
+	return
+}
+
+func (s *Stats) Conns() []ConnStat {
+	if s.conns == nil {
+		return nil
+	}
+	return s.conns()
+}
+
+// Reset clears counters and latency histograms, connection gauges are kept.
+func (s *Stats) Reset() {
+	for _, p := range []*int64{&s.cmd_get, &s.cmd_set, &s.cmd_delete,
+		&s.get_hits, &s.get_misses, &s.total_connections,
+		&s.bytes_read, &s.bytes_written, &s.slow_cmd} {
+		atomic.StoreInt64(p, 0)
+	}
+	for _, h := range s.cmdLatency {
+		h.Reset()
+	}
+	for _, h := range s.stageLatency {
+		h.Reset()
+	}
+}
+
+func summaryLines(name string, hs utils.HistogramSummary) []string {
+	return []string{
+		fmt.Sprintf("STAT %s:count %d\r\n", name, hs.Count),
+		fmt.Sprintf("STAT %s:avg_us %d\r\n", name, hs.AvgUS),
+		fmt.Sprintf("STAT %s:p50_us %d\r\n", name, hs.P50US),
+		fmt.Sprintf("STAT %s:p90_us %d\r\n", name, hs.P90US),
+		fmt.Sprintf("STAT %s:p99_us %d\r\n", name, hs.P99US),
+		fmt.Sprintf("STAT %s:p999_us %d\r\n", name, hs.P999US),
+		fmt.Sprintf("STAT %s:max_us %d\r\n", name, hs.MaxUS),
+	}
+}
+
+func (s *Stats) latencyLines() (ss []string) {
+	ls := s.Latency()
+	for _, name := range LatencyCmds {
+		ss = append(ss, summaryLines(name, ls.Cmds[name])...)
+	}
+	for _, name := range LatencyStages {
+		ss = append(ss, summaryLines("stage_"+name, ls.Stages[name])...)
+	}
+	return
+}
+
+// subStats serves "stats latency", "stats conns" and those provided by the storage client.
+func (s *Stats) subStats(name string, store StorageClient) (msg string, ok bool) {
+	var ss []string
+	switch name {
+	case "latency":
+		ss = s.latencyLines()
+	case "conns":
+		ss = s.connLines()
+	default:
+		sc, isSub := store.(SubStatsClient)
+		if !isSub {
+			return
+		}
+		var lines []string
+		if lines, ok = sc.SubStats(name); !ok {
+			return
+		}
+		ss = make([]string, len(lines))
+		for i, line := range lines {
+			ss[i] = "STAT " + line + "\r\n"
+		}
+	}
+	return strings.Join(ss, ""), true
+}
+
+func (s *Stats) connLines() (ss []string) {
+	conns := s.Conns()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Addr < conns[j].Addr })
+	now := time.Now()
+	for _, c := range conns {
+		ss = append(ss,
+			fmt.Sprintf("STAT %s:age %d\r\n", c.Addr, int64(now.Sub(c.Connected).Seconds())),
+			fmt.Sprintf("STAT %s:idle %d\r\n", c.Addr, c.IdleSec),
+			fmt.Sprintf("STAT %s:cmds %d\r\n", c.Addr, c.NumCmd),
+			fmt.Sprintf("STAT %s:last_cmd %s\r\n", c.Addr, c.LastCmd))
+	}
+	return
+}
+
 func mem_in_go(include_zero bool) runtime.MemProfileRecord {
 	var p []runtime.MemProfileRecord
 	n, ok := runtime.MemProfile(nil, include_zero)
@@ -54,16 +220,16 @@ func mem_in_go(include_zero bool) runtime.MemProfileRecord {
 
 func (s *Stats) Stats() map[string]int64 {
 	st := make(map[string]int64)
-	st["cmd_get"] = s.cmd_get
-	st["cmd_set"] = s.cmd_set
-	st["cmd_delete"] = s.cmd_delete
-	st["get_hits"] = s.get_hits
-	st["get_misses"] = s.get_misses
-	st["curr_connections"] = s.curr_connections
-	st["total_connections"] = s.total_connections
-	st["bytes_read"] = s.bytes_read
-	st["bytes_written"] = s.bytes_written
-	st["slow_cmd"] = s.slow_cmd
+	st["cmd_get"] = atomic.LoadInt64(&s.cmd_get)
+	st["cmd_set"] = atomic.LoadInt64(&s.cmd_set)
+	st["cmd_delete"] = atomic.LoadInt64(&s.cmd_delete)
+	st["get_hits"] = atomic.LoadInt64(&s.get_hits)
+	st["get_misses"] = atomic.LoadInt64(&s.get_misses)
+	st["curr_connections"] = atomic.LoadInt64(&s.curr_connections)
+	st["total_connections"] = atomic.LoadInt64(&s.total_connections)
+	st["bytes_read"] = atomic.LoadInt64(&s.bytes_read)
+	st["bytes_written"] = atomic.LoadInt64(&s.bytes_written)
+	st["slow_cmd"] = atomic.LoadInt64(&s.slow_cmd)
 
 	t := time.Now()
 	st["time"] = int64(t.Unix())
@@ -4,6 +4,8 @@ import (
 	"math/rand"
 	"strconv"
 	"sync"
+
+	"github.com/douban/gobeansdb/trace"
 )
 
 type Storage interface {
@@ -24,6 +26,19 @@ type StorageClient interface {
 	Process(key string, args []string) (string, string)
 }
 
+// SubStatsClient may be implemented by a StorageClient to answer
+// "stats <name>" subcommands which need storage internals, e.g. "stats buckets".
+// Each line is "<name> <value>" without the "STAT " prefix.
+type SubStatsClient interface {
+	SubStats(name string) (lines []string, ok bool)
+}
+
+// TracedClient may be implemented by a StorageClient to add its spans under
+// the span of the request, the span is nil if the request is not sampled.
+type TracedClient interface {
+	SetSpan(span *trace.Span)
+}
+
 type mapStore struct {
 	lock sync.Mutex
 	data map[string]*Item
@@ -28,6 +28,22 @@ type ReqLimiter struct {
 	MaxWait time.Duration
 }
 
+type LimiterState struct {
+	Size    int
+	Busy    int // tokens in use
+	NumWait int32
+	MaxWait time.Duration
+}
+
+func (rl *ReqLimiter) State() LimiterState {
+	return LimiterState{
+		Size:    cap(rl.Chan),
+		Busy:    cap(rl.Chan) - len(rl.Chan),
+		NumWait: atomic.LoadInt32(&rl.NumWait),
+		MaxWait: rl.MaxWait,
+	}
+}
+
 func NewReqLimiter(n int) *ReqLimiter {
 	rl := &ReqLimiter{}
 	rl.Chan = make(chan int, n)
@@ -51,6 +67,8 @@ func (rl *ReqLimiter) Get(req *Request) {
 	ed := time.Now()
 
 	d := ed.Sub(st)
+	req.WaitStart = st
+	req.WaitTime = d
 
 	rl.Histories[t] = ReqHistoy{
 		Cmd:        req.Cmd,
@@ -60,6 +60,9 @@ type BucketInfo struct {
 	SizeVhashKey    string
 	NumSet          int64
 	NumGet          int64
+	NumHolds        int
+	Chunks          []ChunkUsage
+	Device          string // the physical device of Home
 }
 
 type Bucket struct {
@@ -70,12 +73,25 @@ type Bucket struct {
 	htree     *HTree
 	hints     *hintMgr
 	datas     *dataStore
+	versions  *versionIndex // nil if not enabled
+	holds     *holdTable
+	scrub     *scrubState
+	dicts     *dictStore
+	usage     *chunkUsage
 	GCHistory []GCState
+	gcResume  *GCState // set by open if an interrupted gc should be resumed
+
+	hintsChecked chan struct{} // closed once hints of old chunks are checked
 }
 
 func (bkt *Bucket) release() {
 	bkt.hints = nil
 	bkt.datas = nil
+	bkt.versions = nil
+	bkt.holds = nil
+	bkt.scrub = nil
+	bkt.dicts = nil
+	bkt.usage = nil
 	htree := bkt.htree
 	bkt.htree = nil
 	htree.release()
@@ -168,9 +184,32 @@ func (bkt *Bucket) open(bucketID int, home string) (err error) {
 	// load HTree
 	bkt.ID = bucketID
 	bkt.Home = home
+	if bkt.Device, err = utils.DeviceOf(home); err != nil {
+		logger.Errorf("fail to find device of %s: %s", home, err.Error())
+		bkt.Device = home
+	}
 	bkt.datas = NewdataStore(bucketID, home)
 	bkt.hints = newHintMgr(bucketID, home)
 	bkt.hints.loadCollisions()
+	bkt.holds = newHoldTable(home)
+	if err = bkt.holds.load(); err != nil {
+		return err
+	}
+	bkt.scrub = newScrubState(home)
+	if err = bkt.scrub.load(); err != nil {
+		return err
+	}
+	bkt.dicts = newDictStore(bucketID, home)
+	if err = bkt.dicts.load(); err != nil {
+		return err
+	}
+	bkt.datas.dicts = bkt.dicts
+	if Conf.versionIndex(bucketID) {
+		bkt.versions = newVersionIndex(bucketID, Conf.VersionIndexMaxItems, Conf.VersionIndexMaxVers)
+	}
+	if bkt.gcResume, err = bkt.recoverGC(); err != nil {
+		return err
+	}
 	htree := newHTree(Conf.TreeDepth, bucketID, Conf.TreeHeight)
 
 	bkt.TreeID = HintID{0, -1}
@@ -228,9 +267,19 @@ func (bkt *Bucket) open(bucketID int, home string) (err error) {
 			bkt.hints.maxDumpedHintID = HintID{i, startsp + j}
 		}
 	}
+
+	// hints of the chunks before TreeID are loaded later, the records in
+	// them are counted then
+	bkt.usage = newChunkUsage()
+	bkt.initUsage(0, MAX_NUM_CHUNK-1, bkt.loadUsage())
+	htree.usage = bkt.usage
+	bkt.hintsChecked = make(chan struct{})
 	go func() {
+		defer close(bkt.hintsChecked)
 		for i := 0; i < bkt.TreeID.Chunk; i++ {
-			bkt.checkHintWithData(i)
+			if bkt.checkHintWithData(i) == nil {
+				bkt.usage.addUncounted(i, int64(bkt.hints.numKeys(i)))
+			}
 		}
 	}()
 
@@ -339,13 +388,15 @@ func (bkt *Bucket) checkAndUpdateVerison(oldv, ver int32) (int32, bool) {
 	return ver, true
 }
 
-func (bkt *Bucket) checkAndSet(ki *KeyInfo, v *Payload) error {
+// checkAndSet returns the position of the record written, or of the same one
+// if stored is true.
+func (bkt *Bucket) checkAndSet(ki *KeyInfo, v *Payload) (pos Position, stored bool, err error) {
 	if v.Ver >= 0 {
 		rec := &Record{ki.Key, v}
 		v.CalcValueHash()
 
 		oldCap := rec.Payload.CArray.Cap
-		rec.TryCompress()
+		rec.compress(bkt.dicts.current())
 		cmem.DBRL.SetData.AddSize(rec.Payload.CArray.Cap - oldCap)
 	}
 	bkt.writeLock.Lock()
@@ -360,7 +411,7 @@ func (bkt *Bucket) checkAndSet(ki *KeyInfo, v *Payload) error {
 	oldv := int32(0)
 	payload, pos, err := bkt.get(ki, true)
 	if err != nil {
-		return err
+		return
 	}
 
 	if payload != nil {
@@ -371,7 +422,7 @@ func (bkt *Bucket) checkAndSet(ki *KeyInfo, v *Payload) error {
 					// sync script would be here, e.g. set_raw(k, v, rev=xxx)
 					bkt.htree.set(ki, &v.Meta, pos)
 				}
-				return nil
+				return pos, true, nil
 			}
 			atomic.AddInt64(&bkt.NumSameVhash, 1)
 			atomic.AddInt64(&bkt.SizeSameVhash, int64(len(v.Body)))
@@ -382,24 +433,34 @@ func (bkt *Bucket) checkAndSet(ki *KeyInfo, v *Payload) error {
 	var valid bool
 	v.Ver, valid = bkt.checkAndUpdateVerison(oldv, v.Ver)
 	if !valid {
-		return nil
+		return
 	}
 	if v.Ver < 0 && (payload == nil || oldv < 0) {
-		return fmt.Errorf("NOT_FOUND")
+		err = fmt.Errorf("NOT_FOUND")
+		return
+	}
+	if pos, err = bkt.set(ki, v); err != nil {
+		return
 	}
 	ok = true
-	bkt.set(ki, v)
-	return nil
+	return pos, true, nil
 }
 
-func (bkt *Bucket) set(ki *KeyInfo, v *Payload) error {
-	pos, err := bkt.datas.AppendRecord(&Record{ki.Key, v})
+func (bkt *Bucket) set(ki *KeyInfo, v *Payload) (pos Position, err error) {
+	pos, err = bkt.datas.AppendRecord(&Record{ki.Key, v})
 	if err != nil {
-		return err
+		return
+	}
+	bkt.usage.add(pos.ChunkID, v.RecSize)
+	if v.Ver < 0 {
+		bkt.usage.supersede(pos.ChunkID) // deletes are garbage as after a restart
 	}
 	bkt.htree.set(ki, &v.Meta, pos)
 	bkt.hints.set(ki, &v.Meta, pos, v.RecSize, "set")
-	return nil
+	if bkt.versions != nil {
+		bkt.versions.set(ki, &v.Meta, pos)
+	}
+	return
 }
 
 func (bkt *Bucket) get(ki *KeyInfo, memOnly bool) (payload *Payload, pos Position, err error) {
@@ -407,7 +468,9 @@ func (bkt *Bucket) get(ki *KeyInfo, memOnly bool) (payload *Payload, pos Positio
 	var meta *Meta
 	var found bool
 	if hintit == nil {
+		span := ki.Span.Child("htree.get")
 		meta, pos, found = bkt.htree.get(ki)
+		span.End()
 		if !found {
 			return
 		}
@@ -428,9 +491,29 @@ func (bkt *Bucket) get(ki *KeyInfo, memOnly bool) (payload *Payload, pos Positio
 		payload.Meta = *meta
 		return // omit collision
 	}
+	if bkt.scrub.isQuarantined(ki.KeyHash, pos) {
+		err = ErrQuarantined
+		return
+	}
+	stat := ki.Stat
+	if stat == nil && ki.Span != nil {
+		stat = &GetStat{}
+	}
 	beforeGetRecord := time.Now()
-	rec, inbuffer, err := bkt.datas.GetRecordByPos(pos)
+	rec, inbuffer, err := bkt.datas.getRecordByPosWithStat(pos, stat)
 	getRecordTimeCost := time.Now().Sub(beforeGetRecord).Seconds() * 1000 // Millisecond
+	if ki.Span != nil {
+		readEnd := beforeGetRecord.Add(stat.ReadTime)
+		span := ki.Span.ChildAt("data.read", beforeGetRecord)
+		span.SetAttr("chunk", pos.ChunkID)
+		span.SetAttr("offset", int64(pos.Offset))
+		span.SetAttr("inbuffer", stat.InBuffer)
+		span.SetError(err)
+		span.EndAt(readEnd)
+		if stat.Compressed {
+			ki.Span.Record("decompress", readEnd, readEnd.Add(stat.DecompressTime))
+		}
+	}
 	if err != nil {
 		// not remove for now: it may cause many sync
 		// bkt.htree.remove(ki, pos)
@@ -472,7 +555,10 @@ func (bkt *Bucket) get(ki *KeyInfo, memOnly bool) (payload *Payload, pos Positio
 
 	// here: same key hash, diff key
 
+	span := ki.Span.Child("hint.get")
 	hintit, chunkID, err := bkt.hints.getItem(ki.KeyHash, ki.StringKey, false)
+	span.SetError(err)
+	span.End()
 	if err != nil || hintit == nil {
 		return
 	}
@@ -541,11 +627,18 @@ func (bkt *Bucket) incr(ki *KeyInfo, value int) int {
 	payload := &Payload{}
 	payload.Flag = FLAG_INCR
 	payload.Ver = ver
-	payload.TS = uint32(time.Now().Unix())
+	payload.SetTS(time.Now())
 	s := strconv.Itoa(value)
 	payload.Body = []byte(s)
 	payload.CalcValueHash()
-	bkt.set(ki, payload)
+	pos, err := bkt.set(ki, payload)
+	if err == nil {
+		err = bkt.datas.commit(pos, ki.Durability)
+	}
+	if err != nil {
+		logger.Errorf("fail to incr %s: %s", ki.StringKey, err.Error())
+		return 0
+	}
 	return value
 }
 
@@ -563,6 +656,8 @@ func (bkt *Bucket) getInfo() *BucketInfo {
 		bkt.LastGC = &bkt.GCHistory[n-1]
 	}
 	bkt.DU, _ = utils.DirUsage(bkt.Home)
+	bkt.NumHolds = len(bkt.holds.list())
+	bkt.Chunks = bkt.usage.list()
 	return &bkt.BucketInfo
 }
 
@@ -0,0 +1,313 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/quicklz"
+)
+
+// A compressed record has FLAG_COMPRESS, and the id of its codec in the header
+// but not in the flag, which is the client's. Records written before codecs
+// were pluggable have no codec id, which is the id of quicklz.
+
+const (
+	MAX_NUM_CODEC = recCodecMask + 1
+
+	CODEC_QUICKLZ   = 0
+	CODEC_ZSTD      = 1
+	CODEC_LZ4       = 2
+	CODEC_SNAPPY    = 3
+	CODEC_ZSTD_DICT = 4
+)
+
+// Codec compresses values of records. The arrays returned are freed by callers.
+type Codec interface {
+	Name() string
+	// Compress returns false if it fails, e.g. out of memory.
+	Compress(src []byte) (dst cmem.CArray, ok bool)
+	Decompress(src []byte) (dst cmem.CArray, err error)
+	DecompressedSize(src []byte) (int, error)
+}
+
+var (
+	codecs     [MAX_NUM_CODEC]Codec
+	codecNames = make(map[string]int)
+)
+
+func init() {
+	RegisterCodec(CODEC_QUICKLZ, quicklzCodec{})
+	RegisterCodec(CODEC_ZSTD, newZstdCodec())
+	RegisterCodec(CODEC_LZ4, lz4Codec{})
+	RegisterCodec(CODEC_SNAPPY, snappyCodec{})
+	RegisterCodec(CODEC_ZSTD_DICT, zstdDictCodec{})
+}
+
+// RegisterCodec makes a codec usable by its name in config, id is kept in
+// records, so it must not change once used.
+func RegisterCodec(id int, c Codec) {
+	if id < 0 || id >= MAX_NUM_CODEC || codecs[id] != nil {
+		panic(fmt.Sprintf("bad codec id %d for %s", id, c.Name()))
+	}
+	codecs[id] = c
+	codecNames[c.Name()] = id
+}
+
+func getCodecID(name string) (int, error) {
+	id, ok := codecNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown codec %q", name)
+	}
+	return id, nil
+}
+
+func getCodec(id int) (Codec, error) {
+	if codecs[id] == nil {
+		return nil, fmt.Errorf("unknown codec id %d", id)
+	}
+	return codecs[id], nil
+}
+
+// CodecID returns the id of the codec of a compressed record.
+func (p *Payload) CodecID() int {
+	return int(p.Codec)
+}
+
+// CodecName returns "" if the record is not compressed.
+func (p *Payload) CodecName() string {
+	if !p.IsCompressed() {
+		return ""
+	}
+	if c, err := getCodec(p.CodecID()); err == nil {
+		return c.Name()
+	}
+	return fmt.Sprintf("codec%d", p.CodecID())
+}
+
+func (p *Payload) codec() (Codec, error) {
+	return getCodec(p.CodecID())
+}
+
+// checkCodecConfig checks the codec names in Conf.
+func checkCodecConfig() error {
+	if Conf.Codec == "" {
+		return fmt.Errorf("no codec")
+	}
+	if _, err := getCodecID(Conf.Codec); err != nil {
+		return err
+	}
+	for kind, name := range Conf.Codecs {
+		if _, err := getCodecID(name); err != nil {
+			return fmt.Errorf("codec of %s: %s", kind, err.Error())
+		}
+	}
+	if Conf.DictSize <= 0 {
+		return fmt.Errorf("bad dict size %q", Conf.DictSizeStr)
+	}
+	return nil
+}
+
+// codecFor chooses the codec by the MIME type sniffed from the head of a
+// value, it returns -1 if the type is in NotCompress. Types in Codecs are
+// matched by the whole type, the type without parameters, and then the
+// top-level type, e.g. "text/plain; charset=utf-8", "text/plain", "text/*".
+func codecFor(header []byte) int {
+	kind := http.DetectContentType(header)
+	if Conf.NotCompress[kind] {
+		return -1
+	}
+	keys := []string{kind}
+	if i := strings.IndexByte(kind, ';'); i > 0 {
+		keys = append(keys, kind[:i])
+	}
+	if i := strings.IndexByte(kind, '/'); i > 0 {
+		keys = append(keys, kind[:i]+"/*")
+	}
+	for _, k := range keys {
+		if name, ok := Conf.Codecs[k]; ok {
+			if id, err := getCodecID(name); err == nil {
+				return id
+			}
+		}
+	}
+	id, _ := getCodecID(Conf.Codec)
+	return id
+}
+
+// copyToCArray copies data compressed by a go library, as values are kept in
+// c memory if large.
+func copyToCArray(data []byte) (dst cmem.CArray, ok bool) {
+	if !dst.Alloc(len(data)) {
+		return
+	}
+	copy(dst.Body, data)
+	return dst, true
+}
+
+type quicklzCodec struct{}
+
+func (quicklzCodec) Name() string {
+	return "quicklz"
+}
+
+func (quicklzCodec) Compress(src []byte) (cmem.CArray, bool) {
+	return quicklz.CCompress(src)
+}
+
+func (quicklzCodec) Decompress(src []byte) (cmem.CArray, error) {
+	return quicklz.CDecompressSafe(src)
+}
+
+func (quicklzCodec) DecompressedSize(src []byte) (int, error) {
+	if len(src) < 3 || (src[0]&2 != 0 && len(src) < 9) { // short or long header
+		return 0, fmt.Errorf("bad quicklz data, size %d", len(src))
+	}
+	return quicklz.SizeDecompressed(src), nil
+}
+
+// zstdCodec keeps the content size in frames, which is read before
+// decompressing to allocate the value.
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func newZstdCodec() *zstdCodec {
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	dec, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	return &zstdCodec{enc, dec}
+}
+
+func (c *zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCodec) Compress(src []byte) (cmem.CArray, bool) {
+	return copyToCArray(c.enc.EncodeAll(src, nil))
+}
+
+func (c *zstdCodec) DecompressedSize(src []byte) (int, error) {
+	return zstdContentSize(src)
+}
+
+func (c *zstdCodec) Decompress(src []byte) (dst cmem.CArray, err error) {
+	return zstdDecompress(c.dec, src)
+}
+
+func zstdContentSize(src []byte) (int, error) {
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return 0, err
+	} else if !h.HasFCS {
+		return 0, fmt.Errorf("no content size in zstd frame")
+	}
+	return int(h.FrameContentSize), nil
+}
+
+func zstdDecompress(dec *zstd.Decoder, src []byte) (dst cmem.CArray, err error) {
+	size, err := zstdContentSize(src)
+	if err != nil {
+		return
+	}
+	return decompressTo(size, func(body []byte) error {
+		res, err := dec.DecodeAll(src, body[:0])
+		if err == nil && (len(res) != size || (size > 0 && &res[0] != &body[0])) {
+			err = fmt.Errorf("zstd decompressed %d bytes, expect %d", len(res), size)
+		}
+		return err
+	})
+}
+
+// decompressTo allocates size bytes and decompresses into them.
+func decompressTo(size int, decompress func(body []byte) error) (dst cmem.CArray, err error) {
+	if size < 0 || int64(size) > config.MCConf.BodyMax {
+		err = fmt.Errorf("bad decompressed size %d", size)
+		return
+	} else if !dst.Alloc(size) {
+		err = fmt.Errorf("fail to alloc for decompress, size %d", size)
+		return
+	}
+	if err = decompress(dst.Body); err != nil {
+		dst.Free()
+	}
+	return
+}
+
+// lz4Codec writes lz4 blocks after the size of the value in 4 bytes.
+type lz4Codec struct{}
+
+var lz4Compressors = sync.Pool{New: func() interface{} { return new(lz4.Compressor) }}
+
+func (lz4Codec) Name() string {
+	return "lz4"
+}
+
+func (lz4Codec) Compress(src []byte) (dst cmem.CArray, ok bool) {
+	buf := make([]byte, 4+lz4.CompressBlockBound(len(src)))
+	binary.LittleEndian.PutUint32(buf, uint32(len(src)))
+	c := lz4Compressors.Get().(*lz4.Compressor)
+	n, err := c.CompressBlock(src, buf[4:])
+	lz4Compressors.Put(c)
+	if err != nil || n == 0 { // 0 if not compressible
+		return
+	}
+	return copyToCArray(buf[:4+n])
+}
+
+func (lz4Codec) DecompressedSize(src []byte) (int, error) {
+	if len(src) < 4 {
+		return 0, fmt.Errorf("bad lz4 data, size %d", len(src))
+	}
+	return int(binary.LittleEndian.Uint32(src)), nil
+}
+
+func (c lz4Codec) Decompress(src []byte) (dst cmem.CArray, err error) {
+	size, err := c.DecompressedSize(src)
+	if err != nil {
+		return
+	}
+	return decompressTo(size, func(body []byte) error {
+		n, err := lz4.UncompressBlock(src[4:], body)
+		if err == nil && n != size {
+			err = fmt.Errorf("lz4 decompressed %d bytes, expect %d", n, size)
+		}
+		return err
+	})
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Compress(src []byte) (cmem.CArray, bool) {
+	return copyToCArray(snappy.Encode(nil, src))
+}
+
+func (snappyCodec) DecompressedSize(src []byte) (int, error) {
+	return snappy.DecodedLen(src)
+}
+
+func (c snappyCodec) Decompress(src []byte) (dst cmem.CArray, err error) {
+	size, err := c.DecompressedSize(src)
+	if err != nil {
+		return
+	}
+	return decompressTo(size, func(body []byte) error {
+		res, err := snappy.Decode(body, src)
+		if err == nil && (len(res) != size || (size > 0 && &res[0] != &body[0])) {
+			err = fmt.Errorf("snappy decompressed %d bytes, expect %d", len(res), size)
+		}
+		return err
+	})
+}
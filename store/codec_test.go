@@ -0,0 +1,227 @@
+package store
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/quicklz"
+)
+
+func TestCodecs(t *testing.T) {
+	Conf.InitDefault()
+	body := strings.Repeat("hello gobeansdb ", 1000)
+	for _, name := range []string{"quicklz", "zstd", "lz4", "snappy"} {
+		Conf.Codec = name
+		p := &Payload{}
+		p.Body = []byte(body)
+		rec := &Record{[]byte("key"), p}
+		rec.TryCompress()
+		if !p.IsCompressed() || p.CodecName() != name || len(p.Body) >= len(body) {
+			t.Fatalf("%s: flag %x, size %d", name, p.Flag, len(p.Body))
+		}
+		if diff := p.DiffSizeAfterDecompressed(); diff != len(body)-p.CArray.Cap {
+			t.Fatalf("%s: diff %d", name, diff)
+		}
+		if vhash := p.Getvhash(); vhash != Getvhash([]byte(body)) {
+			t.Fatalf("%s: vhash %d", name, vhash)
+		}
+		if err := p.Decompress(); err != nil || p.Flag != 0 || string(p.Body) != body {
+			t.Fatalf("%s: %v, flag %x, size %d", name, err, p.Flag, len(p.Body))
+		}
+		p.Free()
+
+		bad := &Payload{}
+		bad.Flag = FLAG_COMPRESS
+		bad.Body = []byte{1, 2, 3, 4}
+		if err := bad.Decompress(); err == nil || bad.Flag != FLAG_COMPRESS {
+			t.Fatalf("%s: decompressed bad data", name)
+		}
+	}
+	Conf.Codec = "gzip"
+	if err := checkCodecConfig(); err == nil {
+		t.Fatal("unknown codec accepted")
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	Conf.InitDefault()
+	Conf.Init()
+	Conf.Codec = "lz4"
+	Conf.NotCompress = map[string]bool{"image/png": true}
+	Conf.Codecs = map[string]string{
+		"text/html; charset=utf-8": "snappy",
+		"text/plain":               "zstd",
+		"application/*":            "quicklz",
+	}
+	defer func() { Conf.Codecs = nil }()
+	if err := checkCodecConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		head  string
+		codec int
+	}{
+		{"<html><body>", CODEC_SNAPPY},
+		{"plain text", CODEC_ZSTD},
+		{"%PDF-1.4", CODEC_QUICKLZ},
+		{"GIF89a", CODEC_LZ4},
+		{"\x89PNG\x0D\x0A\x1A\x0A", -1},
+	}
+	for _, c := range cases {
+		if id := codecFor([]byte(c.head)); id != c.codec {
+			t.Errorf("%q: codec %d, expect %d", c.head, id, c.codec)
+		}
+	}
+}
+
+// TestCodecLegacy reads a value compressed before codecs were pluggable, when
+// values with client flags in bits 17-19 were compressed by quicklz too.
+func TestCodecLegacy(t *testing.T) {
+	Conf.InitDefault()
+	body := strings.Repeat("legacy ", 100)
+	key := []byte("key")
+	value, _ := quicklz.CCompress([]byte(body))
+	defer value.Free()
+	data := make([]byte, recHeaderSize, recHeaderSize+len(key)+len(value.Body))
+	binary.LittleEndian.PutUint32(data[4:8], 1)
+	binary.LittleEndian.PutUint32(data[8:12], FLAG_COMPRESS|0x20000)
+	binary.LittleEndian.PutUint32(data[12:16], 1)
+	binary.LittleEndian.PutUint32(data[16:20], uint32(len(key)))
+	binary.LittleEndian.PutUint32(data[20:24], uint32(len(value.Body)))
+	data = append(append(data, key...), value.Body...)
+	hasher := newCrc32()
+	hasher.write(data[4:])
+	binary.LittleEndian.PutUint32(data[:4], hasher.get())
+
+	wrec := newWriteRecord()
+	if err := wrec.decode(data); err != nil {
+		t.Fatal(err)
+	}
+	p := wrec.rec.Payload
+	if p.CodecName() != "quicklz" || p.RawValueSize() != len(p.Body) || p.Getvhash() != Getvhash([]byte(body)) {
+		t.Fatalf("%s %d", p.CodecName(), p.RawValueSize())
+	}
+	if err := p.Decompress(); err != nil || p.Flag != 0x20000 || string(p.Body) != body {
+		t.Fatalf("%v %x %q", err, p.Flag, p.Body)
+	}
+	p.Free()
+}
+
+func TestGCRecompress(t *testing.T) {
+	testGC(t, testGCRecompress, "recompress", 10)
+}
+
+// testGCRecompress writes values by quicklz, and then gc them into another
+// chunk after the codec is changed.
+func testGCRecompress(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	defer func() {
+		Conf.Codec = "quicklz"
+		Conf.GCRecompress = false
+	}()
+	gen := newKVGen(16)
+	var ki KeyInfo
+	value := func(i int) string {
+		if i%2 == 0 {
+			return strings.Repeat("compressible ", 100)
+		}
+		return "short"
+	}
+	for i := 0; i < 4; i++ {
+		payload := gen.gen(&ki, i, 0)
+		payload.Body = []byte(value(i))
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bkt := store.buckets[bucketID]
+	bkt.datas.flush(0, true)
+	bkt.datas.flush(1, true)
+
+	Conf.Codec = "zstd"
+	Conf.GCRecompress = true
+	store.gcMgr.gc(bkt, 0, 0, false)
+	gc := bkt.GCHistory[len(bkt.GCHistory)-1]
+	if gc.Err != nil || gc.NumRecompressed != 2 {
+		t.Fatalf("%#v", gc)
+	}
+
+	for i := 0; i < 4; i++ {
+		gen.gen(&ki, i, 0)
+		payload, pos, err := store.Get(&ki, false)
+		if err != nil || payload == nil || string(payload.Body) != value(i) {
+			t.Fatalf("%d: %v", i, err)
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+		payload.CArray.Free()
+
+		wrec, err := readRecordAtPath(bkt.datas.chunks[pos.ChunkID].path, pos.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := ""
+		if i%2 == 0 {
+			codec = "zstd"
+		}
+		if name := wrec.rec.Payload.CodecName(); name != codec {
+			t.Fatalf("%d: codec %q", i, name)
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(wrec.rec.Payload.CArray.Cap)
+		wrec.rec.Payload.Free()
+	}
+}
+
+func TestClientCodecFlag(t *testing.T) {
+	testGC(t, testClientCodecFlag, "clientflag", 10)
+}
+
+// testClientCodecFlag sets a compressible value with a client flag in bits
+// 17-19, which are used by no codec, and recompresses it by a gc.
+func testClientCodecFlag(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	defer func() {
+		Conf.Codec = "quicklz"
+		Conf.GCRecompress = false
+	}()
+	gen := newKVGen(16)
+	var ki KeyInfo
+	body := strings.Repeat("compressible ", 100)
+	flag := uint32(0x00060000)
+	Conf.Codec = "zstd"
+	payload := gen.gen(&ki, 0, 0)
+	payload.Body = []byte(body)
+	payload.Flag = flag
+	cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+	if err := store.Set(&ki, payload); err != nil {
+		t.Fatal(err)
+	}
+	bkt := store.buckets[bucketID]
+	check := func(codec string) {
+		payload, pos, err := store.Get(&ki, false)
+		if err != nil || payload == nil || payload.Flag != flag || string(payload.Body) != body {
+			t.Fatalf("%v %#v", err, payload)
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+		payload.CArray.Free()
+		bkt.datas.flush(pos.ChunkID, true)
+		wrec, err := readRecordAtPath(bkt.datas.chunks[pos.ChunkID].path, pos.Offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p := wrec.rec.Payload; p.Flag != flag|FLAG_COMPRESS || p.CodecName() != codec {
+			t.Fatalf("flag %x, codec %q", p.Flag, p.CodecName())
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(wrec.rec.Payload.CArray.Cap)
+		wrec.rec.Payload.Free()
+	}
+	check("zstd")
+	bkt.datas.flush(0, true)
+	Conf.Codec = "lz4"
+	Conf.GCRecompress = true
+	store.gcMgr.gc(bkt, 0, 0, false)
+	if gc := bkt.GCHistory[len(bkt.GCHistory)-1]; gc.Err != nil || gc.NumRecompressed != 1 {
+		t.Fatalf("%#v", gc)
+	}
+	check("lz4")
+}
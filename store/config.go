@@ -3,6 +3,7 @@ package store
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
 
 	"github.com/douban/gobeansdb/config"
 	"github.com/douban/gobeansdb/utils"
@@ -25,6 +26,8 @@ type HStoreConfig struct {
 	DataConfig  `yaml:"data,omitempty"`
 	HintConfig  `yaml:"hint,omitempty"`
 	HTreeConfig `yaml:"htree,omitempty"`
+	GCConfig    `yaml:"gc,omitempty"`
+	ScrubConfig `yaml:"scrub,omitempty"`
 }
 
 type HtreeDerivedConfig struct {
@@ -44,11 +47,27 @@ type DataConfig struct {
 	FlushInterval int   `yaml:"flush_interval,omitempty"` // the flush go routine run at this interval
 	NoGCDays      int   `yaml:"no_gc_days,omitempty"`     // not data files whose mtime in recent NoGCDays days
 
-	FlushWakeStr   string          `yaml:"flush_wake_str"` //
-	DataFileMaxStr string          `yaml:"datafile_max_str,omitempty"`
-	BufIOCap       int             `yaml:"-"` // for bufio reader/writer, if value is big, then enlarge this cap, defalult: 1MB
-	BufIOCapStr    string          `yaml:"bufio_cap_str,omitempty"`
-	NotCompress    map[string]bool `yaml:"not_compress,omitempty"` // kind do not compress
+	FlushWakeStr   string            `yaml:"flush_wake_str"` //
+	DataFileMaxStr string            `yaml:"datafile_max_str,omitempty"`
+	BufIOCap       int               `yaml:"-"` // for bufio reader/writer, if value is big, then enlarge this cap, defalult: 1MB
+	BufIOCapStr    string            `yaml:"bufio_cap_str,omitempty"`
+	NotCompress    map[string]bool   `yaml:"not_compress,omitempty"` // kind do not compress
+	Codec          string            `yaml:"codec,omitempty"`        // codec of kinds not in NotCompress or Codecs, quicklz, zstd, zstd-dict, lz4 or snappy
+	Codecs         map[string]string `yaml:"codecs,omitempty"`       // codec by kind, e.g. "text/*": zstd
+
+	DictSize    int64  `yaml:"-"` // max size of a zstd dictionary trained for zstd-dict
+	DictSizeStr string `yaml:"dict_size_str,omitempty"`
+	DictSamples int    `yaml:"dict_samples,omitempty"` // max num of values sampled from a bucket to train a dictionary
+
+	RecordVersion int `yaml:"record_version,omitempty"` // header of records written, 2 with ms timestamps, 1 readable by old releases, gc converts old ones
+
+	Padding       int            `yaml:"padding,omitempty"`        // records written are padded to 256 bytes, or 16 which old releases can not read, gc converts old ones
+	BucketPadding map[string]int `yaml:"bucket_padding,omitempty"` // padding of buckets in hex, e.g. "0a": 16
+
+	Encrypt bool   `yaml:"encrypt,omitempty"`  // encrypt records and keys in hints written, gc encrypts old ones by the current key
+	KeyFile string `yaml:"key_file,omitempty"` // keys to encrypt and decrypt, or set by SetKeyProvider
+
+	Durability string `yaml:"durability,omitempty"` // when sets are acked, buffered, flush-before-ack or fsync-before-ack, may be set by requests
 }
 
 type HTreeConfig struct {
@@ -66,6 +85,34 @@ type HintConfig struct {
 
 	SplitCapStr          string `yaml:"hint_split_cap_str,omitempty"`
 	IndexIntervalSizeStr string `yaml:"hint_index_interval_str,omitempty"`
+
+	VersionIndex         bool            `yaml:"hint_version_index,omitempty"`              // index versions of keys in memory, built from hints on first use
+	BucketVersionIndex   map[string]bool `yaml:"hint_bucket_version_index,omitempty"`       // by bucket in hex, e.g. "0a": true
+	VersionIndexMaxItems int             `yaml:"hint_version_index_max_items,omitempty"`    // of a bucket, keys are evicted if more, and then looked up in hints too
+	VersionIndexMaxVers  int             `yaml:"hint_version_index_max_versions,omitempty"` // of a key, the oldest are evicted if more
+
+}
+
+type GCConfig struct {
+	GCSchedInterval int        `yaml:"gc_sched_interval,omitempty"` // seconds between two checks of the gc scheduler, 0 to disable it
+	GCSchedPaused   bool       `yaml:"gc_sched_paused,omitempty"`   // start with the scheduler paused
+	GCMaxPerDisk    int        `yaml:"gc_max_per_disk,omitempty"`   // max running gc on a physical device, manual or scheduled, 0 for no limit
+	GCMaxSetRate    float64    `yaml:"gc_max_set_rate,omitempty"`   // the scheduler skips buckets with more sets per second, 0 for no limit
+	GCPolicies      []GCPolicy `yaml:"gc_policies,omitempty"`       // tried in order, the first one matched starts the gc
+
+	GCMaxMBps          float64 `yaml:"gc_max_mbps,omitempty"`           // bytes read and written by all gc, 0 for no limit
+	GCMaxRecsPerSec    float64 `yaml:"gc_max_recs_per_sec,omitempty"`   // records read by all gc, 0 for no limit
+	GCBackoffLatencyMS int     `yaml:"gc_backoff_latency_ms,omitempty"` // gc backs off while recent gets are slower, 0 to disable
+	GCBackoffWaiting   int     `yaml:"gc_backoff_waiting,omitempty"`    // or while more requests wait for a token, 0 to disable
+
+	GCNoResume   bool `yaml:"gc_no_resume,omitempty"`  // only clean up a gc interrupted by a restart, do not resume it
+	GCRecompress bool `yaml:"gc_recompress,omitempty"` // recompress records kept by gc if the codec of their kind changed
+}
+
+type ScrubConfig struct {
+	ScrubInterval   int     `yaml:"scrub_interval,omitempty"`   // seconds from the end of a scrub round on a bucket to the next, 0 to disable the scrubber
+	ScrubMaxMBps    float64 `yaml:"scrub_max_mbps,omitempty"`   // bytes read by the scrubber, 0 for no limit
+	ScrubQuarantine bool    `yaml:"scrub_quarantine,omitempty"` // gets fail for keys whose newest record is found broken, until set again
 }
 
 // for test
@@ -95,6 +142,60 @@ func (c *HStoreConfig) InitTree() error {
 	return nil
 }
 
+// checkPadding checks Padding and BucketPadding.
+func (c *HStoreConfig) checkPadding() error {
+	if c.Padding != PADDING && c.Padding != FINE_PADDING {
+		return fmt.Errorf("bad padding %d", c.Padding)
+	}
+	for s, padding := range c.BucketPadding {
+		id, err := strconv.ParseInt(s, 16, 32)
+		if err != nil || id < 0 || int(id) >= c.NumBucket {
+			return fmt.Errorf("bad bucket %q of padding", s)
+		} else if padding != PADDING && padding != FINE_PADDING {
+			return fmt.Errorf("bad padding %d of bucket %s", padding, s)
+		}
+	}
+	return nil
+}
+
+// checkVersionIndex checks BucketVersionIndex and the limits of the index.
+func (c *HStoreConfig) checkVersionIndex() error {
+	for s := range c.BucketVersionIndex {
+		id, err := strconv.ParseInt(s, 16, 32)
+		if err != nil || id < 0 || int(id) >= c.NumBucket {
+			return fmt.Errorf("bad bucket %q of version index", s)
+		}
+	}
+	if c.VersionIndexMaxItems <= 0 || c.VersionIndexMaxVers <= 0 {
+		return fmt.Errorf("bad limits of version index, %d items, %d versions",
+			c.VersionIndexMaxItems, c.VersionIndexMaxVers)
+	}
+	return nil
+}
+
+// versionIndex returns true if versions of keys in a bucket are indexed.
+func (c *HStoreConfig) versionIndex(bucketID int) bool {
+	on := c.VersionIndex
+	for s, b := range c.BucketVersionIndex {
+		if id, err := strconv.ParseInt(s, 16, 32); err == nil && int(id) == bucketID {
+			on = b
+		}
+	}
+	return on
+}
+
+// finePadding returns true if records written to a bucket are padded to
+// FINE_PADDING bytes.
+func (c *HStoreConfig) finePadding(bucketID int) bool {
+	padding := c.Padding
+	for s, p := range c.BucketPadding {
+		if id, err := strconv.ParseInt(s, 16, 32); err == nil && int(id) == bucketID {
+			padding = p
+		}
+	}
+	return padding == FINE_PADDING
+}
+
 func GetBucketDir(numBucket, bucketID int) string {
 	if numBucket == 1 {
 		return ""
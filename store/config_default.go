@@ -28,6 +28,8 @@ var (
 		SplitCapStr:          "1M",
 		IndexIntervalSizeStr: "4K",
 		MergeInterval:        1,
+		VersionIndexMaxItems: 1 << 20,
+		VersionIndexMaxVers:  16,
 	}
 
 	DefaultHTreeConfig HTreeConfig = HTreeConfig{
@@ -41,12 +43,26 @@ var (
 		FlushInterval:  0,
 		FlushWakeStr:   "0",
 		BufIOCapStr:    "1M",
+		RecordVersion:  RECORD_VERSION_1,
+		Padding:        PADDING,
+		Durability:     "buffered",
 
 		NoGCDays: 0,
+		Codec:    "quicklz",
 		NotCompress: map[string]bool{
 			"audio/wave": true,
 			"audio/mpeg": true,
 		},
+		DictSizeStr: "64K",
+		DictSamples: 4096,
+	}
+
+	DefaultGCConfig = GCConfig{
+		GCMaxPerDisk: 1,
+	}
+
+	DefaultScrubConfig = ScrubConfig{
+		ScrubMaxMBps: 10,
 	}
 
 	DefaultDBLocalConfig = DBLocalConfig{
@@ -58,6 +74,8 @@ func (c *HStoreConfig) InitDefault() {
 	c.HintConfig = DefaultHintConfig
 	c.HTreeConfig = DefaultHTreeConfig
 	c.DataConfig = DefaultDataConfig
+	c.GCConfig = DefaultGCConfig
+	c.ScrubConfig = DefaultScrubConfig
 	c.DBLocalConfig = DefaultDBLocalConfig
 	c.DBRouteConfig = config.DefaultRouteConfig
 }
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// If Conf.Encrypt, the key and the value of a record are sealed together by
+// AES-GCM, with its header as additional data, and the id of the key in the
+// header. So keys can be rotated: new records use the current key, and gc
+// re-encrypts old ones. Keys in hint files are sealed the same way. The crc of
+// a record is of what is on disk, which is checked without keys.
+
+const (
+	sealNonceSize = 12
+	sealOverhead  = sealNonceSize + 16 // nonce and tag
+)
+
+// KeyProvider gives the keys to encrypt records, e.g. from a KMS. Ids are kept
+// in records, so a key must never change once its id is used.
+type KeyProvider interface {
+	// CurrentKeyID returns the id of the key to encrypt new records, not 0.
+	CurrentKeyID() (uint32, error)
+	// Key returns a key of 16, 24 or 32 bytes for AES-128, 192 or 256.
+	Key(id uint32) ([]byte, error)
+}
+
+var keys = struct {
+	sync.RWMutex
+	provider KeyProvider
+	aeads    map[uint32]cipher.AEAD
+}{aeads: make(map[uint32]cipher.AEAD)}
+
+// SetKeyProvider sets where keys come from if Conf.KeyFile is not set, it
+// must be called before NewHStore.
+func SetKeyProvider(p KeyProvider) {
+	keys.Lock()
+	keys.provider = p
+	keys.aeads = make(map[uint32]cipher.AEAD)
+	keys.Unlock()
+}
+
+// initKeys loads Conf.KeyFile, and checks the current key if Conf.Encrypt.
+func initKeys() error {
+	if Conf.KeyFile != "" {
+		p, err := LoadKeyFile(Conf.KeyFile)
+		if err != nil {
+			return err
+		}
+		SetKeyProvider(p)
+	}
+	if !Conf.Encrypt {
+		return nil
+	}
+	id, err := currentKeyID()
+	if err != nil {
+		return err
+	}
+	_, err = getAEAD(id)
+	return err
+}
+
+// currentKeyID returns the key for new records, 0 if not Conf.Encrypt.
+func currentKeyID() (uint32, error) {
+	if !Conf.Encrypt {
+		return 0, nil
+	}
+	keys.RLock()
+	p := keys.provider
+	keys.RUnlock()
+	if p == nil {
+		return 0, fmt.Errorf("encrypt without keys")
+	}
+	id, err := p.CurrentKeyID()
+	if err == nil && id == 0 {
+		err = fmt.Errorf("bad current key id 0")
+	}
+	return id, err
+}
+
+func getAEAD(id uint32) (aead cipher.AEAD, err error) {
+	keys.RLock()
+	aead = keys.aeads[id]
+	p := keys.provider
+	keys.RUnlock()
+	if aead != nil {
+		return
+	}
+	if p == nil {
+		return nil, fmt.Errorf("no key %d, keys not configured", id)
+	}
+	key, err := p.Key(id)
+	if err != nil {
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad key %d: %s", id, err.Error())
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return
+	}
+	keys.Lock()
+	keys.aeads[id] = aead
+	keys.Unlock()
+	return
+}
+
+// decryptError is returned if a record is not broken but can not be
+// decrypted, e.g. the key is missing, gc stops instead of dropping it.
+type decryptError struct {
+	id  uint32
+	err error
+}
+
+func (e *decryptError) Error() string {
+	return fmt.Sprintf("fail to decrypt by key %d: %s", e.id, e.err.Error())
+}
+
+// seal encrypts the parts as a whole, and returns the nonce, the cipher text
+// and the tag.
+func seal(id uint32, aad []byte, parts ...[]byte) ([]byte, error) {
+	aead, err := getAEAD(id)
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	buf := make([]byte, sealNonceSize, sealOverhead+size)
+	if _, err = rand.Read(buf); err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+	aead.Seal(buf[sealNonceSize:sealNonceSize], buf[:sealNonceSize], buf[sealNonceSize:], aad)
+	return buf[:cap(buf)], nil
+}
+
+// open decrypts what seal returns in place, and returns the plain text.
+func open(id uint32, aad, sealed []byte) ([]byte, error) {
+	aead, err := getAEAD(id)
+	if err != nil {
+		return nil, &decryptError{id, err}
+	}
+	if len(sealed) < sealOverhead {
+		return nil, &decryptError{id, fmt.Errorf("too short, size %d", len(sealed))}
+	}
+	plain, err := aead.Open(sealed[sealNonceSize:sealNonceSize], sealed[:sealNonceSize], sealed[sealNonceSize:], aad)
+	if err != nil {
+		return nil, &decryptError{id, err}
+	}
+	return plain, nil
+}
+
+// keyFile has a key in each line as "<id> <key in hex>", ids are not 0, the
+// last one is the current, so keys are rotated by appending a line.
+type keyFile struct {
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// LoadKeyFile loads keys from a local file, which should be readable only by
+// the server. Lines starting with # are ignored.
+func LoadKeyFile(path string) (KeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err == nil && st.Mode().Perm()&0077 != 0 {
+		logger.Warnf("key file %s is accessible by others, mode %s", path, st.Mode())
+	}
+	kf := &keyFile{keys: make(map[uint32][]byte)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad key file %s, line %d", path, n)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("bad key id in %s, line %d", path, n)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad key in %s, line %d", path, n)
+		} else if _, err = aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("bad key in %s, line %d: %s", path, n, err.Error())
+		} else if _, ok := kf.keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("dup key id %d in %s", id, path)
+		}
+		kf.keys[uint32(id)] = key
+		kf.current = uint32(id)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	} else if kf.current == 0 {
+		return nil, fmt.Errorf("no key in %s", path)
+	}
+	return kf, nil
+}
+
+func (kf *keyFile) CurrentKeyID() (uint32, error) {
+	return kf.current, nil
+}
+
+func (kf *keyFile) Key(id uint32) ([]byte, error) {
+	key, ok := kf.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("no key %d", id)
+	}
+	return key, nil
+}
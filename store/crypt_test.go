@@ -0,0 +1,247 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// setTestKeys makes key i 32 bytes of i, the last one is the current.
+func setTestKeys(ids ...uint32) {
+	kf := &keyFile{keys: make(map[uint32][]byte)}
+	for _, id := range ids {
+		kf.keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+		kf.current = id
+	}
+	SetKeyProvider(kf)
+}
+
+func clearTestKeys() {
+	Conf.Encrypt = false
+	SetKeyProvider(nil)
+}
+
+func TestKeyFile(t *testing.T) {
+	setupTest("TestKeyFile")
+	defer clearTest()
+	path := dir + "/keys"
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key1 := strings.Repeat("01", 16)
+	key2 := strings.Repeat("02", 32)
+	write(fmt.Sprintf("# rotated on 2020-01-01\n1 %s\n\n2 %s\n", key1, key2))
+	p, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := p.CurrentKeyID(); id != 2 {
+		t.Fatalf("current %d", id)
+	}
+	if key, err := p.Key(1); err != nil || len(key) != 16 || key[0] != 1 {
+		t.Fatalf("%v %x", err, key)
+	}
+	if _, err := p.Key(3); err == nil {
+		t.Fatal("got missing key 3")
+	}
+
+	for _, bad := range []string{
+		"",
+		"0 " + key1,
+		"1 " + key1 + "\n1 " + key2,
+		"1 xyz",
+		"1 0102",
+		"1",
+	} {
+		write(bad)
+		if _, err := LoadKeyFile(path); err == nil {
+			t.Fatalf("loaded %q", bad)
+		}
+	}
+}
+
+func TestEncryptRecords(t *testing.T) {
+	setupTest("TestEncryptRecords")
+	defer clearTest()
+	Conf.Init()
+	defer clearTestKeys()
+	setTestKeys(1)
+
+	ds := NewdataStore(0, Conf.Home)
+	keys := []string{"hidden_0", "plain_1", "hidden_2"}
+	var positions []Position
+	for i, key := range keys {
+		Conf.Encrypt = i != 1
+		p := &Payload{}
+		p.TS = uint32(i + 1)
+		p.Ver = int32(i + 1)
+		p.Flag = FLAG_CLIENT_COMPRESS
+		p.Body = []byte(key + " value")
+		pos, err := ds.AppendRecord(&Record{[]byte(key), p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, pos)
+	}
+	ds.flush(-1, true)
+	data, err := ioutil.ReadFile(ds.genPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hidden")) || !bytes.Contains(data, []byte("plain_1 value")) {
+		t.Fatalf("%q", data)
+	}
+
+	check := func(i int, rec *Record) {
+		p := rec.Payload
+		keyID := uint32(1)
+		if i == 1 {
+			keyID = 0
+		}
+		if string(rec.Key) != keys[i] || string(p.Body) != keys[i]+" value" || p.KeyID != keyID {
+			t.Fatalf("%d: %s", i, rec.LogString())
+		}
+	}
+	for i, pos := range positions {
+		rec, _, err := ds.GetRecordByPos(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(i, rec)
+		cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+		rec.Payload.Free()
+	}
+	reader, err := ds.GetStreamReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, pos := range positions {
+		rec, offset, sizeBroken, err := reader.Next()
+		if err != nil || rec == nil || offset != pos.Offset || sizeBroken != 0 {
+			t.Fatalf("%d: %v %d %d %v", i, rec, offset, sizeBroken, err)
+		}
+		check(i, rec)
+	}
+	reader.Close()
+
+	// records by a lost key are not taken as broken
+	setTestKeys(2)
+	if _, _, err := ds.GetRecordByPos(positions[0]); err == nil {
+		t.Fatal("read without the key")
+	}
+	reader, err = ds.GetStreamReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if rec, _, _, err := reader.Next(); rec != nil || err == nil {
+		t.Fatalf("%v %v", rec, err)
+	}
+}
+
+func TestHintEncrypt(t *testing.T) {
+	setupTest("TestHintEncrypt")
+	defer clearTest()
+	defer clearTestKeys()
+	Conf.IndexIntervalSize = 1024
+	Conf.Encrypt = true
+	setTestKeys(1)
+
+	path := fmt.Sprintf("%s/%s", dir, "000.hint.s")
+	w, err := newHintFileWriter(path, 0, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := genSortedHintItems(100)
+	for _, it := range items {
+		if err = w.writeItem(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil || bytes.Contains(data, []byte("key_")) {
+		t.Fatalf("%v %q", err, data)
+	}
+
+	// readable after the key is rotated
+	setTestKeys(1, 2)
+	readHintAndCheck(t, path, items)
+	index, err := loadHintIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.index) < 2 {
+		t.Fatalf("%v", index.index)
+	}
+	checkIndex(t, items, index)
+}
+
+func TestGCReencrypt(t *testing.T) {
+	testGC(t, testGCReencrypt, "reencrypt", 100)
+}
+
+// testGCReencrypt writes records by key 1, and gc rewrites them by key 2 after
+// the key is rotated, or in plain text after encryption is turned off.
+func testGCReencrypt(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	defer clearTestKeys()
+	Conf.Encrypt = true
+	setTestKeys(1)
+	gen := newKVGen(16)
+	var ki KeyInfo
+	n := 10
+	for i := 0; i < n; i++ {
+		payload := gen.gen(&ki, i, 0)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bkt := store.buckets[bucketID]
+	bkt.datas.flush(0, true)
+
+	check := func(keyID uint32) {
+		for i := 0; i < n; i++ {
+			payload := gen.gen(&ki, i, 0)
+			value := string(payload.Body)
+			payload, pos, err := store.Get(&ki, false)
+			if err != nil || payload == nil || string(payload.Body) != value {
+				t.Fatalf("%d: %v %v", i, payload, err)
+			}
+			cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+			payload.CArray.Free()
+
+			wrec, err := readRecordAtPath(bkt.datas.chunks[pos.ChunkID].path, pos.Offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wrec.rec.Payload.KeyID != keyID {
+				t.Fatalf("%d: key %d", i, wrec.rec.Payload.KeyID)
+			}
+			cmem.DBRL.GetData.SubSizeAndCount(wrec.rec.Payload.CArray.Cap)
+			wrec.rec.Payload.Free()
+		}
+	}
+	check(1)
+
+	gc := func() {
+		store.gcMgr.gc(bkt, 0, 0, false)
+		gc := bkt.GCHistory[len(bkt.GCHistory)-1]
+		if gc.Err != nil || gc.NumConverted != int64(n) {
+			t.Fatalf("%#v", gc)
+		}
+	}
+	setTestKeys(1, 2)
+	gc()
+	check(2)
+
+	Conf.Encrypt = false
+	gc()
+	check(0)
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/trace"
 )
 
 const (
@@ -19,9 +20,13 @@ const (
 type dataStore struct {
 	bucketID int
 	home     string
+	dicts    *dictStore // nil if not opened by a bucket
+
+	finePadding bool // of new records
 
 	sync.Mutex
-	flushLock sync.Mutex
+	flushLock  sync.Mutex
+	commitLock sync.Mutex // for writers waiting for durability
 
 	oldHead int // old tail == 0
 	newHead int
@@ -36,6 +41,7 @@ func NewdataStore(bucketID int, home string) *dataStore {
 	ds := new(dataStore)
 	ds.bucketID = bucketID
 	ds.home = home
+	ds.finePadding = Conf.finePadding(bucketID)
 	for i := 0; i < MAX_NUM_CHUNK; i++ {
 		ds.chunks[i].chunkid = i
 		ds.chunks[i].path = genDataPath(ds.home, i)
@@ -63,11 +69,18 @@ func (ds *dataStore) nextChunkID(chunkID int) int {
 }
 
 func (ds *dataStore) AppendRecord(rec *Record) (pos Position, err error) {
+	keyID, err := currentKeyID()
+	if err != nil {
+		return
+	}
 	// must  CalcValueHash before compress
 	oldCap := rec.Payload.CArray.Cap
-	rec.TryCompress()
+	rec.compress(ds.dicts.current())
 	cmem.DBRL.SetData.AddSize(rec.Payload.CArray.Cap - oldCap)
 
+	rec.Payload.setHeaderVersion(Conf.RecordVersion)
+	rec.Payload.FinePadding = ds.finePadding
+	rec.Payload.KeyID = keyID
 	wrec := wrapRecord(rec)
 	ds.Lock()
 	size := rec.Payload.RecSize
@@ -126,12 +139,19 @@ func (ds *dataStore) flush(chunk int, force bool) error {
 		return err
 	}
 
-	filessize := ds.chunks[chunk].getDiskFileSize()
+	filessize := ds.chunks[chunk].flushedSize()
 	if w.offset != filessize {
 		logger.Fatalf("wrong data file size, exp %d, got %d, %s, dataChunk %#v",
 			filessize, w.offset, ds.genPath(chunk), &ds.chunks[chunk])
 	}
+	st := time.Now()
+	span := trace.StartRoot("store.flush", st, trace.SpanContext{})
+	span.SetAttr("bucket", ds.bucketID)
+	span.SetAttr("chunk", chunk)
 	nflushed, err := ds.chunks[chunk].flush(w, false)
+	span.SetAttr("bytes", nflushed)
+	span.End()
+	flushLatency.Observe(time.Since(st))
 	ds.Lock()
 	ds.wbufSize -= nflushed
 	ds.Unlock()
@@ -144,6 +164,13 @@ func (ds *dataStore) GetRecordByPos(pos Position) (res *Record, inbuffer bool, e
 	return ds.chunks[pos.ChunkID].GetRecordByOffset(pos.Offset)
 }
 
+func (ds *dataStore) getRecordByPosWithStat(pos Position, stat *GetStat) (res *Record, inbuffer bool, err error) {
+	if stat != nil {
+		stat.Pos = pos
+	}
+	return ds.chunks[pos.ChunkID].getRecordByOffset(pos.Offset, stat)
+}
+
 func (ds *dataStore) ListFiles() (max int, err error) {
 	max = -1
 	for i := 0; i < MAX_NUM_CHUNK; i++ {
@@ -160,8 +187,8 @@ func (ds *dataStore) ListFiles() (max int, err error) {
 			}
 		} else {
 			sz := uint32(st.Size())
-			if (sz & 0xff) != 0 {
-				err = fmt.Errorf("file not 256 aligned, size 0x%x: %s ", sz, path)
+			if sz%FINE_PADDING != 0 {
+				err = fmt.Errorf("file not %d aligned, size 0x%x: %s ", FINE_PADDING, sz, path)
 				return
 			}
 			ds.chunks[i].size = sz
@@ -194,8 +221,8 @@ func GetStreamWriter(path string, isappend bool) (*DataStreamWriter, error) {
 			if err != nil {
 				logger.Infof(err.Error())
 				return nil, err
-			} else if offset%PADDING != 0 {
-				logger.Fatalf("%s not 256 aligned : %d", path, offset)
+			} else if offset%FINE_PADDING != 0 {
+				logger.Fatalf("%s not %d aligned : %d", path, FINE_PADDING, offset)
 			}
 		}
 	} else {
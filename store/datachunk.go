@@ -5,6 +5,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/douban/gobeansdb/cmem"
 	"github.com/douban/gobeansdb/utils"
@@ -19,6 +20,7 @@ type dataChunk struct {
 
 	writingHead uint32
 	wbuf        []*WriteRecord
+	synced      uint32 // size synced for writers, see dataStore.commit
 
 	rewriting bool
 	gcbufsize uint32
@@ -148,6 +150,11 @@ func (dc *dataChunk) GetRecordByOffsetInBuffer(offset uint32) (res *Record, err
 }
 
 func (dc *dataChunk) GetRecordByOffset(offset uint32) (res *Record, inbuffer bool, err error) {
+	return dc.getRecordByOffset(offset, nil)
+}
+
+func (dc *dataChunk) getRecordByOffset(offset uint32, stat *GetStat) (res *Record, inbuffer bool, err error) {
+	st := time.Now()
 	res, err = dc.GetRecordByOffsetInBuffer(offset)
 	if err != nil {
 		inbuffer = true
@@ -155,17 +162,26 @@ func (dc *dataChunk) GetRecordByOffset(offset uint32) (res *Record, inbuffer boo
 	}
 	if res != nil {
 		inbuffer = true
-		cmem.DBRL.GetData.AddSize(res.Payload.DiffSizeAfterDecompressed())
-		res.Payload.Decompress()
-		return
+	} else {
+		wrec, e := readRecordAtPath(dc.path, offset)
+		if e != nil {
+			return nil, false, e
+		}
+		res = wrec.rec
+	}
+	dt := time.Now()
+	if stat != nil {
+		stat.InBuffer = inbuffer
+		stat.Compressed = res.Payload.IsCompressed()
+		stat.RecSize = res.Payload.RecSize
+		stat.ReadTime = dt.Sub(st)
 	}
-	wrec, e := readRecordAtPath(dc.path, offset)
-	if e != nil {
-		return nil, false, e
+	cmem.DBRL.GetData.AddSize(res.Payload.DiffSizeAfterDecompressed())
+	res.Payload.Decompress()
+	if stat != nil {
+		stat.DecompressTime = time.Since(dt)
 	}
-	cmem.DBRL.GetData.AddSize(wrec.rec.Payload.DiffSizeAfterDecompressed())
-	wrec.rec.Payload.Decompress()
-	return wrec.rec, false, nil
+	return
 }
 
 func (dc *dataChunk) Truncate(size uint32) error {
@@ -202,6 +218,7 @@ func (dc *dataChunk) endGCWriting() (err error) {
 	logger.Infof("endGCWriting chunk %d rewrite %v size %d wsize%d ", dc.chunkid, dc.rewriting, dc.size, dc.writingHead)
 	if dc.gcWriter != nil {
 		err = dc.gcWriter.wbuf.Flush()
+		dc.gcWriter.dropCache()
 		dc.gcWriter.Close()
 		dc.gcWriter = nil
 	}
@@ -10,10 +10,28 @@ import (
 
 	"github.com/douban/gobeansdb/cmem"
 	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/utils"
 )
 
+// A record header of version 1 is crc, ts, flag, ver, ksz and vsz, all
+// uint32. Version 2 puts its version in the high byte of ksz, which is 0 in
+// version 1 as keys are short, and appends the 64-bit ts. The highest bit of
+// ksz is set in headers of both versions if the record is padded to
+// FINE_PADDING bytes, and the next bit if it is encrypted, with the id of the
+// key appended to the header, see crypt.go. The id of the codec of a
+// compressed value is in the bits of ksz below the version, see codec.go.
 const (
-	recHeaderSize = 24
+	recHeaderSize    = 24
+	recHeaderSizeV2  = 32
+	recKeyIDSize     = 4
+	recHeaderSizeMax = recHeaderSizeV2 + recKeyIDSize
+	recVersionShift  = 24
+	recCodecShift    = 20
+	recCodecMask     = 0xf
+	recKeySizeMask   = 1<<recCodecShift - 1
+	recVersionMask   = 0x3f
+	recEncrypted     = 0x40 << recVersionShift
+	recFinePadding   = 0x80 << recVersionShift
 )
 
 var (
@@ -26,7 +44,8 @@ type WriteRecord struct {
 	ksz    uint32
 	vsz    uint32
 	pos    Position
-	header [recHeaderSize]byte
+	header [recHeaderSizeMax]byte
+	sealed []byte // key and value on disk if encrypted
 }
 
 func newWriteRecord() *WriteRecord {
@@ -45,27 +64,49 @@ func wrapRecord(rec *Record) *WriteRecord {
 }
 
 func (wrec *WriteRecord) String() string {
-	return fmt.Sprintf("{ts: %v,flag 0x%x, ver %d, ksz: %d, vsz: %d}",
-		time.Unix(int64(wrec.rec.Payload.TS), 0),
-		wrec.rec.Payload.Flag, wrec.rec.Payload.Ver, wrec.ksz, wrec.vsz)
+	return fmt.Sprintf("{ts: %v,flag 0x%x, ver %d, ksz: %d, vsz: %d, header v%d}",
+		wrec.rec.Payload.Time().Format(time.RFC3339Nano),
+		wrec.rec.Payload.Flag, wrec.rec.Payload.Ver, wrec.ksz, wrec.vsz, wrec.rec.Payload.HeaderVersion())
 }
 
+// decode decodes a record as dumped by Record.Dumps, the key and the value are
+// sliced from data.
 func (wrec *WriteRecord) decode(data []byte) (err error) {
-	wrec.decode(data)
-	decodeHeader(wrec, data)
-	wrec.rec.Key = data[recHeaderSize : recHeaderSize+wrec.ksz]
-	wrec.rec.Payload.Body = data[recHeaderSize+wrec.ksz : recHeaderSize+wrec.ksz+wrec.vsz]
-	if wrec.crc != wrec.getCRC() {
-		err = fmt.Errorf("crc check fail")
-		logger.Infof(err.Error())
+	if len(data) < recHeaderSize {
+		return fmt.Errorf("short record, %d bytes", len(data))
+	}
+	hsize, err := headerSize(data)
+	if err != nil {
 		return
+	} else if len(data) < hsize {
+		return fmt.Errorf("short record, %d bytes", len(data))
+	}
+	copy(wrec.header[:], data[:hsize])
+	decodeHeader(wrec, data)
+	if wrec.rec.Payload.KeyID != 0 {
+		return fmt.Errorf("record encrypted, wrec %v", wrec)
+	} else if !config.IsValidKeySize(wrec.ksz) || !config.IsValidValueSize(wrec.vsz) {
+		return fmt.Errorf("bad size, wrec %v", wrec)
+	}
+	end := hsize + int(wrec.ksz+wrec.vsz)
+	if len(data) < end {
+		return fmt.Errorf("short record, %d bytes, wrec %v", len(data), wrec)
+	}
+	wrec.rec.Key = data[hsize : hsize+int(wrec.ksz)]
+	wrec.rec.Payload.Body = data[hsize+int(wrec.ksz) : end]
+	if crc := wrec.getCRC(); wrec.crc != crc {
+		return fmt.Errorf("crc check fail, wrec %v; %d != %d", wrec, wrec.crc, crc)
 	}
 	return nil
 }
 
 func (wrec *WriteRecord) getCRC() uint32 {
 	hasher := newCrc32()
-	hasher.write(wrec.header[4:])
+	hasher.write(wrec.header[4:wrec.rec.Payload.headerSize()])
+	if wrec.sealed != nil {
+		hasher.write(wrec.sealed)
+		return hasher.get()
+	}
 	if len(wrec.rec.Key) > 0 {
 		hasher.write(wrec.rec.Key)
 	}
@@ -75,13 +116,37 @@ func (wrec *WriteRecord) getCRC() uint32 {
 	return hasher.get()
 }
 
-func (wrec *WriteRecord) encodeHeader() {
+// encodeHeader also seals the record if it has a KeyID.
+func (wrec *WriteRecord) encodeHeader() (err error) {
+	p := wrec.rec.Payload
 	h := wrec.header[:]
-	binary.LittleEndian.PutUint32(h[4:8], wrec.rec.Payload.TS)
-	binary.LittleEndian.PutUint32(h[8:12], wrec.rec.Payload.Flag)
-	binary.LittleEndian.PutUint32(h[12:16], uint32(wrec.rec.Payload.Ver))
-	binary.LittleEndian.PutUint32(h[16:20], wrec.ksz)
+	binary.LittleEndian.PutUint32(h[4:8], p.TS)
+	binary.LittleEndian.PutUint32(h[8:12], p.Flag)
+	binary.LittleEndian.PutUint32(h[12:16], uint32(p.Ver))
+	ksz := wrec.ksz
+	if p.TS64 != 0 {
+		ksz |= RECORD_VERSION_2 << recVersionShift
+		binary.LittleEndian.PutUint64(h[24:32], p.TS64)
+	}
+	if p.FinePadding {
+		ksz |= recFinePadding
+	}
+	if p.IsCompressed() {
+		ksz |= uint32(p.Codec) << recCodecShift
+	}
+	hsize := p.headerSize()
+	if p.KeyID != 0 {
+		ksz |= recEncrypted
+		binary.LittleEndian.PutUint32(h[hsize-recKeyIDSize:hsize], p.KeyID)
+	}
+	binary.LittleEndian.PutUint32(h[16:20], ksz)
 	binary.LittleEndian.PutUint32(h[20:24], wrec.vsz)
+	wrec.sealed = nil
+	if p.KeyID != 0 {
+		if wrec.sealed, err = seal(p.KeyID, h[4:hsize], wrec.rec.Key, p.Body); err != nil {
+			return
+		}
+	}
 	crc := wrec.getCRC()
 	binary.LittleEndian.PutUint32(h[:4], crc)
 	return
@@ -91,13 +156,61 @@ func (wrec *WriteRecord) decodeHeader() (err error) {
 	return decodeHeader(wrec, wrec.header[:])
 }
 
+// decodeHeader decodes a whole header, which is headerSize(h) bytes.
 func decodeHeader(wrec *WriteRecord, h []byte) (err error) {
 	wrec.crc = binary.LittleEndian.Uint32(h[:4])
 	wrec.rec.Payload.TS = binary.LittleEndian.Uint32(h[4:8])
 	wrec.rec.Payload.Flag = binary.LittleEndian.Uint32(h[8:12])
 	wrec.rec.Payload.Ver = int32(binary.LittleEndian.Uint32(h[12:16]))
-	wrec.ksz = binary.LittleEndian.Uint32(h[16:20])
+	ksz := binary.LittleEndian.Uint32(h[16:20])
+	wrec.ksz = ksz & recKeySizeMask
 	wrec.vsz = binary.LittleEndian.Uint32(h[20:24])
+	wrec.rec.Payload.TS64 = 0
+	idOffset := recHeaderSize
+	if ksz>>recVersionShift&recVersionMask == RECORD_VERSION_2 {
+		wrec.rec.Payload.TS64 = binary.LittleEndian.Uint64(h[24:32])
+		idOffset = recHeaderSizeV2
+	}
+	wrec.rec.Payload.FinePadding = ksz&recFinePadding != 0
+	wrec.rec.Payload.Codec = uint8(ksz >> recCodecShift & recCodecMask)
+	wrec.rec.Payload.KeyID = 0
+	if ksz&recEncrypted != 0 {
+		wrec.rec.Payload.KeyID = binary.LittleEndian.Uint32(h[idOffset : idOffset+recKeyIDSize])
+	}
+	return
+}
+
+// unseal decrypts the key and the value in wrec.sealed in place, the value is
+// left in the buffer.
+func (wrec *WriteRecord) unseal() error {
+	p := wrec.rec.Payload
+	plain, err := open(p.KeyID, wrec.header[4:p.headerSize()], wrec.sealed)
+	if err != nil {
+		return err
+	} else if len(plain) != int(wrec.ksz+wrec.vsz) {
+		return fmt.Errorf("bad size of decrypted, %d != %d + %d", len(plain), wrec.ksz, wrec.vsz)
+	}
+	wrec.rec.Key = make([]byte, wrec.ksz)
+	copy(wrec.rec.Key, plain[:wrec.ksz])
+	p.Body = plain[wrec.ksz:]
+	wrec.sealed = nil
+	return nil
+}
+
+// headerSize returns the size of a header by its first recHeaderSize bytes.
+func headerSize(h []byte) (size int, err error) {
+	ksz := binary.LittleEndian.Uint32(h[16:20])
+	switch ksz >> recVersionShift & recVersionMask {
+	case 0:
+		size = recHeaderSize
+	case RECORD_VERSION_2:
+		size = recHeaderSizeV2
+	default:
+		return 0, fmt.Errorf("bad header version, ksz 0x%x", ksz)
+	}
+	if ksz&recEncrypted != 0 {
+		size += recKeyIDSize
+	}
 	return
 }
 
@@ -119,12 +232,17 @@ func readRecordAt(path string, f *os.File, offset uint32) (wrec *WriteRecord, er
 			wrec = nil
 		}
 	}()
-	var n int
-	if n, err = f.ReadAt(wrec.header[:], int64(offset)); err != nil {
+	var n, hsize int
+	if n, err = f.ReadAt(wrec.header[:], int64(offset)); err != nil && (err != io.EOF || n < recHeaderSize) {
 		err = fmt.Errorf("fail to read head %s:%d, err = %s, n = %d", path, offset, err.Error(), n)
 		logger.Errorf(err.Error())
 		return
 	}
+	if hsize, err = headerSize(wrec.header[:]); err != nil || n < hsize {
+		err = fmt.Errorf("bad head %s:%d, err = %v, n = %d", path, offset, err, n)
+		logger.Errorf(err.Error())
+		return
+	}
 	wrec.decodeHeader()
 	if !config.IsValidKeySize(wrec.ksz) {
 		err = fmt.Errorf("bad key size %s:%d, wrec %v", path, offset, wrec)
@@ -136,6 +254,9 @@ func readRecordAt(path string, f *os.File, offset uint32) (wrec *WriteRecord, er
 		return
 	}
 	kvSize := int(wrec.ksz + wrec.vsz)
+	if wrec.rec.Payload.KeyID != 0 {
+		kvSize += sealOverhead
+	}
 	var kv cmem.CArray
 	if !kv.Alloc(int(kvSize)) {
 		err = fmt.Errorf("fail to alloc for read %s:%d, wrec %v ", path, offset, wrec)
@@ -146,17 +267,21 @@ func readRecordAt(path string, f *os.File, offset uint32) (wrec *WriteRecord, er
 
 	wrec.rec.Key = kv.Body[:wrec.ksz]
 
-	if n, err = f.ReadAt(kv.Body, int64(offset)+recHeaderSize); err != nil {
+	if n, err = f.ReadAt(kv.Body, int64(offset)+int64(hsize)); err != nil {
 		err = fmt.Errorf("fail to  read %s:%d, rec %v; return err = %s, n = %d",
 			path, offset, wrec, err.Error(), n)
 		logger.Errorf(err.Error())
 		cmem.DBRL.GetData.SubSizeAndCount(kv.Cap)
 		return
 	}
-	wrec.rec.Key = make([]byte, wrec.ksz)
-	copy(wrec.rec.Key, kv.Body[:wrec.ksz])
 	wrec.rec.Payload.CArray = kv
-	wrec.rec.Payload.Body = kv.Body[wrec.ksz:]
+	if wrec.rec.Payload.KeyID != 0 {
+		wrec.sealed = kv.Body
+	} else {
+		wrec.rec.Key = make([]byte, wrec.ksz)
+		copy(wrec.rec.Key, kv.Body[:wrec.ksz])
+		wrec.rec.Payload.Body = kv.Body[wrec.ksz:]
+	}
 	wrec.rec.Payload.RecSize = wrec.vsz
 	crc := wrec.getCRC()
 	if wrec.crc != crc {
@@ -166,6 +291,13 @@ func readRecordAt(path string, f *os.File, offset uint32) (wrec *WriteRecord, er
 		cmem.DBRL.GetData.SubSizeAndCount(kv.Cap)
 		return
 	}
+	if wrec.sealed != nil {
+		if err = wrec.unseal(); err != nil {
+			logger.Errorf("%s:%d: %s", path, offset, err.Error())
+			cmem.DBRL.GetData.SubSizeAndCount(kv.Cap)
+			return
+		}
+	}
 	return wrec, nil
 }
 
@@ -180,6 +312,7 @@ type DataStreamReader struct {
 	offset uint32
 
 	maxBodyBuf []byte
+	sealBuf    []byte // for encrypted records
 }
 
 func newDataStreamReader(path string, bufsz int) (*DataStreamReader, error) {
@@ -201,12 +334,23 @@ func (stream *DataStreamReader) seek(offset uint32) {
 // TODO: slow
 func (stream *DataStreamReader) nextValid() (rec *Record, offset uint32, sizeBroken uint32, err error) {
 	offset2 := stream.offset
-	offset2 = offset2 & (^uint32(0xff))
-	fd, _ := os.Open(stream.fd.Name())
+	offset2 = offset2 &^ (FINE_PADDING - 1)
+	fd, err := os.Open(stream.fd.Name())
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
 	defer fd.Close()
-	st, _ := fd.Stat()
+	st, err := fd.Stat()
+	if err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
 	for int64(offset2) < st.Size() {
 		wrec, err2 := readRecordAt(stream.path, fd, offset2)
+		if _, ok := err2.(*decryptError); ok {
+			return nil, offset2, sizeBroken, err2
+		}
 		if err2 == nil {
 			logger.Infof("crc fail end offset 0x%x, sizeBroken 0x%x", offset2, sizeBroken)
 			_, rsize := wrec.rec.Sizes()
@@ -214,10 +358,17 @@ func (stream *DataStreamReader) nextValid() (rec *Record, offset uint32, sizeBro
 			stream.fd.Seek(int64(offset3), io.SeekStart)
 			stream.rbuf.Reset(stream.fd)
 			stream.offset = offset2 + rsize
-			return wrec.rec, offset2, sizeBroken, nil
+			// return it in the body buffer as Next does, callers do not free it
+			rec := wrec.rec
+			body := append(stream.maxBodyBuf[:0], rec.Payload.Body...)
+			cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.Cap)
+			rec.Payload.Free()
+			rec.Payload.Body = body
+			rec.Payload.RecSize = rsize
+			return rec, offset2, sizeBroken, nil
 		}
-		sizeBroken += 256
-		offset2 += 256
+		sizeBroken += FINE_PADDING
+		offset2 += FINE_PADDING
 		stream.offset = offset2
 	}
 
@@ -227,7 +378,7 @@ func (stream *DataStreamReader) nextValid() (rec *Record, offset uint32, sizeBro
 
 func (stream *DataStreamReader) Next() (res *Record, offset uint32, sizeBroken uint32, err error) {
 	wrec := newWriteRecord()
-	if _, err = io.ReadFull(stream.rbuf, wrec.header[:]); err != nil {
+	if _, err = io.ReadFull(stream.rbuf, wrec.header[:recHeaderSize]); err != nil {
 		if err != io.EOF {
 			logger.Errorf("%s:0x%x %s", stream.path, stream.offset, err.Error())
 		} else {
@@ -235,6 +386,15 @@ func (stream *DataStreamReader) Next() (res *Record, offset uint32, sizeBroken u
 		}
 		return
 	}
+	hsize, err := headerSize(wrec.header[:])
+	if err != nil {
+		logger.Errorf("gc: %s %d %s", stream.fd.Name(), stream.offset, err.Error())
+		return stream.nextValid()
+	}
+	if _, err = io.ReadFull(stream.rbuf, wrec.header[recHeaderSize:hsize]); err != nil {
+		logger.Errorf(err.Error())
+		return
+	}
 	wrec.decodeHeader()
 	if !config.IsValidKeySize(wrec.ksz) {
 		logger.Errorf("gc: bad key len %s %d %d %d", stream.fd.Name(), stream.offset, wrec.ksz, wrec.vsz)
@@ -246,20 +406,27 @@ func (stream *DataStreamReader) Next() (res *Record, offset uint32, sizeBroken u
 		return stream.nextValid()
 	}
 
-	wrec.rec.Key = make([]byte, wrec.ksz)
-	if _, err = io.ReadFull(stream.rbuf, wrec.rec.Key); err != nil {
-		logger.Errorf(err.Error())
-		return
-	}
-	wrec.rec.Payload.Body = stream.maxBodyBuf[:wrec.vsz]
-	if _, err = io.ReadFull(stream.rbuf, wrec.rec.Payload.Body); err != nil {
-		logger.Errorf(err.Error())
-		return
-	}
-	recsizereal, recsize := wrec.rec.Sizes()
-	tail := recsizereal & 0xff
-	if tail != 0 {
-		stream.rbuf.Discard(int(PADDING - tail))
+	if wrec.rec.Payload.KeyID != 0 {
+		size := int(wrec.ksz+wrec.vsz) + sealOverhead
+		if cap(stream.sealBuf) < size {
+			stream.sealBuf = make([]byte, size)
+		}
+		wrec.sealed = stream.sealBuf[:size]
+		if _, err = io.ReadFull(stream.rbuf, wrec.sealed); err != nil {
+			logger.Errorf(err.Error())
+			return
+		}
+	} else {
+		wrec.rec.Key = make([]byte, wrec.ksz)
+		if _, err = io.ReadFull(stream.rbuf, wrec.rec.Key); err != nil {
+			logger.Errorf(err.Error())
+			return
+		}
+		wrec.rec.Payload.Body = stream.maxBodyBuf[:wrec.vsz]
+		if _, err = io.ReadFull(stream.rbuf, wrec.rec.Payload.Body); err != nil {
+			logger.Errorf(err.Error())
+			return
+		}
 	}
 
 	crc := wrec.getCRC()
@@ -269,6 +436,16 @@ func (stream *DataStreamReader) Next() (res *Record, offset uint32, sizeBroken u
 		sizeBroken += 1
 		return stream.nextValid()
 	}
+	if wrec.sealed != nil {
+		if err = wrec.unseal(); err != nil {
+			logger.Errorf("%s:0x%x %s", stream.path, stream.offset, err.Error())
+			return
+		}
+	}
+	recsizereal, recsize := wrec.rec.Sizes()
+	if recsize > recsizereal {
+		stream.rbuf.Discard(int(recsize - recsizereal))
+	}
 	res = wrec.rec
 	offset = stream.offset
 	stream.offset += recsize
@@ -284,6 +461,12 @@ func (stream *DataStreamReader) Close() error {
 	return stream.fd.Close()
 }
 
+// dropCache tells the kernel that pages already read are not needed, so that
+// a gc reading through the chunk does not evict hot data.
+func (stream *DataStreamReader) dropCache() {
+	utils.Fadvise(stream.fd, 0, int64(stream.offset), utils.FADV_DONTNEED)
+}
+
 type DataStreamWriter struct {
 	path string
 	fd   *os.File
@@ -305,19 +488,31 @@ func (stream *DataStreamWriter) append(wrec *WriteRecord) (offset uint32, err er
 }
 
 func (wrec *WriteRecord) append(wbuf io.Writer, dopadding bool) error {
-	wrec.encodeHeader()
-	size, sizeall := wrec.rec.Sizes()
-	if n, err := wbuf.Write(wrec.header[:]); err != nil {
-		logger.Errorf("%v %d", err, n)
+	if err := wrec.encodeHeader(); err != nil {
+		logger.Errorf("fail to encrypt: %v", err)
 		return err
 	}
-	if n, err := wbuf.Write(wrec.rec.Key); err != nil {
+	size, sizeall := wrec.rec.Sizes()
+	if n, err := wbuf.Write(wrec.header[:wrec.rec.Payload.headerSize()]); err != nil {
 		logger.Errorf("%v %d", err, n)
 		return err
 	}
-	if n, err := wbuf.Write(wrec.rec.Payload.Body); err != nil {
-		logger.Errorf("%v %d", err, n)
-		return err
+	if wrec.sealed != nil {
+		n, err := wbuf.Write(wrec.sealed)
+		wrec.sealed = nil
+		if err != nil {
+			logger.Errorf("%v %d", err, n)
+			return err
+		}
+	} else {
+		if n, err := wbuf.Write(wrec.rec.Key); err != nil {
+			logger.Errorf("%v %d", err, n)
+			return err
+		}
+		if n, err := wbuf.Write(wrec.rec.Payload.Body); err != nil {
+			logger.Errorf("%v %d", err, n)
+			return err
+		}
 	}
 	npad := sizeall - size
 	if dopadding && npad != 0 {
@@ -333,6 +528,14 @@ func (stream *DataStreamWriter) Offset() uint32 {
 	return stream.offset
 }
 
+// dropCache flushes the buffer and drops written pages from page cache,
+// dirty pages are kept by the kernel until written back.
+func (stream *DataStreamWriter) dropCache() {
+	if stream.wbuf.Flush() == nil {
+		utils.Fadvise(stream.fd, 0, 0, utils.FADV_DONTNEED)
+	}
+}
+
 func (stream *DataStreamWriter) Close() error {
 	if err := stream.wbuf.Flush(); err != nil {
 		st, _ := stream.fd.Stat()
@@ -0,0 +1,373 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// Values of kinds using codec zstd-dict are compressed by zstd with a
+// dictionary trained from values sampled in their bucket, which does much
+// better than other codecs for small values of similar content, e.g. json.
+// Dictionaries are saved as zstd.<version>.dict in the bucket dir and never
+// changed, new records use the one of the largest version. A zstd frame keeps
+// the id of its dictionary, made of the bucket id and the version, so old
+// dictionaries are kept to read the values until gc re-encodes them. A bucket
+// without dictionaries compresses such values by plain zstd.
+
+const (
+	MAX_DICT_VERSION = 0xffff
+
+	MIN_DICT_SAMPLES = 16
+)
+
+var ErrNoDictSamples = errors.New("not enough values to train a dictionary")
+
+func dictID(bucketID, version int) uint32 {
+	return uint32(bucketID+1)<<16 | uint32(version)
+}
+
+func dictPath(home string, version int) string {
+	return fmt.Sprintf("%s/zstd.%03d.dict", home, version)
+}
+
+type zstdDict struct {
+	id      uint32
+	version int
+	size    int
+	created time.Time
+
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+
+	// since loaded
+	numEncoded  int64
+	sizeRaw     int64
+	sizeEncoded int64
+}
+
+// DictInfo reports a dictionary of a bucket and how well it compresses.
+type DictInfo struct {
+	Version     int
+	ID          uint32
+	Size        int
+	Created     time.Time
+	Current     bool  // used for new records
+	NumEncoded  int64 // values compressed by it since the server started
+	SizeRaw     int64
+	SizeEncoded int64
+	Ratio       float64 // SizeEncoded / SizeRaw
+
+	NumSamples  int     `json:",omitempty"` // only when trained
+	SampleRatio float64 `json:",omitempty"`
+}
+
+func newZstdDict(version int, content []byte, created time.Time) (d *zstdDict, err error) {
+	info, err := zstd.InspectDictionary(content)
+	if err != nil {
+		return
+	}
+	d = &zstdDict{id: info.ID(), version: version, size: len(content), created: created}
+	if d.enc, err = zstd.NewWriter(nil, zstd.WithEncoderDict(content), zstd.WithEncoderConcurrency(1),
+		zstd.WithSingleSegment(true), zstd.WithEncoderCRC(false)); err != nil {
+		return nil, err
+	}
+	if d.dec, err = zstd.NewReader(nil, zstd.WithDecoderDicts(content), zstd.WithDecoderConcurrency(0)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (d *zstdDict) Name() string {
+	return "zstd-dict"
+}
+
+func (d *zstdDict) Compress(src []byte) (cmem.CArray, bool) {
+	res := d.enc.EncodeAll(src, nil)
+	atomic.AddInt64(&d.numEncoded, 1)
+	atomic.AddInt64(&d.sizeRaw, int64(len(src)))
+	atomic.AddInt64(&d.sizeEncoded, int64(len(res)))
+	return copyToCArray(res)
+}
+
+func (d *zstdDict) DecompressedSize(src []byte) (int, error) {
+	return zstdContentSize(src)
+}
+
+func (d *zstdDict) Decompress(src []byte) (cmem.CArray, error) {
+	return zstdDecompress(d.dec, src)
+}
+
+func (d *zstdDict) info() DictInfo {
+	info := DictInfo{
+		Version:     d.version,
+		ID:          d.id,
+		Size:        d.size,
+		Created:     d.created,
+		NumEncoded:  atomic.LoadInt64(&d.numEncoded),
+		SizeRaw:     atomic.LoadInt64(&d.sizeRaw),
+		SizeEncoded: atomic.LoadInt64(&d.sizeEncoded),
+	}
+	if info.SizeRaw > 0 {
+		info.Ratio = float64(info.SizeEncoded) / float64(info.SizeRaw)
+	}
+	return info
+}
+
+// dictionaries of all buckets by id, to decompress values
+var zstdDicts = struct {
+	sync.RWMutex
+	m map[uint32]*zstdDict
+}{m: make(map[uint32]*zstdDict)}
+
+func findDict(id uint32) *zstdDict {
+	zstdDicts.RLock()
+	defer zstdDicts.RUnlock()
+	return zstdDicts.m[id]
+}
+
+func registerDict(d *zstdDict) {
+	zstdDicts.Lock()
+	zstdDicts.m[d.id] = d
+	zstdDicts.Unlock()
+}
+
+// zstdDictCodec decompresses a value by the dictionary named in its frame,
+// values are compressed by a zstdDict of the bucket.
+type zstdDictCodec struct{}
+
+func (zstdDictCodec) Name() string {
+	return "zstd-dict"
+}
+
+func (zstdDictCodec) Compress(src []byte) (cmem.CArray, bool) {
+	return cmem.CArray{}, false
+}
+
+func (zstdDictCodec) DecompressedSize(src []byte) (int, error) {
+	return zstdContentSize(src)
+}
+
+func (zstdDictCodec) Decompress(src []byte) (dst cmem.CArray, err error) {
+	id, err := dictIDOf(src)
+	if err != nil {
+		return
+	}
+	d := findDict(id)
+	if d == nil {
+		err = fmt.Errorf("no zstd dictionary %d", id)
+		return
+	}
+	return d.Decompress(src)
+}
+
+func dictIDOf(src []byte) (uint32, error) {
+	var h zstd.Header
+	if err := h.Decode(src); err != nil {
+		return 0, err
+	}
+	return h.DictionaryID, nil
+}
+
+type dictStore struct {
+	sync.Mutex
+	trainLock sync.Mutex
+	bucketID  int
+	home      string
+	dicts     []*zstdDict // by version
+}
+
+func newDictStore(bucketID int, home string) *dictStore {
+	return &dictStore{bucketID: bucketID, home: home}
+}
+
+func (s *dictStore) load() error {
+	paths, _ := filepath.Glob(fmt.Sprintf("%s/zstd.*.dict", s.home))
+	s.Lock()
+	defer s.Unlock()
+	s.dicts = nil
+	for _, path := range paths {
+		var version int
+		if _, err := fmt.Sscanf(filepath.Base(path), "zstd.%d.dict", &version); err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		d, err := newZstdDict(version, content, st.ModTime())
+		if err != nil {
+			return fmt.Errorf("bad dictionary %s: %s", path, err.Error())
+		}
+		registerDict(d)
+		s.dicts = append(s.dicts, d)
+	}
+	sort.Slice(s.dicts, func(i, j int) bool { return s.dicts[i].version < s.dicts[j].version })
+	return nil
+}
+
+// current returns the dictionary for new records, nil if none.
+func (s *dictStore) current() *zstdDict {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.dicts) == 0 {
+		return nil
+	}
+	return s.dicts[len(s.dicts)-1]
+}
+
+// train saves a dictionary of the next version trained from samples and uses
+// it for new records.
+func (s *dictStore) train(samples [][]byte) (info DictInfo, err error) {
+	if len(samples) < MIN_DICT_SAMPLES {
+		err = ErrNoDictSamples
+		return
+	}
+	s.trainLock.Lock()
+	defer s.trainLock.Unlock()
+	version := 1
+	if d := s.current(); d != nil {
+		version = d.version + 1
+	}
+	if version > MAX_DICT_VERSION {
+		err = fmt.Errorf("too many dictionaries")
+		return
+	}
+	content, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: int(Conf.DictSize),
+		HashBytes:   6,
+		ZstdDictID:  dictID(s.bucketID, version),
+		ZstdLevel:   zstd.SpeedDefault,
+	})
+	if err != nil {
+		return
+	}
+	d, err := newZstdDict(version, content, time.Now())
+	if err != nil {
+		return
+	}
+	path := dictPath(s.home, version)
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return
+	}
+
+	var raw, encoded int
+	for _, sample := range samples {
+		raw += len(sample)
+		encoded += len(d.enc.EncodeAll(sample, nil))
+	}
+	registerDict(d)
+	s.Lock()
+	s.dicts = append(s.dicts, d)
+	s.Unlock()
+	logger.Infof("trained dictionary %s from %d values", path, len(samples))
+
+	info = d.info()
+	info.Current = true
+	info.NumSamples = len(samples)
+	info.SampleRatio = float64(encoded) / float64(raw)
+	return
+}
+
+func (s *dictStore) list() []DictInfo {
+	s.Lock()
+	defer s.Unlock()
+	res := make([]DictInfo, 0, len(s.dicts))
+	for i, d := range s.dicts {
+		info := d.info()
+		info.Current = i == len(s.dicts)-1
+		res = append(res, info)
+	}
+	return res
+}
+
+// sampleValues reads values to train a dictionary from the newest chunks,
+// only those compressed by zstd-dict and not larger than TRY_COMPRESS_SIZE.
+func (bkt *Bucket) sampleValues(max int) (samples [][]byte, err error) {
+	for chunk := MAX_NUM_CHUNK - 1; chunk >= 0 && len(samples) < max; chunk-- {
+		if _, e := os.Stat(bkt.datas.genPath(chunk)); e != nil {
+			continue
+		}
+		reader, e := bkt.datas.GetStreamReader(chunk)
+		if e != nil {
+			return samples, e
+		}
+		for len(samples) < max {
+			rec, _, _, e := reader.Next()
+			if e != nil || rec == nil {
+				break
+			}
+			if value := sampleValue(rec.Payload); value != nil {
+				samples = append(samples, value)
+			}
+		}
+		reader.Close()
+	}
+	return
+}
+
+func sampleValue(p *Payload) []byte {
+	if p.Ver < 0 || p.Flag&FLAG_CLIENT_COMPRESS != 0 {
+		return nil
+	}
+	body := p.Body
+	if p.IsCompressed() {
+		arr, err := p.decompressed()
+		if err != nil {
+			return nil
+		}
+		defer arr.Free()
+		body = arr.Body
+	}
+	if len(body) > TRY_COMPRESS_SIZE || codecFor(body) != CODEC_ZSTD_DICT {
+		return nil
+	}
+	return append([]byte(nil), body...)
+}
+
+// TrainDict trains a new dictionary for zstd-dict in bucketID from values
+// sampled in its newest chunks, it is used for new records, and by gc to
+// re-encode old ones if Conf.GCRecompress.
+func (store *HStore) TrainDict(bucketID int) (info DictInfo, err error) {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		err = ErrBucketNotServed
+		return
+	}
+	samples, err := bkt.sampleValues(Conf.DictSamples)
+	if err != nil {
+		return
+	}
+	return bkt.dicts.train(samples)
+}
+
+// GetDicts returns the dictionaries of bucketID by version.
+func (store *HStore) GetDicts(bucketID int) []DictInfo {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil
+	}
+	return bkt.dicts.list()
+}
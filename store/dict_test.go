@@ -0,0 +1,163 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func jsonValue(i int) string {
+	return fmt.Sprintf(`{"id": %d, "name": "user_%d", "email": "user_%d@example.com", `+
+		`"created": "2020-01-%02dT08:00:00Z", "roles": ["reader", "writer"], `+
+		`"settings": {"lang": "zh_CN", "theme": "dark", "notify": true}, `+
+		`"address": {"city": "Beijing", "street": "%d Jiuxianqiao Road"}}`, i, i*7, i*7, i%28+1, i)
+}
+
+func jsonSamples(n int) (samples [][]byte) {
+	for i := 0; i < n; i++ {
+		samples = append(samples, []byte(jsonValue(i)))
+	}
+	return
+}
+
+func TestDictStore(t *testing.T) {
+	setupTest("TestDictStore")
+	defer clearTest()
+	Conf.Init()
+	Conf.Codec = "zstd-dict"
+	defer func() { Conf.Codec = "quicklz" }()
+
+	s := newDictStore(3, Conf.Home)
+	if _, err := s.train(jsonSamples(3)); err != ErrNoDictSamples {
+		t.Fatal(err)
+	}
+	info, err := s.train(jsonSamples(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != 1 || info.ID != dictID(3, 1) || !info.Current || info.NumSamples != 200 || info.SampleRatio > 0.5 {
+		t.Fatalf("%#v", info)
+	}
+	if _, err := os.Stat(dictPath(Conf.Home, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	compress := func(value string, dict *zstdDict) *Payload {
+		p := &Payload{}
+		p.Body = []byte(value)
+		(&Record{[]byte("key"), p}).compress(dict)
+		return p
+	}
+	value := jsonValue(1000)
+	plain := compress(value, nil)
+	p := compress(value, s.current())
+	// too small for plain zstd
+	if plain.IsCompressed() || p.CodecName() != "zstd-dict" || len(p.Body) >= len(value)/2 {
+		t.Fatalf("%s %d, %s %d", plain.CodecName(), len(plain.Body), p.CodecName(), len(p.Body))
+	}
+	plain.Free()
+	if !isEncodedBy(p.Body, s.current()) {
+		t.Fatal("no dict id in frame")
+	}
+
+	// a restarted server reads it by the saved dictionary
+	s2 := newDictStore(3, Conf.Home)
+	if err := s2.load(); err != nil {
+		t.Fatal(err)
+	}
+	delete(zstdDicts.m, info.ID)
+	if err := s2.load(); err != nil || len(s2.list()) != 1 || findDict(info.ID) == nil {
+		t.Fatalf("%v %v", err, s2.list())
+	}
+	if err := p.Decompress(); err != nil || string(p.Body) != value {
+		t.Fatalf("%v %q", err, p.Body)
+	}
+	p.Free()
+
+	info, err = s2.train(jsonSamples(100))
+	if err != nil || info.Version != 2 || s2.current().id != dictID(3, 2) {
+		t.Fatalf("%v %#v", err, info)
+	}
+	dicts := s2.list()
+	if len(dicts) != 2 || dicts[0].Current || !dicts[1].Current {
+		t.Fatalf("%#v", dicts)
+	}
+}
+
+func TestGCDict(t *testing.T) {
+	testGC(t, testGCDict, "dict", 1000)
+}
+
+// testGCDict compresses values written before a dictionary is trained, and
+// re-encodes values of an old dictionary.
+func testGCDict(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	Conf.Codec = "zstd-dict"
+	Conf.GCRecompress = true
+	defer func() {
+		Conf.Codec = "quicklz"
+		Conf.GCRecompress = false
+	}()
+	gen := newKVGen(16)
+	var ki KeyInfo
+	n := 100
+	for i := 0; i < n; i++ {
+		payload := gen.gen(&ki, i, 0)
+		payload.Body = []byte(jsonValue(i))
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bkt := store.buckets[bucketID]
+	bkt.datas.flush(0, true)
+
+	check := func(version int) {
+		for i := 0; i < n; i++ {
+			gen.gen(&ki, i, 0)
+			payload, pos, err := store.Get(&ki, false)
+			if err != nil || payload == nil || string(payload.Body) != jsonValue(i) {
+				t.Fatalf("%d: %v", i, err)
+			}
+			cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+			payload.CArray.Free()
+
+			wrec, err := readRecordAtPath(bkt.datas.chunks[pos.ChunkID].path, pos.Offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := wrec.rec.Payload
+			codec := ""
+			if version > 0 {
+				codec = "zstd-dict"
+				if id, _ := dictIDOf(p.Body); id != dictID(bucketID, version) {
+					t.Fatalf("%d: dict %x", i, id)
+				}
+			}
+			if p.CodecName() != codec {
+				t.Fatalf("%d: codec %q", i, p.CodecName())
+			}
+			cmem.DBRL.GetData.SubSizeAndCount(p.CArray.Cap)
+			p.Free()
+		}
+	}
+	check(0)
+
+	for version := 1; version <= 2; version++ {
+		info, err := store.TrainDict(bucketID)
+		if err != nil || info.Version != version || info.NumSamples != n {
+			t.Fatalf("%v %#v", err, info)
+		}
+		store.gcMgr.gc(bkt, 0, 0, false)
+		gc := bkt.GCHistory[len(bkt.GCHistory)-1]
+		if gc.Err != nil || gc.NumRecompressed != int64(n) {
+			t.Fatalf("%#v", gc)
+		}
+		check(version)
+	}
+	dicts := store.GetDicts(bucketID)
+	if len(dicts) != 2 || dicts[1].NumEncoded < int64(n) || dicts[1].Ratio <= 0 || dicts[1].Ratio > 0.5 {
+		t.Fatalf("%#v", dicts)
+	}
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/douban/gobeansdb/utils"
+)
+
+// By default a set is acked once its record is in the write buffer of the
+// bucket, which is written out by the flusher later, so acked records may be
+// lost on a crash. Stricter modes make a writer wait until its record is
+// written to the data file, or also synced to disk. Writers waiting together
+// are committed by one flush and one fsync, the first one does it for all
+// records written so far while the others wait for it.
+
+const (
+	DURABILITY_DEFAULT  = iota // Conf.Durability
+	DURABILITY_BUFFERED        // acked in the write buffer
+	DURABILITY_FLUSH           // acked after written to the data file
+	DURABILITY_FSYNC           // acked after synced to disk
+)
+
+var durabilityNames = [...]string{"", "buffered", "flush-before-ack", "fsync-before-ack"}
+
+// ParseDurability returns DURABILITY_DEFAULT for "".
+func ParseDurability(name string) (int, error) {
+	for mode, s := range durabilityNames {
+		if s == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability %q", name)
+}
+
+// DurabilityName returns the name of mode, as in config.
+func DurabilityName(mode int) string {
+	return durabilityNames[resolveDurability(mode)]
+}
+
+func resolveDurability(mode int) int {
+	if mode == DURABILITY_DEFAULT {
+		mode, _ = ParseDurability(Conf.Durability)
+	}
+	if mode == DURABILITY_DEFAULT {
+		mode = DURABILITY_BUFFERED
+	}
+	return mode
+}
+
+var (
+	flushLatency   utils.Histogram // of all flushes of write buffers
+	fsyncLatency   utils.Histogram // of fsyncs for writers
+	numCommitWait  int64           // writers waited
+	numCommitFlush int64           // writers flushing for others
+	numCommitFsync int64
+)
+
+type DurabilityStats struct {
+	Default  string
+	NumWait  int64 // sets acked after flushed or synced
+	NumFlush int64 // flushes and fsyncs done for them, less than NumWait by group commit
+	NumFsync int64
+	Flush    utils.HistogramSummary // background flushes included
+	Fsync    utils.HistogramSummary
+}
+
+func GetDurabilityStats() DurabilityStats {
+	return DurabilityStats{
+		Default:  DurabilityName(DURABILITY_DEFAULT),
+		NumWait:  atomic.LoadInt64(&numCommitWait),
+		NumFlush: atomic.LoadInt64(&numCommitFlush),
+		NumFsync: atomic.LoadInt64(&numCommitFsync),
+		Flush:    flushLatency.Summary(),
+		Fsync:    fsyncLatency.Summary(),
+	}
+}
+
+// flushedSize returns the size of the chunk written to its file.
+func (dc *dataChunk) flushedSize() uint32 {
+	dc.Lock()
+	defer dc.Unlock()
+	return dc.getDiskFileSize()
+}
+
+// commit waits until the record at pos is durable as mode requires.
+func (ds *dataStore) commit(pos Position, mode int) error {
+	mode = resolveDurability(mode)
+	if mode == DURABILITY_BUFFERED {
+		return nil
+	}
+	atomic.AddInt64(&numCommitWait, 1)
+	dc := &ds.chunks[pos.ChunkID]
+	ds.commitLock.Lock()
+	defer ds.commitLock.Unlock()
+	if dc.flushedSize() <= pos.Offset {
+		atomic.AddInt64(&numCommitFlush, 1)
+		if err := ds.flush(pos.ChunkID, true); err != nil {
+			return err
+		}
+	}
+	if mode != DURABILITY_FSYNC || dc.synced > pos.Offset {
+		return nil
+	}
+	atomic.AddInt64(&numCommitFsync, 1)
+	size := dc.flushedSize()
+	st := time.Now()
+	if err := syncFile(dc.path, dc.synced == 0); err != nil {
+		logger.Errorf("fail to sync %s: %s", dc.path, err.Error())
+		return err
+	}
+	fsyncLatency.Observe(time.Since(st))
+	dc.synced = size
+	return nil
+}
+
+// clearChunk removes a chunk released by gc, synced is reset under commitLock
+// as a commit may be syncing it.
+func (ds *dataStore) clearChunk(chunk int) error {
+	ds.commitLock.Lock()
+	defer ds.commitLock.Unlock()
+	dc := &ds.chunks[chunk]
+	dc.synced = 0
+	return dc.Clear()
+}
+
+// syncFile also syncs the dir of path if the file may be new.
+func syncFile(path string, dir bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil || !dir {
+		return err
+	}
+	if f, err = os.Open(filepath.Dir(path)); err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
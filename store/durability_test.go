@@ -0,0 +1,130 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestParseDurability(t *testing.T) {
+	Conf.InitDefault()
+	for name, mode := range map[string]int{
+		"":                 DURABILITY_DEFAULT,
+		"buffered":         DURABILITY_BUFFERED,
+		"flush-before-ack": DURABILITY_FLUSH,
+		"fsync-before-ack": DURABILITY_FSYNC,
+	} {
+		if m, err := ParseDurability(name); err != nil || m != mode {
+			t.Fatalf("%q: %d %v", name, m, err)
+		}
+	}
+	if _, err := ParseDurability("fsync"); err == nil {
+		t.Fatal("parsed fsync")
+	}
+	Conf.Durability = "fsync-before-ack"
+	if name := DurabilityName(DURABILITY_DEFAULT); name != "fsync-before-ack" {
+		t.Fatal(name)
+	}
+	Conf.Durability = ""
+	if name := DurabilityName(DURABILITY_DEFAULT); name != "buffered" {
+		t.Fatal(name)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	setupTest("TestCommit")
+	defer clearTest()
+	Conf.Init()
+
+	ds := NewdataStore(0, Conf.Home)
+	append := func(i int) Position {
+		p := &Payload{}
+		p.Ver = 1
+		p.Body = []byte(fmt.Sprintf("value_%d", i))
+		pos, err := ds.AppendRecord(&Record{[]byte(fmt.Sprintf("key_%d", i)), p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmem.DBRL.FlushData.SubSizeAndCount(p.CArray.Cap)
+		return pos
+	}
+	commit := func(pos Position, mode int) {
+		if err := ds.commit(pos, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pos := append(0)
+	commit(pos, DURABILITY_BUFFERED)
+	checkFileSize(t, 0, 0)
+	commit(pos, DURABILITY_FLUSH)
+	checkFileSize(t, 0, 256)
+	if ds.chunks[0].synced != 0 {
+		t.Fatalf("synced %d", ds.chunks[0].synced)
+	}
+
+	// one fsync for records written before it
+	append(1)
+	pos = append(2)
+	fsyncs := atomic.LoadInt64(&numCommitFsync)
+	commit(pos, DURABILITY_FSYNC)
+	commit(Position{0, 256}, DURABILITY_FSYNC)
+	if n := atomic.LoadInt64(&numCommitFsync) - fsyncs; n != 1 || ds.chunks[0].synced != 256*3 {
+		t.Fatalf("%d fsyncs, synced %d", n, ds.chunks[0].synced)
+	}
+	checkFileSize(t, 0, 256*3)
+
+	n := 50
+	var wg sync.WaitGroup
+	fsyncs = atomic.LoadInt64(&numCommitFsync)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			commit(append(3+i), DURABILITY_FSYNC)
+		}(i)
+	}
+	wg.Wait()
+	checkFileSize(t, 0, 256*uint32(3+n))
+	if num := atomic.LoadInt64(&numCommitFsync) - fsyncs; num < 1 || num > int64(n) {
+		t.Fatalf("%d fsyncs", num)
+	}
+	st := GetDurabilityStats()
+	if st.NumWait < int64(n+3) || st.Fsync.Count < 2 || st.Flush.Count < 2 {
+		t.Fatalf("%#v", st)
+	}
+}
+
+func TestSetDurability(t *testing.T) {
+	testGC(t, testSetDurability, "durability", 100)
+}
+
+// testSetDurability checks a set asking fsync-before-ack is on disk once acked.
+func testSetDurability(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	gen := newKVGen(16)
+	bkt := store.buckets[bucketID]
+	var ki KeyInfo
+	for i := 0; i < 3; i++ {
+		payload := gen.gen(&ki, i, 0)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		ki.Durability = DURABILITY_FSYNC
+		if i == 1 {
+			ki.Durability = DURABILITY_BUFFERED
+		}
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+		size := uint32(256 * (i + 1))
+		if i == 1 {
+			size = 256
+		}
+		dc := &bkt.datas.chunks[0]
+		if st, err := os.Stat(dc.path); err != nil || uint32(st.Size()) != size || (i != 1 && dc.synced != size) {
+			t.Fatalf("%d: %v %v synced %d", i, st, err, dc.synced)
+		}
+	}
+}
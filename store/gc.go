@@ -5,12 +5,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/douban/gobeansdb/cmem"
 	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/utils"
 )
 
+// drop pages read by gc from page cache every gcDropCacheSize bytes
+const gcDropCacheSize = 64 << 20
+
 type GCMgr struct {
-	mu   sync.RWMutex
-	stat map[*Bucket]*GCState // map[bucketID]*GCState
+	mu       sync.RWMutex
+	stat     map[*Bucket]*GCState // map[bucketID]*GCState
+	throttle *gcThrottle
+	resumed  sync.WaitGroup // gc resumed on opening, waited by tests
 }
 
 type GCState struct {
@@ -30,6 +37,11 @@ type GCState struct {
 
 	Err        error
 	CancelFlag bool
+
+	// set if started by the scheduler
+	Policy string
+	Reason string
+
 	// sum
 	GCFileState
 }
@@ -43,6 +55,10 @@ type GCFileState struct {
 	SizeDeleted        int64
 	SizeBroken         int64
 	NumNotInHtree      int64
+	NumHeld            int64 // old versions kept by retention holds
+	SizeHeld           int64
+	NumConverted       int64 // records rewritten with a header of Conf.RecordVersion, the padding of the bucket or the current key
+	NumRecompressed    int64 // records rewritten with another codec, if Conf.GCRecompress
 }
 
 func (s *GCFileState) add(s2 *GCFileState) {
@@ -54,6 +70,10 @@ func (s *GCFileState) add(s2 *GCFileState) {
 	s.SizeDeleted += s2.SizeDeleted
 	s.SizeReleased += s2.SizeReleased
 	s.NumNotInHtree += s2.NumNotInHtree
+	s.NumHeld += s2.NumHeld
+	s.SizeHeld += s2.SizeHeld
+	s.NumConverted += s2.NumConverted
+	s.NumRecompressed += s2.NumRecompressed
 }
 
 func (s *GCFileState) addRecord(size uint32, isNewest, isDeleted bool, sizeBroken uint32) {
@@ -75,6 +95,79 @@ func (s *GCFileState) String() string {
 	return fmt.Sprintf("%#v", s)
 }
 
+// convertRecord returns a copy of rec with the header of Conf.RecordVersion,
+// the padding of the bucket and encrypted by keyID, and compressed by the
+// codec of its kind if Conf.GCRecompress, or nil if rec is already so. The
+// caller frees the value of the copy.
+func convertRecord(rec *Record, finePadding bool, keyID uint32, dict *zstdDict) (nrec *Record, converted, recompressed bool) {
+	p := &Payload{Meta: rec.Payload.Meta}
+	p.Body = rec.Payload.Body
+	converted = p.setHeaderVersion(Conf.RecordVersion)
+	if p.FinePadding != finePadding {
+		p.FinePadding = finePadding
+		converted = true
+	}
+	if p.KeyID != keyID {
+		p.KeyID = keyID
+		converted = true
+	}
+	if Conf.GCRecompress && p.Ver >= 0 && p.Flag&FLAG_CLIENT_COMPRESS == 0 {
+		recompressed = recompress(rec.Key, p, dict)
+	}
+	if converted || recompressed {
+		nrec = &Record{rec.Key, p}
+	}
+	return
+}
+
+// recompress replaces the value of p if the codec of its kind is not the one
+// it is compressed by, or it is compressed but should not, or by zstd-dict
+// with a dictionary other than dict.
+func recompress(key []byte, p *Payload, dict *zstdDict) bool {
+	current := -1
+	raw := p.Body
+	var arr cmem.CArray
+	if p.IsCompressed() {
+		var err error
+		if arr, err = p.decompressed(); err != nil {
+			logger.Errorf("gc fail to decompress %q: %s", key, err.Error())
+			return false
+		}
+		current = p.CodecID()
+		raw = arr.Body
+	}
+	head := raw
+	if len(head) > TRY_COMPRESS_SIZE {
+		head = head[:TRY_COMPRESS_SIZE]
+	}
+	target := codecFor(head)
+	if target == CODEC_ZSTD_DICT && dict == nil {
+		target = CODEC_ZSTD
+	}
+	if target == current && (current != CODEC_ZSTD_DICT || isEncodedBy(p.Body, dict)) {
+		arr.Free()
+		return false
+	}
+	tmp := &Record{key, &Payload{Meta: p.Meta}}
+	tmp.Payload.Flag &^= FLAG_COMPRESS
+	tmp.Payload.Codec = 0
+	tmp.Payload.CArray = arr
+	tmp.Payload.Body = raw
+	tmp.compress(dict) // frees arr if compressed
+	if !p.IsCompressed() && !tmp.Payload.IsCompressed() {
+		tmp.Payload.CArray.Free()
+		return false
+	}
+	p.Flag, p.Codec = tmp.Payload.Flag, tmp.Payload.Codec
+	p.CArray = tmp.Payload.CArray
+	return true
+}
+
+func isEncodedBy(value []byte, dict *zstdDict) bool {
+	id, err := dictIDOf(value)
+	return err == nil && id == dict.id
+}
+
 func (mgr *GCMgr) UpdateCollision(bkt *Bucket, ki *KeyInfo, oldPos, newPos Position, rec *Record) {
 	// not have to (leave it to get)
 
@@ -121,6 +214,9 @@ func (mgr *GCMgr) BeforeBucket(bkt *Bucket, startChunkID, endChunkID int, merge
 func (mgr *GCMgr) AfterBucket(bkt *Bucket) {
 	bkt.hints.state &= ^HintStateGC
 	bkt.hints.maxDumpableChunkID = MAX_NUM_CHUNK - 1
+	if bkt.versions != nil {
+		bkt.versions.reset()
+	}
 }
 
 func (bkt *Bucket) gcCheckEnd(start, endChunkID, noGCDays int) (end int, err error) {
@@ -186,17 +282,61 @@ func (bkt *Bucket) gcCheckRange(startChunkID, endChunkID, noGCDays int) (start,
 }
 
 func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
+	mgr.gcWithState(bkt, GCState{}, startChunkID, endChunkID, merge)
+}
 
-	logger.Infof("begin GC bucket %d chunk [%d, %d]", bkt.ID, startChunkID, endChunkID)
+// numRunning returns the number of gc on a device, must be called with mu held.
+// canceled reads the CancelFlag of a running gc, which is set under mu.
+func (mgr *GCMgr) canceled(gc *GCState) bool {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	return gc.CancelFlag
+}
+
+func (mgr *GCMgr) numRunning(device string) (n int) {
+	for bkt := range mgr.stat {
+		if bkt.Device == device {
+			n++
+		}
+	}
+	return
+}
 
-	bkt.GCHistory = append(bkt.GCHistory, GCState{})
-	gc := &bkt.GCHistory[len(bkt.GCHistory)-1]
-	// add gc to mgr's stat map
+// begin adds a gc of [st.Begin, st.End] to the history and the running ones.
+// It fails if the bucket is gcing, or maxPerDevice > 0 and as many gc are
+// running on the device of the bucket.
+func (mgr *GCMgr) begin(bkt *Bucket, st GCState, maxPerDevice int) (gc *GCState, err error) {
 	mgr.mu.Lock()
-	mgr.stat[bkt] = gc
-	mgr.mu.Unlock()
+	defer mgr.mu.Unlock()
+	if _, exists := mgr.stat[bkt]; exists {
+		return nil, ErrGCRunning
+	}
+	if n := mgr.numRunning(bkt.Device); maxPerDevice > 0 && n >= maxPerDevice {
+		logger.Infof("gc on bucket %d not started, %d gc running on %s", bkt.ID, n, bkt.Device)
+		return nil, ErrGCDeviceBusy
+	}
+	bkt.GCHistory = append(bkt.GCHistory, st)
+	gc = &bkt.GCHistory[len(bkt.GCHistory)-1]
 	gc.Running = true
 	gc.BeginTS = time.Now()
+	mgr.stat[bkt] = gc
+	return
+}
+
+func (mgr *GCMgr) gcWithState(bkt *Bucket, st GCState, startChunkID, endChunkID int, merge bool) {
+	st.Begin, st.End = startChunkID, endChunkID
+	gc, err := mgr.begin(bkt, st, 0)
+	if err != nil {
+		logger.Errorf("gc not started: %s", err.Error())
+		return
+	}
+	mgr.run(bkt, gc, merge)
+}
+
+// run does the gc added by begin.
+func (mgr *GCMgr) run(bkt *Bucket, gc *GCState, merge bool) {
+	startChunkID, endChunkID := gc.Begin, gc.End
+	logger.Infof("begin GC bucket %d chunk [%d, %d] %s", bkt.ID, startChunkID, endChunkID, gc.Reason)
 	defer func() {
 		mgr.mu.Lock()
 		delete(mgr.stat, bkt)
@@ -204,8 +344,6 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 		gc.Running = false
 		gc.EndTS = time.Now()
 	}()
-	gc.Begin = startChunkID
-	gc.End = endChunkID
 
 	var oldPos Position
 	var newPos Position
@@ -214,6 +352,14 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 
 	mgr.BeforeBucket(bkt, startChunkID, endChunkID, merge)
 	defer mgr.AfterBucket(bkt)
+	bkt.holds.expireOld()
+	dict := bkt.dicts.current()
+	keyID, err := currentKeyID()
+	if err != nil {
+		gc.Err = err
+		return
+	}
+	now := time.Now()
 
 	gc.Dst = startChunkID
 	// try to find the nearest chunk that small than start chunk
@@ -233,20 +379,39 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 		}
 	}
 
+	journal, err := newGCJournal(bkt.getGCJournalPath())
+	if err != nil {
+		gc.Err = err
+		return
+	}
+	defer func() {
+		if gc.Err == nil {
+			journal.remove()
+		} else {
+			journal.close() // recovered when the bucket is opened
+		}
+	}()
+	if err = journal.write(true, "begin %d %d", gc.Begin, gc.End); err != nil {
+		gc.Err = err
+		return
+	}
+
 	dstchunk := &bkt.datas.chunks[gc.Dst]
-	err := dstchunk.beginGCWriting(gc.Begin)
+	err = dstchunk.beginGCWriting(gc.Begin)
 	if err != nil {
 		gc.Err = err
 		return
 	}
 	newPos.ChunkID = gc.Dst
+	firstDst := gc.Dst
 	defer func() {
 		dstchunk.endGCWriting()
 		bkt.hints.trydump(gc.Dst, true)
+		bkt.initUsage(firstDst, gc.End, nil)
 	}()
 
 	for gc.Src = gc.Begin; gc.Src <= gc.End; gc.Src++ {
-		if gc.CancelFlag {
+		if mgr.canceled(gc) {
 			logger.Infof("GC canceled: src %d dst %d", gc.Src, gc.Dst)
 			return
 		}
@@ -256,6 +421,10 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 		}
 		oldPos.ChunkID = gc.Src
 		var fileState GCFileState
+		if err = journal.write(true, "src %d %d %d", gc.Src, gc.Dst, dstchunk.writingHead); err != nil {
+			gc.Err = err
+			return
+		}
 		// reader must have a larger buffer
 		logger.Infof("begin GC bucket %d, file %d -> %d", bkt.ID, gc.Src, gc.Dst)
 		bkt.hints.ClearChunk(gc.Src)
@@ -264,6 +433,8 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 			logger.Errorf("gc failed: %s", err.Error())
 			return
 		}
+		utils.Fadvise(r.fd, 0, 0, utils.FADV_SEQUENTIAL)
+		var dropped uint32
 
 		for {
 			var sizeBroken uint32
@@ -274,8 +445,14 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 				return
 			}
 			if rec == nil {
+				r.dropCache()
+				r.Close()
 				break
 			}
+			if r.offset-dropped > gcDropCacheSize {
+				r.dropCache()
+				dropped = r.offset
+			}
 
 			var isNewest, isCoverdByCollision, isDeleted bool
 			meta := rec.Payload.Meta
@@ -313,12 +490,26 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 
 			wrec := wrapRecord(rec)
 			recsize := wrec.rec.Payload.RecSize
-			fileState.addRecord(recsize, isNewest, isDeleted, sizeBroken)
+			// all records of a held key are kept, including deletes,
+			// otherwise an old value may come back when rebuilding the htree.
+			isHeld := !isNewest && bkt.holds.isHeld(ki.StringKey, now)
+			fileState.addRecord(recsize, isNewest || isHeld, isDeleted, sizeBroken)
 			//logger.Infof("key stat: %v %v %v %v", ki.StringKey, isNewest, isCoverdByCollision, isDeleted)
-			if !isNewest {
+			if isHeld {
+				fileState.NumHeld++
+				fileState.SizeHeld += int64(recsize)
+				meta.ValueHash = rec.Payload.Getvhash()
+			} else if !isNewest {
+				mgr.throttle.wait(int(recsize), 1)
 				continue
 			}
+			mgr.throttle.wait(2*int(recsize), 1)
 
+			nrec, converted, recompressed := convertRecord(rec, bkt.datas.finePadding, keyID, dict)
+			if nrec != nil {
+				wrec = wrapRecord(nrec)
+				recsize = wrec.rec.Payload.RecSize
+			}
 			if recsize+dstchunk.writingHead > uint32(Conf.DataFileMax) {
 				dstchunk.endGCWriting()
 				bkt.hints.trydump(gc.Dst, true)
@@ -326,6 +517,10 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 				gc.Dst++
 				newPos.ChunkID = gc.Dst
 				logger.Infof("continue GC bucket %d, file %d -> %d", bkt.ID, gc.Src, gc.Dst)
+				if err = journal.write(true, "dst %d %d", gc.Src, gc.Dst); err != nil {
+					gc.Err = err
+					return
+				}
 				dstchunk = &bkt.datas.chunks[gc.Dst]
 				err = dstchunk.beginGCWriting(gc.Src)
 				if err != nil {
@@ -333,32 +528,67 @@ func (mgr *GCMgr) gc(bkt *Bucket, startChunkID, endChunkID int, merge bool) {
 					return
 				}
 			}
-			if newPos.Offset, err = dstchunk.AppendRecordGC(wrec); err != nil {
+			if nrec != nil && gc.Src == gc.Dst && dstchunk.writingHead+recsize > r.offset {
+				// a larger record would overwrite records not read yet,
+				// leave it to a gc into another chunk.
+				nrec.Payload.CArray.Free()
+				nrec = nil
+				wrec = wrapRecord(rec)
+				recsize = wrec.rec.Payload.RecSize
+			} else if nrec != nil {
+				if converted {
+					fileState.NumConverted++
+				}
+				if recompressed {
+					fileState.NumRecompressed++
+				}
+			}
+			newPos.Offset, err = dstchunk.AppendRecordGC(wrec)
+			if nrec != nil {
+				nrec.Payload.CArray.Free()
+			}
+			if err != nil {
 				gc.Err = err
 				logger.Errorf("gc failed: %s", err.Error())
 				return
 			}
 			// logger.Infof("%s %v %v", ki.StringKey, newPos, meta)
-			if found {
-				if isCoverdByCollision {
-					mgr.UpdateCollision(bkt, ki, oldPos, newPos, rec)
+			var rotated bool
+			if isHeld {
+				// keep order of versions, but not in htree or collision table
+				it := newHintItem(ki.KeyHash, meta.Ver, meta.ValueHash, Position{0, newPos.Offset}, ki.StringKey)
+				rotated = bkt.hints.setItem(it, newPos.ChunkID, recsize)
+			} else {
+				if found {
+					if isCoverdByCollision {
+						mgr.UpdateCollision(bkt, ki, oldPos, newPos, rec)
+					}
+					mgr.UpdateHtreePos(bkt, ki, oldPos, newPos)
 				}
-				mgr.UpdateHtreePos(bkt, ki, oldPos, newPos)
+				rotated = bkt.hints.set(ki, &meta, newPos, recsize, "gc")
 			}
-
-			rotated := bkt.hints.set(ki, &meta, newPos, recsize, "gc")
 			if rotated {
 				bkt.hints.trydump(gc.Dst, false)
 			}
 		}
 
+		// the copies must be on disk before the source is removed
+		if err = dstchunk.gcWriter.fd.Sync(); err != nil {
+			gc.Err = err
+			logger.Errorf("gc failed: %s", err.Error())
+			return
+		}
 		if gc.Src != gc.Dst {
-			bkt.datas.chunks[gc.Src].Clear()
+			bkt.datas.clearChunk(gc.Src)
 		}
 		if gc.Src+1 >= bkt.NextGCChunk {
 			bkt.NextGCChunk = gc.Src + 1
 			bkt.dumpGCHistroy()
 		}
+		if err = journal.write(true, "done %d %d %d", gc.Src, gc.Dst, dstchunk.writingHead); err != nil {
+			gc.Err = err
+			return
+		}
 		logger.Infof("end GC file %#v", fileState)
 		gc.add(&fileState)
 	}
@@ -0,0 +1,284 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/douban/gobeansdb/utils"
+)
+
+// A running gc appends its progress to gc.journal in the bucket home, and
+// removes it when done. The lines are:
+//
+//	begin <begin> <end>
+//	src <src> <dst> <size of dst>   before gcing a source chunk
+//	dst <src> <dst>                 when moving to the next dst chunk
+//	done <src> <dst> <size of dst>  after the source chunk is cleared
+//
+// If the journal is found when opening the bucket, the gc was interrupted.
+// Records copied from the unfinished source chunk are rolled back, unless the
+// chunk was being rewritten in place, and the gc may be resumed from it.
+
+const gcJournalName = "gc.journal"
+
+type gcJournal struct {
+	path string
+	fd   *os.File
+}
+
+func (bkt *Bucket) getGCJournalPath() string {
+	return filepath.Join(bkt.Home, gcJournalName)
+}
+
+func newGCJournal(path string) (*gcJournal, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &gcJournal{path: path, fd: fd}, nil
+}
+
+// write appends a line, and syncs it if the data before it must be durable.
+func (j *gcJournal) write(sync bool, format string, args ...interface{}) (err error) {
+	if _, err = fmt.Fprintf(j.fd, format+"\n", args...); err != nil {
+		logger.Errorf("fail to write %s: %s", j.path, err.Error())
+		return
+	}
+	if sync {
+		err = j.fd.Sync()
+	}
+	return
+}
+
+func (j *gcJournal) close() {
+	j.fd.Close()
+}
+
+func (j *gcJournal) remove() {
+	j.fd.Close()
+	utils.Remove(j.path)
+}
+
+// gcInterrupted is the progress of an interrupted gc read from the journal.
+type gcInterrupted struct {
+	Begin, End int
+
+	Src     int  // the first source chunk not done
+	Started bool // records of Src may have been copied
+	Dst     int  // Dst and DstSize are where Src started to be copied, or where the last done one ended
+	DstSize uint32
+	Dsts    []int // chunks written while gcing Src
+}
+
+func (j *gcInterrupted) inPlace() bool {
+	for _, c := range j.Dsts {
+		if c == j.Src {
+			return true
+		}
+	}
+	return false
+}
+
+// readGCJournal returns nil if there is no journal. A broken line, e.g. the
+// last one when crashing, ends the journal.
+func readGCJournal(path string) (j *gcInterrupted, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var a, b int
+		var size uint32
+		var e error
+		switch {
+		case strings.HasPrefix(line, "begin "):
+			_, e = fmt.Sscanf(line, "begin %d %d", &a, &b)
+			if e == nil {
+				j = &gcInterrupted{Begin: a, End: b, Src: a, Dst: -1}
+			}
+		case j == nil:
+			e = fmt.Errorf("no begin")
+		case strings.HasPrefix(line, "src "):
+			_, e = fmt.Sscanf(line, "src %d %d %d", &a, &b, &size)
+			if e == nil {
+				j.Src, j.Started, j.Dst, j.DstSize, j.Dsts = a, true, b, size, []int{b}
+			}
+		case strings.HasPrefix(line, "dst "):
+			_, e = fmt.Sscanf(line, "dst %d %d", &a, &b)
+			if e == nil {
+				j.Dsts = append(j.Dsts, b)
+			}
+		case strings.HasPrefix(line, "done "):
+			_, e = fmt.Sscanf(line, "done %d %d %d", &a, &b, &size)
+			if e == nil {
+				j.Src, j.Started, j.Dst, j.DstSize, j.Dsts = a+1, false, b, size, nil
+			}
+		default:
+			e = fmt.Errorf("unknown entry")
+		}
+		if e != nil {
+			logger.Warnf("ignore the rest of %s from %q: %s", path, line, e.Error())
+			break
+		}
+	}
+	if j == nil {
+		logger.Warnf("remove empty gc journal %s", path)
+		utils.Remove(path)
+	}
+	return
+}
+
+// checkChunkData reads all records of a chunk, end is where the last good one ends.
+func (bkt *Bucket) checkChunkData(chunkID int) (n int, sizeBroken int64, end uint32, err error) {
+	r, err := bkt.datas.GetStreamReader(chunkID)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	for {
+		rec, offset, broken, e := r.Next()
+		if e != nil {
+			err = e
+			return
+		}
+		sizeBroken += int64(broken)
+		if rec == nil {
+			return
+		}
+		n++
+		end = offset + rec.Payload.RecSize
+	}
+}
+
+func truncateChunkFile(path string, size uint32) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) && size == 0 {
+			return nil
+		}
+		return err
+	}
+	if st.Size() < int64(size) {
+		return fmt.Errorf("%s has %d bytes, less than %d written before the gc", path, st.Size(), size)
+	}
+	if st.Size() == int64(size) {
+		return nil
+	}
+	logger.Infof("truncate %s %d to %d", path, st.Size(), size)
+	if size == 0 {
+		return utils.Remove(path)
+	}
+	return os.Truncate(path, int64(size))
+}
+
+// recoverGC cleans up after an interrupted gc, it must be called before
+// listing the data files and loading the hints. The chunks written are left
+// without hints, so that they are rebuilt from the data. It returns the
+// state to resume the gc with, or nil.
+func (bkt *Bucket) recoverGC() (resume *GCState, err error) {
+	path := bkt.getGCJournalPath()
+	j, err := readGCJournal(path)
+	if err != nil || j == nil {
+		return
+	}
+	logger.Warnf("bucket %d found interrupted gc: %#v", bkt.ID, j)
+	st := GCState{Begin: j.Begin, End: j.End, Src: j.Src, Dst: j.Dst}
+	st.BeginTS = time.Now()
+
+	srcPath := genDataPath(bkt.Home, j.Src)
+	_, e := os.Stat(srcPath)
+	srcCleared := os.IsNotExist(e)
+	switch {
+	case !j.Started:
+		if j.Dst >= 0 {
+			// the dst may be rewritten in place and still have stale records at the end
+			st.Err = truncateChunkFile(genDataPath(bkt.Home, j.Dst), j.DstSize)
+			bkt.hints.RemoveHintfilesByChunk(j.Dst)
+		}
+		st.Reason = fmt.Sprintf("interrupted before chunk %d", j.Src)
+	case j.inPlace():
+		var n int
+		n, st.SizeBroken, _, st.Err = bkt.checkChunkData(j.Src)
+		for _, c := range j.Dsts {
+			bkt.hints.RemoveHintfilesByChunk(c)
+		}
+		st.Reason = fmt.Sprintf("interrupted when rewriting chunk %d in place, kept %d records, %d bytes broken",
+			j.Src, n, st.SizeBroken)
+	case srcCleared:
+		// done but not journaled, the dsts are complete
+		for _, c := range j.Dsts {
+			bkt.hints.RemoveHintfilesByChunk(c)
+		}
+		j.Src++
+		st.Reason = fmt.Sprintf("interrupted after chunk %d", j.Src-1)
+	default:
+		for _, c := range j.Dsts {
+			var size uint32
+			if c == j.Dst {
+				size = j.DstSize
+			}
+			if st.Err = truncateChunkFile(genDataPath(bkt.Home, c), size); st.Err != nil {
+				break
+			}
+			bkt.hints.RemoveHintfilesByChunk(c)
+		}
+		if st.Err == nil && j.DstSize > 0 {
+			var end uint32
+			if _, st.SizeBroken, end, st.Err = bkt.checkChunkData(j.Dst); st.Err == nil && end != j.DstSize {
+				st.Err = fmt.Errorf("chunk %d ends at %d, expect %d", j.Dst, end, j.DstSize)
+			}
+		}
+		bkt.hints.RemoveHintfilesByChunk(j.Src)
+		st.Reason = fmt.Sprintf("interrupted in chunk %d, rolled back to %d of chunk %d", j.Src, j.DstSize, j.Dst)
+	}
+	st.EndTS = time.Now()
+	if st.Err != nil {
+		// keep the journal to look into
+		logger.Errorf("bucket %d fail to recover gc, %s: %s", bkt.ID, st.Reason, st.Err.Error())
+		bkt.GCHistory = append(bkt.GCHistory, st)
+		return
+	}
+	logger.Infof("bucket %d recovered gc, %s", bkt.ID, st.Reason)
+	bkt.GCHistory = append(bkt.GCHistory, st)
+	utils.Remove(path)
+	if j.Src <= j.End && !Conf.GCNoResume {
+		resume = &GCState{
+			Begin:  j.Src,
+			End:    j.End,
+			Reason: fmt.Sprintf("resume gc [%d, %d] %s", j.Begin, j.End, st.Reason),
+		}
+	}
+	return
+}
+
+// resumeGC restarts the gc interrupted on opening buckets, once the hints
+// of their chunks are checked.
+func (store *HStore) resumeGC() {
+	for _, bkt := range store.buckets {
+		st := bkt.gcResume
+		if st == nil {
+			continue
+		}
+		bkt.gcResume = nil
+		if st.End > bkt.datas.newHead-1 {
+			st.End = bkt.datas.newHead - 1
+		}
+		logger.Infof("bucket %d %s", bkt.ID, st.Reason)
+		store.gcMgr.resumed.Add(1)
+		go func(bkt *Bucket, st GCState) {
+			defer store.gcMgr.resumed.Done()
+			<-bkt.hintsChecked
+			store.gcMgr.gcWithState(bkt, st, st.Begin, st.End, false)
+		}(bkt, *st)
+	}
+}
@@ -0,0 +1,163 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestReadGCJournal(t *testing.T) {
+	setupTest("TestReadGCJournal")
+	defer clearTest()
+
+	path := filepath.Join(dir, gcJournalName)
+	ioutil.WriteFile(path, []byte("begin 2 9\nsrc 2 1 512\ndst 2 2\n"), 0644)
+	j, err := readGCJournal(path)
+	if err != nil || j == nil || !j.Started || j.Src != 2 || j.Dst != 1 || j.DstSize != 512 || !j.inPlace() {
+		t.Fatalf("%#v %v", j, err)
+	}
+
+	// the last line is broken by a crash
+	ioutil.WriteFile(path, []byte("begin 2 9\nsrc 2 1 512\ndone 2 1 768\nsrc 3 1"), 0644)
+	j, err = readGCJournal(path)
+	if err != nil || j == nil || j.Started || j.Src != 3 || j.Dst != 1 || j.DstSize != 768 || j.End != 9 {
+		t.Fatalf("%#v %v", j, err)
+	}
+
+	os.Remove(path)
+	if j, err = readGCJournal(path); j != nil || err != nil {
+		t.Fatalf("%#v %v", j, err)
+	}
+}
+
+func TestGCRecoverRollback(t *testing.T) {
+	testGCRecover(t, false, false)
+}
+
+func TestGCRecoverRollbackNoResume(t *testing.T) {
+	testGCRecover(t, false, true)
+}
+
+func TestGCRecoverInPlace(t *testing.T) {
+	testGCRecover(t, true, false)
+}
+
+func TestGCRecoverInPlaceNoResume(t *testing.T) {
+	testGCRecover(t, true, true)
+}
+
+// testGCRecover fakes a gc of chunks [0, 1] interrupted by a crash, chunk 0 is
+// all garbage and chunk 1 all alive.
+func testGCRecover(t *testing.T, inPlace, noResume bool) {
+	setupTest("TestGCRecover")
+	defer clearTest()
+
+	numbucket := 16
+	bucketID := numbucket - 1
+	Conf.NumBucket = numbucket
+	Conf.BucketsStat = make([]int, numbucket)
+	Conf.BucketsStat[bucketID] = 1
+	Conf.TreeHeight = 3
+	getKeyHash = makeKeyHasherFixBucket(1, bucketID)
+	defer func() {
+		getKeyHash = getKeyHashDefalut
+	}()
+	N := 100
+	Conf.DataFileMaxStr = strconv.Itoa(256 * N)
+	Conf.Init()
+	Conf.GCNoResume = noResume
+	bucketDir := filepath.Join(Conf.Home, "f")
+	os.Mkdir(bucketDir, 0777)
+
+	store, err := NewHStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := newKVGen(numbucket)
+	var ki KeyInfo
+	for ver := 0; ver < 2; ver++ {
+		for i := 0; i < N; i++ {
+			payload := gen.gen(&ki, i, ver)
+			cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+			if err := store.Set(&ki, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	payload := gen.gen(&ki, -1, 0) // rotate
+	cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+	if err := store.Set(&ki, payload); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		store.buckets[bucketID].datas.flush(i, true) // rotated chunks are flushed in background
+	}
+	store.Close()
+
+	path0 := genDataPath(bucketDir, 0)
+	data0, _ := ioutil.ReadFile(path0)
+	data1, _ := ioutil.ReadFile(genDataPath(bucketDir, 1))
+	var journal string
+	if inPlace {
+		// chunk 0 is broken by a half written record
+		copy(data0, make([]byte, 256))
+		journal = "begin 0 1\nsrc 0 0 0\n"
+	} else {
+		// chunk 0 is rewritten to empty, and 10 records of chunk 1 are
+		// copied to it, followed by half of a record
+		copy(data0, data1[:256*10+128])
+		journal = "begin 0 1\nsrc 0 0 0\ndone 0 0 0\nsrc 1 0 0\n"
+	}
+	ioutil.WriteFile(path0, data0, 0644)
+	ioutil.WriteFile(filepath.Join(bucketDir, gcJournalName), []byte(journal), 0644)
+
+	if store, err = NewHStore(); err != nil {
+		t.Fatal(err)
+	}
+	bkt := store.buckets[bucketID]
+	if _, err := os.Stat(bkt.getGCJournalPath()); !os.IsNotExist(err) {
+		t.Fatalf("journal not removed: %v", err)
+	}
+	numGC := 1
+	if !noResume {
+		numGC = 2
+	}
+	store.gcMgr.resumed.Wait()
+	if len(bkt.GCHistory) != numGC || bkt.GCHistory[numGC-1].Running {
+		t.Fatalf("gc not done: %#v", bkt.GCHistory)
+	}
+	recovered := bkt.GCHistory[0]
+	if recovered.Err != nil || (inPlace && recovered.SizeBroken != 256) {
+		t.Fatalf("%#v", recovered)
+	}
+
+	var sizes []uint32
+	switch {
+	case noResume && inPlace:
+		sizes = []uint32{uint32(256 * N), uint32(256 * N), 256}
+	case noResume:
+		sizes = []uint32{0, uint32(256 * N), 256}
+	default:
+		gc := bkt.GCHistory[1]
+		if gc.Err != nil || gc.Begin != recovered.Src {
+			t.Fatalf("%#v", gc)
+		}
+		if inPlace {
+			sizes = []uint32{uint32(256 * N), 0, 256}
+		} else {
+			sizes = []uint32{0, uint32(256 * N), 256}
+		}
+	}
+	checkDataSize(t, bkt.datas, sizes)
+	readHStore(t, store, N, 1)
+
+	store.Close()
+	if !cmem.DBRL.IsZero() {
+		t.Fatalf("%#v", cmem.DBRL)
+	}
+	checkAllDataWithHints(bucketDir)
+}
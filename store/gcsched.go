@@ -0,0 +1,303 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/douban/gobeansdb/config"
+	"github.com/douban/gobeansdb/utils"
+)
+
+// The gc scheduler checks all buckets every GCSchedInterval seconds, and
+// starts gc on a bucket when a policy matches it. Only buckets not gcing, on
+// a device with less than GCMaxPerDisk running gc, and not busy with sets are
+// considered.
+
+type GCPolicy struct {
+	Name        string   `yaml:"name"`
+	Windows     []string `yaml:"windows,omitempty"`       // e.g. "22:00-06:00" in local time, any time if empty
+	MinGarbage  float64  `yaml:"min_garbage,omitempty"`   // gc from the first chunk with more estimated garbage ratio
+	MaxDiskFree float64  `yaml:"max_disk_free,omitempty"` // only if free ratio of the disk is below, 0 for any
+	MaxChunks   int      `yaml:"max_chunks,omitempty"`    // max chunks in a gc, 0 for no limit
+	Merge       bool     `yaml:"merge,omitempty"`
+}
+
+// parseGCWindow returns the window in minutes of a day, to may be less than from.
+func parseGCWindow(s string) (from, to int, err error) {
+	var h1, m1, h2, m2 int
+	if _, err = fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		err = fmt.Errorf("bad gc window %q: %s", s, err.Error())
+		return
+	}
+	if h1 < 0 || h1 > 24 || h2 < 0 || h2 > 24 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 {
+		err = fmt.Errorf("bad gc window %q", s)
+		return
+	}
+	return h1*60 + m1, h2*60 + m2, nil
+}
+
+func (p *GCPolicy) check() error {
+	for _, w := range p.Windows {
+		if _, _, err := parseGCWindow(w); err != nil {
+			return err
+		}
+	}
+	if p.MinGarbage < 0 || p.MinGarbage > 1 || p.MaxDiskFree < 0 || p.MaxDiskFree > 1 {
+		return fmt.Errorf("gc policy %s: ratio should be in [0, 1]", p.Name)
+	}
+	return nil
+}
+
+func (p *GCPolicy) inWindow(now time.Time) bool {
+	if len(p.Windows) == 0 {
+		return true
+	}
+	m := now.Hour()*60 + now.Minute()
+	for _, w := range p.Windows {
+		from, to, err := parseGCWindow(w)
+		if err != nil {
+			continue
+		}
+		if (from <= to && m >= from && m < to) || (from > to && (m >= from || m < to)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GCDecision is the last check of a bucket by the scheduler.
+type GCDecision struct {
+	Bucket   string
+	Time     time.Time
+	Started  bool
+	Policy   string  `json:",omitempty"`
+	Begin    int     `json:",omitempty"`
+	End      int     `json:",omitempty"`
+	Garbage  float64 `json:",omitempty"` // estimated, of chunks [Begin, End]
+	DiskFree float64 `json:",omitempty"`
+	SetRate  float64 `json:",omitempty"`
+	Reason   string
+}
+
+type GCSchedStatus struct {
+	Interval   int
+	Paused     bool
+	MaxPerDisk int
+	MaxSetRate float64
+	Policies   []GCPolicy
+	LastCheck  time.Time
+	Decisions  []GCDecision
+}
+
+type gcScheduler struct {
+	sync.Mutex
+	paused    bool
+	lastCheck time.Time
+	numSet    map[int]int64 // at lastCheck
+	decisions map[int]GCDecision
+}
+
+func newGCScheduler() *gcScheduler {
+	return &gcScheduler{
+		paused:    Conf.GCSchedPaused,
+		numSet:    make(map[int]int64),
+		decisions: make(map[int]GCDecision),
+	}
+}
+
+// estimateGarbage returns the ratio of superseded bytes of each chunk in
+// [start, end], by the usage counters of the bucket.
+func (bkt *Bucket) estimateGarbage(start, end int) []float64 {
+	res := make([]float64, end-start+1)
+	for i := start; i <= end; i++ {
+		cu := bkt.usage.get(i)
+		res[i-start] = cu.Garbage()
+	}
+	return res
+}
+
+// pickGCRange returns the chunks to gc by policy p, ok is false if the
+// garbage is too little. ratio is the estimated garbage of [begin, last].
+func (bkt *Bucket) pickGCRange(p *GCPolicy, start, end int, garbage []float64) (begin, last int, ratio float64, ok bool) {
+	begin = -1
+	var size, sizeGarbage float64
+	for i := start; i <= end; i++ {
+		if begin >= 0 && p.MaxChunks > 0 && i >= begin+p.MaxChunks {
+			break
+		}
+		sz := float64(bkt.datas.chunks[i].size)
+		if sz == 0 {
+			continue
+		}
+		if begin < 0 {
+			if garbage[i-start] < p.MinGarbage {
+				continue
+			}
+			begin = i
+		}
+		last = i
+		size += sz
+		sizeGarbage += sz * garbage[i-start]
+	}
+	if begin < 0 {
+		return
+	}
+	return begin, last, sizeGarbage / size, true
+}
+
+// checkGC runs one round of the scheduler and returns the decisions.
+func (store *HStore) checkGC(now time.Time) (decisions []GCDecision) {
+	sched := store.gcSched
+	sched.Lock()
+	defer sched.Unlock()
+	elapsed := now.Sub(sched.lastCheck).Seconds()
+	first := sched.lastCheck.IsZero()
+	sched.lastCheck = now
+
+	running := make(map[string]int)
+	store.gcMgr.mu.RLock()
+	gcing := make(map[*Bucket]bool)
+	for bkt := range store.gcMgr.stat {
+		gcing[bkt] = true
+		running[bkt.Device]++
+	}
+	store.gcMgr.mu.RUnlock()
+
+	for id, bkt := range store.buckets {
+		if bkt.State != BUCKET_STAT_READY {
+			continue
+		}
+		d := GCDecision{Bucket: config.BucketIDHex(id, Conf.NumBucket), Time: now}
+		store.checkBucketGC(bkt, &d, gcing[bkt], running, elapsed, first)
+		sched.numSet[id] = atomic.LoadInt64(&bkt.NumSet)
+		sched.decisions[id] = d
+		decisions = append(decisions, d)
+	}
+	return
+}
+
+func (store *HStore) checkBucketGC(bkt *Bucket, d *GCDecision, gcing bool, running map[string]int, elapsed float64, first bool) {
+	sched := store.gcSched
+	if !first && elapsed > 0 {
+		d.SetRate = float64(atomic.LoadInt64(&bkt.NumSet)-sched.numSet[bkt.ID]) / elapsed
+	}
+	if sched.paused {
+		d.Reason = "paused"
+		return
+	}
+	if gcing {
+		d.Reason = "gc running"
+		return
+	}
+	if bkt.hints.state&HintStateMerge != 0 {
+		d.Reason = "hint merging"
+		return
+	}
+	if first && Conf.GCMaxSetRate > 0 {
+		d.Reason = "measuring set rate"
+		return
+	}
+	if Conf.GCMaxSetRate > 0 && d.SetRate > Conf.GCMaxSetRate {
+		d.Reason = fmt.Sprintf("busy, %.1f sets/s", d.SetRate)
+		return
+	}
+	disk, err := utils.DiskUsage(bkt.Home)
+	if err != nil {
+		d.Reason = err.Error()
+		return
+	}
+	if disk.All > 0 {
+		d.DiskFree = float64(disk.Free) / float64(disk.All)
+	}
+	if Conf.GCMaxPerDisk > 0 && running[bkt.Device] >= Conf.GCMaxPerDisk {
+		d.Reason = fmt.Sprintf("%d gc running on %s", running[bkt.Device], bkt.Device)
+		return
+	}
+	start, end, err := bkt.gcCheckRange(-1, -1, -1)
+	if err != nil {
+		d.Reason = err.Error()
+		return
+	}
+
+	var garbage []float64
+	d.Reason = "no policy matched"
+	for i := range Conf.GCPolicies {
+		p := &Conf.GCPolicies[i]
+		if !p.inWindow(d.Time) || (p.MaxDiskFree > 0 && d.DiskFree >= p.MaxDiskFree) {
+			continue
+		}
+		if garbage == nil {
+			garbage = bkt.estimateGarbage(start, end)
+		}
+		begin, last, ratio, ok := bkt.pickGCRange(p, start, end, garbage)
+		if !ok {
+			d.Reason = fmt.Sprintf("garbage of chunks [%d, %d] below %.2f", start, end, p.MinGarbage)
+			continue
+		}
+		d.Policy, d.Begin, d.End, d.Garbage = p.Name, begin, last, ratio
+		reason := fmt.Sprintf("policy %s: garbage %.2f of chunks [%d, %d], disk free %.2f",
+			p.Name, ratio, begin, last, d.DiskFree)
+		gc, err := store.gcMgr.begin(bkt, GCState{Begin: begin, End: last, Policy: p.Name, Reason: reason}, Conf.GCMaxPerDisk)
+		if err != nil {
+			d.Reason = err.Error()
+			return
+		}
+		d.Started, d.Reason = true, reason
+		running[bkt.Device]++
+		logger.Infof("gc scheduler starts gc on bucket %s, %s", d.Bucket, d.Reason)
+		go store.gcMgr.run(bkt, gc, p.Merge)
+		return
+	}
+}
+
+// GCScheduler checks buckets for gc every GCSchedInterval seconds, it returns
+// at once if the interval is 0.
+func (store *HStore) GCScheduler() {
+	if Conf.GCSchedInterval <= 0 {
+		return
+	}
+	for i := range Conf.GCPolicies {
+		if err := Conf.GCPolicies[i].check(); err != nil {
+			logger.Errorf("gc scheduler not started: %s", err.Error())
+			return
+		}
+	}
+	logger.Infof("gc scheduler started, %d policies", len(Conf.GCPolicies))
+	interval := time.Duration(Conf.GCSchedInterval) * time.Second
+	for {
+		store.checkGC(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// PauseGCScheduler pauses or resumes the scheduler, running gc are not canceled.
+func (store *HStore) PauseGCScheduler(paused bool) {
+	store.gcSched.Lock()
+	defer store.gcSched.Unlock()
+	if store.gcSched.paused != paused {
+		logger.Infof("gc scheduler paused: %v", paused)
+	}
+	store.gcSched.paused = paused
+}
+
+func (store *HStore) GCSchedulerStatus() *GCSchedStatus {
+	sched := store.gcSched
+	sched.Lock()
+	defer sched.Unlock()
+	st := &GCSchedStatus{
+		Interval:   Conf.GCSchedInterval,
+		Paused:     sched.paused,
+		MaxPerDisk: Conf.GCMaxPerDisk,
+		MaxSetRate: Conf.GCMaxSetRate,
+		Policies:   Conf.GCPolicies,
+		LastCheck:  sched.lastCheck,
+	}
+	for _, d := range sched.decisions {
+		st.Decisions = append(st.Decisions, d)
+	}
+	sort.Slice(st.Decisions, func(i, j int) bool { return st.Decisions[i].Bucket < st.Decisions[j].Bucket })
+	return st
+}
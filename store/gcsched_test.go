@@ -0,0 +1,142 @@
+package store
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestGCPolicyWindow(t *testing.T) {
+	p := GCPolicy{Windows: []string{"01:00-06:00", "22:30-00:30"}}
+	if err := p.check(); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	for m, in := range map[int]bool{
+		0: true, 29: true, 30: false, 60: true, 359: true, 360: false, 22*60 + 29: false, 22*60 + 30: true,
+	} {
+		if p.inWindow(day.Add(time.Duration(m)*time.Minute)) != in {
+			t.Errorf("minute %d should be in window: %v", m, in)
+		}
+	}
+	for _, w := range []string{"1-6", "25:00-01:00", "01:60-02:00"} {
+		p = GCPolicy{Windows: []string{w}}
+		if p.check() == nil {
+			t.Errorf("%q should be bad", w)
+		}
+	}
+}
+
+func TestGCScheduler(t *testing.T) {
+	testGC(t, testGCSched, "sched", 100)
+}
+
+func testGCSched(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	gen := newKVGen(16)
+	var ki KeyInfo
+	// chunk 0 is all garbage
+	for ver := 0; ver < 2; ver++ {
+		for i := 0; i < numRecPerFile; i++ {
+			payload := gen.gen(&ki, i, ver)
+			cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+			if err := store.Set(&ki, payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	payload := gen.gen(&ki, -1, 0) // rotate
+	cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+	if err := store.Set(&ki, payload); err != nil {
+		t.Fatal(err)
+	}
+	bkt := store.buckets[bucketID]
+	for i := 0; i < 3; i++ {
+		bkt.datas.flush(i, true) // rotated chunks are flushed in background
+	}
+	if garbage := bkt.estimateGarbage(0, 1); garbage[0] != 1 || garbage[1] != 0 {
+		t.Fatalf("garbage %v", garbage)
+	}
+
+	Conf.GCMaxSetRate = 1
+	Conf.GCPolicies = []GCPolicy{
+		{Name: "never", Windows: []string{"00:00-00:00"}},
+		{Name: "chunk0", MinGarbage: 0.5, MaxChunks: 1},
+	}
+	now := time.Now()
+	check := func(started bool, reason string) GCDecision {
+		now = now.Add(time.Minute)
+		ds := store.checkGC(now)
+		if len(ds) != 1 || ds[0].Started != started || (reason != "" && ds[0].Reason != reason) {
+			t.Fatalf("%#v", ds)
+		}
+		return ds[0]
+	}
+	store.PauseGCScheduler(true)
+	check(false, "paused")
+	store.PauseGCScheduler(false)
+	atomic.AddInt64(&bkt.NumSet, 120)
+	check(false, "busy, 2.0 sets/s")
+
+	d := check(true, "")
+	if d.Policy != "chunk0" || d.Begin != 0 || d.End != 0 || d.Garbage != 1 {
+		t.Fatalf("%#v", d)
+	}
+	for i := 0; ; i++ {
+		if len(bkt.GCHistory) > 0 && !bkt.GCHistory[0].Running {
+			break
+		} else if i > 100 {
+			t.Fatalf("gc not done")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	gc := bkt.GCHistory[0]
+	if gc.Err != nil || gc.Policy != "chunk0" || gc.Reason != d.Reason || gc.NumReleased != int64(numRecPerFile) {
+		t.Fatalf("%#v", gc)
+	}
+	check(false, "garbage of chunks [1, 1] below 0.50")
+}
+
+func TestGCDeviceLimit(t *testing.T) {
+	mgr := &GCMgr{stat: make(map[*Bucket]*GCState)}
+	store := &HStore{gcMgr: mgr}
+	var bkts [3]*Bucket
+	for i := range bkts {
+		bkts[i] = &Bucket{}
+		bkts[i].ID = i
+		bkts[i].Device = "sda"
+		bkts[i].datas = NewdataStore(i, "")
+	}
+	bkts[2].Device = "sdb"
+
+	if _, err := mgr.begin(bkts[0], GCState{Begin: 0, End: 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.begin(bkts[0], GCState{}, 0); err != ErrGCRunning {
+		t.Fatalf("expect ErrGCRunning, got %v", err)
+	}
+	if _, err := mgr.begin(bkts[1], GCState{}, 1); err != ErrGCDeviceBusy {
+		t.Fatalf("expect ErrGCDeviceBusy, got %v", err)
+	}
+	if _, err := mgr.begin(bkts[2], GCState{}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.begin(bkts[1], GCState{}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(bkts[0].GCHistory) != 1 || !bkts[0].GCHistory[0].Running || len(bkts[1].GCHistory) != 1 {
+		t.Fatalf("%#v %#v", bkts[0].GCHistory, bkts[1].GCHistory)
+	}
+	if !store.IsGCRunning() {
+		t.Fatal("gc should be running")
+	}
+	if st := store.CancelAllGC(); len(st) != 3 || st[2].Disk != "sdb" {
+		t.Fatalf("%#v", st)
+	}
+	for _, bkt := range bkts {
+		if !bkt.GCHistory[0].CancelFlag {
+			t.Fatalf("bucket %d not canceled", bkt.ID)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// GC is throttled by bytes and records per second, shared by all running gc,
+// and backs off while the foreground is loaded, as reported by GCLoadFunc.
+
+const (
+	gcLoadCheckInterval = 100 * time.Millisecond
+	gcMinBackoff        = 10 * time.Millisecond
+	gcMaxBackoff        = time.Second
+	gcMinSleep          = 5 * time.Millisecond // shorter sleeps are accumulated
+)
+
+type GCLoad struct {
+	Waiting int           // requests waiting in the queue of the server
+	Latency time.Duration // recent average latency of gets
+}
+
+// GCLoadFunc is set by the server, nil if unknown.
+var GCLoadFunc func() GCLoad
+
+type GCThrottle struct {
+	MaxMBps       float64 // 0 for no limit
+	MaxRecsPerSec float64
+}
+
+type GCThrottleStatus struct {
+	GCThrottle
+	Backoff     time.Duration // current sleep per load check
+	NumBackoff  int64
+	TimeBackoff time.Duration
+	TimeLimited time.Duration // slept because of the rate limits
+	Load        GCLoad
+}
+
+type gcThrottle struct {
+	sync.Mutex
+	GCThrottleStatus
+	next      time.Time // when the next byte or record is allowed
+	lastCheck time.Time
+}
+
+func newGCThrottle() *gcThrottle {
+	t := &gcThrottle{}
+	t.MaxMBps = Conf.GCMaxMBps
+	t.MaxRecsPerSec = Conf.GCMaxRecsPerSec
+	return t
+}
+
+// checkLoad returns how long to back off, must be called with the lock held.
+func (t *gcThrottle) checkLoad(now time.Time) time.Duration {
+	if GCLoadFunc == nil || now.Sub(t.lastCheck) < gcLoadCheckInterval {
+		return 0
+	}
+	t.lastCheck = now
+	t.Load = GCLoadFunc()
+	busy := (Conf.GCBackoffLatencyMS > 0 && t.Load.Latency > time.Duration(Conf.GCBackoffLatencyMS)*time.Millisecond) ||
+		(Conf.GCBackoffWaiting > 0 && t.Load.Waiting > Conf.GCBackoffWaiting)
+	if busy {
+		t.Backoff *= 2
+		if t.Backoff < gcMinBackoff {
+			t.Backoff = gcMinBackoff
+		} else if t.Backoff > gcMaxBackoff {
+			t.Backoff = gcMaxBackoff
+		}
+		t.NumBackoff++
+		t.TimeBackoff += t.Backoff
+		return t.Backoff
+	}
+	t.Backoff /= 2
+	if t.Backoff < gcMinBackoff {
+		t.Backoff = 0
+	}
+	return 0
+}
+
+// wait blocks the gc for nbytes read or written and nrecs records handled.
+func (t *gcThrottle) wait(nbytes, nrecs int) {
+	t.Lock()
+	now := time.Now()
+	backoff := t.checkLoad(now)
+	var d time.Duration
+	if t.MaxMBps > 0 {
+		d = time.Duration(float64(nbytes) / (t.MaxMBps * (1 << 20)) * float64(time.Second))
+	}
+	if t.MaxRecsPerSec > 0 {
+		if d2 := time.Duration(float64(nrecs) / t.MaxRecsPerSec * float64(time.Second)); d2 > d {
+			d = d2
+		}
+	}
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(d)
+	sleep := t.next.Sub(now)
+	if sleep < gcMinSleep {
+		sleep = 0
+	} else {
+		t.TimeLimited += sleep
+	}
+	t.Unlock()
+	if sleep+backoff > 0 {
+		time.Sleep(sleep + backoff)
+	}
+}
+
+func (t *gcThrottle) set(th GCThrottle) {
+	t.Lock()
+	defer t.Unlock()
+	t.GCThrottle = th
+	t.next = time.Time{}
+	logger.Infof("gc throttle set to %.1f MB/s, %.0f records/s", th.MaxMBps, th.MaxRecsPerSec)
+}
+
+func (t *gcThrottle) status() GCThrottleStatus {
+	t.Lock()
+	defer t.Unlock()
+	return t.GCThrottleStatus
+}
+
+// SetGCThrottle changes the limits of gc, it takes effect on running gc at once.
+func (store *HStore) SetGCThrottle(th GCThrottle) {
+	store.gcMgr.throttle.set(th)
+}
+
+func (store *HStore) GCThrottleStatus() GCThrottleStatus {
+	return store.gcMgr.throttle.status()
+}
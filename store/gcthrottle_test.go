@@ -0,0 +1,64 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCThrottleRate(t *testing.T) {
+	Conf.InitDefault()
+	th := newGCThrottle()
+	th.set(GCThrottle{MaxRecsPerSec: 200})
+	st := time.Now()
+	for i := 0; i < 40; i++ {
+		th.wait(256, 1)
+	}
+	if d := time.Since(st); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("40 records at 200/s took %s", d)
+	}
+	th.set(GCThrottle{MaxMBps: 1})
+	st = time.Now()
+	th.wait(1<<18, 1)
+	th.wait(1<<18, 1)
+	if d := time.Since(st); d < 200*time.Millisecond || d > time.Second {
+		t.Fatalf("512K at 1MB/s took %s", d)
+	}
+}
+
+func TestGCThrottleBackoff(t *testing.T) {
+	Conf.InitDefault()
+	Conf.GCBackoffLatencyMS = 10
+	Conf.GCBackoffWaiting = 4
+	load := GCLoad{Latency: 20 * time.Millisecond}
+	GCLoadFunc = func() GCLoad { return load }
+	defer func() {
+		GCLoadFunc = nil
+	}()
+	th := newGCThrottle()
+	now := time.Now()
+	check := func(expect time.Duration) {
+		now = now.Add(gcLoadCheckInterval)
+		if d := th.checkLoad(now); d != expect {
+			t.Fatalf("backoff %s, expect %s, load %#v", d, expect, load)
+		}
+	}
+	check(10 * time.Millisecond)
+	check(20 * time.Millisecond)
+	if d := th.checkLoad(now); d != 0 {
+		t.Fatalf("load checked again at once, backoff %s", d)
+	}
+	load = GCLoad{Latency: time.Millisecond, Waiting: 5}
+	check(40 * time.Millisecond)
+	load.Waiting = 0
+	check(0)
+	if st := th.status(); st.Backoff != 20*time.Millisecond || st.NumBackoff != 3 {
+		t.Fatalf("%#v", st)
+	}
+	check(0)
+	check(0)
+	if st := th.status(); st.Backoff != 0 {
+		t.Fatalf("%#v", st)
+	}
+	load.Latency = time.Second
+	check(10 * time.Millisecond)
+}
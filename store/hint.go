@@ -624,6 +624,22 @@ func (h *hintMgr) getItemCollision(keyhash uint64, key string) (it *HintItem, Ch
 	return
 }
 
+// numKeys returns the number of hint items of a chunk, a key set in different
+// splits is counted more than once.
+func (h *hintMgr) numKeys(chunkID int) (n int) {
+	ck := h.chunks[chunkID]
+	ck.Lock()
+	defer ck.Unlock()
+	for _, sp := range ck.splits {
+		if sp.file != nil {
+			n += sp.file.numKey
+		} else if sp.buf != nil {
+			n += sp.buf.num
+		}
+	}
+	return
+}
+
 func (h *hintMgr) RemoveHintfilesByChunk(chunkID int) {
 	pattern := h.getPath(chunkID, -1, false)
 	paths, _ := filepath.Glob(pattern)
@@ -684,13 +700,17 @@ func (hm *hintMgr) loadHintsByChunk(chunkID int) (datasize uint32) {
 			} else {
 				datasize = sp.file.datasize
 			}
+			ck.Lock()
 			l := len(ck.splits)
 
 			bufsp := ck.splits[l-1]
 			ck.splits[l-1] = sp
 			ck.splits = append(ck.splits, bufsp)
+			ck.Unlock()
 		}
 	}
+	ck.Lock()
+	defer ck.Unlock()
 	if len(ck.splits) < 2 {
 		return 0
 	}
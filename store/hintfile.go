@@ -12,6 +12,10 @@ const (
 	HINTFILE_HEAD_SIZE = 16
 	HINTITEM_HEAD_SIZE = 23
 	HINTINDEX_ROW_SIZE = 4096
+
+	// an item with a sealed key has 0 as the key size, and then the size of
+	// the sealed key in 2 bytes and the id of the key to encrypt it in 4 bytes.
+	HINTITEM_SEALED_HEAD_SIZE = 6
 )
 
 type hintFileMeta struct {
@@ -40,10 +44,11 @@ type hintFileReader struct {
 	chunkID int
 	size    int64
 
-	fd     *os.File
-	rbuf   *bufio.Reader
-	offset int64
-	buf    [256]byte
+	fd      *os.File
+	rbuf    *bufio.Reader
+	offset  int64
+	buf     [256]byte
+	sealBuf []byte
 }
 
 func newHintFileReader(path string, chunkID, bufsize int) (reader *hintFileReader) {
@@ -108,6 +113,9 @@ func (reader *hintFileReader) next() (item *HintItem, err error) {
 	item.Ver = int32(binary.LittleEndian.Uint32(h[16:20]))
 	item.Vhash = binary.LittleEndian.Uint16(h[20:22])
 	ksz := int(h[22])
+	if ksz == 0 {
+		return reader.nextSealed(item)
+	}
 	key := reader.buf[:ksz]
 	readn, err = io.ReadFull(reader.rbuf, key)
 	if err != nil {
@@ -123,6 +131,33 @@ func (reader *hintFileReader) next() (item *HintItem, err error) {
 	return item, nil
 }
 
+// nextSealed reads the sealed key of item after its head.
+func (reader *hintFileReader) nextSealed(item *HintItem) (*HintItem, error) {
+	h := reader.buf[HINTITEM_HEAD_SIZE : HINTITEM_HEAD_SIZE+HINTITEM_SEALED_HEAD_SIZE]
+	if _, err := io.ReadFull(reader.rbuf, h); err != nil {
+		logger.Errorf("bad hint file %s: %s", reader.path, err.Error())
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint16(h[0:2]))
+	keyID := binary.LittleEndian.Uint32(h[2:6])
+	if cap(reader.sealBuf) < size {
+		reader.sealBuf = make([]byte, size)
+	}
+	sealed := reader.sealBuf[:size]
+	if _, err := io.ReadFull(reader.rbuf, sealed); err != nil {
+		logger.Errorf("bad hint file %s: %s", reader.path, err.Error())
+		return nil, err
+	}
+	key, err := open(keyID, reader.buf[:8], sealed)
+	if err != nil {
+		logger.Errorf("%s: %s", reader.path, err.Error())
+		return nil, err
+	}
+	item.Key = string(key)
+	reader.offset += HINTITEM_HEAD_SIZE + HINTITEM_SEALED_HEAD_SIZE + int64(size)
+	return item, nil
+}
+
 func (reader *hintFileReader) close() {
 	reader.fd.Close()
 }
@@ -131,7 +166,8 @@ func (reader *hintFileReader) close() {
 type hintFileWriter struct {
 	index *hintFileIndexBuffer
 	hintFileMeta
-	path string
+	path  string
+	keyID uint32 // to seal keys if not 0
 
 	fd     *os.File
 	wbuf   *bufio.Writer
@@ -140,6 +176,10 @@ type hintFileWriter struct {
 }
 
 func newHintFileWriter(path string, maxOffset uint32, bufsize int) (w *hintFileWriter, err error) {
+	keyID, err := currentKeyID()
+	if err != nil {
+		return
+	}
 	var fd *os.File
 	tmp := path + ".tmp"
 	logger.Infof("create hint file: %s", tmp)
@@ -154,6 +194,7 @@ func newHintFileWriter(path string, maxOffset uint32, bufsize int) (w *hintFileW
 		wbuf:         wbuf,
 		offset:       HINTFILE_HEAD_SIZE,
 		path:         path,
+		keyID:        keyID,
 		hintFileMeta: hintFileMeta{datasize: maxOffset}}
 	w.wbuf.Write(w.buf[:HINTFILE_HEAD_SIZE])
 	w.index = newHintFileIndex()
@@ -167,14 +208,31 @@ func (w *hintFileWriter) writeItem(item *HintItem) error {
 	binary.LittleEndian.PutUint32(h[12:16], item.Pos.Offset)
 	binary.LittleEndian.PutUint32(h[16:20], uint32(item.Ver))
 	binary.LittleEndian.PutUint16(h[20:22], item.Vhash)
-	h[22] = byte(len(item.Key))
-	w.wbuf.Write(h)
-	w.wbuf.WriteString(item.Key)
+	size := HINTITEM_HEAD_SIZE + len(item.Key)
+	if w.keyID != 0 {
+		sealed, err := seal(w.keyID, h[:8], []byte(item.Key))
+		if err != nil {
+			logger.Errorf("fail to encrypt key in %s: %s", w.path, err.Error())
+			return err
+		}
+		h[22] = 0
+		w.wbuf.Write(h)
+		sh := w.buf[HINTITEM_HEAD_SIZE : HINTITEM_HEAD_SIZE+HINTITEM_SEALED_HEAD_SIZE]
+		binary.LittleEndian.PutUint16(sh[0:2], uint16(len(sealed)))
+		binary.LittleEndian.PutUint32(sh[2:6], w.keyID)
+		w.wbuf.Write(sh)
+		w.wbuf.Write(sealed)
+		size = HINTITEM_HEAD_SIZE + HINTITEM_SEALED_HEAD_SIZE + len(sealed)
+	} else {
+		h[22] = byte(len(item.Key))
+		w.wbuf.Write(h)
+		w.wbuf.WriteString(item.Key)
+	}
 	// TODO: refactor
 	if (w.offset - w.index.lastoffset) > int64(Conf.IndexIntervalSize-HINTITEM_HEAD_SIZE-256) {
 		w.index.append(item.Keyhash, w.offset)
 	}
-	w.offset += HINTITEM_HEAD_SIZE + int64(len(item.Key))
+	w.offset += int64(size)
 	w.numKey += 1
 	return nil
 }
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// Old versions of a key stay in data files until GC. Hints keep only the last
+// record of a key in each split, so without the version index the versions
+// overwritten within one split are not found.
+
+type VersionInfo struct {
+	Ver      int32 // < 0 for delete
+	TS       uint32
+	TS64     uint64 // 0 for a header of version 1
+	Time     time.Time
+	Flag     uint32
+	Size     uint32 // as stored, maybe compressed
+	Pos      Position
+	InBuffer bool
+}
+
+// versionIndex keeps positions of known records of each key of a bucket, at
+// most maxVers of a key and maxItems in all. It is built from hint files on
+// first use, updated on each write, and dropped by GC, which moves records and
+// removes old ones. Once any item is evicted, keys are looked up in hints too.
+type versionIndex struct {
+	sync.Mutex
+	bucketID int
+	built    bool
+	items    map[uint64][]HintItem // Pos.ChunkID is the real chunk, oldest first
+	num      int
+	evicted  int
+	maxItems int
+	maxVers  int
+}
+
+func newVersionIndex(bucketID, maxItems, maxVers int) *versionIndex {
+	return &versionIndex{bucketID: bucketID, maxItems: maxItems, maxVers: maxVers}
+}
+
+func (idx *versionIndex) reset() {
+	idx.Lock()
+	idx.built = false
+	idx.items = nil
+	idx.num = 0
+	idx.evicted = 0
+	idx.Unlock()
+}
+
+// add must be called with the lock held
+func (idx *versionIndex) add(it *HintItem) {
+	items := idx.items[it.Keyhash]
+	for _, old := range items {
+		if old.Pos == it.Pos && old.Key == it.Key {
+			return
+		}
+	}
+	if len(items) >= idx.maxVers {
+		copy(items, items[1:])
+		items = items[:len(items)-1]
+		idx.num--
+		idx.evicted++
+	} else if len(items) == 0 && idx.num >= idx.maxItems {
+		idx.evictKey()
+	}
+	idx.items[it.Keyhash] = append(items, *it)
+	idx.num++
+}
+
+// evictKey removes the items of a random keyhash, with the lock held.
+func (idx *versionIndex) evictKey() {
+	for h, items := range idx.items {
+		delete(idx.items, h)
+		idx.num -= len(items)
+		if idx.evicted == 0 {
+			logger.Warnf("version index of bucket %d is full, %d items", idx.bucketID, idx.maxItems)
+		}
+		idx.evicted += len(items)
+		return
+	}
+}
+
+func (idx *versionIndex) set(ki *KeyInfo, meta *Meta, pos Position) {
+	idx.Lock()
+	if idx.built {
+		idx.add(newHintItem(ki.KeyHash, meta.Ver, meta.ValueHash, pos, ki.StringKey))
+	}
+	idx.Unlock()
+}
+
+// get returns the items of a key, partial is true if any item is evicted.
+func (idx *versionIndex) get(h *hintMgr, keyhash uint64, key string) (items []HintItem, partial bool, err error) {
+	idx.Lock()
+	defer idx.Unlock()
+	if !idx.built {
+		if err = idx.build(h); err != nil {
+			idx.items = nil
+			return
+		}
+		idx.built = true
+	}
+	for _, it := range idx.items[keyhash] {
+		if it.Key == key {
+			items = append(items, it)
+		}
+	}
+	partial = idx.evicted > 0
+	return
+}
+
+// build reads all hint splits, dumped or not, with the lock held.
+func (idx *versionIndex) build(h *hintMgr) error {
+	st := time.Now()
+	idx.items = make(map[uint64][]HintItem)
+	for i := 0; i <= h.maxChunkID; i++ {
+		ck := h.chunks[i]
+		ck.Lock()
+		var paths []string
+		for _, sp := range ck.splits {
+			if sp.file != nil {
+				paths = append(paths, sp.file.path)
+			} else if sp.buf != nil {
+				for _, it := range sp.buf.items[:sp.buf.num] {
+					item := *it
+					item.Pos.ChunkID = i
+					idx.add(&item)
+				}
+			}
+		}
+		ck.Unlock()
+		for _, path := range paths {
+			r := newHintFileReader(path, i, 1<<20)
+			if err := r.open(); err != nil {
+				if os.IsNotExist(err) { // removed by merge or gc
+					continue
+				}
+				return err
+			}
+			for {
+				it, err := r.next()
+				if err != nil {
+					r.close()
+					return err
+				}
+				if it == nil {
+					break
+				}
+				it.Pos.ChunkID = i
+				idx.add(it)
+			}
+			r.close()
+		}
+	}
+	logger.Infof("version index of bucket %d built, %d keyhash, %d evicted, use time %s",
+		idx.bucketID, len(idx.items), idx.evicted, time.Since(st))
+	return nil
+}
+
+// versionPositions returns the known positions of a key, the current one first.
+func (bkt *Bucket) versionPositions(ki *KeyInfo) (items []HintItem, err error) {
+	if it, _ := bkt.hints.collisions.get(ki.KeyHash, ki.StringKey); it != nil {
+		items = append(items, *it)
+	} else if meta, pos, found := bkt.htree.get(ki); found {
+		items = append(items, *newHintItem(ki.KeyHash, meta.Ver, meta.ValueHash, pos, ki.StringKey))
+	}
+	partial := true
+	if bkt.versions != nil {
+		var more []HintItem
+		if more, partial, err = bkt.versions.get(bkt.hints, ki.KeyHash, ki.StringKey); err != nil {
+			return
+		}
+		items = append(items, more...)
+	}
+	if partial {
+		var locs []HintLocation
+		locs, err = bkt.hints.allItems(ki.KeyHash, ki.StringKey)
+		for _, loc := range locs {
+			items = append(items, loc.Item)
+		}
+	}
+	return
+}
+
+// listVersions reads the header of each known record of a key, records moved
+// or removed by GC are skipped.
+func (bkt *Bucket) listVersions(ki *KeyInfo) (versions []VersionInfo, err error) {
+	items, err := bkt.versionPositions(ki)
+	if err != nil {
+		return
+	}
+	seen := make(map[int32]bool)
+	for _, it := range items {
+		if seen[it.Ver] {
+			continue
+		}
+		wrec, inbuffer, e := bkt.datas.readRecordRaw(it.Pos)
+		if e != nil {
+			logger.Warnf("read version %d of %s at %v: %s", it.Ver, ki.StringKey, it.Pos, e.Error())
+			continue
+		} else if wrec == nil {
+			continue
+		}
+		p := wrec.rec.Payload
+		if bytes.Equal(wrec.rec.Key, ki.Key) && p.Ver == it.Ver {
+			seen[it.Ver] = true
+			versions = append(versions, VersionInfo{
+				Ver:      p.Ver,
+				TS:       p.TS,
+				TS64:     p.TS64,
+				Time:     p.Time(),
+				Flag:     p.Flag,
+				Size:     wrec.vsz,
+				Pos:      it.Pos,
+				InBuffer: inbuffer,
+			})
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(p.CArray.Cap)
+		p.CArray.Free()
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := abs(versions[i].Ver), abs(versions[j].Ver)
+		if a != b {
+			return a > b
+		}
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return
+}
+
+func (store *HStore) readyBucket(ki *KeyInfo) (*Bucket, error) {
+	ki.KeyHash = getKeyHash(ki.Key)
+	ki.Prepare()
+	bkt := store.getBucket(ki.BucketID)
+	if bkt == nil {
+		return nil, ErrBucketNotServed
+	}
+	return bkt, nil
+}
+
+// ListVersions returns the records of a key still in data files, newest first.
+func (store *HStore) ListVersions(ki *KeyInfo) ([]VersionInfo, error) {
+	bkt, err := store.readyBucket(ki)
+	if err != nil {
+		return nil, err
+	}
+	return bkt.listVersions(ki)
+}
+
+// GetVersion returns the value of version ver of a key, or the newest version
+// set at or before ts if ver is 0. The payload is nil if there is no such
+// version or the key was deleted then; info is still set for a delete.
+// As Get, the caller should free the payload.
+func (store *HStore) GetVersion(ki *KeyInfo, ver int32, ts uint32) (payload *Payload, info *VersionInfo, err error) {
+	bkt, err := store.readyBucket(ki)
+	if err != nil {
+		return
+	}
+	versions, err := bkt.listVersions(ki)
+	if err != nil {
+		return
+	}
+	for i := range versions {
+		v := &versions[i]
+		if (ver != 0 && v.Ver == ver) || (ver == 0 && v.TS <= ts) {
+			info = v
+			break
+		}
+	}
+	if info == nil || info.Ver < 0 {
+		return
+	}
+	rec, _, err := bkt.datas.GetRecordByPos(info.Pos)
+	if err != nil {
+		return
+	} else if rec == nil || !bytes.Equal(rec.Key, ki.Key) {
+		if rec != nil {
+			cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+			rec.Payload.CArray.Free()
+		}
+		return nil, nil, fmt.Errorf("version %d of %s moved by gc", info.Ver, ki.StringKey)
+	}
+	payload = rec.Payload
+	return
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestVersionIndex(t *testing.T) {
+	testVersions(t, true)
+}
+
+func TestVersionsFromHints(t *testing.T) {
+	testVersions(t, false)
+}
+
+func testVersions(t *testing.T, index bool) {
+	setupTest(fmt.Sprintf("TestVersions_%v", index))
+	defer clearTest()
+
+	numbucket := 1
+	Conf.NumBucket = numbucket
+	Conf.BucketsStat = make([]int, numbucket)
+	Conf.BucketsStat[0] = 1
+	Conf.TreeHeight = 3
+	Conf.VersionIndex = index
+	defer func() {
+		Conf.VersionIndex = false
+	}()
+	Conf.Init()
+	os.Mkdir(GetBucketPath(0), 0777)
+
+	gen := newKVGen(numbucket)
+	getKeyHash = makeKeyHasherParseKey(gen.depth, 0)
+	defer func() {
+		getKeyHash = getKeyHashDefalut
+	}()
+
+	store, err := NewHStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var ki KeyInfo
+	gen.gen(&ki, 0, 0)
+	if versions, err := store.ListVersions(&ki); err != nil || len(versions) != 0 {
+		t.Fatalf("%v %v", versions, err)
+	}
+
+	N := 3
+	for ver := 0; ver < N; ver++ {
+		payload := gen.gen(&ki, 0, ver)
+		payload.TS = uint32(100 * (ver + 1))
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payload := GetPayloadForDelete()
+	payload.TS = 400
+	if err := store.Set(&ki, payload); err != nil {
+		t.Fatal(err)
+	}
+	store.flushdatas(true)
+
+	versions, err := store.ListVersions(&ki)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index {
+		// only the delete, the hint split keeps the last record
+		if len(versions) != 1 || versions[0].Ver != -int32(N+1) {
+			t.Fatalf("%#v", versions)
+		}
+		return
+	}
+	if len(versions) != N+1 {
+		t.Fatalf("%#v", versions)
+	}
+	for i, v := range versions {
+		if abs(v.Ver) != int32(N+1-i) || v.TS != uint32(100*(N+1-i)) {
+			t.Fatalf("%d: %#v", i, v)
+		}
+	}
+
+	check := func(ver int32, ts uint32, value string, infoVer int32) {
+		p, info, err := store.GetVersion(&ki, ver, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if infoVer == 0 {
+			if info != nil || p != nil {
+				t.Fatalf("ver %d ts %d: should not find %#v", ver, ts, info)
+			}
+			return
+		}
+		if info == nil || info.Ver != infoVer {
+			t.Fatalf("ver %d ts %d: got %#v, expect ver %d", ver, ts, info, infoVer)
+		}
+		if value == "" {
+			if p != nil {
+				t.Fatalf("ver %d ts %d: deleted, but got %q", ver, ts, p.Body)
+			}
+			return
+		}
+		if p == nil || string(p.Body) != value {
+			t.Fatalf("ver %d ts %d: got %v, expect %q", ver, ts, p, value)
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(p.CArray.Cap)
+		p.CArray.Free()
+	}
+	check(1, 0, "value_0_0", 1)
+	check(2, 0, "value_0_1", 2)
+	check(5, 0, "", 0)
+	check(0, 99, "", 0)
+	check(0, 250, "value_0_1", 2)
+	check(0, 300, "value_0_2", 3)
+	check(0, 1000, "", -4)
+}
+
+func TestVersionIndexLimits(t *testing.T) {
+	Conf.InitDefault()
+	Conf.NumBucket = 16
+	Conf.BucketVersionIndex = map[string]bool{"0a": true, "01": false}
+	defer Conf.InitDefault()
+	if err := Conf.checkVersionIndex(); err != nil {
+		t.Fatal(err)
+	}
+	Conf.VersionIndex = true
+	if !Conf.versionIndex(10) || Conf.versionIndex(1) || !Conf.versionIndex(2) {
+		t.Fatal("bad version index of buckets")
+	}
+	Conf.BucketVersionIndex["10"] = true
+	if err := Conf.checkVersionIndex(); err == nil {
+		t.Fatal("bucket 0x10 accepted")
+	}
+
+	idx := newVersionIndex(0, 3, 2)
+	idx.built = true
+	idx.items = make(map[uint64][]HintItem)
+	add := func(keyhash uint64, ver int32) {
+		idx.add(newHintItem(keyhash, ver, 0, Position{0, uint32(ver) * 256}, fmt.Sprintf("key%d", keyhash)))
+	}
+	for ver := int32(1); ver <= 3; ver++ {
+		add(1, ver)
+	}
+	items, partial, err := idx.get(nil, 1, "key1")
+	if err != nil || !partial || len(items) != 2 || items[0].Ver != 2 || items[1].Ver != 3 || idx.num != 2 {
+		t.Fatalf("%v %v %#v", err, partial, items)
+	}
+	add(2, 1)
+	add(3, 1)
+	// key1 is evicted, as the index is full
+	if idx.num != 2 || len(idx.items) != 2 || idx.items[1] != nil || idx.items[3] == nil {
+		t.Fatalf("%d %#v", idx.num, idx.items)
+	}
+	idx.reset()
+	if idx.num != 0 || idx.evicted != 0 {
+		t.Fatalf("%d %d", idx.num, idx.evicted)
+	}
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Retention holds keep all versions of some keys through GC until they
+// expire. They are saved in holds.yaml of the bucket, which only exists while
+// the bucket has holds.
+
+var ErrNoHold = errors.New("no such hold")
+
+type RetentionHold struct {
+	Pattern string    `yaml:"pattern"` // a key, or a glob where * matches any chars and ? one char
+	Expire  time.Time `yaml:"expire"`
+	Reason  string    `yaml:"reason,omitempty"`
+	Created time.Time `yaml:"created"`
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	s := regexp.QuoteMeta(pattern)
+	s = strings.Replace(s, `\*`, ".*", -1)
+	s = strings.Replace(s, `\?`, ".", -1)
+	return regexp.Compile("^" + s + "$")
+}
+
+type holdTable struct {
+	sync.Mutex
+	path  string
+	holds []RetentionHold
+
+	// derived from holds
+	keys  map[string]time.Time
+	globs []*regexp.Regexp
+	ends  []time.Time
+}
+
+type holdFile struct {
+	Holds []RetentionHold `yaml:"holds"`
+}
+
+func newHoldTable(home string) *holdTable {
+	return &holdTable{path: fmt.Sprintf("%s/%s", home, "holds.yaml")}
+}
+
+func (t *holdTable) load() error {
+	content, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var f holdFile
+	if err = yaml.Unmarshal(content, &f); err != nil {
+		return fmt.Errorf("bad %s: %s", t.path, err.Error())
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.holds = f.Holds
+	return t.compile()
+}
+
+// compile must be called with the lock held
+func (t *holdTable) compile() error {
+	t.keys = make(map[string]time.Time)
+	t.globs = nil
+	t.ends = nil
+	for _, h := range t.holds {
+		if !isGlob(h.Pattern) {
+			if h.Expire.After(t.keys[h.Pattern]) {
+				t.keys[h.Pattern] = h.Expire
+			}
+			continue
+		}
+		re, err := globToRegexp(h.Pattern)
+		if err != nil {
+			return err
+		}
+		t.globs = append(t.globs, re)
+		t.ends = append(t.ends, h.Expire)
+	}
+	return nil
+}
+
+// dump must be called with the lock held
+func (t *holdTable) dump() error {
+	if len(t.holds) == 0 {
+		if err := os.Remove(t.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := yaml.Marshal(&holdFile{t.holds})
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// prune removes expired holds, must be called with the lock held.
+func (t *holdTable) prune(now time.Time) (changed bool) {
+	holds := t.holds[:0]
+	for _, h := range t.holds {
+		if h.Expire.After(now) {
+			holds = append(holds, h)
+		} else {
+			logger.Infof("retention hold expired: %s", h.Pattern)
+			changed = true
+		}
+	}
+	t.holds = holds
+	return
+}
+
+// add replaces the hold of the same pattern.
+func (t *holdTable) add(h RetentionHold) error {
+	if isGlob(h.Pattern) {
+		if _, err := globToRegexp(h.Pattern); err != nil {
+			return err
+		}
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.prune(time.Now())
+	found := false
+	for i := range t.holds {
+		if t.holds[i].Pattern == h.Pattern {
+			t.holds[i] = h
+			found = true
+		}
+	}
+	if !found {
+		t.holds = append(t.holds, h)
+	}
+	t.compile()
+	return t.dump()
+}
+
+func (t *holdTable) remove(pattern string) error {
+	t.Lock()
+	defer t.Unlock()
+	n := len(t.holds)
+	holds := t.holds[:0]
+	for _, h := range t.holds {
+		if h.Pattern != pattern {
+			holds = append(holds, h)
+		}
+	}
+	t.holds = holds
+	if len(holds) == n {
+		return ErrNoHold
+	}
+	t.compile()
+	return t.dump()
+}
+
+func (t *holdTable) list() []RetentionHold {
+	t.Lock()
+	defer t.Unlock()
+	return append([]RetentionHold(nil), t.holds...)
+}
+
+// expireOld is called before GC, so that an expired hold is released.
+func (t *holdTable) expireOld() {
+	t.Lock()
+	defer t.Unlock()
+	if t.prune(time.Now()) {
+		t.compile()
+		if err := t.dump(); err != nil {
+			logger.Errorf("dump %s: %s", t.path, err.Error())
+		}
+	}
+}
+
+func (t *holdTable) isHeld(key string, now time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+	if end, ok := t.keys[key]; ok && end.After(now) {
+		return true
+	}
+	for i, re := range t.globs {
+		if t.ends[i].After(now) && re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddHold puts keys matching pattern under hold until expire. A pattern
+// without * or ? is a key and goes to its bucket, a glob goes to bucketID, or
+// to all buckets if bucketID is -1.
+func (store *HStore) AddHold(bucketID int, pattern, reason string, expire time.Time) (buckets []int, err error) {
+	if pattern == "" || !expire.After(time.Now()) {
+		return nil, fmt.Errorf("need a pattern and an expire time in the future")
+	}
+	h := RetentionHold{Pattern: pattern, Expire: expire, Reason: reason, Created: time.Now()}
+	if !isGlob(pattern) {
+		if !IsValidKeyString(pattern) {
+			return nil, fmt.Errorf("bad key %q", pattern)
+		}
+		ki := NewKeyInfoFromBytes([]byte(pattern), getKeyHash([]byte(pattern)), false)
+		if bucketID >= 0 && bucketID != ki.BucketID {
+			return nil, fmt.Errorf("key %s is in bucket %d", pattern, ki.BucketID)
+		}
+		bucketID = ki.BucketID
+	}
+	for id, bkt := range store.buckets {
+		if (bucketID >= 0 && id != bucketID) || bkt.State != BUCKET_STAT_READY {
+			continue
+		}
+		if err = bkt.holds.add(h); err != nil {
+			return
+		}
+		buckets = append(buckets, id)
+	}
+	if len(buckets) == 0 {
+		err = ErrBucketNotServed
+	}
+	return
+}
+
+// RemoveHold removes the hold of pattern in bucketID, or in all buckets if -1.
+func (store *HStore) RemoveHold(bucketID int, pattern string) (buckets []int, err error) {
+	for id, bkt := range store.buckets {
+		if (bucketID >= 0 && id != bucketID) || bkt.State != BUCKET_STAT_READY {
+			continue
+		}
+		if e := bkt.holds.remove(pattern); e == nil {
+			buckets = append(buckets, id)
+		} else if e != ErrNoHold {
+			return buckets, e
+		}
+	}
+	if len(buckets) == 0 {
+		err = ErrNoHold
+	}
+	return
+}
+
+// GetHolds returns holds of served buckets, by bucket id.
+func (store *HStore) GetHolds() map[int][]RetentionHold {
+	res := make(map[int][]RetentionHold)
+	for id, bkt := range store.buckets {
+		if bkt.State != BUCKET_STAT_READY {
+			continue
+		}
+		if holds := bkt.holds.list(); len(holds) > 0 {
+			sort.Slice(holds, func(i, j int) bool { return holds[i].Pattern < holds[j].Pattern })
+			res[id] = holds
+		}
+	}
+	return res
+}
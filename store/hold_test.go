@@ -0,0 +1,159 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestHoldTable(t *testing.T) {
+	setupTest("TestHoldTable")
+	defer clearTest()
+
+	tab := newHoldTable(dir)
+	expire := time.Now().Add(time.Hour)
+	if err := tab.add(RetentionHold{Pattern: "a/*/c?", Expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tab.add(RetentionHold{Pattern: "k.1", Expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for key, held := range map[string]bool{
+		"a/b/c1": true, "a/b/x/c2": true, "a/b/c": false, "k.1": true, "kx1": false,
+	} {
+		if tab.isHeld(key, now) != held {
+			t.Errorf("%s should be held: %v", key, held)
+		}
+	}
+	if tab.isHeld("k.1", expire.Add(time.Second)) {
+		t.Errorf("hold should expire")
+	}
+
+	tab2 := newHoldTable(dir)
+	if err := tab2.load(); err != nil || len(tab2.list()) != 2 || !tab2.isHeld("a/b/c1", now) {
+		t.Fatalf("load: %v %#v", err, tab2.list())
+	}
+	if err := tab2.remove("a/*/c?"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tab2.remove("a/*/c?"); err != ErrNoHold {
+		t.Fatalf("remove twice: %v", err)
+	}
+	tab2.remove("k.1")
+	if _, err := os.Stat(tab2.path); !os.IsNotExist(err) {
+		t.Fatalf("%s should be removed when empty", tab2.path)
+	}
+}
+
+func TestGCHold(t *testing.T) {
+	setupTest("TestGCHold")
+	defer clearTest()
+
+	numbucket := 16
+	bucketID := numbucket - 1
+	Conf.NumBucket = numbucket
+	Conf.BucketsStat = make([]int, numbucket)
+	Conf.BucketsStat[bucketID] = 1
+	Conf.TreeHeight = 3
+	getKeyHash = makeKeyHasherFixBucket(1, bucketID)
+	defer func() {
+		getKeyHash = getKeyHashDefalut
+	}()
+	numRecPerFile := 100
+	Conf.DataFileMaxStr = strconv.Itoa(256 * numRecPerFile)
+	Conf.Init()
+	bucketDir := filepath.Join(Conf.Home, "f")
+	os.Mkdir(bucketDir, 0777)
+
+	store, err := NewHStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := newKVGen(numbucket)
+	var ki KeyInfo
+	N := numRecPerFile / 2
+	set := func(i, ver int) {
+		payload := gen.gen(&ki, i, ver)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for ver := 0; ver < 2; ver++ {
+		for i := 0; i < N; i++ {
+			set(i, ver)
+		}
+	}
+	store.flushdatas(true)
+	set(-1, 0) // rotate
+	store.flushdatas(true)
+
+	expire := time.Now().Add(time.Hour)
+	// key_f_0 ... key_f_f and key_f_20
+	if _, err := store.AddHold(-1, "key_f_?", "", expire); err != nil {
+		t.Fatal(err)
+	}
+	if buckets, err := store.AddHold(-1, "key_f_20", "", expire); err != nil || len(buckets) != 1 {
+		t.Fatalf("%v %v", buckets, err)
+	}
+	numHeld := 17
+
+	bkt := store.buckets[bucketID]
+	store.gcMgr.gc(bkt, 0, 0, true)
+	gc := bkt.GCHistory[len(bkt.GCHistory)-1]
+	if gc.Err != nil || gc.NumHeld != int64(numHeld) || gc.NumReleased != int64(N-numHeld) {
+		t.Fatalf("%#v", gc)
+	}
+	checkDataSize(t, bkt.datas, []uint32{uint32(256 * (N + numHeld)), 256})
+
+	check := func() {
+		for i := 0; i < N; i++ {
+			payload := gen.gen(&ki, i, 1)
+			payload2, _, err := store.Get(&ki, false)
+			if err != nil || payload2 == nil {
+				t.Fatalf("%d: %v %v", i, payload2, err)
+			}
+			if string(payload2.Body) != string(payload.Body) {
+				t.Fatalf("%d: got %s", i, payload2.Body)
+			}
+			cmem.DBRL.GetData.SubSizeAndCount(payload2.CArray.Cap)
+			payload2.CArray.Free()
+		}
+		for _, i := range []int{0, 15, 32, 16} {
+			gen.gen(&ki, i, 0)
+			positions, err := store.buckets[bucketID].datas.scanKey(ki.Key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect := 2
+			if i == 16 {
+				expect = 1
+			}
+			if len(positions) != expect {
+				t.Fatalf("key %d: %#v", i, positions)
+			}
+		}
+	}
+	check()
+
+	// the old versions are before the new ones after the htree is rebuilt
+	store.Close()
+	os.Remove(filepath.Join(bucketDir, "000.000.idx.hash"))
+	if store, err = NewHStore(); err != nil {
+		t.Fatal(err)
+	}
+	if holds := store.GetHolds()[bucketID]; len(holds) != 2 {
+		t.Fatalf("holds not loaded: %#v", holds)
+	}
+	check()
+	store.Close()
+	if !cmem.DBRL.IsZero() {
+		t.Fatalf("%#v", cmem.DBRL)
+	}
+	checkAllDataWithHints(bucketDir)
+}
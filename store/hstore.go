@@ -2,9 +2,11 @@ package store
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,12 +20,18 @@ import (
 var (
 	logger    = loghub.ErrorLogger
 	mergeChan chan int
-	gcLock    sync.Mutex
+
+	ErrHintBusy        = errors.New("hint merge or gc in progress")
+	ErrBucketNotServed = errors.New("bucket not served")
+	ErrGCRunning       = errors.New("gc already running")
+	ErrGCDeviceBusy    = errors.New("too many gc running on the device")
 )
 
 type HStore struct {
 	buckets   []*Bucket
 	gcMgr     *GCMgr
+	gcSched   *gcScheduler
+	scrubber  *scrubber
 	htree     *HTree
 	htreeLock sync.Mutex
 }
@@ -76,6 +84,24 @@ func (store *HStore) allocBucket(bucketID int) (err error) {
 }
 
 func NewHStore() (store *HStore, err error) {
+	if Conf.RecordVersion != RECORD_VERSION_1 && Conf.RecordVersion != RECORD_VERSION_2 {
+		return nil, fmt.Errorf("bad record version %d", Conf.RecordVersion)
+	}
+	if err := checkCodecConfig(); err != nil {
+		return nil, err
+	}
+	if err := Conf.checkPadding(); err != nil {
+		return nil, err
+	}
+	if err := Conf.checkVersionIndex(); err != nil {
+		return nil, err
+	}
+	if err := initKeys(); err != nil {
+		return nil, err
+	}
+	if _, err := ParseDurability(Conf.Durability); err != nil {
+		return nil, err
+	}
 	home := Conf.Home
 	if err := os.MkdirAll(home, os.ModePerm); err != nil {
 		logger.Fatalf("fail to init home %s", home)
@@ -84,7 +110,9 @@ func NewHStore() (store *HStore, err error) {
 	cmem.DBRL.ResetAll()
 	st := time.Now()
 	store = new(HStore)
-	store.gcMgr = &GCMgr{stat: make(map[*Bucket]*GCState)}
+	store.gcMgr = &GCMgr{stat: make(map[*Bucket]*GCState), throttle: newGCThrottle()}
+	store.gcSched = newGCScheduler()
+	store.scrubber = newScrubber()
 	store.buckets = make([]*Bucket, Conf.NumBucket)
 	for i := 0; i < Conf.NumBucket; i++ {
 		store.buckets[i] = &Bucket{}
@@ -146,6 +174,7 @@ func NewHStore() (store *HStore, err error) {
 	}
 	logger.Infof("all %d bucket loaded, ready to serve, maxrss = %d, use time %s",
 		n, utils.GetMaxRSS(), time.Since(st))
+	store.resumeGC()
 	return
 }
 
@@ -168,6 +197,24 @@ func (store *HStore) flushdatas(force bool) {
 	}
 }
 
+// MergeHints starts merging the dumped hint files of a bucket in background.
+func (store *HStore) MergeHints(bucketID int) error {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return fmt.Errorf("no data for bucket id: %d", bucketID)
+	}
+	if bkt.hints.state&(HintStateMerge|HintStateGC) != 0 {
+		return ErrHintBusy
+	}
+	go bkt.hints.Merge(false)
+	return nil
+}
+
+// Flush writes all buffered records to data files now.
+func (store *HStore) Flush() {
+	store.flushdatas(true)
+}
+
 func (store *HStore) Close() {
 	for _, b := range store.buckets {
 		if b.datas != nil {
@@ -245,30 +292,87 @@ func (store *HStore) ListDir(ki *KeyInfo) ([]byte, error) {
 	return store.ListUpper(ki)
 }
 
-func (store *HStore) GCBuckets() map[string][]string {
-
-	fetchRemain := func(current, end int, b *Bucket) int {
-		var cnt int
-		for i := current; i <= end; i++ {
-			if b.datas.chunks[i].size > 0 {
-				cnt++
-			}
+func gcRemain(b *Bucket, current, end int) int {
+	var cnt int
+	for i := current; i <= end; i++ {
+		if b.datas.chunks[i].size > 0 {
+			cnt++
 		}
-		return cnt
 	}
+	return cnt
+}
 
+func (store *HStore) GCBuckets() map[string][]string {
 	store.gcMgr.mu.Lock()
 	result := make(map[string][]string)
 	for bkt, st := range store.gcMgr.stat {
-		disk, _ := utils.DiskUsage(bkt.Home)
-		remain := fetchRemain(st.Src, st.End, bkt)
+		remain := gcRemain(bkt, st.Src, st.End)
 		gcResult := fmt.Sprintf("bkt: %02x, start -> %d, end -> %d, remain -> %d", bkt.ID, st.Begin, st.End, remain)
-		result[disk.Root] = append(result[disk.Root], gcResult)
+		result[bkt.Device] = append(result[bkt.Device], gcResult)
 	}
 	store.gcMgr.mu.Unlock()
 	return result
 }
 
+// GCStatus is a running gc, as reported by the admin api.
+type GCStatus struct {
+	Bucket string
+	Disk   string
+	Remain int    // chunks with data in [Src, End]
+	Error  string `json:",omitempty"`
+	GCState
+}
+
+func newGCStatus(bkt *Bucket, st *GCState) GCStatus {
+	s := GCStatus{
+		Bucket:  config.BucketIDHex(bkt.ID, Conf.NumBucket),
+		Disk:    bkt.Device,
+		Remain:  gcRemain(bkt, st.Src, st.End),
+		GCState: *st,
+	}
+	if st.Err != nil {
+		s.Error = st.Err.Error()
+	}
+	return s
+}
+
+// GCStatus returns all running gc, ordered by bucket.
+func (store *HStore) GCStatus() []GCStatus {
+	store.gcMgr.mu.RLock()
+	defer store.gcMgr.mu.RUnlock()
+	res := make([]GCStatus, 0, len(store.gcMgr.stat))
+	for bkt, st := range store.gcMgr.stat {
+		res = append(res, newGCStatus(bkt, st))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Bucket < res[j].Bucket })
+	return res
+}
+
+// GetGCStatus returns nil if the bucket is not gcing.
+func (store *HStore) GetGCStatus(bucketID int) *GCStatus {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil
+	}
+	store.gcMgr.mu.RLock()
+	defer store.gcMgr.mu.RUnlock()
+	if st, ok := store.gcMgr.stat[bkt]; ok {
+		s := newGCStatus(bkt, st)
+		return &s
+	}
+	return nil
+}
+
+func (store *HStore) GetGCHistory(bucketID int) []GCState {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil
+	}
+	store.gcMgr.mu.RLock()
+	defer store.gcMgr.mu.RUnlock()
+	return append([]GCState(nil), bkt.GCHistory...)
+}
+
 func (store *HStore) getBucket(bucketID int) *Bucket {
 	if bucketID < 0 || bucketID >= len(store.buckets) {
 		return nil
@@ -312,14 +416,15 @@ func (store *HStore) GC(bucketID, beginChunkID, endChunkID, noGCDays int, merge,
 		return
 	}
 
-	go store.gcMgr.gc(bkt, begin, end, merge)
+	gc, err := store.gcMgr.begin(bkt, GCState{Begin: begin, End: end}, Conf.GCMaxPerDisk)
+	if err != nil {
+		return
+	}
+	go store.gcMgr.run(bkt, gc, merge)
 	return
 }
 
 func (store *HStore) CancelGC(bucketID int) (src, dst int) {
-	// prevent same bucket concurrent request
-	gcLock.Lock()
-	defer gcLock.Unlock()
 	bkt := store.getBucket(bucketID)
 	if bkt == nil {
 		logger.Warnf("get bucket: %02x error", bucketID)
@@ -327,12 +432,14 @@ func (store *HStore) CancelGC(bucketID int) (src, dst int) {
 		return
 	}
 	// will delete key at goroutine in store/gc.go
-	store.gcMgr.mu.RLock()
+	store.gcMgr.mu.Lock()
 	stat, exists := store.gcMgr.stat[bkt]
-	store.gcMgr.mu.RUnlock()
-
 	if exists {
 		stat.CancelFlag = true
+	}
+	store.gcMgr.mu.Unlock()
+
+	if exists {
 		src, dst = stat.Src, stat.Dst
 	} else {
 		src, dst = -1, -1
@@ -340,15 +447,21 @@ func (store *HStore) CancelGC(bucketID int) (src, dst int) {
 	return
 }
 
+// CancelAllGC cancels the gc of all buckets, and returns them.
+func (store *HStore) CancelAllGC() []GCStatus {
+	store.gcMgr.mu.Lock()
+	for _, st := range store.gcMgr.stat {
+		st.CancelFlag = true
+	}
+	store.gcMgr.mu.Unlock()
+	return store.GCStatus()
+}
+
+// IsGCRunning returns true if any bucket is gcing, GCStatus lists them.
 func (store *HStore) IsGCRunning() bool {
-	var result bool
 	store.gcMgr.mu.RLock()
 	defer store.gcMgr.mu.RUnlock()
-	if len(store.gcMgr.stat) > 0 {
-		result = true
-	}
-
-	return result
+	return len(store.gcMgr.stat) > 0
 }
 
 func (store *HStore) GetBucketInfo(bucketID int) *BucketInfo {
@@ -356,8 +469,14 @@ func (store *HStore) GetBucketInfo(bucketID int) *BucketInfo {
 }
 
 func (store *HStore) Get(ki *KeyInfo, memOnly bool) (payload *Payload, pos Position, err error) {
+	ki.Span = ki.Span.Child("hstore.get")
+	defer func() {
+		ki.Span.SetError(err)
+		ki.Span.End()
+	}()
 	ki.KeyHash = getKeyHash(ki.Key)
 	ki.Prepare()
+	ki.Span.SetAttr("bucket", ki.BucketID)
 	bkt := store.buckets[ki.BucketID]
 	atomic.AddInt64(&bkt.NumGet, 1)
 	if bkt.State != BUCKET_STAT_READY {
@@ -366,9 +485,15 @@ func (store *HStore) Get(ki *KeyInfo, memOnly bool) (payload *Payload, pos Posit
 	return bkt.get(ki, memOnly)
 }
 
-func (store *HStore) Set(ki *KeyInfo, p *Payload) error {
+func (store *HStore) Set(ki *KeyInfo, p *Payload) (err error) {
+	ki.Span = ki.Span.Child("hstore.set")
+	defer func() {
+		ki.Span.SetError(err)
+		ki.Span.End()
+	}()
 	ki.KeyHash = getKeyHash(ki.Key)
 	ki.Prepare()
+	ki.Span.SetAttr("bucket", ki.BucketID)
 
 	bkt := store.buckets[ki.BucketID]
 	atomic.AddInt64(&bkt.NumSet, 1)
@@ -378,7 +503,13 @@ func (store *HStore) Set(ki *KeyInfo, p *Payload) error {
 		return nil
 	}
 
-	return bkt.checkAndSet(ki, p)
+	pos, stored, err := bkt.checkAndSet(ki, p)
+	if err == nil && stored {
+		span := ki.Span.Child("commit")
+		err = bkt.datas.commit(pos, ki.Durability)
+		span.End()
+	}
+	return err
 }
 
 func (store *HStore) GetRecordByKeyHash(ki *KeyInfo) (*Record, bool, error) {
@@ -407,6 +538,7 @@ func (store *HStore) HintDumper(interval time.Duration) {
 		for _, bkt := range store.buckets {
 			if bkt.State == BUCKET_STAT_READY {
 				bkt.hints.dumpAndMerge(false)
+				bkt.dumpUsage()
 			}
 		}
 		select {
@@ -424,12 +556,36 @@ func (store *HStore) GetCollisionsByBucket(bucketID int) (content []byte) {
 	return
 }
 
+// GetCollisionItems returns a copy of the collision table of a bucket.
+func (store *HStore) GetCollisionItems(bucketID int) []HintItem {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil
+	}
+	table := bkt.hints.collisions
+	table.Lock()
+	defer table.Unlock()
+	items := make([]HintItem, 0)
+	for _, m := range table.Items {
+		for _, it := range m {
+			items = append(items, it)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Keyhash != items[j].Keyhash {
+			return items[i].Keyhash < items[j].Keyhash
+		}
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
+
 func GetPayloadForDelete() *Payload {
 	payload := &Payload{}
 	payload.Flag = 0
 	payload.Body = nil
 	payload.Ver = -1
-	payload.TS = uint32(time.Now().Unix())
+	payload.SetTS(time.Now())
 	return payload
 }
 
@@ -448,6 +604,25 @@ func NewDU() (du *DU) {
 	return
 }
 
+func (store *HStore) GetBucketState(bucketID int) int {
+	return store.buckets[bucketID].State
+}
+
+// CheckDataHomes checks the home of each ready bucket,
+// returns error messages keyed by bucket home.
+func (store *HStore) CheckDataHomes() map[string]string {
+	errs := make(map[string]string)
+	for _, bkt := range store.buckets {
+		if bkt.State != BUCKET_STAT_READY {
+			continue
+		}
+		if err := utils.CheckDisk(bkt.Home); err != nil {
+			errs[bkt.Home] = err.Error()
+		}
+	}
+	return errs
+}
+
 func (store *HStore) GetDU() (du *DU) {
 	du = NewDU()
 	for i, bkt := range store.buckets {
@@ -514,6 +689,18 @@ func (store *HStore) ChangeRoute(newConf config.DBRouteConfig) (loaded, unloaded
 	return
 }
 
+func (store *HStore) GetNumKeyByBuckets() (counts []int) {
+	n := Conf.NumBucket
+	counts = make([]int, n)
+	for i := 0; i < n; i++ {
+		bkt := store.buckets[i]
+		if bkt.State == BUCKET_STAT_READY {
+			counts[i] = int(bkt.htree.levels[0][0].count)
+		}
+	}
+	return
+}
+
 func (store *HStore) GetNumCmdByBuckets() (counts [][]int64) {
 	n := Conf.NumBucket
 	counts = make([][]int64, n)
@@ -572,6 +572,12 @@ func testGCAfterRebuildHTree(t *testing.T, store *HStore, bucketID, numRecPerFil
 	if stat.Begin > 0 {
 		t.Fatalf("Begin 0")
 	}
+	if h := store.GetGCHistory(bucketID); len(h) != len(bkt.GCHistory) || h[len(h)-1].Running {
+		t.Fatalf("bad gc history %#v", h)
+	}
+	if st := store.GCStatus(); len(st) != 0 || store.GetGCStatus(bucketID) != nil {
+		t.Fatalf("gc should be done %#v", st)
+	}
 	store.Close()
 	dir = utils.NewDir()
 	// dir.Set("000.data", int64(n/2))
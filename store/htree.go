@@ -56,6 +56,9 @@ type HTree struct {
 
 	// tmp, to avoid alloc
 	ni NodeInfo
+
+	// counts the live items replaced or removed by chunk, nil when loading
+	usage *chunkUsage
 }
 
 type Node struct {
@@ -222,6 +225,9 @@ func (tree *HTree) setToLeaf(ni *NodeInfo, req *HTreeReq) {
 		node.count -= 1
 	}
 	node.hash += vhash * uint16(req.ki.KeyHash>>32)
+	if exist && oldm.Ver > 0 && tree.usage != nil && oldm.Pos != req.Position {
+		tree.usage.supersede(oldm.Pos.ChunkID)
+	}
 }
 
 func (tree *HTree) remvoeFromLeaf(ni *NodeInfo, ki *KeyInfo, oldPos Position) {
@@ -231,6 +237,9 @@ func (tree *HTree) remvoeFromLeaf(ni *NodeInfo, ki *KeyInfo, oldPos Position) {
 		node.hash -= oldm.Vhash * uint16(ki.KeyHash>>32)
 		node.count -= 1
 	}
+	if removed && oldm.Ver > 0 && tree.usage != nil {
+		tree.usage.supersede(oldm.Pos.ChunkID)
+	}
 }
 
 func (tree *HTree) getLeaf(ki *KeyInfo, ni *NodeInfo) {
@@ -314,7 +323,7 @@ func (tree *HTree) get(ki *KeyInfo) (meta *Meta, pos Position, found bool) {
 	var req HTreeReq
 	req.ki = ki
 	found = tree.getReq(&req)
-	meta = &Meta{0, 0, req.item.Ver, req.item.Vhash, 0}
+	meta = &Meta{Ver: req.item.Ver, ValueHash: req.item.Vhash}
 	pos = req.item.Pos
 	return
 }
@@ -383,6 +392,24 @@ func (tree *HTree) collectItems(ni *NodeInfo, items []HTreeItem, filterkeyhash,
 	return items
 }
 
+// countByChunk returns the number of keys whose last record is in each chunk,
+// deleted keys excluded.
+func (tree *HTree) countByChunk() (counts []int) {
+	tree.Lock()
+	defer tree.Unlock()
+	counts = make([]int, MAX_NUM_CHUNK)
+	var ni NodeInfo
+	f := func(h uint64, m *HTreeItem) {
+		if m.Ver > 0 {
+			counts[m.Pos.ChunkID]++
+		}
+	}
+	for i := range tree.leafs {
+		tree.leafs[i].Iter(f, &ni)
+	}
+	return
+}
+
 func (tree *HTree) listDir(ki *KeyInfo) (items []HTreeItem, nodes []*Node) {
 	var ni NodeInfo
 	if len(ki.KeyPath) == tree.depth {
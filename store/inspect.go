@@ -0,0 +1,278 @@
+package store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// Everything the store knows about one key, for debugging.
+
+type RecordHeader struct {
+	Version int
+	CRC     uint32
+	TS      uint32
+	TS64    uint64
+	Flag    uint32
+	Ver     int32
+	KSZ     uint32
+	VSZ     uint32
+}
+
+type RecordInfo struct {
+	Pos        Position
+	InBuffer   bool
+	Header     RecordHeader
+	Time       time.Time
+	RecSize    uint32 // with padding
+	Compressed bool
+	Codec      string `json:",omitempty"`
+	Dict       uint32 `json:",omitempty"` // id of the zstd dictionary
+	KeyID      uint32 `json:",omitempty"` // of the key encrypting it on disk
+	ValueSize  int    // after decompress
+	Hexdump    string `json:",omitempty"` // head of the decompressed value
+	Err        string `json:",omitempty"`
+}
+
+type HTreeEntry struct {
+	Pos       Position
+	Ver       int32
+	ValueHash uint16
+}
+
+// HintLocation is an item of the key in a hint split or in the merged hint file.
+type HintLocation struct {
+	Chunk int
+	Split int    // -1 for the merged file
+	Path  string `json:",omitempty"` // empty if the split is still in memory
+	Item  HintItem
+}
+
+type KeyInspection struct {
+	Key       string
+	KeyHash   string
+	Bucket    int
+	HTree     *HTreeEntry `json:",omitempty"`
+	Collision *HintItem   `json:",omitempty"`
+	Hints     []HintLocation
+	Record    *RecordInfo  `json:",omitempty"` // the one served by get
+	Older     []RecordInfo // other records of the key not yet gc-ed, newest first
+	Partial   bool         // Older is located with hints and may miss records, unless scanned
+}
+
+// allItems returns the items of a key in every hint split and the merged file.
+func (h *hintMgr) allItems(keyhash uint64, key string) (locs []HintLocation, err error) {
+	h.mergeLock.Lock()
+	merged := h.merged
+	h.mergeLock.Unlock()
+	if merged != nil {
+		it, e := merged.get(keyhash, key)
+		if e != nil {
+			return nil, e
+		} else if it != nil {
+			locs = append(locs, HintLocation{it.Pos.ChunkID, -1, merged.path, *it})
+		}
+	}
+	for i := h.maxChunkID; i >= 0; i-- {
+		ck := h.chunks[i]
+		ck.Lock()
+		splits := make([]hintSplit, len(ck.splits))
+		for j, sp := range ck.splits {
+			splits[j] = *sp
+		}
+		ck.Unlock()
+		for j := len(splits) - 1; j >= 0; j-- {
+			var it *HintItem
+			path := ""
+			if splits[j].buf != nil {
+				ck.Lock()
+				it, _ = splits[j].buf.Get(keyhash, key)
+				ck.Unlock()
+			} else if splits[j].file != nil {
+				path = splits[j].file.path
+				if it, err = splits[j].file.get(keyhash, key); err != nil {
+					return
+				}
+			}
+			if it != nil {
+				item := *it
+				item.Pos.ChunkID = i
+				locs = append(locs, HintLocation{i, j, path, item})
+			}
+		}
+	}
+	return
+}
+
+// readRecordRaw reads a record as stored, the caller must free it.
+func (ds *dataStore) readRecordRaw(pos Position) (wrec *WriteRecord, inbuffer bool, err error) {
+	dc := &ds.chunks[pos.ChunkID]
+	rec, err := dc.GetRecordByOffsetInBuffer(pos.Offset)
+	if err != nil {
+		return
+	}
+	if rec != nil {
+		wrec = wrapRecord(rec)
+		if err = wrec.encodeHeader(); err != nil {
+			cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+			rec.Payload.Free()
+			return nil, true, err
+		}
+		wrec.sealed = nil
+		wrec.decodeHeader()
+		return wrec, true, nil
+	}
+	wrec, err = readRecordAtPath(dc.path, pos.Offset)
+	return
+}
+
+func (ds *dataStore) inspectRecord(pos Position, key []byte, preview int) (info RecordInfo) {
+	info.Pos = pos
+	wrec, inbuffer, err := ds.readRecordRaw(pos)
+	if err != nil {
+		info.Err = err.Error()
+		return
+	} else if wrec == nil {
+		info.Err = "not found"
+		return
+	}
+	p := wrec.rec.Payload
+	defer func() {
+		cmem.DBRL.GetData.SubSizeAndCount(p.CArray.Cap)
+		p.CArray.Free()
+	}()
+	info.InBuffer = inbuffer
+	info.Header = RecordHeader{p.HeaderVersion(), wrec.crc, p.TS, p.TS64, p.Flag, p.Ver, wrec.ksz, wrec.vsz}
+	info.Time = p.Time()
+	_, info.RecSize = wrec.rec.Sizes()
+	info.KeyID = p.KeyID
+	info.Compressed = p.IsCompressed()
+	info.Codec = p.CodecName()
+	if info.Compressed && p.CodecID() == CODEC_ZSTD_DICT {
+		info.Dict, _ = dictIDOf(p.Body)
+	}
+	if !bytes.Equal(wrec.rec.Key, key) {
+		info.Err = fmt.Sprintf("key mismatch: %q", wrec.rec.Key)
+		return
+	}
+	body := p.Body
+	if info.Compressed {
+		arr, e := p.decompressed()
+		if e != nil {
+			info.Err = e.Error()
+			return
+		}
+		defer arr.Free()
+		body = arr.Body
+	}
+	info.ValueSize = len(body)
+	if preview > len(body) {
+		preview = len(body)
+	}
+	if preview > 0 {
+		info.Hexdump = hex.Dump(body[:preview])
+	}
+	return
+}
+
+// scanKey finds all records of the key in data files and write buffers.
+func (ds *dataStore) scanKey(key []byte) (positions []Position, err error) {
+	for i := 0; i < MAX_NUM_CHUNK; i++ {
+		dc := &ds.chunks[i]
+		if dc.size == 0 {
+			continue
+		}
+		if dc.getDiskFileSize() > 0 {
+			var r *DataStreamReader
+			if r, err = ds.GetStreamReader(i); err != nil {
+				return
+			}
+			for {
+				rec, offset, _, e := r.Next()
+				if e != nil {
+					r.Close()
+					return positions, e
+				}
+				if rec == nil {
+					break
+				}
+				if bytes.Equal(rec.Key, key) {
+					positions = append(positions, Position{i, offset})
+				}
+			}
+			r.Close()
+		}
+		dc.Lock()
+		for _, wrec := range dc.wbuf {
+			if bytes.Equal(wrec.rec.Key, key) {
+				positions = append(positions, wrec.pos)
+			}
+		}
+		dc.Unlock()
+	}
+	return
+}
+
+// InspectKey shows how a key is stored. Older records are located with hints,
+// which keep only the last record of a key in each split; scan reads all data
+// files instead, which is slow but finds every record.
+func (store *HStore) InspectKey(key []byte, scan bool, preview int) (res *KeyInspection, err error) {
+	ki := NewKeyInfoFromBytes(key, getKeyHash(key), false)
+	bkt := store.getBucket(ki.BucketID)
+	if bkt == nil {
+		return nil, ErrBucketNotServed
+	}
+	res = &KeyInspection{
+		Key:     ki.StringKey,
+		KeyHash: fmt.Sprintf("%016x", ki.KeyHash),
+		Bucket:  ki.BucketID,
+		Partial: !scan,
+	}
+
+	var current *Position
+	if meta, pos, found := bkt.htree.get(ki); found {
+		res.HTree = &HTreeEntry{pos, meta.Ver, meta.ValueHash}
+		current = &res.HTree.Pos
+	}
+	if it, ok := bkt.hints.collisions.get(ki.KeyHash, ki.StringKey); ok && it != nil {
+		res.Collision = it
+		current = &it.Pos // get() prefers the collision table
+	}
+	if res.Hints, err = bkt.hints.allItems(ki.KeyHash, ki.StringKey); err != nil {
+		return
+	}
+	if current != nil {
+		info := bkt.datas.inspectRecord(*current, key, preview)
+		res.Record = &info
+	}
+
+	var positions []Position
+	if scan {
+		if positions, err = bkt.datas.scanKey(key); err != nil {
+			return
+		}
+	} else {
+		for _, loc := range res.Hints {
+			positions = append(positions, loc.Item.Pos)
+		}
+	}
+	seen := make(map[Position]bool)
+	if current != nil {
+		seen[*current] = true
+	}
+	for _, pos := range positions {
+		if seen[pos] {
+			continue
+		}
+		seen[pos] = true
+		res.Older = append(res.Older, bkt.datas.inspectRecord(pos, key, preview))
+	}
+	sort.Slice(res.Older, func(i, j int) bool {
+		return res.Older[i].Pos.CmpKey() > res.Older[j].Pos.CmpKey()
+	})
+	return
+}
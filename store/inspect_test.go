@@ -0,0 +1,77 @@
+package store
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestInspectKey(t *testing.T) {
+	setupTest("TestInspectKey")
+	defer clearTest()
+
+	numbucket := 1
+	Conf.NumBucket = numbucket
+	Conf.BucketsStat = make([]int, numbucket)
+	Conf.BucketsStat[0] = 1
+	Conf.TreeHeight = 3
+	Conf.Init()
+	os.Mkdir(GetBucketPath(0), 0777)
+
+	gen := newKVGen(numbucket)
+	getKeyHash = makeKeyHasherParseKey(gen.depth, 0)
+	defer func() {
+		getKeyHash = getKeyHashDefalut
+	}()
+
+	store, err := NewHStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var ki KeyInfo
+	N := 3
+	for ver := 0; ver < N; ver++ {
+		payload := gen.gen(&ki, 0, ver)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(scan bool, numOlder int) {
+		res, err := store.InspectKey(ki.Key, scan, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.HTree == nil || res.HTree.Ver != int32(N) {
+			t.Fatalf("scan %v: bad htree entry %#v", scan, res.HTree)
+		}
+		rec := res.Record
+		if rec == nil || rec.Err != "" || rec.Header.Ver != int32(N) || rec.Pos != res.HTree.Pos {
+			t.Fatalf("scan %v: bad record %#v", scan, rec)
+		}
+		if rec.ValueSize != len("value_0_2") || !strings.Contains(rec.Hexdump, "value") {
+			t.Fatalf("scan %v: bad value %d %q", scan, rec.ValueSize, rec.Hexdump)
+		}
+		if len(res.Hints) == 0 || res.Partial == scan {
+			t.Fatalf("scan %v: no hint item, or partial %v", scan, res.Partial)
+		}
+		if len(res.Older) != numOlder {
+			t.Fatalf("scan %v: %d older records, expect %d: %#v", scan, len(res.Older), numOlder, res.Older)
+		}
+		for i, o := range res.Older {
+			if o.Err != "" || o.Header.Ver != int32(N-1-i) {
+				t.Fatalf("scan %v: bad older record %d %#v", scan, i, o)
+			}
+		}
+	}
+	// in write buffer
+	check(true, N-1)
+	store.flushdatas(true)
+	// hints keep only the last record of a key in a split
+	check(false, 0)
+	check(true, N-1)
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"fmt"
 
-	"net/http"
-
 	"github.com/douban/gobeansdb/cmem"
 	"github.com/douban/gobeansdb/quicklz"
 	"github.com/douban/gobeansdb/utils"
@@ -18,13 +16,19 @@ const (
 	COMPRESS_RATIO_LIMIT = 0.7
 	TRY_COMPRESS_SIZE    = 1024 * 10
 	PADDING              = 256
+	FINE_PADDING         = 16 // for buckets of small values, see Conf.BucketPadding
 	HEADER_SIZE          = 512
 )
 
 type Meta struct {
 	TS   uint32
+	TS64 uint64 // hybrid logical clock, 0 if the record has a header of version 1
 	Flag uint32
 	Ver  int32
+
+	FinePadding bool   // padded to FINE_PADDING bytes instead of PADDING
+	Codec       uint8  // id of the codec if compressed, see codec.go
+	KeyID       uint32 // of the key encrypting it on disk, 0 if not encrypted
 	// computed once
 	ValueHash uint16
 	RecSize   uint32
@@ -81,7 +85,15 @@ func (p *Payload) IsCompressed() bool {
 
 func (p *Payload) DiffSizeAfterDecompressed() int {
 	if p.IsCompressed() {
-		return quicklz.SizeDecompressed(p.CArray.Body) - p.CArray.Cap
+		c, err := p.codec()
+		if err != nil {
+			return 0
+		}
+		size, err := c.DecompressedSize(p.CArray.Body)
+		if err != nil {
+			return 0
+		}
+		return size - p.CArray.Cap
 	}
 	return 0
 }
@@ -104,7 +116,7 @@ func (p *Payload) CalcValueHash() {
 }
 
 func (p *Payload) RawValueSize() int {
-	if !p.IsCompressed() {
+	if !p.IsCompressed() || p.CodecID() != CODEC_QUICKLZ {
 		return len(p.Body)
 	} else {
 		return quicklz.SizeCompressed(p.Body)
@@ -112,12 +124,15 @@ func (p *Payload) RawValueSize() int {
 }
 
 func NeedCompress(header []byte) bool {
-	typeValue := http.DetectContentType(header)
-	_, ok := Conf.NotCompress[typeValue]
-	return !ok
+	return codecFor(header) >= 0
 }
 
 func (rec *Record) TryCompress() {
+	rec.compress(nil)
+}
+
+// compress uses dict for zstd-dict, or zstd if dict is nil.
+func (rec *Record) compress(dict *zstdDict) {
 	if rec.Payload.Ver < 0 {
 		return
 	}
@@ -134,10 +149,19 @@ func (rec *Record) TryCompress() {
 	if len(body) > TRY_COMPRESS_SIZE {
 		try = try[:TRY_COMPRESS_SIZE]
 	}
-	if !NeedCompress(try) {
+	id := codecFor(try)
+	if id < 0 {
 		return
 	}
-	compressed, ok := quicklz.CCompress(try)
+	codec := codecs[id]
+	if id == CODEC_ZSTD_DICT {
+		if dict != nil {
+			codec = dict
+		} else {
+			id, codec = CODEC_ZSTD, codecs[CODEC_ZSTD]
+		}
+	}
+	compressed, ok := codec.Compress(try)
 	if !ok {
 		// because oom, just not compress it
 		return
@@ -148,7 +172,7 @@ func (rec *Record) TryCompress() {
 	}
 	if len(body) > len(try) {
 		compressed.Free()
-		compressed, ok = quicklz.CCompress(body)
+		compressed, ok = codec.Compress(body)
 		if !ok {
 			// because oom, just not compress it
 			return
@@ -156,7 +180,8 @@ func (rec *Record) TryCompress() {
 	}
 	p.CArray.Free()
 	p.CArray = compressed
-	p.Flag += FLAG_COMPRESS
+	p.Flag |= FLAG_COMPRESS
+	p.Codec = uint8(id)
 	return
 }
 
@@ -164,17 +189,27 @@ func (p *Payload) Decompress() (err error) {
 	if p.Flag&FLAG_COMPRESS == 0 {
 		return
 	}
-	arr, err := quicklz.CDecompressSafe(p.Body)
+	arr, err := p.decompressed()
 	if err != nil {
 		logger.Errorf("decompress fail %s", err.Error())
 		return
 	}
 	p.CArray.Free()
 	p.CArray = arr
-	p.Flag -= FLAG_COMPRESS
+	p.Flag &^= FLAG_COMPRESS
+	p.Codec = 0
 	return
 }
 
+// decompressed returns a decompressed copy of the value, which is compressed.
+func (p *Payload) decompressed() (arr cmem.CArray, err error) {
+	c, err := p.codec()
+	if err != nil {
+		return
+	}
+	return c.Decompress(p.Body)
+}
+
 func (p *Payload) Getvhash() uint16 {
 	if p.Ver < 0 {
 		return 0
@@ -182,7 +217,7 @@ func (p *Payload) Getvhash() uint16 {
 	if p.Flag&FLAG_COMPRESS == 0 {
 		return Getvhash(p.Body)
 	}
-	arr, _ := quicklz.CDecompressSafe(p.Body)
+	arr, _ := p.decompressed()
 	vhash := Getvhash(arr.Body)
 	arr.Free()
 	return vhash
@@ -217,8 +252,15 @@ func (rec *Record) Copy() *Record {
 
 // must be compressed
 func (rec *Record) Sizes() (uint32, uint32) {
-	recSize := uint32(24 + len(rec.Key) + len(rec.Payload.Body))
-	return recSize, ((recSize + 255) >> 8) << 8
+	recSize := uint32(rec.Payload.headerSize() + len(rec.Key) + len(rec.Payload.Body))
+	if rec.Payload.KeyID != 0 {
+		recSize += sealOverhead
+	}
+	padding := uint32(PADDING)
+	if rec.Payload.FinePadding {
+		padding = FINE_PADDING
+	}
+	return recSize, (recSize + padding - 1) / padding * padding
 }
 
 func (rec *Record) Size() uint32 {
@@ -226,9 +268,18 @@ func (rec *Record) Size() uint32 {
 	return size
 }
 
+// Dumps returns the record as on disk but not encrypted or finely padded,
+// with a header of version 1 unless records are written in version 2, as
+// sync tools expect.
 func (rec *Record) Dumps() []byte {
 	var buf bytes.Buffer
-	wrec := wrapRecord(rec)
+	p := *rec.Payload
+	p.KeyID = 0
+	p.FinePadding = false
+	if Conf.RecordVersion != RECORD_VERSION_2 {
+		p.setHeaderVersion(RECORD_VERSION_1)
+	}
+	wrec := wrapRecord(&Record{rec.Key, &p})
 	wrec.append(&buf, false)
 	return buf.Bytes()
 }
@@ -2,9 +2,12 @@ package store
 
 import (
 	"strconv"
+	"time"
 	"unicode"
 
 	"github.com/spaolacci/murmur3"
+
+	"github.com/douban/gobeansdb/trace"
 )
 
 const (
@@ -74,6 +77,21 @@ type KeyInfo struct {
 	Key       []byte
 	StringKey string
 	KeyPos
+
+	Stat *GetStat    // optional, filled by HStore.Get
+	Span *trace.Span // nil if not traced
+
+	Durability int // of a set, DURABILITY_DEFAULT for Conf.Durability
+}
+
+// GetStat tells where a get found its record and how long it took.
+type GetStat struct {
+	Pos            Position
+	InBuffer       bool
+	Compressed     bool
+	RecSize        uint32
+	ReadTime       time.Duration
+	DecompressTime time.Duration
 }
 
 func getBucketFromKey(key string) int {
@@ -50,12 +50,17 @@ func getNodeKhash(path []int) uint32 {
 	return khash
 }
 
+// An item keeps the offset without its low byte, and the chunk id in 2 bytes.
+// As chunk ids are less than 1024, the high bits of the second byte of the
+// chunk keep bits 4 to 7 of the offset, which are 0 unless FINE_PADDING.
+const leafOffsetLowMask = 0xff &^ (FINE_PADDING - 1)
+
 func bytesToItem(b []byte, item *HTreeItem) {
 	item.Ver = int32(binary.LittleEndian.Uint32(b))
 	item.Vhash = binary.LittleEndian.Uint16(b[4:])
-	item.Pos.Offset = (uint32(b[6])<<8 | uint32(b[7])<<16 | uint32(b[8])<<24)
+	item.Pos.Offset = (uint32(b[10]&leafOffsetLowMask) | uint32(b[6])<<8 | uint32(b[7])<<16 | uint32(b[8])<<24)
 	//item.pos.ChunkID = int(uint32(b[9]))
-	item.Pos.ChunkID = int(uint32(b[9]) | uint32(b[10])<<8)
+	item.Pos.ChunkID = int(uint32(b[9]) | uint32(b[10]&^leafOffsetLowMask)<<8)
 }
 
 func itemToBytes(b []byte, item *HTreeItem) {
@@ -65,9 +70,10 @@ func itemToBytes(b []byte, item *HTreeItem) {
 	b[6] = byte(v >> 8)
 	b[7] = byte(v >> 16)
 	b[8] = byte(v >> 24)
+	b[10] = byte(v) & leafOffsetLowMask
 	v = uint32(item.Pos.ChunkID)
 	b[9] = byte(v)
-	b[10] = byte(v >> 8)
+	b[10] |= byte(v >> 8)
 }
 
 func khashToBytes(b []byte, khash uint64) {
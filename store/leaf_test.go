@@ -14,6 +14,15 @@ func TestBytes(t *testing.T) {
 	if m != m2 {
 		t.Fatalf("bytesToItem fail %v != %v", m, m2)
 	}
+	// positions of records of FINE_PADDING
+	for _, pos := range []Position{{MAX_NUM_CHUNK - 1, 0xfffffff0}, {0x3ff, 0x1230}, {0x100, 0x10}} {
+		m.Pos = pos
+		itemToBytes(b, &m)
+		bytesToItem(b, &m2)
+		if m != m2 {
+			t.Fatalf("bytesToItem fail %v != %v", m, m2)
+		}
+	}
 
 	k := uint64(0xaaabbbbb) << 32
 	path := []int{0xa, 0xa, 0xa}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestFinePadding(t *testing.T) {
+	setupTest("TestFinePadding")
+	defer clearTest()
+	Conf.Init()
+
+	ds := NewdataStore(0, Conf.Home)
+	key := []byte("key")
+	bodies := []string{"v1", "v2", strings.Repeat("x", 229), "v4", "v5"}
+	paddings := []bool{false, true, true, false, true}
+	var positions []Position
+	for i, body := range bodies {
+		ds.finePadding = paddings[i]
+		Conf.RecordVersion = RECORD_VERSION_1 + i%2
+		p := &Payload{}
+		p.TS = uint32(i + 1)
+		p.Ver = int32(i + 1)
+		p.Flag = FLAG_CLIENT_COMPRESS
+		p.Body = []byte(body)
+		pos, err := ds.AppendRecord(&Record{key, p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, pos)
+	}
+	ds.flush(-1, true)
+	// 24+3+2 to 256, 32+3+2 to 48, 24+3+229 to 256, 32+3+2 to 256, 24+3+2 to 32
+	if fmt.Sprint(positions) != "[{0 0} {0 256} {0 304} {0 560} {0 816}]" {
+		t.Fatalf("%v", positions)
+	}
+	checkFileSize(t, 0, 848)
+
+	check := func(i int, rec *Record) {
+		p := rec.Payload
+		if string(rec.Key) != "key" || string(p.Body) != bodies[i] || p.FinePadding != paddings[i] || p.HeaderVersion() != RECORD_VERSION_1+i%2 {
+			t.Fatalf("%d: %s", i, rec.LogString())
+		}
+	}
+	for i, pos := range positions {
+		rec, _, err := ds.GetRecordByPos(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(i, rec)
+		cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+		rec.Payload.Free()
+	}
+
+	reader, err := ds.GetStreamReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for i, pos := range positions {
+		rec, offset, sizeBroken, err := reader.Next()
+		if err != nil || rec == nil || offset != pos.Offset || sizeBroken != 0 {
+			t.Fatalf("%d: %v %d %d %v", i, rec, offset, sizeBroken, err)
+		}
+		check(i, rec)
+	}
+	if rec, _, _, err := reader.Next(); rec != nil || err != nil {
+		t.Fatalf("%v %v", rec, err)
+	}
+}
+
+func TestGCFinePadding(t *testing.T) {
+	testGC(t, testGCFinePadding, "finePadding", 100)
+}
+
+// testGCFinePadding packs records of a bucket once its padding is changed.
+func testGCFinePadding(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	Conf.RecordVersion = RECORD_VERSION_2
+	defer func() {
+		Conf.RecordVersion = RECORD_VERSION_1
+	}()
+	gen := newKVGen(16)
+	var ki KeyInfo
+	n := 20
+	for i := 0; i < n; i++ {
+		payload := gen.gen(&ki, i, 0)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bkt := store.buckets[bucketID]
+	bkt.datas.flush(0, true)
+	checkDataSize(t, bkt.datas, []uint32{256 * uint32(n)})
+
+	// as restarted with BucketPadding
+	bkt.datas.finePadding = true
+	store.gcMgr.gc(bkt, 0, 0, false)
+	gc := bkt.GCHistory[len(bkt.GCHistory)-1]
+	if gc.Err != nil || gc.NumConverted != int64(n) {
+		t.Fatalf("%#v", gc)
+	}
+	// header 32, key_f_0 and value_0_0 to 48, key_f_10 and value_10_0 to 64
+	checkDataSize(t, bkt.datas, []uint32{48*16 + 64*4})
+
+	payload := gen.gen(&ki, n, 0)
+	cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+	if err := store.Set(&ki, payload); err != nil {
+		t.Fatal(err)
+	}
+	bkt.datas.flush(0, true)
+	for i := 0; i <= n; i++ {
+		gen.gen(&ki, i, 0)
+		payload, pos, err := store.Get(&ki, false)
+		if err != nil || payload == nil || string(payload.Body) != fmt.Sprintf("value_%x_0", i) || (i == n && pos.Offset != 1024) {
+			t.Fatalf("%d %v: %v %v", i, pos, payload, err)
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+		payload.CArray.Free()
+	}
+}
+
+func TestDumpsFinePadding(t *testing.T) {
+	testGC(t, testDumpsFinePadding, "dumpsFinePadding", 100)
+}
+
+// testDumpsFinePadding dumps a record of a bucket with fine padding for
+// "@@keyhash", which is padded as in other buckets.
+func testDumpsFinePadding(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	// as opened with bucket_padding
+	Conf.BucketPadding = map[string]int{"f": FINE_PADDING}
+	bkt := store.buckets[bucketID]
+	bkt.datas.finePadding = Conf.finePadding(bucketID)
+	gen := newKVGen(16)
+	var ki KeyInfo
+	payload := gen.gen(&ki, 1, 0)
+	cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+	if err := store.Set(&ki, payload); err != nil {
+		t.Fatal(err)
+	}
+	bkt.datas.flush(0, true)
+	rec, _, err := store.GetRecordByKeyHash(NewKeyInfoFromBytes(ki.Key, getKeyHash(ki.Key), false))
+	if err != nil || rec == nil || !rec.Payload.FinePadding {
+		t.Fatalf("%v %v", err, rec)
+	}
+	data := rec.Dumps()
+	cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+	rec.Payload.Free()
+	if ksz := binary.LittleEndian.Uint32(data[16:20]); ksz != uint32(len(ki.Key)) || len(data) != recHeaderSize+len("key_f_1value_1_0") {
+		t.Fatalf("ksz 0x%x, size %d", ksz, len(data))
+	}
+	rec, err = decodeRecord(data)
+	if err != nil || string(rec.Key) != "key_f_1" || string(rec.Payload.Body) != "value_1_0" || rec.Payload.FinePadding {
+		t.Fatalf("%v %v", err, rec)
+	}
+	rec.Payload.Free()
+}
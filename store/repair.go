@@ -0,0 +1,180 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// A broken record is repaired by fetching the record of its key from a
+// replica of the bucket, as served for "@@keyhash", and appending it again
+// with its version and timestamp, so it is the same as on the replica.
+
+var (
+	ErrNotBroken    = errors.New("record not broken")
+	ErrNoPeerRecord = errors.New("no valid record on peers")
+)
+
+// RepairPeer is a replica of a bucket. FetchRecord returns the record of
+// keyhash as dumped by Record.Dumps, or nil if not found.
+type RepairPeer interface {
+	Addr() string
+	FetchRecord(keyhash uint64) ([]byte, error)
+}
+
+type RepairResult struct {
+	KeyHash string
+	Key     string `json:",omitempty"`
+	Peer    string `json:",omitempty"` // the record is from
+	Ver     int32  `json:",omitempty"`
+	TS      uint32 `json:",omitempty"`
+	Err     string `json:",omitempty"`
+}
+
+// decodeRecord decodes and checks a record fetched from a peer, which is
+// copied into a new payload.
+func decodeRecord(data []byte) (*Record, error) {
+	wrec := newWriteRecord()
+	if err := wrec.decode(data); err != nil {
+		return nil, err
+	}
+	rec := wrec.rec
+	p := &Payload{Meta: rec.Payload.Meta}
+	if p.Ver > 0 {
+		if !p.CArray.Alloc(len(rec.Payload.Body)) {
+			return nil, fmt.Errorf("fail to alloc %d bytes", len(rec.Payload.Body))
+		}
+		copy(p.Body, rec.Payload.Body)
+	}
+	return &Record{append([]byte(nil), rec.Key...), p}, nil
+}
+
+// fetchRecord returns the first valid record of keyhash on peers, and the
+// peer it is from. key is checked if not nil.
+func fetchRecord(keyhash uint64, key []byte, peers []RepairPeer) (rec *Record, peer string, err error) {
+	err = ErrNoPeerRecord
+	for _, p := range peers {
+		data, e := p.FetchRecord(keyhash)
+		if e == nil && data == nil {
+			continue
+		}
+		if e == nil {
+			rec, e = decodeRecord(data)
+		}
+		if e == nil && (getKeyHash(rec.Key) != keyhash || (key != nil && !bytes.Equal(rec.Key, key))) {
+			e = fmt.Errorf("record of another key %q", rec.Key)
+			rec.Payload.Free()
+		}
+		if e != nil {
+			logger.Warnf("fail to fetch %016x from %s: %s", keyhash, p.Addr(), e.Error())
+			err = fmt.Errorf("%s: %s", p.Addr(), e.Error())
+			continue
+		}
+		return rec, p.Addr(), nil
+	}
+	return nil, "", err
+}
+
+// repair appends rec fetched from a peer if the record of its key is broken
+// or missing here. It is not appended if older than the broken one.
+func (bkt *Bucket) repair(ki *KeyInfo, rec *Record) (pos Position, err error) {
+	p := rec.Payload
+	bkt.writeLock.Lock()
+	defer func() {
+		bkt.writeLock.Unlock()
+		if err != nil {
+			p.Free()
+		}
+	}()
+	meta, oldPos, found := bkt.htree.get(ki)
+	if found {
+		old, _, e := bkt.datas.GetRecordByPos(oldPos)
+		if e == nil {
+			cmem.DBRL.GetData.SubSizeAndCount(old.Payload.CArray.Cap)
+			old.Payload.Free()
+			if bytes.Equal(old.Key, ki.Key) {
+				return pos, ErrNotBroken
+			}
+		}
+		if abs(p.Ver) < abs(meta.Ver) {
+			return pos, fmt.Errorf("peer has version %d, older than %d", p.Ver, meta.Ver)
+		}
+	}
+	if p.Flag&FLAG_COMPRESS != 0 {
+		// the codec or dict may be only on the peer
+		if err = p.Decompress(); err != nil {
+			return
+		}
+	}
+	p.CalcValueHash()
+	if p.Ver > 0 {
+		cmem.DBRL.SetData.AddSizeAndCount(p.CArray.Cap)
+	}
+	if pos, err = bkt.set(ki, p); err != nil {
+		if p.Ver > 0 {
+			cmem.DBRL.SetData.SubSizeAndCount(p.CArray.Cap)
+		}
+		return
+	}
+	logger.Infof("repair %016x of bucket %d, version %d, ts %d, at %v",
+		ki.KeyHash, bkt.ID, p.Ver, p.TS, pos)
+	return
+}
+
+// Repair fetches records of keys and keyhashes of a bucket from peers, and
+// appends them again if broken or missing here. All broken keys found by the
+// scrubber are repaired if none is given.
+func (store *HStore) Repair(bucketID int, keys []string, keyhashes []uint64, peers []RepairPeer) ([]RepairResult, error) {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil, ErrBucketNotServed
+	}
+	type target struct {
+		key     []byte
+		keyhash uint64
+	}
+	var targets []target
+	for _, key := range keys {
+		targets = append(targets, target{[]byte(key), getKeyHash([]byte(key))})
+	}
+	for _, h := range keyhashes {
+		targets = append(targets, target{nil, h})
+	}
+	if len(targets) == 0 {
+		for _, k := range bkt.scrub.status().BrokenKeys {
+			targets = append(targets, target{nil, k.KeyHash})
+		}
+	}
+	results := make([]RepairResult, 0, len(targets))
+	for _, t := range targets {
+		res := RepairResult{KeyHash: fmt.Sprintf("%016x", t.keyhash), Key: string(t.key)}
+		if err := bkt.repairKey(t.key, t.keyhash, peers, &res); err != nil {
+			res.Err = err.Error()
+		}
+		results = append(results, res)
+	}
+	bkt.pruneBrokenKeys()
+	return results, nil
+}
+
+func (bkt *Bucket) repairKey(key []byte, keyhash uint64, peers []RepairPeer, res *RepairResult) error {
+	if ki := NewKeyInfoFromBytes(key, keyhash, false); ki.BucketID != bkt.ID {
+		return fmt.Errorf("not in bucket %d", bkt.ID)
+	}
+	rec, peer, err := fetchRecord(keyhash, key, peers)
+	if err != nil {
+		return err
+	}
+	res.Peer, res.Ver, res.TS = peer, rec.Payload.Ver, rec.Payload.TS
+	if !Conf.Encrypt {
+		res.Key = string(rec.Key)
+	}
+	ki := NewKeyInfoFromBytes(rec.Key, keyhash, false)
+	pos, err := bkt.repair(ki, rec)
+	if err != nil {
+		return err
+	}
+	return bkt.datas.commit(pos, DURABILITY_FSYNC)
+}
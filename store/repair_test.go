@@ -0,0 +1,133 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// recordPeer stands in for a replica, serving records dumped before they
+// are broken here.
+type recordPeer struct {
+	addr string
+	recs map[uint64][]byte
+}
+
+func (p *recordPeer) Addr() string {
+	return p.addr
+}
+
+func (p *recordPeer) FetchRecord(keyhash uint64) ([]byte, error) {
+	if p.recs == nil {
+		return nil, errors.New("connection refused")
+	}
+	return p.recs[keyhash], nil
+}
+
+func TestRepair(t *testing.T) {
+	testGC(t, testRepair, "repair", 100)
+}
+
+// testRepair breaks keys 3 and 6, key 3 is repaired from the peer, while the
+// peer only has an older version of key 6.
+func testRepair(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	Conf.ScrubQuarantine = true
+	defer func() {
+		Conf.ScrubQuarantine = false
+	}()
+	gen := newKVGen(16)
+	bkt := store.buckets[bucketID]
+	var ki KeyInfo
+	set := func(i, ver int) {
+		payload := gen.gen(&ki, i, ver)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 10
+	for i := 0; i < n; i++ {
+		set(i, 0)
+	}
+	bkt.datas.flush(0, true)
+
+	good := &recordPeer{"good", make(map[uint64][]byte)}
+	bad := &recordPeer{"bad", make(map[uint64][]byte)}
+	for _, i := range []int{3, 4, 6} {
+		gen.gen(&ki, i, 0)
+		rec, _, err := bkt.GetRecordByKeyHash(NewKeyInfoFromBytes(ki.Key, getKeyHash(ki.Key), false))
+		if err != nil || rec == nil {
+			t.Fatal(err)
+		}
+		data := rec.Dumps()
+		cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+		rec.Payload.Free()
+		keyhash := getKeyHash(ki.Key)
+		good.recs[keyhash] = data
+		data = append([]byte(nil), data...)
+		data[len(data)-1]++
+		bad.recs[keyhash] = data
+	}
+	set(6, 2)
+	bkt.datas.flush(0, true)
+	bkt.hints.trydump(0, true)
+
+	fd, err := os.OpenFile(bkt.datas.genPath(0), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("broken"), 256*3+24)
+	fd.WriteAt([]byte("broken"), 256*int64(n)+24)
+	fd.Close()
+	if done, err := store.scrubBucket(bucketID); !done || err != nil {
+		t.Fatalf("%v %v", done, err)
+	}
+	if st := store.GetScrubStatus(bucketID); len(st.BrokenKeys) != 2 {
+		t.Fatalf("%#v", st)
+	}
+
+	peers := []RepairPeer{&recordPeer{addr: "down"}, bad, good}
+	results, err := store.Repair(bucketID, nil, nil, peers)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("%v %#v", err, results)
+	}
+	for _, res := range results {
+		switch res.Key {
+		case "key_f_3":
+			if res.Peer != "good" || res.Ver != 1 || res.TS != 4 || res.Err != "" {
+				t.Fatalf("%#v", res)
+			}
+		case "key_f_6":
+			if res.Peer != "good" || res.Ver != 1 || res.Err != "peer has version 1, older than 2" {
+				t.Fatalf("%#v", res)
+			}
+		default:
+			t.Fatalf("%#v", res)
+		}
+	}
+
+	// repaired as on the peer, and no longer quarantined
+	gen.gen(&ki, 3, 0)
+	payload, _, err := store.Get(&ki, false)
+	if err != nil || payload == nil || string(payload.Body) != "value_3_0" || payload.Ver != 1 || payload.TS != 4 {
+		t.Fatalf("%v %#v", err, payload)
+	}
+	cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+	payload.CArray.Free()
+	if st := store.GetScrubStatus(bucketID); len(st.BrokenKeys) != 1 || st.BrokenKeys[0].Key != "key_f_6" {
+		t.Fatalf("%#v", st)
+	}
+
+	results, err = store.Repair(bucketID, []string{"key_f_4"}, []uint64{0x0123456789abcdef, getKeyHash([]byte("key_f_5"))}, peers)
+	if err != nil || len(results) != 3 ||
+		results[0].Err != ErrNotBroken.Error() ||
+		results[1].Err != "not in bucket 15" ||
+		results[2].Err != "down: connection refused" {
+		t.Fatalf("%v %#v", err, results)
+	}
+	if _, err := store.Repair(bucketID^1, nil, nil, peers); err != ErrBucketNotServed {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,651 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/douban/gobeansdb/cmem"
+	"github.com/douban/gobeansdb/config"
+)
+
+// The scrubber reads all records of served buckets in background, a bucket a
+// time, to find broken records before a get or gc meets them. It also checks
+// that hint and htree items of a chunk point to records of their keys. A
+// bucket is scrubbed again ScrubInterval seconds after its last round, under
+// the I/O budget ScrubMaxMBps, backing off like gc while the server is busy.
+//
+// What is found is kept in scrub.yaml of the bucket with the progress of the
+// round, so a restart resumes from where it stopped. With ScrubQuarantine,
+// gets of a key whose newest record is broken fail until it is set again.
+// Results of a chunk are dropped if gc runs on the bucket while scanning it.
+
+var (
+	ErrQuarantined  = errors.New("key quarantined, its record is broken")
+	ErrScrubRunning = errors.New("scrub already running")
+	ErrNoBrokenKey  = errors.New("no such broken key")
+)
+
+const (
+	scrubCheckInterval = time.Minute
+	scrubSaveSize      = 64 << 20 // save progress after scanning each
+	scrubMaxReports    = 1000     // of each kind kept for a bucket
+)
+
+// ScrubRange is a range of broken bytes in a chunk.
+type ScrubRange struct {
+	Chunk int       `yaml:"chunk"`
+	Begin uint32    `yaml:"begin"`
+	End   uint32    `yaml:"end"`
+	Found time.Time `yaml:"found"`
+}
+
+// ScrubMismatch is a hint or htree item not pointing to a record of its key.
+type ScrubMismatch struct {
+	Index   string    `yaml:"index"` // "hint" or "htree"
+	KeyHash uint64    `yaml:"keyhash"`
+	Chunk   int       `yaml:"chunk"`
+	Offset  uint32    `yaml:"offset"`
+	Found   time.Time `yaml:"found"`
+}
+
+// BrokenKey is a key whose newest record is in a broken range, the key is
+// only known by its hash if records are encrypted.
+type BrokenKey struct {
+	KeyHash     uint64    `yaml:"keyhash"`
+	Key         string    `yaml:"key,omitempty"`
+	Chunk       int       `yaml:"chunk"`
+	Offset      uint32    `yaml:"offset"`
+	Found       time.Time `yaml:"found"`
+	Quarantined bool      `yaml:"quarantined,omitempty"`
+}
+
+type ScrubStatus struct {
+	Bucket     string    `yaml:"-"`
+	Scanning   bool      `yaml:"-"`
+	Chunk      int       `yaml:"chunk"` // the next record to scan
+	Offset     uint32    `yaml:"offset"`
+	RoundStart time.Time `yaml:"round_start"` // zero if not in a round
+	LastRound  time.Time `yaml:"last_round"`  // when the last round ended
+	Rounds     int       `yaml:"rounds"`
+	Scanned    int64     `yaml:"scanned"`       // bytes of the current round
+	Err        string    `yaml:"err,omitempty"` // of the last chunk not fully scanned
+
+	Ranges     []ScrubRange    `yaml:"ranges,omitempty"`
+	Mismatches []ScrubMismatch `yaml:"mismatches,omitempty"`
+	BrokenKeys []BrokenKey     `yaml:"broken_keys,omitempty"`
+}
+
+type scrubState struct {
+	sync.Mutex
+	path string
+	ScrubStatus
+	resumed bool // Offset is from the file, it may be stale if gc ran before the restart
+
+	// derived from BrokenKeys
+	quarantine    map[uint64]Position
+	numQuarantine int32
+}
+
+func newScrubState(home string) *scrubState {
+	return &scrubState{
+		path:       filepath.Join(home, "scrub.yaml"),
+		quarantine: make(map[uint64]Position),
+	}
+}
+
+func (sc *scrubState) load() error {
+	content, err := ioutil.ReadFile(sc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	if err = yaml.Unmarshal(content, &sc.ScrubStatus); err != nil {
+		return fmt.Errorf("bad %s: %s", sc.path, err.Error())
+	}
+	sc.resumed = sc.Offset > 0
+	sc.compile()
+	return nil
+}
+
+// compile must be called with the lock held
+func (sc *scrubState) compile() {
+	sc.quarantine = make(map[uint64]Position)
+	for _, k := range sc.BrokenKeys {
+		if k.Quarantined {
+			sc.quarantine[k.KeyHash] = Position{k.Chunk, k.Offset}
+		}
+	}
+	atomic.StoreInt32(&sc.numQuarantine, int32(len(sc.quarantine)))
+}
+
+// dump must be called with the lock held
+func (sc *scrubState) dump() {
+	content, err := yaml.Marshal(&sc.ScrubStatus)
+	if err == nil {
+		tmp := sc.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, content, 0644); err == nil {
+			err = os.Rename(tmp, sc.path)
+		}
+	}
+	if err != nil {
+		logger.Errorf("fail to dump %s: %s", sc.path, err.Error())
+	}
+}
+
+// isQuarantined is called by gets, pos is where the htree points to.
+func (sc *scrubState) isQuarantined(keyhash uint64, pos Position) bool {
+	if atomic.LoadInt32(&sc.numQuarantine) == 0 {
+		return false
+	}
+	sc.Lock()
+	defer sc.Unlock()
+	qpos, ok := sc.quarantine[keyhash]
+	return ok && qpos == pos
+}
+
+func (sc *scrubState) status() ScrubStatus {
+	sc.Lock()
+	defer sc.Unlock()
+	st := sc.ScrubStatus
+	st.Ranges = append([]ScrubRange(nil), st.Ranges...)
+	st.Mismatches = append([]ScrubMismatch(nil), st.Mismatches...)
+	st.BrokenKeys = append([]BrokenKey(nil), st.BrokenKeys...)
+	return st
+}
+
+func (sc *scrubState) due(now time.Time) bool {
+	sc.Lock()
+	defer sc.Unlock()
+	return !sc.RoundStart.IsZero() || now.Sub(sc.LastRound) >= time.Duration(Conf.ScrubInterval)*time.Second
+}
+
+// scrubFindings are what is found in [begin, end) of a chunk.
+type scrubFindings struct {
+	chunk      int
+	begin, end uint32
+
+	ranges     []ScrubRange
+	mismatches []ScrubMismatch
+	brokenKeys []BrokenKey
+}
+
+func (f *scrubFindings) inRange(offset uint32) bool {
+	for _, r := range f.ranges {
+		if offset >= r.Begin && offset < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// save replaces what was found before in the range of f, and moves the
+// progress to (chunk, offset).
+func (sc *scrubState) save(f *scrubFindings, chunk int, offset uint32, scanned int64) {
+	sc.Lock()
+	defer sc.Unlock()
+	old := func(c int, o uint32) bool {
+		return c != f.chunk || o < f.begin || o >= f.end
+	}
+	ranges := f.ranges
+	for _, r := range sc.Ranges {
+		if old(r.Chunk, r.Begin) {
+			ranges = append(ranges, r)
+		}
+	}
+	mismatches := f.mismatches
+	for _, m := range sc.Mismatches {
+		if old(m.Chunk, m.Offset) {
+			mismatches = append(mismatches, m)
+		}
+	}
+	brokenKeys := f.brokenKeys
+	for _, k := range sc.BrokenKeys {
+		if old(k.Chunk, k.Offset) {
+			brokenKeys = append(brokenKeys, k)
+		}
+	}
+	if len(ranges) > scrubMaxReports {
+		ranges = ranges[:scrubMaxReports]
+	}
+	if len(mismatches) > scrubMaxReports {
+		mismatches = mismatches[:scrubMaxReports]
+	}
+	if len(brokenKeys) > scrubMaxReports {
+		brokenKeys = brokenKeys[:scrubMaxReports]
+	}
+	sc.Ranges, sc.Mismatches, sc.BrokenKeys = ranges, mismatches, brokenKeys
+	sc.compile()
+	sc.Chunk, sc.Offset = chunk, offset
+	sc.Scanned += scanned
+	sc.dump()
+}
+
+type ScrubStats struct {
+	Paused      bool
+	Bucket      string // being scrubbed
+	MaxMBps     float64
+	Bytes       int64 // read by the scrubber
+	Records     int64
+	BrokenBytes int64
+	Ranges      int64 // broken ranges found
+	Mismatches  int64
+	BrokenKeys  int64
+	Rounds      int64
+}
+
+type scrubber struct {
+	sync.Mutex
+	paused   bool
+	bucket   int // being scrubbed, -1 if none
+	throttle *gcThrottle
+	stats    ScrubStats
+}
+
+func newScrubber() *scrubber {
+	t := &gcThrottle{}
+	t.MaxMBps = Conf.ScrubMaxMBps
+	return &scrubber{bucket: -1, throttle: t}
+}
+
+func (s *scrubber) isPaused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.paused
+}
+
+// gcSeq returns the number of gc begun on bkt, and if one is running.
+func (mgr *GCMgr) gcSeq(bkt *Bucket) (n int, running bool) {
+	mgr.mu.RLock()
+	defer mgr.mu.RUnlock()
+	_, running = mgr.stat[bkt]
+	return len(bkt.GCHistory), running
+}
+
+// Scrubber scrubs the buckets due every minute, it returns at once if
+// ScrubInterval is 0.
+func (store *HStore) Scrubber() {
+	if Conf.ScrubInterval <= 0 {
+		return
+	}
+	logger.Infof("scrubber started, %.1f MB/s", Conf.ScrubMaxMBps)
+	for {
+		for id, bkt := range store.buckets {
+			if bkt.State == BUCKET_STAT_READY && !store.scrubber.isPaused() && bkt.scrub.due(time.Now()) {
+				if _, err := store.scrubBucket(id); err != nil && err != ErrScrubRunning {
+					logger.Errorf("fail to scrub bucket %d: %s", id, err.Error())
+				}
+			}
+		}
+		time.Sleep(scrubCheckInterval)
+	}
+}
+
+// ScrubBucket runs or resumes a round on a bucket at once, in background.
+func (store *HStore) ScrubBucket(bucketID int) error {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return ErrBucketNotServed
+	}
+	store.scrubber.Lock()
+	defer store.scrubber.Unlock()
+	if store.scrubber.bucket >= 0 {
+		return ErrScrubRunning
+	}
+	go store.scrubBucket(bucketID)
+	return nil
+}
+
+// scrubBucket scans the bucket to the end of the round, done is false if it
+// stops before, e.g. paused or gc is running.
+func (store *HStore) scrubBucket(bucketID int) (done bool, err error) {
+	s := store.scrubber
+	s.Lock()
+	if s.bucket >= 0 {
+		s.Unlock()
+		return false, ErrScrubRunning
+	}
+	s.bucket = bucketID
+	s.Unlock()
+	bkt := store.buckets[bucketID]
+	sc := bkt.scrub
+	defer func() {
+		sc.Lock()
+		sc.Scanning = false
+		sc.Unlock()
+		s.Lock()
+		s.bucket = -1
+		s.Unlock()
+	}()
+
+	sc.Lock()
+	sc.Scanning = true
+	if sc.RoundStart.IsZero() {
+		sc.RoundStart = time.Now()
+		sc.Chunk, sc.Offset, sc.Scanned, sc.resumed = 0, 0, 0, false
+		logger.Infof("bucket %d begin scrub round %d", bucketID, sc.Rounds+1)
+	}
+	sc.Unlock()
+
+	for {
+		sc.Lock()
+		chunk, offset := sc.Chunk, sc.Offset
+		sc.Unlock()
+		if chunk > bkt.datas.newHead {
+			break
+		}
+		if s.isPaused() {
+			return false, nil
+		}
+		ok, err := store.scrubChunk(bkt, chunk, offset)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	sc.Lock()
+	sc.Rounds++
+	sc.LastRound = time.Now()
+	logger.Infof("bucket %d end scrub round %d, %d bytes in %s, %d broken ranges, %d mismatches, %d broken keys",
+		bucketID, sc.Rounds, sc.Scanned, sc.LastRound.Sub(sc.RoundStart),
+		len(sc.Ranges), len(sc.Mismatches), len(sc.BrokenKeys))
+	sc.RoundStart = time.Time{}
+	sc.Chunk, sc.Offset = 0, 0
+	sc.dump()
+	sc.Unlock()
+	bkt.pruneBrokenKeys()
+	s.Lock()
+	s.stats.Rounds++
+	s.Unlock()
+	return true, nil
+}
+
+// pruneBrokenKeys drops broken keys set again since found.
+func (bkt *Bucket) pruneBrokenKeys() {
+	sc := bkt.scrub
+	sc.Lock()
+	defer sc.Unlock()
+	keys := sc.BrokenKeys[:0]
+	for _, k := range sc.BrokenKeys {
+		ki := NewKeyInfoFromBytes([]byte(k.Key), k.KeyHash, false)
+		if _, pos, found := bkt.htree.get(ki); found && pos == (Position{k.Chunk, k.Offset}) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) != len(sc.BrokenKeys) {
+		sc.BrokenKeys = keys
+		sc.compile()
+		sc.dump()
+	}
+}
+
+// RemoveBrokenKey forgets a broken key, e.g. after it is repaired or deleted
+// by hand, and gets of it are not quarantined any more.
+func (store *HStore) RemoveBrokenKey(bucketID int, keyhash uint64) error {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return ErrBucketNotServed
+	}
+	sc := bkt.scrub
+	sc.Lock()
+	defer sc.Unlock()
+	keys := sc.BrokenKeys[:0]
+	for _, k := range sc.BrokenKeys {
+		if k.KeyHash != keyhash {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == len(sc.BrokenKeys) {
+		return ErrNoBrokenKey
+	}
+	sc.BrokenKeys = keys
+	sc.compile()
+	sc.dump()
+	return nil
+}
+
+// PauseScrubber pauses or resumes the scrubber, a chunk being scanned is
+// stopped at the next save of the progress.
+func (store *HStore) PauseScrubber(paused bool) {
+	s := store.scrubber
+	s.Lock()
+	defer s.Unlock()
+	if s.paused != paused {
+		logger.Infof("scrubber paused: %v", paused)
+	}
+	s.paused = paused
+}
+
+func (store *HStore) ScrubStats() ScrubStats {
+	s := store.scrubber
+	s.Lock()
+	defer s.Unlock()
+	st := s.stats
+	st.Paused = s.paused
+	st.MaxMBps = s.throttle.status().MaxMBps
+	if s.bucket >= 0 {
+		st.Bucket = config.BucketIDHex(s.bucket, Conf.NumBucket)
+	}
+	return st
+}
+
+// GetScrubStatus returns the scrub status of a served bucket, or nil.
+func (store *HStore) GetScrubStatus(bucketID int) *ScrubStatus {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil
+	}
+	st := bkt.scrub.status()
+	st.Bucket = config.BucketIDHex(bucketID, Conf.NumBucket)
+	return &st
+}
+
+// ScrubStatus returns the status of served buckets.
+func (store *HStore) ScrubStatus() (res []ScrubStatus) {
+	for id, bkt := range store.buckets {
+		if bkt.State == BUCKET_STAT_READY {
+			res = append(res, *store.GetScrubStatus(id))
+		}
+	}
+	return
+}
+
+// scrubRec is a record scanned, or an htree item, in a chunk.
+type scrubRec struct {
+	offset  uint32
+	keyhash uint64
+}
+
+// scrubChunk scans a chunk from start, ok is false if the bucket should be
+// scrubbed later, e.g. gc ran on it.
+func (store *HStore) scrubChunk(bkt *Bucket, chunk int, start uint32) (ok bool, err error) {
+	s := store.scrubber
+	sc := bkt.scrub
+	gcSeq, gcing := store.gcMgr.gcSeq(bkt)
+	if gcing {
+		return false, nil
+	}
+	gcRan := func() bool {
+		n, gcing := store.gcMgr.gcSeq(bkt)
+		return gcing || n != gcSeq
+	}
+	limit := bkt.datas.chunks[chunk].flushedSize()
+	path := bkt.datas.genPath(chunk)
+	sc.Lock()
+	resumed := sc.resumed
+	sc.resumed = false
+	sc.Unlock()
+	if start > 0 && resumed {
+		// the chunk may be rewritten by a gc before the restart
+		if wrec, e := readRecordAtPath(path, start); e != nil {
+			logger.Infof("scrub %s from 0, no record at %d", path, start)
+			start = 0
+		} else {
+			cmem.DBRL.GetData.SubSizeAndCount(wrec.rec.Payload.CArray.Cap)
+			wrec.rec.Payload.Free()
+		}
+	}
+	if start >= limit {
+		sc.save(&scrubFindings{chunk: chunk, begin: start, end: math.MaxUint32}, chunk+1, 0, 0)
+		return true, nil
+	}
+
+	r, err := newDataStreamReader(path, Conf.BufIOCap)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	r.seek(start)
+
+	now := time.Now()
+	all := &scrubFindings{chunk: chunk, begin: start, end: math.MaxUint32}
+	f := &scrubFindings{chunk: chunk, begin: start} // since the last save
+	var recs, htreeItems []scrubRec
+	var scanned, saved int64
+	addRange := func(begin, end uint32) {
+		if end > limit {
+			end = limit
+		}
+		if begin >= end {
+			return
+		}
+		logger.Errorf("scrub found %d bytes broken in %s [%d, %d)", end-begin, path, begin, end)
+		f.ranges = append(f.ranges, ScrubRange{chunk, begin, end, now})
+		all.ranges = append(all.ranges, f.ranges[len(f.ranges)-1])
+		s.Lock()
+		s.stats.BrokenBytes += int64(end - begin)
+		s.stats.Ranges++
+		s.Unlock()
+	}
+	for r.Offset() < limit {
+		rec, offset, sizeBroken, e := r.Next()
+		if e != nil {
+			if e == io.ErrUnexpectedEOF {
+				addRange(r.Offset(), limit)
+			} else {
+				sc.Lock()
+				sc.Err = fmt.Sprintf("chunk %d at %d: %s", chunk, r.Offset(), e.Error())
+				sc.Unlock()
+			}
+			break
+		}
+		if sizeBroken > 0 {
+			addRange(offset-sizeBroken, offset)
+		}
+		size := sizeBroken
+		if rec != nil && offset < limit {
+			size += rec.Payload.RecSize
+			keyhash := getKeyHash(rec.Key)
+			recs = append(recs, scrubRec{offset, keyhash})
+			_, pos, found := bkt.htree.get(NewKeyInfoFromBytes(rec.Key, keyhash, false))
+			if found && pos.ChunkID == chunk && pos.Offset >= start && pos.Offset < limit {
+				htreeItems = append(htreeItems, scrubRec{pos.Offset, keyhash})
+			}
+		}
+		scanned += int64(size)
+		s.throttle.wait(int(size), 1)
+		s.Lock()
+		s.stats.Bytes += int64(size)
+		s.stats.Records++
+		s.Unlock()
+		if rec == nil || offset >= limit {
+			break
+		}
+
+		if scanned-saved >= scrubSaveSize {
+			if gcRan() {
+				logger.Infof("scrub %s stopped by gc", path)
+				sc.save(&scrubFindings{}, chunk, 0, 0)
+				return false, nil
+			}
+			f.end = r.Offset()
+			sc.save(f, chunk, f.end, scanned-saved)
+			saved = scanned
+			f = &scrubFindings{chunk: chunk, begin: f.end}
+			if s.isPaused() {
+				return false, nil
+			}
+		}
+	}
+	if gcRan() {
+		logger.Infof("scrub %s stopped by gc", path)
+		sc.save(&scrubFindings{}, chunk, 0, 0)
+		return false, nil
+	}
+	bkt.scrubCheckIndex(all, limit, recs, htreeItems, now)
+	s.Lock()
+	s.stats.Mismatches += int64(len(all.mismatches))
+	s.stats.BrokenKeys += int64(len(all.brokenKeys))
+	s.Unlock()
+	sc.save(all, chunk+1, 0, scanned-saved)
+	return true, nil
+}
+
+// scrubCheckIndex checks hint items of the chunk and htree items of the keys
+// scanned in [f.begin, limit) against the records scanned, and finds keys
+// whose newest record is broken by their hint items.
+func (bkt *Bucket) scrubCheckIndex(f *scrubFindings, limit uint32, recs, htreeItems []scrubRec, now time.Time) {
+	isRec := func(offset uint32, keyhash uint64) bool {
+		i := sort.Search(len(recs), func(i int) bool { return recs[i].offset >= offset })
+		return i < len(recs) && recs[i].offset == offset && recs[i].keyhash == keyhash
+	}
+	mismatch := func(index string, offset uint32, keyhash uint64) {
+		logger.Errorf("scrub found %s item of %016x not pointing to a record, chunk %d offset %d",
+			index, keyhash, f.chunk, offset)
+		f.mismatches = append(f.mismatches, ScrubMismatch{index, keyhash, f.chunk, offset, now})
+	}
+	for _, it := range htreeItems {
+		if !isRec(it.offset, it.keyhash) && !f.inRange(it.offset) {
+			mismatch("htree", it.offset, it.keyhash)
+		}
+	}
+
+	paths, _ := filepath.Glob(bkt.hints.getPath(f.chunk, -1, false))
+	for _, path := range paths {
+		reader := newHintFileReader(path, f.chunk, 1<<20)
+		if err := reader.open(); err != nil {
+			continue
+		}
+		for {
+			it, err := reader.next()
+			if err != nil || it == nil {
+				break
+			}
+			offset := it.Pos.Offset
+			if offset < f.begin || offset >= limit || isRec(offset, it.Keyhash) {
+				continue
+			}
+			if !f.inRange(offset) {
+				mismatch("hint", offset, it.Keyhash)
+				continue
+			}
+			ki := NewKeyInfoFromBytes([]byte(it.Key), it.Keyhash, false)
+			_, pos, found := bkt.htree.get(ki)
+			if !found || pos != (Position{f.chunk, offset}) {
+				continue // an old version
+			}
+			logger.Errorf("scrub found newest record of %016x broken, chunk %d offset %d, quarantined: %v",
+				it.Keyhash, f.chunk, offset, Conf.ScrubQuarantine)
+			k := BrokenKey{KeyHash: it.Keyhash, Chunk: f.chunk, Offset: offset, Found: now, Quarantined: Conf.ScrubQuarantine}
+			if !Conf.Encrypt {
+				k.Key = it.Key
+			}
+			f.brokenKeys = append(f.brokenKeys, k)
+		}
+		reader.close()
+	}
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestScrub(t *testing.T) {
+	testGC(t, testScrub, "scrub", 100)
+}
+
+// testScrub breaks the record of key 3, which is found by the scrubber and
+// quarantined until set again.
+func testScrub(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	Conf.ScrubQuarantine = true
+	defer func() {
+		Conf.ScrubQuarantine = false
+	}()
+	gen := newKVGen(16)
+	bkt := store.buckets[bucketID]
+	var ki KeyInfo
+	n := 10
+	set := func(i, ver int) {
+		payload := gen.gen(&ki, i, ver)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(i int) error {
+		gen.gen(&ki, i, 0)
+		payload, _, err := store.Get(&ki, false)
+		if payload != nil {
+			cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+			payload.CArray.Free()
+		}
+		return err
+	}
+	for i := 0; i < n; i++ {
+		set(i, 0)
+	}
+	bkt.datas.flush(0, true)
+	bkt.hints.trydump(0, true)
+
+	fd, err := os.OpenFile(bkt.datas.genPath(0), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteAt([]byte("broken"), 256*3+24)
+	fd.Close()
+
+	scrub := func() *ScrubStatus {
+		if done, err := store.scrubBucket(bucketID); !done || err != nil {
+			t.Fatalf("%v %v", done, err)
+		}
+		return store.GetScrubStatus(bucketID)
+	}
+	st := scrub()
+	if len(st.Ranges) != 1 || st.Ranges[0].Begin != 256*3 || st.Ranges[0].End != 256*4 ||
+		len(st.BrokenKeys) != 1 || st.BrokenKeys[0].Key != "key_f_3" || !st.BrokenKeys[0].Quarantined ||
+		len(st.Mismatches) != 0 || st.Rounds != 1 || st.Scanned != 256*int64(n) {
+		t.Fatalf("%#v", st)
+	}
+	if err := get(3); err != ErrQuarantined {
+		t.Fatalf("get quarantined: %v", err)
+	}
+	if err := get(4); err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.ScrubStats(); stats.Ranges != 1 || stats.BrokenKeys != 1 || stats.Rounds != 1 {
+		t.Fatalf("%#v", stats)
+	}
+
+	// kept through a restart
+	sc := newScrubState(bkt.Home)
+	if err := sc.load(); err != nil || !sc.isQuarantined(st.BrokenKeys[0].KeyHash, Position{0, 256 * 3}) {
+		t.Fatalf("%v %#v", err, sc.ScrubStatus)
+	}
+
+	// resume from a stale offset, and the key is repaired by a set
+	set(3, 1)
+	bkt.datas.flush(0, true)
+	if err := get(3); err != nil {
+		t.Fatal(err)
+	}
+	bkt.scrub.Lock()
+	bkt.scrub.RoundStart, bkt.scrub.Offset, bkt.scrub.resumed = st.LastRound, 100, true
+	bkt.scrub.Unlock()
+	st = scrub()
+	if len(st.Ranges) != 1 || st.Ranges[0].Begin != 256*3 || len(st.BrokenKeys) != 0 || st.Rounds != 2 {
+		t.Fatalf("%#v", st)
+	}
+
+	// an htree item pointing to a record of another key
+	gen.gen(&ki, 5, 0)
+	meta, pos, _ := bkt.htree.get(&ki)
+	bkt.htree.set(&ki, meta, Position{0, 256 * 6})
+	st = scrub()
+	bkt.htree.set(&ki, meta, pos)
+	if len(st.Mismatches) != 1 || st.Mismatches[0].Index != "htree" || st.Mismatches[0].Offset != 256*6 {
+		t.Fatalf("%#v", st)
+	}
+	if err := store.RemoveBrokenKey(bucketID, ki.KeyHash); err != ErrNoBrokenKey {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubMaxReports(t *testing.T) {
+	home, err := ioutil.TempDir("", "scrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	sc := newScrubState(home)
+	f := &scrubFindings{chunk: 0, begin: 0, end: 1 << 20}
+	for i := 0; i <= scrubMaxReports; i++ {
+		pos := Position{0, uint32(i) * 256}
+		f.ranges = append(f.ranges, ScrubRange{Chunk: pos.ChunkID, Begin: pos.Offset, End: pos.Offset + 256})
+		f.mismatches = append(f.mismatches, ScrubMismatch{Index: "hint", KeyHash: uint64(i), Offset: pos.Offset})
+		f.brokenKeys = append(f.brokenKeys, BrokenKey{KeyHash: uint64(i), Offset: pos.Offset, Quarantined: true})
+	}
+	sc.save(f, 1, 0, 1<<20)
+	st := sc.status()
+	if len(st.Ranges) != scrubMaxReports || len(st.Mismatches) != scrubMaxReports ||
+		len(st.BrokenKeys) != scrubMaxReports || len(sc.quarantine) != scrubMaxReports {
+		t.Fatalf("%d %d %d %d", len(st.Ranges), len(st.Mismatches), len(st.BrokenKeys), len(sc.quarantine))
+	}
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// Records with a header of version 2 keep a 64-bit timestamp besides TS.
+// It is a hybrid logical clock: unix milliseconds in the high 48 bits, and a
+// counter in the low 16 bits, so the timestamps given by a server increase
+// strictly, even for writes in the same millisecond or after the system
+// clock goes back. Records with a header of version 1 have only TS in
+// seconds, which is taken as the clock at the beginning of that second.
+
+const (
+	RECORD_VERSION_1 = 1
+	RECORD_VERSION_2 = 2
+
+	hlcLogicalBits = 16
+)
+
+type hybridClock struct {
+	sync.Mutex
+	last uint64
+}
+
+var clock hybridClock
+
+func (c *hybridClock) now(t time.Time) uint64 {
+	ts := uint64(t.UnixNano()/int64(time.Millisecond)) << hlcLogicalBits
+	c.Lock()
+	if ts <= c.last {
+		ts = c.last + 1
+	}
+	c.last = ts
+	c.Unlock()
+	return ts
+}
+
+func ts64FromSeconds(ts uint32) uint64 {
+	return uint64(ts) * 1000 << hlcLogicalBits
+}
+
+// TS64Time returns the physical part of a 64-bit timestamp.
+func TS64Time(ts uint64) time.Time {
+	ms := int64(ts >> hlcLogicalBits)
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// SetTS stamps a new record received at t.
+func (m *Meta) SetTS(t time.Time) {
+	m.TS64 = clock.now(t)
+	m.TS = uint32(TS64Time(m.TS64).Unix())
+}
+
+// Timestamp returns TS64, or TS as one for a header of version 1,
+// timestamps of records of both versions are comparable.
+func (m *Meta) Timestamp() uint64 {
+	if m.TS64 != 0 {
+		return m.TS64
+	}
+	return ts64FromSeconds(m.TS)
+}
+
+func (m *Meta) Time() time.Time {
+	return TS64Time(m.Timestamp())
+}
+
+func (m *Meta) HeaderVersion() int {
+	if m.TS64 != 0 {
+		return RECORD_VERSION_2
+	}
+	return RECORD_VERSION_1
+}
+
+// setHeaderVersion makes the record written with a header of version v,
+// converting the timestamp, and returns false if it is already of v.
+func (m *Meta) setHeaderVersion(v int) bool {
+	old := m.TS64
+	if v == RECORD_VERSION_1 {
+		m.TS64 = 0
+	} else if m.TS64 == 0 {
+		m.TS64 = ts64FromSeconds(m.TS) // still 0 if TS is 0
+	}
+	return m.TS64 != old
+}
+
+func (m *Meta) headerSize() int {
+	size := recHeaderSize
+	if m.TS64 != 0 {
+		size = recHeaderSizeV2
+	}
+	if m.KeyID != 0 {
+		size += recKeyIDSize
+	}
+	return size
+}
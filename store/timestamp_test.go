@@ -0,0 +1,192 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestHybridClock(t *testing.T) {
+	var c hybridClock
+	now := time.Now()
+	ts1 := c.now(now)
+	ts2 := c.now(now)
+	ts3 := c.now(now.Add(-time.Second))
+	if ts2 != ts1+1 || ts3 != ts2+1 {
+		t.Fatalf("%x %x %x", ts1, ts2, ts3)
+	}
+	if got := TS64Time(ts1); got.UnixNano()/1e6 != now.UnixNano()/1e6 {
+		t.Fatalf("%v != %v", got, now)
+	}
+
+	var m, old Meta
+	m.SetTS(now)
+	old.TS = m.TS
+	if m.TS != uint32(now.Unix()) || m.HeaderVersion() != RECORD_VERSION_2 || old.HeaderVersion() != RECORD_VERSION_1 {
+		t.Fatalf("%#v", m)
+	}
+	if old.Timestamp() > m.Timestamp() || old.Time().Unix() != m.Time().Unix() {
+		t.Fatalf("%v %v", old.Time(), m.Time())
+	}
+}
+
+func TestRecordHeaderVersions(t *testing.T) {
+	setupTest("TestRecordHeaderVersions")
+	defer clearTest()
+	Conf.Init()
+
+	ds := NewdataStore(0, Conf.Home)
+	key := []byte("key")
+	// header size decides if the last one takes 1 or 2 slots
+	bodies := []string{"v1", "v2", strings.Repeat("x", 229), strings.Repeat("y", 229)}
+	var positions []Position
+	for i, body := range bodies {
+		Conf.RecordVersion = RECORD_VERSION_1 + i%2
+		p := &Payload{}
+		p.TS = uint32(i + 1)
+		p.Ver = int32(i + 1)
+		p.Flag = FLAG_CLIENT_COMPRESS
+		p.Body = []byte(body)
+		pos, err := ds.AppendRecord(&Record{key, p})
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, pos)
+	}
+	ds.flush(-1, true)
+	if fmt.Sprint(positions) != "[{0 0} {0 256} {0 512} {0 768}]" {
+		t.Fatalf("%v", positions)
+	}
+	checkFileSize(t, 0, 256*5)
+
+	check := func(i int, rec *Record) {
+		p := rec.Payload
+		ts64 := uint64(0)
+		if i%2 == 1 {
+			ts64 = ts64FromSeconds(p.TS)
+		}
+		if string(rec.Key) != "key" || string(p.Body) != bodies[i] || p.TS != uint32(i+1) || p.TS64 != ts64 {
+			t.Fatalf("%d: %s", i, rec.LogString())
+		}
+	}
+	for i, pos := range positions {
+		rec, _, err := ds.GetRecordByPos(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(i, rec)
+		cmem.DBRL.GetData.SubSizeAndCount(rec.Payload.CArray.Cap)
+		rec.Payload.Free()
+	}
+
+	reader, err := ds.GetStreamReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for i, pos := range positions {
+		rec, offset, sizeBroken, err := reader.Next()
+		if err != nil || rec == nil || offset != pos.Offset || sizeBroken != 0 {
+			t.Fatalf("%d: %v %d %d %v", i, rec, offset, sizeBroken, err)
+		}
+		check(i, rec)
+	}
+	if rec, _, _, err := reader.Next(); rec != nil || err != nil {
+		t.Fatalf("%v %v", rec, err)
+	}
+}
+
+func TestGCConvertHeader(t *testing.T) {
+	testGC(t, testGCConvertHeader, "convertHeader", 12)
+}
+
+// testGCConvertHeader rewrites a chunk of records of header version 1 in
+// place, records with the larger header take 2 slots, so they are converted
+// only after enough garbage is dropped.
+func testGCConvertHeader(t *testing.T, store *HStore, bucketID, numRecPerFile int) {
+	gen := newKVGen(16)
+	var ki KeyInfo
+	set := func(i, ver int, body string) {
+		payload := gen.gen(&ki, i, ver)
+		payload.Body = []byte(body)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := strings.Repeat("x", 220)
+	Conf.RecordVersion = RECORD_VERSION_1
+	for i := 0; i < 10; i++ {
+		set(i, 0, big)
+	}
+	// 0 to 3 are garbage in chunk 0, the new 0 and 1 fill it and 2 and 3 go to chunk 1
+	Conf.RecordVersion = RECORD_VERSION_2
+	for i := 0; i < 4; i++ {
+		set(i, 1, "small")
+	}
+	bkt := store.buckets[bucketID]
+	bkt.datas.flush(0, true)
+	bkt.datas.flush(1, true)
+
+	store.gcMgr.gc(bkt, 0, 0, false)
+	gc := bkt.GCHistory[len(bkt.GCHistory)-1]
+	if gc.Err != nil || gc.NumReleased != 4 || gc.NumConverted != 4 {
+		t.Fatalf("%#v", gc)
+	}
+	// 4 converted taking 2 slots, 2 not and 2 small
+	checkDataSize(t, bkt.datas, []uint32{256 * 12, 256 * 2, 0})
+
+	for i := 0; i < 10; i++ {
+		gen.gen(&ki, i, 0)
+		payload, pos, err := store.Get(&ki, false)
+		if err != nil || payload == nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		expect, version := big, RECORD_VERSION_1
+		switch {
+		case i < 4:
+			expect, version = "small", RECORD_VERSION_2
+		case i < 8:
+			version = RECORD_VERSION_2
+		}
+		if string(payload.Body) != expect || payload.HeaderVersion() != version || payload.Time().Unix() != int64(i+1) {
+			t.Fatalf("%d %v: %#v", i, pos, payload.Meta)
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+		payload.CArray.Free()
+	}
+}
+
+// TestDumpsHeaderVersion checks "@@keyhash" returns headers of version 1
+// unless records are written in version 2.
+func TestDumpsHeaderVersion(t *testing.T) {
+	Conf.InitDefault()
+	defer Conf.InitDefault()
+	p := &Payload{}
+	p.Ver = 1
+	p.SetTS(time.Now())
+	p.Body = []byte("value")
+	rec := &Record{[]byte("key"), p}
+	for _, version := range []int{RECORD_VERSION_1, RECORD_VERSION_2} {
+		Conf.RecordVersion = version
+		data := rec.Dumps()
+		wrec := newWriteRecord()
+		if err := wrec.decode(data); err != nil {
+			t.Fatal(err)
+		}
+		size := recHeaderSize
+		if version == RECORD_VERSION_2 {
+			size = recHeaderSizeV2
+		}
+		if hsize, _ := headerSize(data); hsize != size || wrec.rec.Payload.HeaderVersion() != version ||
+			wrec.rec.Payload.TS != p.TS || string(wrec.rec.Key) != "key" {
+			t.Fatalf("v%d: %d %#v", version, hsize, wrec.rec.Payload.Meta)
+		}
+	}
+	if p.TS64 == 0 {
+		t.Fatal("ts64 of the record cleared")
+	}
+}
@@ -0,0 +1,263 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+// A delete only appends a tombstone, the last value stays in data files until
+// GC. Undelete appends that value again with a version above the tombstone.
+
+var (
+	ErrNotDeleted    = errors.New("key is not deleted")
+	ErrNoLiveVersion = errors.New("no value left in data files")
+)
+
+type UndeleteResult struct {
+	Key     string
+	Ver     int32  `json:",omitempty"` // the new version
+	FromVer int32  `json:",omitempty"` // version of the restored value
+	Err     string `json:",omitempty"`
+}
+
+// findLive returns the newest not deleted record of a key and the max version
+// ever seen. Data files are scanned if the versions known by hints are all deleted.
+func (bkt *Bucket) findLive(ki *KeyInfo) (pos Position, liveVer, maxVer int32, err error) {
+	versions, err := bkt.listVersions(ki)
+	if err != nil {
+		return
+	}
+	for _, v := range versions {
+		if abs(v.Ver) > maxVer {
+			maxVer = abs(v.Ver)
+		}
+		if v.Ver > liveVer {
+			pos, liveVer = v.Pos, v.Ver
+		}
+	}
+	if liveVer > 0 {
+		return
+	}
+	positions, err := bkt.datas.scanKey(ki.Key)
+	if err != nil {
+		return
+	}
+	for _, p := range positions {
+		wrec, _, e := bkt.datas.readRecordRaw(p)
+		if e != nil || wrec == nil {
+			continue
+		}
+		payload := wrec.rec.Payload
+		if bytes.Equal(wrec.rec.Key, ki.Key) {
+			if abs(payload.Ver) > maxVer {
+				maxVer = abs(payload.Ver)
+			}
+			if payload.Ver > liveVer {
+				pos, liveVer = p, payload.Ver
+			}
+		}
+		cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+		payload.CArray.Free()
+	}
+	if liveVer <= 0 {
+		err = ErrNoLiveVersion
+	}
+	return
+}
+
+// undelete appends the record at pos as version maxVer + 1 if the key is
+// still deleted, and commits it as a set. Nothing is written if pretend.
+func (bkt *Bucket) undelete(ki *KeyInfo, pos Position, liveVer, maxVer int32, pretend bool) (ver int32, err error) {
+	ver, newPos, stored, err := bkt.checkAndUndelete(ki, pos, liveVer, maxVer, pretend)
+	if err == nil && stored {
+		err = bkt.datas.commit(newPos, ki.Durability)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return
+}
+
+// checkAndUndelete appends the record under writeLock, it is committed after
+// the lock is released, so other sets are not blocked by the sync.
+func (bkt *Bucket) checkAndUndelete(ki *KeyInfo, pos Position, liveVer, maxVer int32, pretend bool) (ver int32, newPos Position, stored bool, err error) {
+	bkt.writeLock.Lock()
+	defer bkt.writeLock.Unlock()
+
+	cur, _, err := bkt.get(ki, true)
+	if err != nil {
+		return
+	}
+	if cur != nil {
+		if cur.Ver > 0 {
+			err = ErrNotDeleted
+			return
+		}
+		if abs(cur.Ver) > maxVer {
+			maxVer = abs(cur.Ver)
+		}
+	}
+	ver = maxVer + 1
+	if pretend {
+		return
+	}
+
+	rec, _, err := bkt.datas.GetRecordByPos(pos)
+	if err != nil {
+		return
+	} else if rec == nil {
+		err = ErrNoLiveVersion
+		return
+	}
+	p := rec.Payload
+	cmem.DBRL.GetData.SubSizeAndCount(p.CArray.Cap)
+	if !bytes.Equal(rec.Key, ki.Key) || p.Ver != liveVer {
+		p.CArray.Free()
+		err = fmt.Errorf("record of version %d moved by gc", liveVer)
+		return
+	}
+	cmem.DBRL.SetData.AddSizeAndCount(p.CArray.Cap)
+	p.Ver = ver
+	p.SetTS(time.Now())
+	p.CalcValueHash()
+	oldCap := p.CArray.Cap
+	rec.compress(bkt.dicts.current())
+	cmem.DBRL.SetData.AddSize(p.CArray.Cap - oldCap)
+	if newPos, err = bkt.set(ki, p); err != nil {
+		cmem.DBRL.SetData.SubSizeAndCount(p.CArray.Cap)
+		p.Free()
+		return
+	}
+	stored = true
+	logger.Infof("undelete %s, version %d -> %d", ki.StringKey, liveVer, ver)
+	return
+}
+
+// Undelete restores the last value of a deleted key, ver is the new version
+// and fromVer the version of the value.
+func (store *HStore) Undelete(ki *KeyInfo, pretend bool) (ver, fromVer int32, err error) {
+	bkt, err := store.readyBucket(ki)
+	if err != nil {
+		return
+	}
+	pos, fromVer, maxVer, err := bkt.findLive(ki)
+	if err != nil {
+		return
+	}
+	ver, err = bkt.undelete(ki, pos, fromVer, maxVer, pretend)
+	return
+}
+
+type deletedKey struct {
+	maxVer  int32
+	lastTS  uint32 // of the record with maxVer
+	liveVer int32
+	pos     Position
+}
+
+// scanRecords calls fn with each record in data files of the bucket, the
+// payload is only valid during the call.
+func (bkt *Bucket) scanRecords(fn func(rec *Record, pos Position)) error {
+	bkt.datas.flush(-1, true)
+	for i := 0; i < MAX_NUM_CHUNK; i++ {
+		if bkt.datas.chunks[i].size == 0 {
+			continue
+		}
+		r, err := bkt.datas.GetStreamReader(i)
+		if err != nil {
+			return err
+		}
+		for {
+			rec, offset, _, err := r.Next()
+			if err != nil {
+				r.Close()
+				return err
+			}
+			if rec == nil {
+				break
+			}
+			fn(rec, Position{i, offset})
+		}
+		r.Close()
+	}
+	return nil
+}
+
+// undeleteRange restores keys whose last record is a tombstone written in
+// [from, to].
+func (bkt *Bucket) undeleteRange(from, to uint32, pretend bool) (results []UndeleteResult, err error) {
+	if bkt.hints.state&HintStateGC != 0 {
+		return nil, ErrHintBusy
+	}
+	keys := make(map[string]*deletedKey)
+	err = bkt.scanRecords(func(rec *Record, pos Position) {
+		p := rec.Payload
+		if p.Ver < 0 && p.TS >= from && p.TS <= to {
+			keys[string(rec.Key)] = &deletedKey{}
+		}
+	})
+	if err != nil || len(keys) == 0 {
+		return
+	}
+	err = bkt.scanRecords(func(rec *Record, pos Position) {
+		k := keys[string(rec.Key)]
+		if k == nil {
+			return
+		}
+		v := rec.Payload.Ver
+		if abs(v) > k.maxVer {
+			k.maxVer, k.lastTS = abs(v), rec.Payload.TS
+		}
+		if v > k.liveVer {
+			k.liveVer, k.pos = v, pos
+		}
+	})
+	if err != nil {
+		return
+	}
+	for key, k := range keys {
+		if k.lastTS < from || k.lastTS > to {
+			continue // set or deleted again later
+		}
+		ki := NewKeyInfoFromBytes([]byte(key), getKeyHash([]byte(key)), false)
+		res := UndeleteResult{Key: key, FromVer: k.liveVer}
+		var e error
+		if k.liveVer <= 0 {
+			e = ErrNoLiveVersion
+		} else {
+			res.Ver, e = bkt.undelete(ki, k.pos, k.liveVer, k.maxVer, pretend)
+		}
+		if e == ErrNotDeleted {
+			continue // set again after the delete
+		} else if e != nil {
+			res.Err = e.Error()
+		}
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	return
+}
+
+// UndeleteRange restores the keys deleted in [from, to] (unix time) in a
+// bucket, or in all buckets if bucketID is -1. It reads all data files twice.
+func (store *HStore) UndeleteRange(bucketID int, from, to uint32, pretend bool) (results []UndeleteResult, err error) {
+	for id, bkt := range store.buckets {
+		if (bucketID >= 0 && id != bucketID) || bkt.State != BUCKET_STAT_READY {
+			continue
+		}
+		var res []UndeleteResult
+		if res, err = bkt.undeleteRange(from, to, pretend); err != nil {
+			return
+		}
+		results = append(results, res...)
+	}
+	if bucketID >= 0 && store.getBucket(bucketID) == nil {
+		err = ErrBucketNotServed
+	}
+	return
+}
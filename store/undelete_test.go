@@ -0,0 +1,117 @@
+package store
+
+import (
+	"os"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestUndelete(t *testing.T) {
+	setupTest("TestUndelete")
+	defer clearTest()
+
+	numbucket := 1
+	Conf.NumBucket = numbucket
+	Conf.BucketsStat = make([]int, numbucket)
+	Conf.BucketsStat[0] = 1
+	Conf.TreeHeight = 3
+	Conf.Init()
+	os.Mkdir(GetBucketPath(0), 0777)
+
+	gen := newKVGen(numbucket)
+	getKeyHash = makeKeyHasherParseKey(gen.depth, 0)
+	defer func() {
+		getKeyHash = getKeyHashDefalut
+	}()
+
+	store, err := NewHStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ki KeyInfo
+	set := func(i, ver int, ts uint32) {
+		payload := gen.gen(&ki, i, ver)
+		payload.TS = ts
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	del := func(i int, ts uint32) {
+		gen.gen(&ki, i, 0)
+		payload := GetPayloadForDelete()
+		payload.TS = ts
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(i int) string {
+		gen.gen(&ki, i, 0)
+		payload, _, err := store.Get(&ki, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload == nil {
+			return ""
+		}
+		defer func() {
+			cmem.DBRL.GetData.SubSizeAndCount(payload.CArray.Cap)
+			payload.CArray.Free()
+		}()
+		if payload.Ver < 0 {
+			return ""
+		}
+		return string(payload.Body)
+	}
+
+	set(0, 0, 100)
+	set(0, 1, 200)
+	del(0, 300)
+	// still in write buffer
+	if ver, fromVer, err := store.Undelete(&ki, true); err != nil || ver != 4 || fromVer != 2 {
+		t.Fatalf("pretend: %d %d %v", ver, fromVer, err)
+	}
+	if v := get(0); v != "" {
+		t.Fatalf("pretend should not write, got %q", v)
+	}
+	store.flushdatas(true)
+	if ver, fromVer, err := store.Undelete(&ki, false); err != nil || ver != 4 || fromVer != 2 {
+		t.Fatalf("undelete: %d %d %v", ver, fromVer, err)
+	}
+	if v := get(0); v != "value_0_1" {
+		t.Fatalf("got %q after undelete", v)
+	}
+	if _, _, err := store.Undelete(&ki, false); err != ErrNotDeleted {
+		t.Fatalf("undelete twice: %v", err)
+	}
+
+	set(1, 0, 400)
+	del(1, 500)
+	set(2, 0, 400)
+	del(2, 900)
+	set(3, 0, 400)
+	del(3, 500)
+	set(3, 1, 600)
+	store.Close()
+	// tombstones are not in the rebuilt htree
+	if store, err = NewHStore(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	results, err := store.UndeleteRange(-1, 450, 550, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Key != "key_0_1" || results[0].Err != "" ||
+		results[0].Ver != 3 || results[0].FromVer != 1 {
+		t.Fatalf("%#v", results)
+	}
+	for i, expect := range []string{"value_0_1", "value_1_0", "", "value_3_1"} {
+		if v := get(i); v != expect {
+			t.Fatalf("key %d: got %q, expect %q", i, v, expect)
+		}
+	}
+}
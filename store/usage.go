@@ -0,0 +1,188 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Each bucket counts the records written to every chunk, and those
+// superseded since then, i.e. deletes and records no longer pointed to by the
+// htree. The counters are updated on set, delete and htree replacement,
+// dumped to usage.yaml by the hint dumper, and reconciled with the hints and
+// htree when the bucket is opened.
+//
+// The size of a superseded record is not known without reading it, so the
+// superseded bytes are estimated by the average record size of the chunk.
+
+type ChunkUsage struct {
+	Chunk          int   `yaml:"chunk"`
+	NumRecs        int64 `yaml:"num_recs"`
+	Size           int64 `yaml:"size"`
+	NumSuperseded  int64 `yaml:"num_superseded"`
+	NumLive        int64 `yaml:"-"`
+	SizeLive       int64 `yaml:"-"`
+	SizeSuperseded int64 `yaml:"-"` // estimated
+}
+
+func (u *ChunkUsage) fill() {
+	if u.NumSuperseded > u.NumRecs {
+		u.NumSuperseded = u.NumRecs
+	}
+	u.NumLive = u.NumRecs - u.NumSuperseded
+	if u.NumRecs > 0 {
+		u.SizeSuperseded = u.Size * u.NumSuperseded / u.NumRecs
+	}
+	u.SizeLive = u.Size - u.SizeSuperseded
+}
+
+// Garbage returns the ratio of superseded bytes.
+func (u *ChunkUsage) Garbage() float64 {
+	if u.Size == 0 {
+		return 0
+	}
+	return float64(u.SizeSuperseded) / float64(u.Size)
+}
+
+type chunkUsage struct {
+	sync.Mutex
+	chunks [MAX_NUM_CHUNK]ChunkUsage
+}
+
+func newChunkUsage() *chunkUsage {
+	u := &chunkUsage{}
+	for i := range u.chunks {
+		u.chunks[i].Chunk = i
+	}
+	return u
+}
+
+func (u *chunkUsage) add(chunkID int, size uint32) {
+	u.Lock()
+	u.chunks[chunkID].NumRecs++
+	u.chunks[chunkID].Size += int64(size)
+	u.Unlock()
+}
+
+func (u *chunkUsage) supersede(chunkID int) {
+	if chunkID < 0 || chunkID >= MAX_NUM_CHUNK {
+		return
+	}
+	u.Lock()
+	u.chunks[chunkID].NumSuperseded++
+	u.Unlock()
+}
+
+// addUncounted raises the number of records of a chunk to n if less, the
+// records not counted are superseded, as the live ones are in the htree.
+func (u *chunkUsage) addUncounted(chunkID int, n int64) {
+	u.Lock()
+	cu := &u.chunks[chunkID]
+	if cu.Size > 0 && n > cu.NumRecs {
+		cu.NumSuperseded += n - cu.NumRecs
+		cu.NumRecs = n
+	}
+	u.Unlock()
+}
+
+func (u *chunkUsage) set(cu ChunkUsage) {
+	u.Lock()
+	u.chunks[cu.Chunk] = cu
+	u.Unlock()
+}
+
+func (u *chunkUsage) get(chunkID int) (cu ChunkUsage) {
+	u.Lock()
+	cu = u.chunks[chunkID]
+	u.Unlock()
+	cu.fill()
+	return
+}
+
+// list returns the chunks with records.
+func (u *chunkUsage) list() (res []ChunkUsage) {
+	u.Lock()
+	defer u.Unlock()
+	for _, cu := range u.chunks {
+		if cu.NumRecs > 0 || cu.Size > 0 {
+			cu.fill()
+			res = append(res, cu)
+		}
+	}
+	return
+}
+
+func (bkt *Bucket) getUsagePath() string {
+	return fmt.Sprintf("%s/usage.yaml", bkt.Home)
+}
+
+func (bkt *Bucket) dumpUsage() {
+	path := bkt.getUsagePath()
+	content, err := yaml.Marshal(bkt.usage.list())
+	if err != nil {
+		logger.Errorf("marshal yaml failed %s: %s", path, err.Error())
+		return
+	}
+	if err = ioutil.WriteFile(path, content, 0644); err != nil {
+		logger.Errorf("write yaml failed %s: %s", path, err.Error())
+	}
+}
+
+func (bkt *Bucket) loadUsage() (saved map[int]ChunkUsage) {
+	path := bkt.getUsagePath()
+	saved = make(map[int]ChunkUsage)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Errorf("read yaml failed %s: %s", path, err.Error())
+		}
+		return
+	}
+	var list []ChunkUsage
+	if err = yaml.Unmarshal(content, &list); err != nil {
+		logger.Errorf("unmarshal yaml failed %s: %s", path, err.Error())
+		return
+	}
+	for _, cu := range list {
+		if cu.Chunk >= 0 && cu.Chunk < MAX_NUM_CHUNK {
+			saved[cu.Chunk] = cu
+		}
+	}
+	return
+}
+
+// initUsage sets the counters of chunks [start, end] by the data size, the
+// keys in hints and the htree. The number of records dumped is used if the
+// chunk has not changed since, as hints keep only the last record of a key
+// in a split.
+func (bkt *Bucket) initUsage(start, end int, saved map[int]ChunkUsage) {
+	live := bkt.htree.countByChunk()
+	for i := start; i <= end && i < MAX_NUM_CHUNK; i++ {
+		cu := ChunkUsage{Chunk: i, Size: int64(bkt.datas.chunks[i].size)}
+		if cu.Size > 0 {
+			cu.NumRecs = int64(bkt.hints.numKeys(i))
+			if s, ok := saved[i]; ok && s.Size == cu.Size && s.NumRecs > cu.NumRecs {
+				cu.NumRecs = s.NumRecs
+			}
+			if n := int64(live[i]); n > cu.NumRecs {
+				cu.NumRecs = n
+			} else {
+				cu.NumSuperseded = cu.NumRecs - n
+			}
+		}
+		bkt.usage.set(cu)
+	}
+}
+
+// GetChunkUsage returns the counters of the chunks with records in a bucket,
+// or nil if the bucket is not served.
+func (store *HStore) GetChunkUsage(bucketID int) []ChunkUsage {
+	bkt := store.getBucket(bucketID)
+	if bkt == nil {
+		return nil
+	}
+	return bkt.usage.list()
+}
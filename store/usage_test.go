@@ -0,0 +1,108 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/douban/gobeansdb/cmem"
+)
+
+func TestChunkUsage(t *testing.T) {
+	setupTest("TestChunkUsage")
+	defer clearTest()
+
+	numbucket := 16
+	bucketID := numbucket - 1
+	Conf.NumBucket = numbucket
+	Conf.BucketsStat = make([]int, numbucket)
+	Conf.BucketsStat[bucketID] = 1
+	Conf.TreeHeight = 3
+	getKeyHash = makeKeyHasherFixBucket(1, bucketID)
+	defer func() {
+		getKeyHash = getKeyHashDefalut
+	}()
+	N := 100
+	Conf.DataFileMaxStr = strconv.Itoa(256 * N)
+	Conf.Init()
+	bucketDir := filepath.Join(Conf.Home, "f")
+	os.Mkdir(bucketDir, 0777)
+
+	store, err := NewHStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := newKVGen(numbucket)
+	var ki KeyInfo
+	set := func(i, ver int) {
+		payload := gen.gen(&ki, i, ver)
+		cmem.DBRL.SetData.AddSizeAndCount(payload.CArray.Cap)
+		if err := store.Set(&ki, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// chunk 0: 0-99, chunk 1: 0-49, 0-9 again and deletes of 50-59
+	for i := 0; i < N; i++ {
+		set(i, 0)
+	}
+	for i := 0; i < N/2; i++ {
+		set(i, 1)
+	}
+	for i := 0; i < 10; i++ {
+		set(i, 2)
+	}
+	for i := 50; i < 60; i++ {
+		gen.gen(&ki, i, 0)
+		if err := store.Set(&ki, GetPayloadForDelete()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(expect ...ChunkUsage) {
+		usage := store.GetBucketInfo(bucketID).Chunks
+		if len(usage) != len(expect) {
+			t.Fatalf("%#v", usage)
+		}
+		for i, e := range expect {
+			u := usage[i]
+			if u.Chunk != e.Chunk || u.NumRecs != e.NumRecs || u.NumLive != e.NumLive || u.Size != 256*e.NumRecs || u.SizeLive != 256*e.NumLive {
+				t.Fatalf("expect %#v, got %#v", e, u)
+			}
+		}
+	}
+	usage0 := ChunkUsage{Chunk: 0, NumRecs: 100, NumLive: 40}
+	usage1 := ChunkUsage{Chunk: 1, NumRecs: 70, NumLive: 50}
+	check(usage0, usage1)
+	if usage := store.GetChunkUsage(bucketID); len(usage) != 2 {
+		t.Fatalf("%#v", usage)
+	}
+	for _, id := range []int{bucketID ^ 1, -1, len(store.buckets)} {
+		if usage := store.GetChunkUsage(id); usage != nil {
+			t.Fatalf("%d: %#v", id, usage)
+		}
+	}
+
+	// the records of chunk 1 are more than the keys in its hints
+	store.buckets[bucketID].datas.flush(0, true)
+	store.buckets[bucketID].dumpUsage() // by the hint dumper
+	store.Close()
+	if store, err = NewHStore(); err != nil {
+		t.Fatal(err)
+	}
+	check(usage0, usage1)
+
+	bkt := store.buckets[bucketID]
+	if garbage := bkt.estimateGarbage(0, 1); garbage[0] != 0.6 || garbage[1] != float64(20)/70 {
+		t.Fatalf("%v", garbage)
+	}
+	store.gcMgr.gc(bkt, 0, 0, false)
+	if gc := bkt.GCHistory[len(bkt.GCHistory)-1]; gc.Err != nil {
+		t.Fatal(gc.Err)
+	}
+	check(ChunkUsage{Chunk: 0, NumRecs: 40, NumLive: 40}, usage1)
+
+	store.Close()
+	if !cmem.DBRL.IsZero() {
+		t.Fatalf("%#v", cmem.DBRL)
+	}
+}
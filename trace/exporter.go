@@ -0,0 +1,321 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/douban/gobeansdb/loghub"
+)
+
+var (
+	logger = loghub.ErrorLogger
+	tracer atomic.Value // *Tracer, nil if disabled
+
+	batchSize     = 256
+	batchInterval = time.Second
+)
+
+type Options struct {
+	Sample      float64 // fraction of requests traced, requests with a remote trace id are always traced
+	Exporter    string  // "otlp" or "file"
+	Endpoint    string  // OTLP/HTTP traces endpoint, e.g. http://127.0.0.1:4318/v1/traces
+	File        string  // JSON lines output
+	ServiceName string
+	QueueSize   int // spans dropped if the queue is full
+}
+
+type exporter interface {
+	export(spans []*Span) error
+	close()
+}
+
+type Tracer struct {
+	sample  float64
+	ch      chan *Span
+	exp     exporter
+	wg      sync.WaitGroup
+	dropped int64
+
+	mu     sync.RWMutex
+	closed bool // ch is closed, no more spans are accepted
+}
+
+func getTracer() *Tracer {
+	t, _ := tracer.Load().(*Tracer)
+	return t
+}
+
+// Init starts the global tracer, tracing stays disabled if it is not called.
+func Init(opts Options) (err error) {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "gobeansdb"
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 10000
+	}
+	var exp exporter
+	switch opts.Exporter {
+	case "otlp":
+		if opts.Endpoint == "" {
+			return fmt.Errorf("trace: otlp exporter needs an endpoint")
+		}
+		exp = &otlpExporter{endpoint: opts.Endpoint, service: opts.ServiceName,
+			client: &http.Client{Timeout: 5 * time.Second}}
+	case "file":
+		f, e := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if e != nil {
+			return e
+		}
+		exp = &fileExporter{f: f, w: bufio.NewWriter(f), service: opts.ServiceName}
+	default:
+		return fmt.Errorf("trace: unknown exporter %q", opts.Exporter)
+	}
+	t := &Tracer{
+		sample: opts.Sample,
+		ch:     make(chan *Span, opts.QueueSize),
+		exp:    exp,
+	}
+	t.wg.Add(1)
+	go t.run()
+	tracer.Store(t)
+	logger.Infof("tracing enabled, exporter %s, sample %f", opts.Exporter, opts.Sample)
+	return
+}
+
+// Close stops the global tracer and flushes spans in the queue.
+func Close() {
+	t := getTracer()
+	if t == nil {
+		return
+	}
+	tracer.Store((*Tracer)(nil))
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.ch)
+	t.mu.Unlock()
+	t.wg.Wait()
+	t.exp.close()
+}
+
+func Enabled() bool {
+	return getTracer() != nil
+}
+
+// export drops spans ended after the tracer is closed, or if the queue is full.
+func (t *Tracer) export(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.ch <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exp.export(batch); err != nil {
+			logger.Warnf("fail to export %d spans: %s", len(batch), err.Error())
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-t.ch:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// OTLP JSON encoding, see opentelemetry-proto/opentelemetry/proto/trace/v1
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is a string in proto3 JSON
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPValue(v interface{}) (ov otlpValue) {
+	switch x := v.(type) {
+	case string:
+		ov.StringValue = &x
+	case bool:
+		ov.BoolValue = &x
+	case int:
+		s := strconv.FormatInt(int64(x), 10)
+		ov.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		ov.IntValue = &s
+	case uint32:
+		s := strconv.FormatInt(int64(x), 10)
+		ov.IntValue = &s
+	case float64:
+		ov.DoubleValue = &x
+	default:
+		s := fmt.Sprintf("%v", x)
+		ov.StringValue = &s
+	}
+	return
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	o := otlpSpan{
+		TraceID:           s.TraceID.String(),
+		SpanID:            s.SpanID.String(),
+		Name:              s.Name,
+		Kind:              2, // server
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+	}
+	if s.ParentID.IsValid() {
+		o.ParentSpanID = s.ParentID.String()
+		o.Kind = 1 // internal
+	}
+	for _, a := range s.Attrs {
+		o.Attributes = append(o.Attributes, otlpAttr{a.Key, toOTLPValue(a.Value)})
+	}
+	if s.Err != "" {
+		o.Status = &otlpStatus{2, s.Err}
+	}
+	return o
+}
+
+func newOTLPRequest(service string, spans []*Span) *otlpRequest {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttr{{"service.name", toOTLPValue(service)}}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "github.com/douban/gobeansdb/trace"
+	ss.Spans = make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		ss.Spans[i] = toOTLPSpan(s)
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return &otlpRequest{[]otlpResourceSpans{rs}}
+}
+
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+func (e *otlpExporter) export(spans []*Span) error {
+	body, err := json.Marshal(newOTLPRequest(e.service, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp endpoint %s returns %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) close() {}
+
+// fileSpan is one line in the JSON lines file.
+type fileSpan struct {
+	Service string `json:"service"`
+	otlpSpan
+}
+
+type fileExporter struct {
+	f       *os.File
+	w       *bufio.Writer
+	service string
+}
+
+func (e *fileExporter) export(spans []*Span) error {
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(fileSpan{e.service, toOTLPSpan(s)}); err != nil {
+			return err
+		}
+	}
+	return e.w.Flush()
+}
+
+func (e *fileExporter) close() {
+	e.w.Flush()
+	e.f.Close()
+}
@@ -0,0 +1,191 @@
+// Package trace records request spans and exports them as OTLP/HTTP JSON
+// or as JSON lines to a local file.
+//
+// All methods of *Span accept a nil receiver, a nil span means the request
+// is not sampled, so instrumented code never needs to check.
+package trace
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span from another process, e.g. the proxy.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid()
+}
+
+func ParseSpanContext(traceID, spanID string) (sc SpanContext, err error) {
+	b, err := hex.DecodeString(traceID)
+	if err != nil || len(b) != len(sc.TraceID) {
+		return sc, errors.New("bad trace id")
+	}
+	copy(sc.TraceID[:], b)
+	if spanID != "" {
+		b, err = hex.DecodeString(spanID)
+		if err != nil || len(b) != len(sc.SpanID) {
+			return SpanContext{}, errors.New("bad span id")
+		}
+		copy(sc.SpanID[:], b)
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("bad trace id")
+	}
+	return
+}
+
+type Attr struct {
+	Key   string
+	Value interface{} // string, bool, int, int64, uint32, float64
+}
+
+type Span struct {
+	TraceID   TraceID
+	SpanID    SpanID
+	ParentID  SpanID
+	Name      string
+	StartTime time.Time
+	EndTime   time.Time
+	Attrs     []Attr
+	Err       string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+var (
+	idLock sync.Mutex
+	idRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func newSpanID() (id SpanID) {
+	idLock.Lock()
+	idRand.Read(id[:])
+	idLock.Unlock()
+	return
+}
+
+func newTraceID() (id TraceID) {
+	idLock.Lock()
+	idRand.Read(id[:])
+	idLock.Unlock()
+	return
+}
+
+func sampled(t *Tracer) bool {
+	if t.sample >= 1 {
+		return true
+	}
+	idLock.Lock()
+	f := idRand.Float64()
+	idLock.Unlock()
+	return f < t.sample
+}
+
+// StartRoot starts a root span at time start, it returns nil if tracing is
+// disabled or the span is not sampled. A valid parent from a remote caller
+// is always sampled.
+func StartRoot(name string, start time.Time, parent SpanContext) *Span {
+	t := getTracer()
+	if t == nil {
+		return nil
+	}
+	if !parent.IsValid() && !sampled(t) {
+		return nil
+	}
+	s := &Span{Name: name, StartTime: start, SpanID: newSpanID()}
+	if parent.IsValid() {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = newTraceID()
+	}
+	return s
+}
+
+func (s *Span) Child(name string) *Span {
+	return s.ChildAt(name, time.Now())
+}
+
+func (s *Span) ChildAt(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		TraceID:   s.TraceID,
+		ParentID:  s.SpanID,
+		SpanID:    newSpanID(),
+		Name:      name,
+		StartTime: start,
+	}
+}
+
+// Record adds a child span which has already finished.
+func (s *Span) Record(name string, start, end time.Time) {
+	if s == nil {
+		return
+	}
+	s.ChildAt(name, start).EndAt(end)
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attrs = append(s.Attrs, Attr{key, value})
+	s.mu.Unlock()
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Err = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+func (s *Span) EndAt(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = t
+	s.mu.Unlock()
+	if tr := getTracer(); tr != nil {
+		tr.export(s)
+	}
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{s.TraceID, s.SpanID}
+}
@@ -0,0 +1,117 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSpanContext(t *testing.T) {
+	sc, err := ParseSpanContext("0102030405060708090a0b0c0d0e0f10", "0102030405060708")
+	if err != nil || sc.TraceID.String() != "0102030405060708090a0b0c0d0e0f10" || sc.SpanID.String() != "0102030405060708" {
+		t.Fatalf("%v %v", sc, err)
+	}
+	for _, bad := range [][2]string{
+		{"0102", ""},
+		{"00000000000000000000000000000000", ""},
+		{"0102030405060708090a0b0c0d0e0f10", "01"},
+		{"zz02030405060708090a0b0c0d0e0f10", ""},
+	} {
+		if _, err := ParseSpanContext(bad[0], bad[1]); err == nil {
+			t.Fatalf("should fail: %v", bad)
+		}
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	var nilSpan *Span
+	nilSpan.Child("a").End() // disabled, must not panic
+	if StartRoot("x", time.Now(), SpanContext{}) != nil {
+		t.Fatal("tracing is not enabled")
+	}
+
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spans.json")
+	if err := Init(Options{Exporter: "file", File: path, Sample: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if StartRoot("unsampled", time.Now(), SpanContext{}) != nil {
+		t.Fatal("sample 0 should not trace")
+	}
+	parent, _ := ParseSpanContext("0102030405060708090a0b0c0d0e0f10", "0102030405060708")
+	root := StartRoot("mc.get", time.Now(), parent)
+	child := root.Child("hstore.get")
+	child.SetAttr("bucket", 3)
+	child.SetError(errors.New("oops"))
+	child.End()
+	root.End()
+	root.End() // exported once
+	Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var spans []fileSpan
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var s fileSpan
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("expect 2 spans, got %v", spans)
+	}
+	c, r := spans[0], spans[1]
+	if r.Name != "mc.get" || r.TraceID != parent.TraceID.String() || r.ParentSpanID != parent.SpanID.String() {
+		t.Fatalf("bad root %#v", r)
+	}
+	if c.ParentSpanID != r.SpanID || c.TraceID != r.TraceID || c.Status == nil ||
+		len(c.Attributes) != 1 || *c.Attributes[0].Value.IntValue != "3" || c.Service != "gobeansdb" {
+		t.Fatalf("bad child %#v", c)
+	}
+}
+
+// TestCloseWhileTracing ends spans while the tracer is closed, which are
+// dropped after it.
+func TestCloseWhileTracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := Init(Options{Exporter: "file", File: filepath.Join(dir, "spans.json"), Sample: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s := StartRoot("mc.get", time.Now(), SpanContext{})
+				s.Child("hstore.get").End()
+				s.End()
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	Close()
+	wg.Wait()
+	if Enabled() {
+		t.Fatal("still enabled")
+	}
+}
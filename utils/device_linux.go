@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// DeviceOf returns the name of the block device holding path, e.g. "sda" for
+// a file on /dev/sda1, so that paths on partitions of one disk share a name.
+// Devices not found in /sys, e.g. of tmpfs, are named by major:minor.
+func DeviceOf(path string) (string, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return "", err
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	id := fmt.Sprintf("%d:%d", major, minor)
+	sys, err := filepath.EvalSymlinks("/sys/dev/block/" + id)
+	if err != nil {
+		return id, nil
+	}
+	if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+		sys = filepath.Dir(sys)
+	}
+	return filepath.Base(sys), nil
+}
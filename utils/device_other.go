@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+// DeviceOf returns the top dir of path, as the device is not known.
+func DeviceOf(path string) (string, error) {
+	disk, err := DiskUsage(path)
+	return disk.Root, err
+}
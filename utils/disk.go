@@ -176,6 +176,36 @@ func DiskUsage(path string) (disk DiskStatus, err error) {
 	return
 }
 
+// CheckDisk returns an error if path can not be written: missing, read-only
+// mounted, no permission or no free space.
+func CheckDisk(path string) error {
+	const (
+		accessW  = 0x2 // W_OK
+		stRdonly = 0x1 // ST_RDONLY, MNT_RDONLY
+	)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a dir", path)
+	}
+	fs := syscall.Statfs_t{}
+	if err = syscall.Statfs(path, &fs); err != nil {
+		return err
+	}
+	if uint64(fs.Flags)&stRdonly != 0 {
+		return fmt.Errorf("%s is on a read-only fs", path)
+	}
+	if fs.Bavail == 0 {
+		return fmt.Errorf("no space left for %s", path)
+	}
+	if err = syscall.Access(path, accessW); err != nil {
+		return fmt.Errorf("%s not writable: %s", path, err.Error())
+	}
+	return nil
+}
+
 func DirUsage(path string) (size int64, err error) {
 	size = 0
 	f, err := os.Open(path)
@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	FADV_SEQUENTIAL = 2
+	FADV_DONTNEED   = 4
+)
+
+// Fadvise gives the kernel a hint about the page cache of [offset, offset+length)
+// of f, length 0 means to the end. Only a hint, so errors may be ignored.
+func Fadvise(f *os.File, offset, length int64, advice int) error {
+	_, _, e := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(offset), uintptr(length), uintptr(advice), 0, 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
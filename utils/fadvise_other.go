@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import "os"
+
+const (
+	FADV_SEQUENTIAL = 2
+	FADV_DONTNEED   = 4
+)
+
+func Fadvise(f *os.File, offset, length int64, advice int) error {
+	return nil
+}
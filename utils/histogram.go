@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	histSubBits    = 3
+	histSub        = 1 << histSubBits
+	histMaxExp     = 40 // 2^40 us, about 12 days
+	histNumBuckets = (histMaxExp - histSubBits + 1) * histSub
+)
+
+// Histogram records durations in microseconds into log-linear buckets:
+// every power of two is split into 8 sub buckets, so a reported percentile
+// is at most 12.5% larger than the real one. All methods are safe for
+// concurrent use and lock free.
+type Histogram struct {
+	count   int64
+	sum     int64
+	max     int64
+	buckets [histNumBuckets]int64
+}
+
+type HistogramSummary struct {
+	Count  int64 `json:"count"`
+	AvgUS  int64 `json:"avg_us"`
+	P50US  int64 `json:"p50_us"`
+	P90US  int64 `json:"p90_us"`
+	P99US  int64 `json:"p99_us"`
+	P999US int64 `json:"p999_us"`
+	MaxUS  int64 `json:"max_us"`
+}
+
+func histIndex(v uint64) int {
+	if v < histSub {
+		return int(v)
+	}
+	e := bits.Len64(v) - 1
+	if e > histMaxExp {
+		return histNumBuckets - 1
+	}
+	sub := (v >> uint(e-histSubBits)) & (histSub - 1)
+	return (e-histSubBits+1)*histSub + int(sub)
+}
+
+// upper bound of values falling into bucket i
+func histUpper(i int) int64 {
+	if i < histSub {
+		return int64(i)
+	}
+	e := uint(i/histSub + histSubBits - 1)
+	sub := uint64(i % histSub)
+	lower := (histSub + sub) << (e - histSubBits)
+	return int64(lower + (1 << (e - histSubBits)) - 1)
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	us := int64(d / time.Microsecond)
+	if us < 0 {
+		us = 0
+	}
+	atomic.AddInt64(&h.count, 1)
+	atomic.AddInt64(&h.sum, us)
+	atomic.AddInt64(&h.buckets[histIndex(uint64(us))], 1)
+	for {
+		m := atomic.LoadInt64(&h.max)
+		if us <= m || atomic.CompareAndSwapInt64(&h.max, m, us) {
+			break
+		}
+	}
+}
+
+func (h *Histogram) Reset() {
+	atomic.StoreInt64(&h.count, 0)
+	atomic.StoreInt64(&h.sum, 0)
+	atomic.StoreInt64(&h.max, 0)
+	for i := range h.buckets {
+		atomic.StoreInt64(&h.buckets[i], 0)
+	}
+}
+
+func (h *Histogram) Count() int64 {
+	return atomic.LoadInt64(&h.count)
+}
+
+// Sum returns the total of all durations observed.
+func (h *Histogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.sum)) * time.Microsecond
+}
+
+func (h *Histogram) snapshot() (buckets [histNumBuckets]int64, total int64) {
+	for i := range h.buckets {
+		buckets[i] = atomic.LoadInt64(&h.buckets[i])
+		total += buckets[i]
+	}
+	return
+}
+
+func percentile(buckets *[histNumBuckets]int64, total int64, q float64) int64 {
+	if total == 0 {
+		return 0
+	}
+	rank := int64(q*float64(total) + 0.999999)
+	if rank < 1 {
+		rank = 1
+	}
+	var n int64
+	for i, c := range buckets {
+		n += c
+		if n >= rank {
+			return histUpper(i)
+		}
+	}
+	return histUpper(histNumBuckets - 1)
+}
+
+// Percentile returns the upper bound of the bucket holding the q-th quantile (0 < q <= 1).
+func (h *Histogram) Percentile(q float64) time.Duration {
+	buckets, total := h.snapshot()
+	return time.Duration(percentile(&buckets, total, q)) * time.Microsecond
+}
+
+func (h *Histogram) Summary() (s HistogramSummary) {
+	buckets, total := h.snapshot()
+	s.Count = atomic.LoadInt64(&h.count)
+	if s.Count > 0 {
+		s.AvgUS = atomic.LoadInt64(&h.sum) / s.Count
+	}
+	s.MaxUS = atomic.LoadInt64(&h.max)
+	s.P50US = percentile(&buckets, total, 0.5)
+	s.P90US = percentile(&buckets, total, 0.9)
+	s.P99US = percentile(&buckets, total, 0.99)
+	s.P999US = percentile(&buckets, total, 0.999)
+	// bucket upper bounds may exceed the real max
+	for _, p := range []*int64{&s.P50US, &s.P90US, &s.P99US, &s.P999US} {
+		if *p > s.MaxUS {
+			*p = s.MaxUS
+		}
+	}
+	return
+}
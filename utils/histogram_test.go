@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistIndex(t *testing.T) {
+	last := -1
+	for v := uint64(0); v < 1<<16; v++ {
+		i := histIndex(v)
+		if i < last {
+			t.Fatalf("index not monotonic at %d: %d < %d", v, i, last)
+		}
+		last = i
+		if up := histUpper(i); uint64(up) < v {
+			t.Fatalf("value %d > upper bound %d of bucket %d", v, up, i)
+		}
+		if i > 0 && uint64(histUpper(i-1)) >= v {
+			t.Fatalf("value %d should be in bucket %d", v, i-1)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Observe(time.Duration(i) * time.Microsecond)
+	}
+	s := h.Summary()
+	if s.Count != 1000 || s.MaxUS != 1000 || s.AvgUS != 500 {
+		t.Fatalf("bad summary %#v", s)
+	}
+	check := func(got, expect int64) {
+		if got < expect || float64(got) > float64(expect)*1.125 {
+			t.Fatalf("percentile %d not close to %d, %#v", got, expect, s)
+		}
+	}
+	check(s.P50US, 500)
+	check(s.P90US, 900)
+	check(s.P99US, 990)
+	check(s.P999US, 999)
+
+	h.Reset()
+	s = h.Summary()
+	if s.Count != 0 || s.P99US != 0 || s.MaxUS != 0 {
+		t.Fatalf("not reset %#v", s)
+	}
+}